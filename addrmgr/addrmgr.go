@@ -0,0 +1,395 @@
+package addrmgr
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+// The layout of the address tables follows Bitcoin Core's addrman. Addresses we've only heard
+// about live in the 'new' table, and are bucketed by who told us about them so that a single
+// source can't flood it. Addresses we've successfully connected to are promoted to the 'tried'
+// table, bucketed by their own network group.
+const (
+	NEW_BUCKET_COUNT             = 1024
+	TRIED_BUCKET_COUNT           = 256
+	BUCKET_SIZE                  = 64
+	NEW_BUCKETS_PER_SOURCE_GROUP = 64
+	TRIED_BUCKETS_PER_GROUP      = 8
+	NEW_BUCKETS_PER_ADDRESS      = 8
+
+	// The share of our addresses we'll give out in response to a 'getaddr', and the most we'll send.
+	GETADDR_MAX_PERCENT = 23
+	GETADDR_MAX         = proto.MAX_ADDR_ENTRIES
+
+	// How long to wait between updates of an address's last seen time when we're connected to it.
+	CONNECTED_UPDATE_INTERVAL = 20 * time.Minute
+
+	// How many random picks Select will make before giving up on finding a suitable address.
+	MAX_SELECT_ATTEMPTS = 1000
+)
+
+// AddrManager keeps track of the addresses of other nodes, and which ones are worth connecting to.
+type AddrManager struct {
+	mu sync.Mutex
+
+	path string
+	key  [32]byte
+	rand *mathrand.Rand
+
+	index        map[string]*KnownAddress
+	newBuckets   [NEW_BUCKET_COUNT]map[string]*KnownAddress
+	triedBuckets [TRIED_BUCKET_COUNT][]*KnownAddress
+	nNew         int
+	nTried       int
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates an address manager that persists to the file at path, loading any addresses that
+// were previously saved there.
+func New(path string) (*AddrManager, error) {
+	a := &AddrManager{
+		path: path,
+		rand: mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}
+	a.reset()
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reset empties the address tables and picks a new secret bucketing key.
+func (a *AddrManager) reset() {
+	// The key stops other nodes from predicting which bucket an address will land in
+	rand.Read(a.key[:])
+
+	a.index = map[string]*KnownAddress{}
+	for i := range a.newBuckets {
+		a.newBuckets[i] = map[string]*KnownAddress{}
+	}
+	for i := range a.triedBuckets {
+		a.triedBuckets[i] = nil
+	}
+	a.nNew = 0
+	a.nTried = 0
+}
+
+// NumAddresses is the total number of addresses we know about.
+func (a *AddrManager) NumAddresses() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nNew + a.nTried
+}
+
+// NumTried is the number of addresses we've successfully connected to at some point.
+func (a *AddrManager) NumTried() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nTried
+}
+
+// Add records addresses gossiped to us by src. Addresses that aren't publicly routable are ignored.
+func (a *AddrManager) Add(addrs []proto.NetAddressV2, src proto.NetAddressV2) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, na := range addrs {
+		if !IsRoutable(na) {
+			continue
+		}
+		a.addOrUpdate(na, src)
+	}
+}
+
+// AddManual records an address supplied by the user (e.g. on the command line). It's taken on
+// trust, so isn't required to be routable, and is treated as its own source.
+func (a *AddrManager) AddManual(na proto.NetAddressV2) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if na.Time == 0 {
+		na.Time = uint32(time.Now().Unix())
+	}
+	a.addOrUpdate(na, na)
+}
+
+// Attempt records that we tried to connect to the address.
+func (a *AddrManager) Attempt(na proto.NetAddressV2) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.index[na.String()]
+	if ka == nil {
+		return
+	}
+	ka.Attempts++
+	ka.LastAttempt = time.Now()
+}
+
+// Connected records that we're still connected to the address, which keeps it fresh.
+func (a *AddrManager) Connected(na proto.NetAddressV2) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.index[na.String()]
+	if ka == nil {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(int64(ka.Addr.Time), 0)) > CONNECTED_UPDATE_INTERVAL {
+		ka.Addr.Time = uint32(now.Unix())
+	}
+}
+
+// Good records that we successfully connected to the address, and promotes it to the tried table.
+func (a *AddrManager) Good(na proto.NetAddressV2) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.index[na.String()]
+	if ka == nil {
+		return
+	}
+
+	now := time.Now()
+	ka.LastSuccess = now
+	ka.LastAttempt = now
+	ka.Attempts = 0
+	ka.Addr.Time = uint32(now.Unix())
+
+	if ka.tried {
+		return
+	}
+	a.moveToTried(ka)
+}
+
+// Select picks an address to make an outbound connection to, favouring those that have worked
+// before and avoiding any in the excluded network groups. It returns nil if there's nothing suitable.
+func (a *AddrManager) Select(excludeGroups map[string]bool) *KnownAddress {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.nNew+a.nTried == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	factor := 1.0
+	for i := 0; i < MAX_SELECT_ATTEMPTS; i++ {
+		var ka *KnownAddress
+		if a.nTried > 0 && (a.nNew == 0 || a.rand.Intn(2) == 0) {
+			ka = a.randomTried()
+		} else {
+			ka = a.randomNew()
+		}
+
+		if !IsDialable(ka.Addr) || excludeGroups[GroupKey(ka.Addr)] {
+			continue
+		}
+
+		// Accept the address in proportion to how promising it looks, becoming less picky each
+		// time round so that we do eventually settle on something
+		if a.rand.Float64() < ka.chance(now)*factor {
+			selected := *ka
+			return &selected
+		}
+		factor *= 1.2
+	}
+	return nil
+}
+
+// AddressCache returns a random selection of the addresses we know about, suitable for answering
+// a 'getaddr' request.
+func (a *AddrManager) AddressCache() []proto.NetAddressV2 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	addrs := make([]proto.NetAddressV2, 0, len(a.index))
+	for _, ka := range a.index {
+		if !ka.isTerrible(now) {
+			addrs = append(addrs, ka.Addr)
+		}
+	}
+
+	a.rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+
+	n := min(len(a.index)*GETADDR_MAX_PERCENT/100, GETADDR_MAX)
+	if n < len(addrs) {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+// hash derives a pseudo-random number from our secret key and the given data, for bucketing.
+func (a *AddrManager) hash(data ...[]byte) uint64 {
+	h := sha256.New()
+	h.Write(a.key[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// newBucket picks which new bucket an address belongs in. Each source group can only place
+// addresses in NEW_BUCKETS_PER_SOURCE_GROUP of the buckets.
+func (a *AddrManager) newBucket(na, src proto.NetAddressV2) int {
+	srcGroup := []byte(GroupKey(src))
+	slot := a.hash([]byte(GroupKey(na)), srcGroup) % NEW_BUCKETS_PER_SOURCE_GROUP
+	return int(a.hash(srcGroup, binary.LittleEndian.AppendUint64(nil, slot)) % NEW_BUCKET_COUNT)
+}
+
+// triedBucket picks which tried bucket an address belongs in. Each group can only place addresses
+// in TRIED_BUCKETS_PER_GROUP of the buckets.
+func (a *AddrManager) triedBucket(na proto.NetAddressV2) int {
+	slot := a.hash([]byte(na.String())) % TRIED_BUCKETS_PER_GROUP
+	return int(a.hash([]byte(GroupKey(na)), binary.LittleEndian.AppendUint64(nil, slot)) % TRIED_BUCKET_COUNT)
+}
+
+func (a *AddrManager) addOrUpdate(na, src proto.NetAddressV2) {
+	key := na.String()
+	ka := a.index[key]
+
+	if ka != nil {
+		// Someone else has heard of it more recently than we have
+		if na.Time > ka.Addr.Time {
+			ka.Addr.Time = na.Time
+		}
+		ka.Addr.Services |= na.Services
+
+		if ka.tried || ka.refs >= NEW_BUCKETS_PER_ADDRESS {
+			return
+		}
+
+		// The more buckets an address is already in, the less likely we are to add it to another
+		if a.rand.Intn(1<<ka.refs) != 0 {
+			return
+		}
+	} else {
+		ka = &KnownAddress{Addr: na, Src: src}
+		a.index[key] = ka
+		a.nNew++
+	}
+
+	a.addToNewBucket(ka, a.newBucket(na, src))
+}
+
+// addToNewBucket places an address in a new bucket, making room if necessary.
+func (a *AddrManager) addToNewBucket(ka *KnownAddress, bucket int) {
+	key := ka.Addr.String()
+	if _, ok := a.newBuckets[bucket][key]; ok {
+		return
+	}
+
+	if len(a.newBuckets[bucket]) >= BUCKET_SIZE {
+		a.expireNew(bucket)
+	}
+
+	a.newBuckets[bucket][key] = ka
+	ka.refs++
+}
+
+// expireNew makes room in a full new bucket by dropping any terrible addresses, or failing that,
+// the one we heard about least recently.
+func (a *AddrManager) expireNew(bucket int) {
+	now := time.Now()
+
+	var oldest *KnownAddress
+	for _, ka := range a.newBuckets[bucket] {
+		if ka.isTerrible(now) {
+			a.removeFromNewBucket(ka, bucket)
+			continue
+		}
+		if oldest == nil || ka.Addr.Time < oldest.Addr.Time {
+			oldest = ka
+		}
+	}
+
+	if len(a.newBuckets[bucket]) >= BUCKET_SIZE && oldest != nil {
+		a.removeFromNewBucket(oldest, bucket)
+	}
+}
+
+// removeFromNewBucket drops a reference to an address, forgetting it entirely once nothing refers to it.
+func (a *AddrManager) removeFromNewBucket(ka *KnownAddress, bucket int) {
+	key := ka.Addr.String()
+	delete(a.newBuckets[bucket], key)
+	ka.refs--
+
+	if ka.refs == 0 && !ka.tried {
+		delete(a.index, key)
+		a.nNew--
+	}
+}
+
+// moveToTried promotes an address out of the new table. If its tried bucket is full, the entry
+// that's gone longest without a successful connection is demoted back to the new table.
+func (a *AddrManager) moveToTried(ka *KnownAddress) {
+	key := ka.Addr.String()
+	for i := range a.newBuckets {
+		if _, ok := a.newBuckets[i][key]; ok {
+			delete(a.newBuckets[i], key)
+		}
+	}
+	ka.refs = 0
+	ka.tried = true
+	a.nNew--
+
+	bucket := a.triedBucket(ka.Addr)
+	if len(a.triedBuckets[bucket]) < BUCKET_SIZE {
+		a.triedBuckets[bucket] = append(a.triedBuckets[bucket], ka)
+		a.nTried++
+		return
+	}
+
+	oldestIdx := 0
+	for i, candidate := range a.triedBuckets[bucket] {
+		if candidate.LastSuccess.Before(a.triedBuckets[bucket][oldestIdx].LastSuccess) {
+			oldestIdx = i
+		}
+	}
+	evicted := a.triedBuckets[bucket][oldestIdx]
+	a.triedBuckets[bucket][oldestIdx] = ka
+
+	evicted.tried = false
+	a.nNew++
+	a.addToNewBucket(evicted, a.newBucket(evicted.Addr, evicted.Src))
+}
+
+// randomTried picks an address uniformly from a random non-empty tried bucket.
+func (a *AddrManager) randomTried() *KnownAddress {
+	for {
+		bucket := a.triedBuckets[a.rand.Intn(TRIED_BUCKET_COUNT)]
+		if len(bucket) > 0 {
+			return bucket[a.rand.Intn(len(bucket))]
+		}
+	}
+}
+
+// randomNew picks an address uniformly from a random non-empty new bucket.
+func (a *AddrManager) randomNew() *KnownAddress {
+	for {
+		bucket := a.newBuckets[a.rand.Intn(NEW_BUCKET_COUNT)]
+		if len(bucket) == 0 {
+			continue
+		}
+
+		n := a.rand.Intn(len(bucket))
+		for _, ka := range bucket {
+			if n == 0 {
+				return ka
+			}
+			n--
+		}
+	}
+}
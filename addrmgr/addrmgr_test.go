@@ -0,0 +1,173 @@
+package addrmgr_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/addrmgr"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAddr(addrPort string) proto.NetAddressV2 {
+	return proto.NewNetAddressV2(uint32(time.Now().Unix()), 1, netip.MustParseAddrPort(addrPort))
+}
+
+func newAddrManager(t *testing.T) (*addrmgr.AddrManager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "peers.json")
+	a, err := addrmgr.New(path)
+	require.NoError(t, err)
+	return a, path
+}
+
+func TestAddrManager_Add(t *testing.T) {
+	a, _ := newAddrManager(t)
+	src := newAddr("8.8.8.8:8333")
+
+	a.Add([]proto.NetAddressV2{
+		newAddr("1.2.3.4:8333"),
+		newAddr("1.2.3.4:8333"),  // Duplicate
+		newAddr("10.0.0.1:8333"), // Private, so ignored
+		newAddr("[2a00:1450::1]:8333"),
+		{Time: uint32(time.Now().Unix()), NetworkID: proto.NET_TORV3, Addr: make([]byte, 32), Port: 8333},
+	}, src)
+
+	assert.Equal(t, 3, a.NumAddresses())
+	assert.Equal(t, 0, a.NumTried())
+
+	// Unroutable addresses can still be added by hand
+	a.AddManual(newAddr("127.0.0.1:8333"))
+	assert.Equal(t, 4, a.NumAddresses())
+}
+
+func TestAddrManager_GoodPromotesToTried(t *testing.T) {
+	a, _ := newAddrManager(t)
+	addr := newAddr("1.2.3.4:8333")
+	a.Add([]proto.NetAddressV2{addr}, newAddr("8.8.8.8:8333"))
+
+	a.Attempt(addr)
+	a.Good(addr)
+	assert.Equal(t, 1, a.NumAddresses())
+	assert.Equal(t, 1, a.NumTried())
+
+	selected := a.Select(nil)
+	require.NotNil(t, selected)
+	assert.True(t, selected.Tried())
+	assert.Equal(t, 0, selected.Attempts)
+	assert.False(t, selected.LastSuccess.IsZero())
+}
+
+func TestAddrManager_SelectExcludesGroups(t *testing.T) {
+	a, _ := newAddrManager(t)
+	a.Add([]proto.NetAddressV2{
+		newAddr("1.2.3.4:8333"),
+		newAddr("1.2.5.6:8333"),
+		newAddr("5.6.7.8:8333"),
+	}, newAddr("8.8.8.8:8333"))
+
+	for i := 0; i < 20; i++ {
+		selected := a.Select(map[string]bool{"IPv4:0102": true})
+		require.NotNil(t, selected)
+		assert.Equal(t, "5.6.7.8:8333", selected.Addr.String())
+	}
+
+	// Nothing left once every group is excluded
+	assert.Nil(t, a.Select(map[string]bool{"IPv4:0102": true, "IPv4:0506": true}))
+}
+
+func TestAddrManager_SelectSkipsUndialable(t *testing.T) {
+	a, _ := newAddrManager(t)
+	a.Add([]proto.NetAddressV2{
+		{Time: uint32(time.Now().Unix()), NetworkID: proto.NET_TORV3, Addr: make([]byte, 32), Port: 8333},
+	}, newAddr("8.8.8.8:8333"))
+
+	assert.Equal(t, 1, a.NumAddresses())
+	assert.Nil(t, a.Select(nil))
+}
+
+func TestAddrManager_SourceCannotFloodNewTable(t *testing.T) {
+	a, _ := newAddrManager(t)
+	src := newAddr("8.8.8.8:8333")
+
+	// A single source can only fill NEW_BUCKETS_PER_SOURCE_GROUP buckets, no matter how many
+	// addresses it sends us
+	for i := 0; i < 100; i++ {
+		var addrs []proto.NetAddressV2
+		for j := 0; j < proto.MAX_ADDR_ENTRIES; j++ {
+			addrs = append(addrs, newAddr(fmt.Sprintf("%d.%d.%d.1:8333", 1+i, j/256, j%256)))
+		}
+		a.Add(addrs, src)
+	}
+
+	assert.LessOrEqual(t, a.NumAddresses(), addrmgr.NEW_BUCKETS_PER_SOURCE_GROUP*addrmgr.BUCKET_SIZE)
+}
+
+func TestAddrManager_AddressCache(t *testing.T) {
+	a, _ := newAddrManager(t)
+
+	var addrs []proto.NetAddressV2
+	for i := 0; i < 100; i++ {
+		addrs = append(addrs, newAddr(fmt.Sprintf("%d.1.1.1:8333", 1+i)))
+	}
+	a.Add(addrs, newAddr("8.8.8.8:8333"))
+
+	cache := a.AddressCache()
+	assert.Len(t, cache, a.NumAddresses()*addrmgr.GETADDR_MAX_PERCENT/100)
+}
+
+func TestAddrManager_SaveLoad(t *testing.T) {
+	a, path := newAddrManager(t)
+	tried := newAddr("1.2.3.4:8333")
+	a.Add([]proto.NetAddressV2{tried, newAddr("5.6.7.8:8333")}, newAddr("8.8.8.8:8333"))
+	a.Good(tried)
+	require.NoError(t, a.Save())
+
+	loaded, err := addrmgr.New(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, loaded.NumAddresses())
+	assert.Equal(t, 1, loaded.NumTried())
+}
+
+func TestAddrManager_LoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+
+	a, err := addrmgr.New(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, a.NumAddresses())
+}
+
+func TestAddrManager_LoadInvalidAddress(t *testing.T) {
+	a, path := newAddrManager(t)
+	torV3 := proto.NetAddressV2{NetworkID: proto.NET_TORV3, Addr: make([]byte, 32), Port: 8333}
+	torV3.Addr[0] = 1
+	a.Add([]proto.NetAddressV2{newAddr("1.2.3.4:8333"), torV3}, newAddr("8.8.8.8:8333"))
+	require.NoError(t, a.Save())
+	require.Equal(t, 2, a.NumAddresses())
+
+	// Cut the onion address short, so there is not even a first byte to group it by
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var sam map[string]any
+	require.NoError(t, json.Unmarshal(data, &sam))
+	for _, sa := range sam["Addresses"].([]any) {
+		addr := sa.(map[string]any)["Addr"].(map[string]any)
+		if addr["NetworkID"] == float64(proto.NET_TORV3) {
+			addr["Addr"] = ""
+		}
+	}
+	data, err = json.Marshal(sam)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	loaded, err := addrmgr.New(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, loaded.NumAddresses())
+}
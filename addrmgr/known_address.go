@@ -0,0 +1,83 @@
+package addrmgr
+
+import (
+	"math"
+	"time"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// How long since we last heard of an address before we consider it stale.
+	HORIZON = 30 * 24 * time.Hour
+
+	// How many failed connection attempts to a never-successful address before we give up on it.
+	RETRIES = 3
+
+	// How many failed connection attempts since the last success, at least MIN_FAIL_AGE ago,
+	// before we give up on an address we were once able to connect to.
+	MAX_FAILURES = 10
+	MIN_FAIL_AGE = 7 * 24 * time.Hour
+)
+
+// KnownAddress is an address in the address manager, along with what we know about connecting to it.
+type KnownAddress struct {
+	Addr        proto.NetAddressV2
+	Src         proto.NetAddressV2 // Who told us about it
+	Attempts    int                // Failed connection attempts since the last success
+	LastAttempt time.Time
+	LastSuccess time.Time
+
+	tried bool
+	refs  int // How many new buckets reference this address
+}
+
+// Tried reports whether we have ever successfully connected to the address.
+func (ka *KnownAddress) Tried() bool {
+	return ka.tried
+}
+
+// isTerrible reports whether an address is so unlikely to be any good that it can be dropped.
+func (ka *KnownAddress) isTerrible(now time.Time) bool {
+	// Never drop something we tried in the last minute
+	if now.Sub(ka.LastAttempt) < time.Minute {
+		return false
+	}
+
+	lastSeen := time.Unix(int64(ka.Addr.Time), 0)
+
+	// Came from the future
+	if lastSeen.After(now.Add(10 * time.Minute)) {
+		return true
+	}
+
+	// Not seen in ages
+	if ka.Addr.Time == 0 || now.Sub(lastSeen) > HORIZON {
+		return true
+	}
+
+	// Never managed to connect, despite trying
+	if ka.LastSuccess.IsZero() && ka.Attempts >= RETRIES {
+		return true
+	}
+
+	// Used to work, but hasn't for a long time
+	if now.Sub(ka.LastSuccess) > MIN_FAIL_AGE && ka.Attempts >= MAX_FAILURES {
+		return true
+	}
+
+	return false
+}
+
+// chance is the relative probability that we should pick this address to connect to.
+func (ka *KnownAddress) chance(now time.Time) float64 {
+	c := 1.0
+
+	// Deprioritise very recent attempts
+	if now.Sub(ka.LastAttempt) < 10*time.Minute {
+		c *= 0.01
+	}
+
+	// Each failed attempt makes us less likely to try again
+	return c * math.Pow(0.66, float64(min(ka.Attempts, 8)))
+}
@@ -0,0 +1,93 @@
+package addrmgr
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+// Address ranges that aren't reachable on the public internet, over and above the private,
+// loopback, link-local etc. ranges netip already knows about.
+var unroutablePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // RFC1122 'this network'
+	netip.MustParsePrefix("100.64.0.0/10"),   // RFC6598 carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // RFC6890 IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // RFC5737 TEST-NET-1
+	netip.MustParsePrefix("198.18.0.0/15"),   // RFC2544 benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // RFC5737 TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // RFC5737 TEST-NET-3
+	netip.MustParsePrefix("240.0.0.0/4"),     // RFC1112 reserved
+	netip.MustParsePrefix("2001:db8::/32"),   // RFC3849 documentation
+	netip.MustParsePrefix("2001:10::/28"),    // RFC4843 ORCHID
+	netip.MustParsePrefix("fc00::/7"),        // RFC4193 unique local
+}
+
+// IsRoutable reports whether the address could plausibly be reached over the public internet (or
+// the overlay network it belongs to).
+func IsRoutable(na proto.NetAddressV2) bool {
+	switch na.NetworkID {
+	case proto.NET_TORV3, proto.NET_I2P, proto.NET_CJDNS:
+		return true
+	case proto.NET_IPV4, proto.NET_IPV6:
+	default:
+		// TorV2 is dead, and we've no idea about anything else
+		return false
+	}
+
+	addrPort, ok := na.AddrPort()
+	if !ok {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range unroutablePrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDialable reports whether we can make an outbound connection to the address. We don't have any
+// proxy support, so that's only IPv4 and IPv6.
+func IsDialable(na proto.NetAddressV2) bool {
+	return na.NetworkID == proto.NET_IPV4 || na.NetworkID == proto.NET_IPV6
+}
+
+// GroupKey returns the network group the address belongs to. Addresses in the same group are
+// likely to be controlled by the same operator, so we spread our connections and our address
+// table across as many groups as possible. For IPv4 that's the /16, for IPv6 the /32, and for the
+// overlay networks a few leading bits of the address.
+func GroupKey(na proto.NetAddressV2) string {
+	if !IsRoutable(na) {
+		if addrPort, ok := na.AddrPort(); ok && addrPort.Addr().IsLoopback() {
+			return "local"
+		}
+		return "unroutable"
+	}
+
+	switch na.NetworkID {
+	case proto.NET_IPV4:
+		return fmt.Sprintf("%s:%x", na.NetworkID, na.Addr[:2])
+	case proto.NET_IPV6:
+		addr, _ := netip.AddrFromSlice(na.Addr)
+
+		// 6to4 (RFC3964) and Teredo (RFC4380) tunnel IPv4 addresses, so group by those instead
+		if netip.MustParsePrefix("2002::/16").Contains(addr) {
+			return fmt.Sprintf("%s:%x", proto.NET_IPV4, na.Addr[2:4])
+		}
+		if netip.MustParsePrefix("2001::/32").Contains(addr) {
+			return fmt.Sprintf("%s:%x", proto.NET_IPV4, []byte{na.Addr[12] ^ 0xff, na.Addr[13] ^ 0xff})
+		}
+		return fmt.Sprintf("%s:%x", na.NetworkID, na.Addr[:4])
+	case proto.NET_CJDNS:
+		// All CJDNS addresses start fc, so look at the 12 bits after the first 4
+		return fmt.Sprintf("%s:%x", na.NetworkID, []byte{na.Addr[0] & 0x0f, na.Addr[1]})
+	default:
+		return fmt.Sprintf("%s:%x", na.NetworkID, []byte{na.Addr[0] >> 4})
+	}
+}
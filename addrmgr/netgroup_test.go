@@ -0,0 +1,38 @@
+package addrmgr_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/pscott31/mynode/addrmgr"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     proto.NetAddressV2
+		group    string
+		routable bool
+	}{
+		{"IPv4", newAddr("1.2.3.4:8333"), "IPv4:0102", true},
+		{"IPv4 same /16", newAddr("1.2.200.1:8333"), "IPv4:0102", true},
+		{"IPv4 private", newAddr("192.168.1.1:8333"), "unroutable", false},
+		{"IPv4 documentation", newAddr("192.0.2.1:8333"), "unroutable", false},
+		{"IPv4 loopback", newAddr("127.0.0.1:8333"), "local", false},
+		{"IPv6", newAddr("[2a00:1450:4009::1]:8333"), "IPv6:2a001450", true},
+		{"IPv6 6to4", newAddr("[2002:0102:0304::1]:8333"), "IPv4:0102", true},
+		{"IPv6 documentation", newAddr("[2001:db8::1]:8333"), "unroutable", false},
+		{"TorV3", proto.NetAddressV2{NetworkID: proto.NET_TORV3, Addr: append([]byte{0xab}, make([]byte, 31)...)}, "TorV3:0a", true},
+		{"TorV2", proto.NetAddressV2{NetworkID: proto.NET_TORV2, Addr: make([]byte, 10)}, "unroutable", false},
+		{"CJDNS", proto.NetAddressV2{NetworkID: proto.NET_CJDNS, Addr: netip.MustParseAddr("fc12:3456::1").AsSlice()}, "CJDNS:0c12", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.group, addrmgr.GroupKey(tt.addr))
+			assert.Equal(t, tt.routable, addrmgr.IsRoutable(tt.addr))
+		})
+	}
+}
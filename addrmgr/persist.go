@@ -0,0 +1,192 @@
+package addrmgr
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// Bumped whenever the layout of the peers file changes incompatibly.
+	SERIALISATION_VERSION = 1
+
+	// How often the address tables are written to disk while running.
+	SAVE_INTERVAL = 10 * time.Minute
+)
+
+type serialisedAddress struct {
+	Addr        proto.NetAddressV2
+	Src         proto.NetAddressV2
+	Attempts    int
+	LastAttempt int64
+	LastSuccess int64
+	Tried       bool
+}
+
+type serialisedAddrManager struct {
+	Version   int
+	Key       string
+	Addresses []serialisedAddress
+}
+
+// Start periodically saves the address tables to disk until Stop is called.
+func (a *AddrManager) Start() {
+	a.quit = make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		ticker := time.NewTicker(SAVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.Save(); err != nil {
+					log.Printf("error saving addresses: %v", err)
+				}
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the periodic saving started by Start, and saves one last time.
+func (a *AddrManager) Stop() error {
+	if a.quit != nil {
+		close(a.quit)
+		a.wg.Wait()
+		a.quit = nil
+	}
+	return a.Save()
+}
+
+// Save writes the address tables to disk. The file is written alongside and then renamed into
+// place, so a crash part way through doesn't lose what was there before.
+func (a *AddrManager) Save() error {
+	a.mu.Lock()
+	sam := serialisedAddrManager{
+		Version:   SERIALISATION_VERSION,
+		Key:       hex.EncodeToString(a.key[:]),
+		Addresses: make([]serialisedAddress, 0, len(a.index)),
+	}
+	for _, ka := range a.index {
+		sam.Addresses = append(sam.Addresses, serialisedAddress{
+			Addr:        ka.Addr,
+			Src:         ka.Src,
+			Attempts:    ka.Attempts,
+			LastAttempt: unixOrZero(ka.LastAttempt),
+			LastSuccess: unixOrZero(ka.LastSuccess),
+			Tried:       ka.tried,
+		})
+	}
+	a.mu.Unlock()
+
+	samBytes, err := json.Marshal(sam)
+	if err != nil {
+		return fmt.Errorf("unable to marshal addresses: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o700); err != nil {
+		return fmt.Errorf("unable to create directory for %s: %w", a.path, err)
+	}
+
+	tmpPath := a.path + ".tmp"
+	if err := os.WriteFile(tmpPath, samBytes, 0o600); err != nil {
+		return fmt.Errorf("unable to write %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return fmt.Errorf("unable to replace %s: %w", a.path, err)
+	}
+	return nil
+}
+
+// load reads back the address tables saved by Save, if there are any. A file we can't make sense
+// of is logged and ignored, since we can always learn addresses again.
+func (a *AddrManager) load() error {
+	samBytes, err := os.ReadFile(a.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", a.path, err)
+	}
+
+	if err := a.deserialise(samBytes); err != nil {
+		log.Printf("ignoring corrupt peers file %s: %v", a.path, err)
+		a.reset()
+	}
+	return nil
+}
+
+func (a *AddrManager) deserialise(samBytes []byte) error {
+	var sam serialisedAddrManager
+	if err := json.Unmarshal(samBytes, &sam); err != nil {
+		return err
+	}
+
+	if sam.Version != SERIALISATION_VERSION {
+		return fmt.Errorf("unsupported version %d", sam.Version)
+	}
+
+	key, err := hex.DecodeString(sam.Key)
+	if err != nil || len(key) != len(a.key) {
+		return fmt.Errorf("invalid key")
+	}
+	copy(a.key[:], key)
+
+	// Bucket positions are derived from the key, so putting everything back where it belongs just
+	// means adding it all again
+	for _, sa := range sam.Addresses {
+		if err := sa.Addr.Validate(); err != nil {
+			return fmt.Errorf("invalid address %x: %w", sa.Addr.Addr, err)
+		}
+		if err := sa.Src.Validate(); err != nil {
+			return fmt.Errorf("invalid source address %x: %w", sa.Src.Addr, err)
+		}
+
+		ka := &KnownAddress{
+			Addr:        sa.Addr,
+			Src:         sa.Src,
+			Attempts:    sa.Attempts,
+			LastAttempt: timeOrZero(sa.LastAttempt),
+			LastSuccess: timeOrZero(sa.LastSuccess),
+		}
+		key := ka.Addr.String()
+		if _, ok := a.index[key]; ok {
+			continue
+		}
+
+		a.index[key] = ka
+		a.nNew++
+		if sa.Tried {
+			a.moveToTried(ka)
+		} else {
+			a.addToNewBucket(ka, a.newBucket(ka.Addr, ka.Src))
+		}
+	}
+	return nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
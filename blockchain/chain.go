@@ -0,0 +1,395 @@
+// Package blockchain validates blocks in full and connects them to the tip of the chain, keeping
+// the UTXO set in step. The header chain has already checked everything a block can be checked
+// for on its own; what's left are the rules that depend on the outputs it spends.
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/utxo"
+)
+
+// Chain is the chain of fully validated blocks, and the UTXO set as of its tip.
+type Chain struct {
+	params  *config.Params
+	headers *headerchain.HeaderChain
+	utxos   *utxo.Cache
+	workers int
+
+	mu  sync.Mutex
+	tip *headerchain.HeaderNode
+
+	// notifyMu is held while telling listeners about changes, to keep them in order.
+	notifyMu  sync.Mutex
+	listeners []*Listeners
+}
+
+// New picks up the chain from wherever the UTXO set is, which must be a block the header chain
+// knows about; an empty set is at the genesis block. Scripts are verified by workers goroutines
+// at a time, or one per CPU if workers is zero.
+func New(headers *headerchain.HeaderChain, utxos *utxo.Cache, workers int) (*Chain, error) {
+	tip := headers.NodeAtHeight(0)
+	if best := utxos.BestBlock(); !best.IsZero() {
+		tip = headers.LookupNode(best)
+		if tip == nil {
+			return nil, fmt.Errorf("UTXO set is as of block %s, which has no known header", best)
+		}
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return &Chain{
+		params:  headers.Params(),
+		headers: headers,
+		utxos:   utxos,
+		workers: workers,
+		tip:     tip,
+	}, nil
+}
+
+// Params are the parameters of the network the chain is for.
+func (c *Chain) Params() *config.Params {
+	return c.params
+}
+
+// Tip is the last block connected.
+func (c *Chain) Tip() *headerchain.HeaderNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tip
+}
+
+// FetchUTXO looks up an unspent output as of the tip, returning nil if there isn't one.
+func (c *Chain) FetchUTXO(op proto.OutPoint) (*utxo.Entry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.utxos.Entry(op)
+}
+
+// SequenceLocksMet reports whether a transaction's BIP68 relative lock times would let it into the
+// next block, given the heights of the outputs it spends. Outputs that aren't confirmed yet count
+// as being in the next block.
+func (c *Chain) SequenceLocksMet(tx *proto.Tx, prevHeights []int32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The tip stands in for the next block, as the lock can't depend on anything after it
+	lock := c.calcSequenceLock(tx, prevHeights, c.tip)
+	return lock.satisfied(c.tip.Height+1, c.tip.MedianTimePast())
+}
+
+// ProcessBlock validates a block and, if it extends the chain with the most work, connects it. A
+// block building on the tip is simply added to it; one on another branch is left in the block
+// store until that branch has more work than ours, when we reorganise onto it, rolling back to
+// where they fork and connecting the new branch's blocks from the store.
+//
+// A block that fails the header chain's CheckBlock is rejected with its error. One that breaks the
+// rules on connecting returns a RuleError and has its header marked invalid, since no version of
+// it could be valid. A reorg that runs into an invalid block is abandoned, leaving the chain as it
+// was, unless the blocks connected before it already have more work.
+func (c *Chain) ProcessBlock(node *headerchain.HeaderNode, block *proto.Block) error {
+	c.mu.Lock()
+	var notifications []notification
+	defer func() { c.notifyAndUnlock(notifications) }()
+
+	if hash := block.BlockHash(); hash != node.Hash {
+		return fmt.Errorf("block %s doesn't match header %s", hash, node.Hash)
+	}
+
+	switch {
+	case node.Height <= c.tip.Height && c.headers.Ancestor(c.tip, node.Height) == node:
+		// Already connected
+		return nil
+
+	case node.Parent == c.tip:
+		if err := c.connectBlock(node, block); err != nil {
+			return c.invalidate(node, err)
+		}
+		notifications = append(notifications, blockConnected(node, block))
+		return nil
+
+	case node.Work.Cmp(c.tip.Work) > 0:
+		var err error
+		notifications, err = c.reorganize(node, block)
+		return err
+	}
+
+	// A side branch with no more work than ours, which may yet overtake it
+	return nil
+}
+
+// invalidate marks a block's header invalid if it broke a consensus rule.
+func (c *Chain) invalidate(node *headerchain.HeaderNode, err error) error {
+	var ruleErr RuleError
+	if errors.As(err, &ruleErr) {
+		return errors.Join(err, c.headers.InvalidateBlock(node))
+	}
+	return err
+}
+
+// reorganize switches the chain to the branch ending with node, whose block is given; the rest
+// of the branch is read from the block store. It returns what to report about the switch.
+func (c *Chain) reorganize(node *headerchain.HeaderNode, block *proto.Block) ([]notification, error) {
+	oldTip := c.tip
+	fork := c.findFork(node)
+	if depth := oldTip.Height - fork.Height; depth > utxo.UNDO_DEPTH {
+		return nil, fmt.Errorf("reorg to block %s would disconnect %d blocks, more than the %d we can undo", node.Hash, depth, utxo.UNDO_DEPTH)
+	}
+
+	var branch []*headerchain.HeaderNode
+	for n := node; n != fork; n = n.Parent {
+		branch = append(branch, n)
+	}
+	slices.Reverse(branch)
+
+	reorg := &Reorg{OldTip: oldTip}
+	var notifications []notification
+	for c.tip != fork {
+		disconnected := c.tip
+		tipBlock, err := c.disconnectTip()
+		if err != nil {
+			return nil, errors.Join(err, c.reconnect(oldTip, fork))
+		}
+		reorg.Disconnected = append(reorg.Disconnected, disconnected.Hash)
+		notifications = append(notifications, blockDisconnected(disconnected, tipBlock))
+	}
+
+	for _, n := range branch {
+		b := block
+		if n != node {
+			var err error
+			if b, err = c.readBlock(n); err != nil {
+				return nil, errors.Join(err, c.reconnect(oldTip, fork))
+			}
+		}
+
+		if err := c.connectBlock(n, b); err != nil {
+			err = c.invalidate(n, err)
+			if c.tip.Work.Cmp(oldTip.Work) <= 0 {
+				return nil, errors.Join(err, c.reconnect(oldTip, fork))
+			}
+			// The valid part of the branch still has more work, so that's where we stay
+			reorg.NewTip = c.tip
+			reorg.Depth = len(reorg.Disconnected)
+			return append(notifications, reorged(reorg)), err
+		}
+		reorg.Connected = append(reorg.Connected, n.Hash)
+		notifications = append(notifications, blockConnected(n, b))
+	}
+
+	reorg.NewTip = c.tip
+	reorg.Depth = len(reorg.Disconnected)
+	log.Printf("reorganised from %s at height %d to %s at height %d, disconnecting %d blocks", oldTip.Hash, oldTip.Height, c.tip.Hash, c.tip.Height, reorg.Depth)
+	return append(notifications, reorged(reorg)), nil
+}
+
+// findFork finds the last block that's on both the connected chain and the one leading to node.
+func (c *Chain) findFork(node *headerchain.HeaderNode) *headerchain.HeaderNode {
+	a, b := c.tip, node
+	for a.Height > b.Height {
+		a = a.Parent
+	}
+	for b.Height > a.Height {
+		b = b.Parent
+	}
+	for a != b {
+		a, b = a.Parent, b.Parent
+	}
+	return a
+}
+
+// disconnectTip undoes the tip block, making its parent the tip, and returns the block.
+func (c *Chain) disconnectTip() (*proto.Block, error) {
+	block, err := c.readBlock(c.tip)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.utxos.DisconnectBlock(block, c.tip.Height); err != nil {
+		return nil, fmt.Errorf("unable to disconnect block %s: %w", c.tip.Hash, err)
+	}
+	c.tip = c.tip.Parent
+	return block, nil
+}
+
+// reconnect puts the chain back on the branch ending at oldTip after an abandoned reorg, which has
+// already been rolled back to somewhere between the fork point and the new branch's blocks. The
+// blocks on the old branch were valid before, so they're connected without checking them again.
+func (c *Chain) reconnect(oldTip, fork *headerchain.HeaderNode) error {
+	for c.tip != fork && c.headers.Ancestor(oldTip, c.tip.Height) != c.tip {
+		if _, err := c.disconnectTip(); err != nil {
+			return err
+		}
+	}
+
+	var branch []*headerchain.HeaderNode
+	for n := oldTip; n != c.tip; n = n.Parent {
+		branch = append(branch, n)
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		block, err := c.readBlock(branch[i])
+		if err != nil {
+			return err
+		}
+		if err := c.utxos.ConnectBlock(block, branch[i].Height); err != nil {
+			return fmt.Errorf("unable to reconnect block %s: %w", branch[i].Hash, err)
+		}
+		c.tip = branch[i]
+	}
+	return nil
+}
+
+// readBlock loads a block from the block store.
+func (c *Chain) readBlock(node *headerchain.HeaderNode) (*proto.Block, error) {
+	raw, err := c.headers.ReadBlock(node.Hash)
+	if err != nil {
+		return nil, err
+	}
+	block := &proto.Block{}
+	if err := block.UnmarshalFromReader(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("unable to decode stored block %s: %w", node.Hash, err)
+	}
+	return block, nil
+}
+
+// Flush writes the UTXO set to disk.
+func (c *Chain) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.utxos.Flush()
+}
+
+// checkBlockContext checks the rules that depend on where the block is in the chain, but not on
+// what its transactions spend.
+func (c *Chain) checkBlockContext(node *headerchain.HeaderNode, block *proto.Block) error {
+	// BIP113: once CSV is active, lock times are compared against the median time past rather than
+	// the block's own timestamp, which miners have more leeway over
+	lockTimeCutoff := block.Header.Time()
+	if node.Height >= c.params.CSVHeight {
+		lockTimeCutoff = node.Parent.MedianTimePast()
+	}
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		if !IsFinalTx(tx, node.Height, lockTimeCutoff) {
+			return ruleError(ErrUnfinalizedTx, "block %s contains unfinalized transaction %s", node.Hash, tx.TxHash())
+		}
+	}
+
+	if node.Height >= c.params.BIP34Height {
+		if err := checkCoinbaseHeight(block, node.Height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectBlock validates a block building on the tip and, if all is well, connects it to the
+// UTXO set and makes it the tip.
+func (c *Chain) connectBlock(node *headerchain.HeaderNode, block *proto.Block) error {
+	if err := c.headers.CheckBlock(block); err != nil {
+		return err
+	}
+	if err := c.checkBlockContext(node, block); err != nil {
+		return err
+	}
+	return c.connectTransactions(node, block)
+}
+
+// connectTransactions checks the block's transactions against the outputs they spend, verifies
+// their scripts, and if all is well, updates the UTXO set.
+func (c *Chain) connectTransactions(node *headerchain.HeaderNode, block *proto.Block) error {
+	height := node.Height
+	flags := BlockScriptFlags(c.params, height, node.Hash)
+
+	// BIP30: a transaction can't have the same hash as an earlier one with outputs still unspent,
+	// bar two that did before it was enforced
+	enforceBIP30 := (height < c.params.BIP34Height || height >= BIP34_IMPLIES_BIP30_LIMIT) &&
+		!slices.Contains(c.params.BIP30Exceptions, node.Hash)
+	enforceBIP68 := height >= c.params.CSVHeight
+	medianTimePast := node.Parent.MedianTimePast()
+
+	view := newUTXOView(c.utxos)
+	var checks []scriptCheck
+	var fees int64
+	sigOpCost := 0
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		txHash := tx.TxHash()
+
+		if enforceBIP30 {
+			for index := range tx.TxOut {
+				entry, err := view.entry(proto.OutPoint{Hash: txHash, Index: uint32(index)})
+				if err != nil {
+					return err
+				}
+				if entry != nil {
+					return ruleError(ErrOverwriteTx, "block %s transaction %s would overwrite an unspent output", node.Hash, txHash)
+				}
+			}
+		}
+
+		var prevOuts []proto.TxOut
+		if !tx.IsCoinBase() {
+			var prevHeights []int32
+			var fee int64
+			var err error
+			prevOuts, prevHeights, fee, err = view.spendInputs(tx, txHash, height)
+			if err != nil {
+				return err
+			}
+
+			fees += fee
+			if fees > headerchain.MAX_MONEY {
+				return ruleError(ErrBadFees, "block %s fees total more than the maximum", node.Hash)
+			}
+
+			if enforceBIP68 {
+				if lock := c.calcSequenceLock(tx, prevHeights, node); !lock.satisfied(height, medianTimePast) {
+					return ruleError(ErrSequenceLockNotMet, "block %s transaction %s is before its relative lock time", node.Hash, txHash)
+				}
+			}
+		}
+
+		sigOpCost += TxSigOpCost(tx, prevOuts, flags)
+		if sigOpCost > MAX_BLOCK_SIGOPS_COST {
+			return ruleError(ErrTooManySigOps, "block %s has a signature check cost of more than %d", node.Hash, MAX_BLOCK_SIGOPS_COST)
+		}
+
+		if !tx.IsCoinBase() {
+			// Every input's signatures hash the same parts of the transaction, so that's done once
+			midstate := proto.NewSigHashMidstate(*tx, prevOuts)
+			for idx := range tx.TxIn {
+				checks = append(checks, scriptCheck{tx: tx, idx: idx, prevOuts: prevOuts, midstate: midstate})
+			}
+		}
+		view.addTx(tx, txHash, height)
+	}
+
+	var coinbaseValue int64
+	for _, out := range block.Transactions[0].TxOut {
+		coinbaseValue += out.Value
+	}
+	if maxValue := CalcBlockSubsidy(height, c.params) + fees; coinbaseValue > maxValue {
+		return ruleError(ErrBadCoinbaseValue, "block %s coinbase pays %d, more than the %d allowed", node.Hash, coinbaseValue, maxValue)
+	}
+
+	// The most expensive checks last, once everything else has passed
+	if err := verifyScripts(checks, flags, c.workers); err != nil {
+		return err
+	}
+
+	if err := c.utxos.ConnectBlock(block, height); err != nil {
+		return fmt.Errorf("unable to connect block %s: %w", node.Hash, err)
+	}
+	c.tip = node
+	return nil
+}
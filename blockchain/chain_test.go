@@ -0,0 +1,401 @@
+package blockchain_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/pscott31/mynode/blockchain"
+	"github.com/pscott31/mynode/blockstore"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/pscott31/mynode/utxo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The coinbases in the test chain pay to two outputs: one anyone can spend, and one that needs a
+// 2 pushing.
+var (
+	opTrueScript   = []byte{txscript.OP_TRUE}
+	twoEqualScript = []byte{txscript.OP_2, txscript.OP_EQUAL}
+)
+
+const twoEqualValue = 1000
+
+// testChain builds and connects regtest blocks.
+type testChain struct {
+	t       *testing.T
+	params  *config.Params
+	headers *headerchain.HeaderChain
+	db      *utxo.DB
+	utxos   *utxo.Cache
+	chain   *blockchain.Chain
+	blocks  []*proto.Block // The connected blocks, by height; genesis is nil
+}
+
+// newTestChain builds a chain up to the given height out of blocks with just a coinbase.
+func newTestChain(t *testing.T, height int) *testChain {
+	t.Helper()
+	params := &config.RegTestParams
+	db, err := utxo.OpenDB(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	store, err := blockstore.Open(t.TempDir(), config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	headers, err := headerchain.Load(params, store)
+	require.NoError(t, err)
+
+	utxos := utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	chain, err := blockchain.New(headers, utxos, 4)
+	require.NoError(t, err)
+
+	c := &testChain{t: t, params: params, headers: headers, db: db, utxos: utxos, chain: chain, blocks: []*proto.Block{nil}}
+	for len(c.blocks) <= height {
+		require.NoError(t, c.submit(c.newBlock()))
+	}
+	return c
+}
+
+// heightPush is the BIP34 prefix of a coinbase's signature script, for the small heights we use.
+func heightPush(height int32) []byte {
+	if height <= 16 {
+		return []byte{txscript.OP_1 + byte(height-1)}
+	}
+	return []byte{0x01, byte(height)}
+}
+
+// newBlock builds a block on the tip with the transactions and a coinbase claiming the subsidy.
+func (c *testChain) newBlock(txs ...proto.Tx) *proto.Block {
+	return c.newBlockOn(c.chain.Tip(), txs...)
+}
+
+// newBlockOn builds a block on the given parent, which need not be the tip.
+func (c *testChain) newBlockOn(parent *headerchain.HeaderNode, txs ...proto.Tx) *proto.Block {
+	height := parent.Height + 1
+	subsidy := blockchain.CalcBlockSubsidy(height, c.params)
+	coinbase := proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX},
+			SignatureScript:  append(heightPush(height), 0x00),
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{
+			{Value: subsidy - twoEqualValue, PkScript: opTrueScript},
+			{Value: twoEqualValue, PkScript: twoEqualScript},
+		},
+	}
+
+	return &proto.Block{
+		Header: proto.BlockHeader{
+			Version:   4,
+			PrevBlock: parent.Hash,
+			Timestamp: parent.Header.Timestamp + 600,
+			Bits:      c.params.PowLimitBits,
+		},
+		Transactions: append([]proto.Tx{coinbase}, txs...),
+	}
+}
+
+// store mines the block, adds its header and saves it to the block store, as syncing would.
+func (c *testChain) store(block *proto.Block) *headerchain.HeaderNode {
+	c.t.Helper()
+	block.Header.MerkleRoot, _ = block.MerkleRoot()
+	for headerchain.CheckProofOfWork(block.Header, c.params.PowLimit) != nil {
+		block.Header.Nonce++
+	}
+	_, err := c.headers.ProcessHeaders([]proto.BlockHeader{block.Header})
+	require.NoError(c.t, err)
+	require.NoError(c.t, c.headers.AcceptBlock(block))
+	return c.headers.LookupNode(block.BlockHash())
+}
+
+// submit stores the block and tries to connect it to the tip.
+func (c *testChain) submit(block *proto.Block) error {
+	c.t.Helper()
+	if err := c.chain.ProcessBlock(c.store(block), block); err != nil {
+		return err
+	}
+	c.blocks = append(c.blocks, block)
+	return nil
+}
+
+// coinbaseOut is an output of the coinbase at the given height.
+func (c *testChain) coinbaseOut(height int, index uint32) proto.OutPoint {
+	return proto.OutPoint{Hash: c.blocks[height].Transactions[0].TxHash(), Index: index}
+}
+
+func spendTx(value int64, sigScript []byte, ops ...proto.OutPoint) proto.Tx {
+	tx := proto.Tx{Version: 2, TxOut: []proto.TxOut{{Value: value, PkScript: opTrueScript}}}
+	for _, op := range ops {
+		tx.TxIn = append(tx.TxIn, proto.TxIn{PreviousOutPoint: op, SignatureScript: sigScript, Sequence: proto.MAX_TX_IN_SEQUENCE})
+	}
+	return tx
+}
+
+func requireRuleError(t *testing.T, err error, code blockchain.ErrorCode) {
+	t.Helper()
+	var ruleErr blockchain.RuleError
+	require.True(t, errors.As(err, &ruleErr), "expected a rule error, got %v", err)
+	assert.Equal(t, code, ruleErr.Code, ruleErr.Description)
+}
+
+func TestChain_ConnectsBlocks(t *testing.T) {
+	c := newTestChain(t, 110)
+	assert.Equal(t, int32(110), c.chain.Tip().Height)
+	assert.Equal(t, c.blocks[110].BlockHash(), c.utxos.BestBlock())
+
+	// Spend a mature coinbase, and the new output in the same block, claiming the fees
+	subsidy := blockchain.CalcBlockSubsidy(1, c.params)
+	first := spendTx(subsidy-twoEqualValue-100, nil, c.coinbaseOut(1, 0))
+	second := spendTx(subsidy-twoEqualValue-300, nil, proto.OutPoint{Hash: first.TxHash()})
+	block := c.newBlock(first, second)
+	block.Transactions[0].TxOut[0].Value += 300
+	require.NoError(t, c.submit(block))
+	assert.Equal(t, int32(111), c.chain.Tip().Height)
+
+	entry, err := c.utxos.Entry(c.coinbaseOut(1, 0))
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	entry, err = c.utxos.Entry(proto.OutPoint{Hash: second.TxHash()})
+	require.NoError(t, err)
+	assert.Equal(t, second.TxOut[0].Value, entry.Amount)
+
+	// Picking up again after a restart carries on from the same tip
+	require.NoError(t, c.chain.Flush())
+	restarted, err := blockchain.New(c.headers, utxo.NewCache(c.db, utxo.DEFAULT_CACHE_SIZE), 1)
+	require.NoError(t, err)
+	assert.Equal(t, c.chain.Tip(), restarted.Tip())
+}
+
+func TestChain_RejectsInvalidBlocks(t *testing.T) {
+	c := newTestChain(t, 110)
+	subsidy := blockchain.CalcBlockSubsidy(1, c.params)
+	value := subsidy - twoEqualValue
+
+	tests := []struct {
+		name  string
+		block func() *proto.Block
+		code  blockchain.ErrorCode
+	}{
+		{"wrong coinbase height", func() *proto.Block {
+			block := c.newBlock()
+			block.Transactions[0].TxIn[0].SignatureScript = append(heightPush(110), 0x00)
+			return block
+		}, blockchain.ErrBadCoinbaseHeight},
+		{"coinbase claims too much", func() *proto.Block {
+			block := c.newBlock()
+			block.Transactions[0].TxOut[0].Value++
+			return block
+		}, blockchain.ErrBadCoinbaseValue},
+		{"coinbase claims more than the fees", func() *proto.Block {
+			block := c.newBlock(spendTx(value-100, nil, c.coinbaseOut(1, 0)))
+			block.Transactions[0].TxOut[0].Value += 101
+			return block
+		}, blockchain.ErrBadCoinbaseValue},
+		{"unfinalized transaction", func() *proto.Block {
+			tx := spendTx(value, nil, c.coinbaseOut(1, 0))
+			tx.LockTime = 500
+			tx.TxIn[0].Sequence = 0
+			return c.newBlock(tx)
+		}, blockchain.ErrUnfinalizedTx},
+		{"missing output", func() *proto.Block {
+			return c.newBlock(spendTx(1, nil, proto.OutPoint{Hash: proto.DoubleSHA256([]byte("nothing"))}))
+		}, blockchain.ErrMissingTxOut},
+		{"double spend", func() *proto.Block {
+			return c.newBlock(spendTx(value, nil, c.coinbaseOut(1, 0)), spendTx(value-1, nil, c.coinbaseOut(1, 0)))
+		}, blockchain.ErrMissingTxOut},
+		{"spends output from later in the block", func() *proto.Block {
+			first := spendTx(value, nil, c.coinbaseOut(1, 0))
+			return c.newBlock(spendTx(value, nil, proto.OutPoint{Hash: first.TxHash()}), first)
+		}, blockchain.ErrMissingTxOut},
+		{"immature coinbase", func() *proto.Block {
+			return c.newBlock(spendTx(value, nil, c.coinbaseOut(12, 0)))
+		}, blockchain.ErrImmatureSpend},
+		{"spends more than inputs", func() *proto.Block {
+			return c.newBlock(spendTx(value+1, nil, c.coinbaseOut(1, 0)))
+		}, blockchain.ErrSpendTooHigh},
+		{"relative lock time", func() *proto.Block {
+			tx := spendTx(value, nil, c.coinbaseOut(1, 0))
+			tx.TxIn[0].Sequence = 150
+			return c.newBlock(tx)
+		}, blockchain.ErrSequenceLockNotMet},
+		{"too many signature checks", func() *proto.Block {
+			tx := spendTx(value, nil, c.coinbaseOut(1, 0))
+			tx.TxOut[0].PkScript = bytes.Repeat([]byte{txscript.OP_CHECKSIG}, blockchain.MAX_BLOCK_SIGOPS_COST/proto.WITNESS_SCALE_FACTOR+1)
+			return c.newBlock(tx)
+		}, blockchain.ErrTooManySigOps},
+		{"failing script", func() *proto.Block {
+			var inputs []proto.OutPoint
+			for height := 1; height <= 10; height++ {
+				inputs = append(inputs, c.coinbaseOut(height, 1))
+			}
+			tx := spendTx(10*twoEqualValue, []byte{txscript.OP_2}, inputs...)
+			tx.TxIn[6].SignatureScript = []byte{txscript.OP_3}
+			return c.newBlock(tx)
+		}, blockchain.ErrScriptValidation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requireRuleError(t, c.submit(tt.block()), tt.code)
+
+			// Nothing changes when a block is rejected
+			assert.Equal(t, int32(110), c.chain.Tip().Height)
+			assert.Equal(t, c.blocks[110].BlockHash(), c.utxos.BestBlock())
+			entry, err := c.utxos.Entry(c.coinbaseOut(1, 0))
+			require.NoError(t, err)
+			assert.NotNil(t, entry)
+		})
+	}
+
+	// The same spends are fine when done properly
+	var inputs []proto.OutPoint
+	for height := 1; height <= 10; height++ {
+		inputs = append(inputs, c.coinbaseOut(height, 1))
+	}
+	require.NoError(t, c.submit(c.newBlock(spendTx(10*twoEqualValue, []byte{txscript.OP_2}, inputs...))))
+}
+
+// branch stores blocks building on the given one, each spending the next of the test chain's
+// coinbases, starting at the given height, so they differ from the blocks already there.
+func (c *testChain) branch(from *headerchain.HeaderNode, n int, spending int) ([]*headerchain.HeaderNode, []*proto.Block) {
+	c.t.Helper()
+	value := blockchain.CalcBlockSubsidy(1, c.params) - twoEqualValue
+	var nodes []*headerchain.HeaderNode
+	var blocks []*proto.Block
+	for i := 0; i < n; i++ {
+		block := c.newBlockOn(from, spendTx(value, nil, c.coinbaseOut(spending+i, 0)))
+		from = c.store(block)
+		nodes = append(nodes, from)
+		blocks = append(blocks, block)
+	}
+	return nodes, blocks
+}
+
+// recorder remembers what the chain reported to its listeners.
+type recorder struct {
+	connected    []proto.Hash
+	disconnected []proto.Hash
+	reorgs       []*blockchain.Reorg
+}
+
+func (c *testChain) subscribe() *recorder {
+	r := &recorder{}
+	c.chain.Subscribe(&blockchain.Listeners{
+		OnBlockConnected: func(node *headerchain.HeaderNode, block *proto.Block) { r.connected = append(r.connected, node.Hash) },
+		OnBlockDisconnected: func(node *headerchain.HeaderNode, block *proto.Block) {
+			r.disconnected = append(r.disconnected, node.Hash)
+		},
+		OnReorg: func(reorg *blockchain.Reorg) { r.reorgs = append(r.reorgs, reorg) },
+	})
+	return r
+}
+
+func hashesOf(nodes []*headerchain.HeaderNode) []proto.Hash {
+	var hashes []proto.Hash
+	for _, node := range nodes {
+		hashes = append(hashes, node.Hash)
+	}
+	return hashes
+}
+
+func TestChain_Reorganizes(t *testing.T) {
+	c := newTestChain(t, 108)
+	events := c.subscribe()
+
+	// Spend a coinbase on the current branch, which the reorg should undo
+	value := blockchain.CalcBlockSubsidy(1, c.params) - twoEqualValue
+	require.NoError(t, c.submit(c.newBlock(spendTx(value, nil, c.coinbaseOut(1, 0)))))
+	require.NoError(t, c.submit(c.newBlock()))
+	oldTip := c.chain.Tip()
+	assert.Equal(t, []proto.Hash{c.blocks[109].BlockHash(), c.blocks[110].BlockHash()}, events.connected)
+
+	// Blocks on a branch without more work are left alone
+	fork := c.headers.LookupNode(c.blocks[107].BlockHash())
+	nodes, blocks := c.branch(fork, 4, 2)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.chain.ProcessBlock(nodes[i], blocks[i]))
+		assert.Equal(t, oldTip, c.chain.Tip())
+	}
+
+	require.NoError(t, c.chain.ProcessBlock(nodes[3], blocks[3]))
+	assert.Equal(t, nodes[3], c.chain.Tip())
+	assert.Equal(t, nodes[3].Hash, c.utxos.BestBlock())
+
+	require.Len(t, events.reorgs, 1)
+	assert.Equal(t, &blockchain.Reorg{
+		Depth:        3,
+		OldTip:       oldTip,
+		NewTip:       nodes[3],
+		Disconnected: []proto.Hash{c.blocks[110].BlockHash(), c.blocks[109].BlockHash(), c.blocks[108].BlockHash()},
+		Connected:    hashesOf(nodes),
+	}, events.reorgs[0])
+	assert.Equal(t, events.reorgs[0].Disconnected, events.disconnected)
+	assert.Equal(t, append([]proto.Hash{c.blocks[109].BlockHash(), c.blocks[110].BlockHash()}, hashesOf(nodes)...), events.connected)
+
+	// The spend on the old branch is undone, and those on the new one made
+	entry, err := c.utxos.Entry(c.coinbaseOut(1, 0))
+	require.NoError(t, err)
+	assert.NotNil(t, entry)
+	entry, err = c.utxos.Entry(c.coinbaseOut(2, 0))
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestChain_AbandonsReorgToInvalidBranch(t *testing.T) {
+	c := newTestChain(t, 110)
+	oldTip := c.chain.Tip()
+	events := c.subscribe()
+
+	// The branch would have more work, but its second block spends an output twice
+	fork := c.headers.LookupNode(c.blocks[109].BlockHash())
+	nodes, blocks := c.branch(fork, 1, 1)
+	bad := c.newBlockOn(nodes[0], spendTx(1, nil, c.coinbaseOut(1, 0)))
+	require.NoError(t, c.chain.ProcessBlock(nodes[0], blocks[0]))
+	badNode := c.store(bad)
+
+	requireRuleError(t, c.chain.ProcessBlock(badNode, bad), blockchain.ErrMissingTxOut)
+	assert.Equal(t, oldTip, c.chain.Tip())
+	assert.Equal(t, oldTip.Hash, c.utxos.BestBlock())
+	assert.NotZero(t, badNode.Status&headerchain.STATUS_INVALID)
+	assert.Empty(t, events.connected)
+	assert.Empty(t, events.disconnected)
+	assert.Empty(t, events.reorgs)
+
+	// The old branch carries on as before
+	entry, err := c.utxos.Entry(c.coinbaseOut(1, 0))
+	require.NoError(t, err)
+	assert.NotNil(t, entry)
+	require.NoError(t, c.submit(c.newBlock()))
+}
+
+func TestChain_KeepsValidPartOfReorg(t *testing.T) {
+	c := newTestChain(t, 110)
+	oldTip := c.chain.Tip()
+	events := c.subscribe()
+
+	fork := c.headers.LookupNode(c.blocks[109].BlockHash())
+	nodes, _ := c.branch(fork, 2, 1)
+	bad := c.newBlockOn(nodes[1])
+	bad.Transactions[0].TxOut[0].Value++
+	badNode := c.store(bad)
+
+	requireRuleError(t, c.chain.ProcessBlock(badNode, bad), blockchain.ErrBadCoinbaseValue)
+	assert.Equal(t, nodes[1], c.chain.Tip())
+	assert.Equal(t, nodes[1].Hash, c.utxos.BestBlock())
+	assert.Equal(t, nodes[1], c.headers.Tip())
+	require.Len(t, events.reorgs, 1)
+	assert.Equal(t, &blockchain.Reorg{
+		Depth:        1,
+		OldTip:       oldTip,
+		NewTip:       nodes[1],
+		Disconnected: []proto.Hash{oldTip.Hash},
+		Connected:    hashesOf(nodes),
+	}, events.reorgs[0])
+}
@@ -0,0 +1,58 @@
+package blockchain
+
+import "fmt"
+
+// ErrorCode identifies which consensus rule a block broke when it was connected to the chain.
+type ErrorCode int
+
+const (
+	ErrBadCoinbaseHeight ErrorCode = iota
+	ErrUnfinalizedTx
+	ErrOverwriteTx
+	ErrMissingTxOut
+	ErrImmatureSpend
+	ErrBadTxInputValue
+	ErrSpendTooHigh
+	ErrBadFees
+	ErrSequenceLockNotMet
+	ErrTooManySigOps
+	ErrBadCoinbaseValue
+	ErrScriptValidation
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrBadCoinbaseHeight:  "ErrBadCoinbaseHeight",
+	ErrUnfinalizedTx:      "ErrUnfinalizedTx",
+	ErrOverwriteTx:        "ErrOverwriteTx",
+	ErrMissingTxOut:       "ErrMissingTxOut",
+	ErrImmatureSpend:      "ErrImmatureSpend",
+	ErrBadTxInputValue:    "ErrBadTxInputValue",
+	ErrSpendTooHigh:       "ErrSpendTooHigh",
+	ErrBadFees:            "ErrBadFees",
+	ErrSequenceLockNotMet: "ErrSequenceLockNotMet",
+	ErrTooManySigOps:      "ErrTooManySigOps",
+	ErrBadCoinbaseValue:   "ErrBadCoinbaseValue",
+	ErrScriptValidation:   "ErrScriptValidation",
+}
+
+func (e ErrorCode) String() string {
+	if s, ok := errorCodeStrings[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// RuleError is returned when a block breaks a consensus rule that can only be checked against the
+// chain it's being connected to, as opposed to something going wrong on our side.
+type RuleError struct {
+	Code        ErrorCode
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+func ruleError(code ErrorCode, format string, args ...any) RuleError {
+	return RuleError{Code: code, Description: fmt.Sprintf(format, args...)}
+}
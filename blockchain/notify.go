@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+)
+
+// Reorg describes the chain switching from one branch to another with more work.
+type Reorg struct {
+	Depth        int // How many blocks were disconnected
+	OldTip       *headerchain.HeaderNode
+	NewTip       *headerchain.HeaderNode
+	Disconnected []proto.Hash // From the old tip back to the fork point
+	Connected    []proto.Hash // From the fork point up to the new tip
+}
+
+// Listeners are told about changes to the chain, in the order they happen. A reorg is reported
+// block by block, then as a whole. Any listener can be nil. They're called after the chain has
+// been updated, so they can look at it, but they mustn't subscribe more listeners.
+type Listeners struct {
+	OnBlockConnected    func(node *headerchain.HeaderNode, block *proto.Block)
+	OnBlockDisconnected func(node *headerchain.HeaderNode, block *proto.Block)
+	OnReorg             func(reorg *Reorg)
+}
+
+// notification is a change waiting to be reported to the listeners.
+type notification func(l *Listeners)
+
+// Subscribe adds listeners to be told about changes to the chain from now on.
+func (c *Chain) Subscribe(listeners *Listeners) {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	c.listeners = append(c.listeners, listeners)
+}
+
+func blockConnected(node *headerchain.HeaderNode, block *proto.Block) notification {
+	return func(l *Listeners) {
+		if l.OnBlockConnected != nil {
+			l.OnBlockConnected(node, block)
+		}
+	}
+}
+
+func blockDisconnected(node *headerchain.HeaderNode, block *proto.Block) notification {
+	return func(l *Listeners) {
+		if l.OnBlockDisconnected != nil {
+			l.OnBlockDisconnected(node, block)
+		}
+	}
+}
+
+func reorged(reorg *Reorg) notification {
+	return func(l *Listeners) {
+		if l.OnReorg != nil {
+			l.OnReorg(reorg)
+		}
+	}
+}
+
+// notifyAndUnlock releases the chain lock, then reports the changes. Holding notifyMu across the
+// handover keeps changes from different calls from being reported out of order.
+func (c *Chain) notifyAndUnlock(notifications []notification) {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	c.mu.Unlock()
+
+	for _, notify := range notifications {
+		for _, l := range c.listeners {
+			notify(l)
+		}
+	}
+}
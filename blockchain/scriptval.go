@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+)
+
+// scriptCheck is an input whose scripts need verifying.
+type scriptCheck struct {
+	tx       *proto.Tx
+	idx      int
+	prevOuts []proto.TxOut
+	midstate *proto.SigHashMidstate
+}
+
+// verifyScripts checks the scripts of every input, shared out among a pool of workers. It returns
+// as soon as it can once one fails; if several do, which one is reported isn't defined.
+func verifyScripts(checks []scriptCheck, flags txscript.ScriptFlags, workers int) error {
+	var (
+		next     atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	workers = max(min(workers, len(checks)), 1)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !failed.Load() {
+				n := int(next.Add(1)) - 1
+				if n >= len(checks) {
+					return
+				}
+
+				check := checks[n]
+				if err := txscript.VerifyScript(check.tx, check.idx, check.prevOuts, flags, check.midstate); err != nil {
+					errOnce.Do(func() {
+						firstErr = ruleError(ErrScriptValidation, "transaction %s input %d failed script validation: %v", check.tx.TxHash(), check.idx, err)
+					})
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
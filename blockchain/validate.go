@@ -0,0 +1,185 @@
+package blockchain
+
+import (
+	"bytes"
+	"slices"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+)
+
+const (
+	// Coinbase outputs can't be spent until this many blocks have been built on them, so a
+	// reorg can't invalidate a chain of transactions descending from them.
+	COINBASE_MATURITY = 100
+
+	// BIP141: the most signature checks a block may have, with legacy ones costing four times as
+	// much as witness ones.
+	MAX_BLOCK_SIGOPS_COST = 80_000
+
+	// The subsidy for the first blocks, in satoshis, which halves every SubsidyHalvingInterval.
+	BASE_SUBSIDY = 50 * 100_000_000
+
+	// BIP34 makes every coinbase different, and so every transaction, which makes BIP30 redundant
+	// up to this height, where coinbases from before BIP34 that happen to start with a push of the
+	// height could be repeated.
+	BIP34_IMPLIES_BIP30_LIMIT = 1_983_702
+)
+
+// CalcBlockSubsidy is the amount of new coins the coinbase of the block at the given height may
+// claim, besides the fees.
+func CalcBlockSubsidy(height int32, params *config.Params) int64 {
+	halvings := height / params.SubsidyHalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return BASE_SUBSIDY >> halvings
+}
+
+// BlockScriptFlags are the script rules that apply to the transactions in a block, given the soft
+// forks that are active at its height.
+func BlockScriptFlags(params *config.Params, height int32, hash proto.Hash) txscript.ScriptFlags {
+	// P2SH applies everywhere, bar the block or two mined before it was enforced that break it
+	if slices.Contains(params.BIP16Exceptions, hash) {
+		return txscript.SCRIPT_VERIFY_NONE
+	}
+	flags := txscript.SCRIPT_VERIFY_P2SH
+
+	if height >= params.BIP66Height {
+		flags |= txscript.SCRIPT_VERIFY_DERSIG
+	}
+	if height >= params.BIP65Height {
+		flags |= txscript.SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY
+	}
+	if height >= params.CSVHeight {
+		flags |= txscript.SCRIPT_VERIFY_CHECKSEQUENCEVERIFY
+	}
+	if height >= params.SegwitHeight {
+		flags |= txscript.SCRIPT_VERIFY_WITNESS | txscript.SCRIPT_VERIFY_NULLDUMMY
+	}
+	if height >= params.TaprootHeight {
+		flags |= txscript.SCRIPT_VERIFY_TAPROOT
+	}
+	return flags
+}
+
+// IsFinalTx reports whether a transaction's lock time has passed, so it can be included in a block
+// at the given height and time. The lock time is ignored if every input opts out of it with the
+// maximum sequence number.
+func IsFinalTx(tx *proto.Tx, height int32, blockTime time.Time) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	// Lock times below the threshold are heights, and above it timestamps
+	cutoff := int64(height)
+	if tx.LockTime >= proto.LOCKTIME_THRESHOLD {
+		cutoff = blockTime.Unix()
+	}
+	if int64(tx.LockTime) < cutoff {
+		return true
+	}
+
+	for _, in := range tx.TxIn {
+		if in.Sequence != proto.MAX_TX_IN_SEQUENCE {
+			return false
+		}
+	}
+	return true
+}
+
+// coinbaseHeightPrefix is how BIP34 says a coinbase's signature script must start: with the height
+// pushed as a script number.
+func coinbaseHeightPrefix(height int32) []byte {
+	switch {
+	case height == 0:
+		return []byte{txscript.OP_0}
+	case height <= 16:
+		return []byte{txscript.OP_1 + byte(height-1)}
+	}
+
+	var num []byte
+	for n := height; n > 0; n >>= 8 {
+		num = append(num, byte(n))
+	}
+	// The top bit is the sign, so a positive number that would have it set needs another byte
+	if num[len(num)-1]&0x80 != 0 {
+		num = append(num, 0)
+	}
+	return append([]byte{byte(len(num))}, num...)
+}
+
+// checkCoinbaseHeight checks the coinbase starts with the block's height, as BIP34 requires.
+func checkCoinbaseHeight(block *proto.Block, height int32) error {
+	sigScript := block.Transactions[0].TxIn[0].SignatureScript
+	if prefix := coinbaseHeightPrefix(height); !bytes.HasPrefix(sigScript, prefix) {
+		return ruleError(ErrBadCoinbaseHeight, "block %s coinbase doesn't start with its height %d", block.BlockHash(), height)
+	}
+	return nil
+}
+
+// TxSigOpCost is how much of the block's signature check budget a transaction uses. prevOuts are
+// the outputs its inputs spend, and are ignored for a coinbase.
+func TxSigOpCost(tx *proto.Tx, prevOuts []proto.TxOut, flags txscript.ScriptFlags) int {
+	legacy := 0
+	for _, in := range tx.TxIn {
+		legacy += txscript.CountSigOps(in.SignatureScript, false)
+	}
+	for _, out := range tx.TxOut {
+		legacy += txscript.CountSigOps(out.PkScript, false)
+	}
+	cost := legacy * proto.WITNESS_SCALE_FACTOR
+	if tx.IsCoinBase() {
+		return cost
+	}
+
+	for i, in := range tx.TxIn {
+		if flags&txscript.SCRIPT_VERIFY_P2SH != 0 {
+			cost += txscript.CountP2SHSigOps(in.SignatureScript, prevOuts[i].PkScript) * proto.WITNESS_SCALE_FACTOR
+		}
+		cost += txscript.CountWitnessSigOps(in.SignatureScript, prevOuts[i].PkScript, in.Witness, flags)
+	}
+	return cost
+}
+
+// sequenceLock is the BIP68 relative lock time of a transaction: the last height and median time
+// past at which it can't yet be included, or -1 for none.
+type sequenceLock struct {
+	minHeight int32
+	minTime   int64
+}
+
+// calcSequenceLock works out a transaction's relative lock time from its inputs' sequence numbers
+// and the heights of the outputs they spend. A time lock counts from the median time past of the
+// block before the output's, which is found on the chain leading up to node.
+func (c *Chain) calcSequenceLock(tx *proto.Tx, prevHeights []int32, node *headerchain.HeaderNode) sequenceLock {
+	lock := sequenceLock{minHeight: -1, minTime: -1}
+	if tx.Version < 2 {
+		return lock
+	}
+
+	for i, in := range tx.TxIn {
+		if in.Sequence&proto.SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+			continue
+		}
+		value := int64(in.Sequence & proto.SEQUENCE_LOCKTIME_MASK)
+
+		if in.Sequence&proto.SEQUENCE_LOCKTIME_TYPE_FLAG != 0 {
+			// Time locks are in units of 512 seconds
+			start := c.headers.Ancestor(node, max(prevHeights[i]-1, 0)).MedianTimePast().Unix()
+			lock.minTime = max(lock.minTime, start+value<<proto.SEQUENCE_LOCKTIME_GRANULARITY-1)
+		} else {
+			lock.minHeight = max(lock.minHeight, prevHeights[i]+int32(value)-1)
+		}
+	}
+	return lock
+}
+
+// satisfied reports whether the lock has passed for a block at the given height, whose parent has
+// the given median time past.
+func (l sequenceLock) satisfied(height int32, medianTimePast time.Time) bool {
+	return l.minHeight < height && l.minTime < medianTimePast.Unix()
+}
@@ -0,0 +1,111 @@
+package blockchain_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/blockchain"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalcBlockSubsidy(t *testing.T) {
+	tests := []struct {
+		params *config.Params
+		height int32
+		want   int64
+	}{
+		{&config.MainNetParams, 0, 50 * 100_000_000},
+		{&config.MainNetParams, 209_999, 50 * 100_000_000},
+		{&config.MainNetParams, 210_000, 25 * 100_000_000},
+		{&config.MainNetParams, 840_000, 3_1250_0000},
+		{&config.MainNetParams, 6_720_000, 1},
+		{&config.MainNetParams, 6_930_000, 0},
+		{&config.MainNetParams, 64 * 210_000, 0},
+		{&config.RegTestParams, 150, 25 * 100_000_000},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, blockchain.CalcBlockSubsidy(tt.height, tt.params), "%s height %d", tt.params.Name, tt.height)
+	}
+}
+
+func TestCalcBlockSubsidy_TotalSupply(t *testing.T) {
+	var total int64
+	for height := int32(0); ; height += config.MainNetParams.SubsidyHalvingInterval {
+		subsidy := blockchain.CalcBlockSubsidy(height, &config.MainNetParams)
+		if subsidy == 0 {
+			break
+		}
+		total += subsidy * int64(config.MainNetParams.SubsidyHalvingInterval)
+	}
+	assert.Equal(t, int64(2_099_999_997_690_000), total)
+}
+
+func TestIsFinalTx(t *testing.T) {
+	blockTime := time.Unix(1_600_000_000, 0)
+	tx := func(lockTime, sequence uint32) *proto.Tx {
+		return &proto.Tx{LockTime: lockTime, TxIn: []proto.TxIn{{Sequence: sequence}}}
+	}
+
+	tests := []struct {
+		name string
+		tx   *proto.Tx
+		want bool
+	}{
+		{"no lock time", tx(0, 0), true},
+		{"height passed", tx(99, 0), true},
+		{"height not passed", tx(100, 0), false},
+		{"time passed", tx(1_599_999_999, 0), true},
+		{"time not passed", tx(1_600_000_000, 0), false},
+		{"lock time disabled", tx(100, proto.MAX_TX_IN_SEQUENCE), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, blockchain.IsFinalTx(tt.tx, 100, blockTime))
+		})
+	}
+}
+
+func TestBlockScriptFlags(t *testing.T) {
+	params := &config.MainNetParams
+	hash := proto.DoubleSHA256([]byte("block"))
+
+	assert.Equal(t, txscript.SCRIPT_VERIFY_P2SH, blockchain.BlockScriptFlags(params, 100_000, hash))
+	assert.Equal(t, txscript.SCRIPT_VERIFY_NONE, blockchain.BlockScriptFlags(params, 170_060, params.BIP16Exceptions[0]))
+	assert.Equal(t, txscript.SCRIPT_VERIFY_P2SH|txscript.SCRIPT_VERIFY_DERSIG, blockchain.BlockScriptFlags(params, params.BIP66Height, hash))
+
+	segwit := blockchain.BlockScriptFlags(params, params.SegwitHeight, hash)
+	assert.NotZero(t, segwit&txscript.SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY)
+	assert.NotZero(t, segwit&txscript.SCRIPT_VERIFY_CHECKSEQUENCEVERIFY)
+	assert.NotZero(t, segwit&txscript.SCRIPT_VERIFY_WITNESS)
+	assert.NotZero(t, segwit&txscript.SCRIPT_VERIFY_NULLDUMMY)
+	assert.Zero(t, segwit&txscript.SCRIPT_VERIFY_TAPROOT)
+
+	taproot := blockchain.BlockScriptFlags(params, params.TaprootHeight, hash)
+	assert.NotZero(t, taproot&txscript.SCRIPT_VERIFY_TAPROOT)
+}
+
+func TestTxSigOpCost(t *testing.T) {
+	multisig := []byte{txscript.OP_1, txscript.OP_2, txscript.OP_CHECKMULTISIG}
+	p2sh := append([]byte{txscript.OP_HASH160, 0x14}, make([]byte, 20)...)
+	p2sh = append(p2sh, txscript.OP_EQUAL)
+	p2wpkh := append([]byte{txscript.OP_0, 0x14}, make([]byte, 20)...)
+
+	tx := &proto.Tx{
+		TxIn: []proto.TxIn{
+			{PreviousOutPoint: proto.OutPoint{Index: 0}, SignatureScript: append([]byte{byte(len(multisig))}, multisig...)},
+			{PreviousOutPoint: proto.OutPoint{Index: 1}, Witness: proto.TxWitness{{0x01}, {0x02}}},
+		},
+		TxOut: []proto.TxOut{{PkScript: []byte{txscript.OP_CHECKSIG}}},
+	}
+	prevOuts := []proto.TxOut{{PkScript: p2sh}, {PkScript: p2wpkh}}
+
+	// One legacy check in the output, two in the redeem script, and one for the P2WPKH spend
+	flags := txscript.SCRIPT_VERIFY_P2SH | txscript.SCRIPT_VERIFY_WITNESS
+	assert.Equal(t, 1*4+2*4+1, blockchain.TxSigOpCost(tx, prevOuts, flags))
+	assert.Equal(t, 1*4, blockchain.TxSigOpCost(tx, prevOuts, txscript.SCRIPT_VERIFY_NONE))
+}
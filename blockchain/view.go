@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/utxo"
+)
+
+// utxoView is the UTXO set as a transaction part way through a block sees it: with the outputs
+// created by the transactions before it, and without those they spent. The set itself isn't
+// touched until the whole block has been checked.
+type utxoView struct {
+	utxos *utxo.Cache
+	added map[proto.OutPoint]*utxo.Entry
+	spent map[proto.OutPoint]struct{}
+}
+
+func newUTXOView(utxos *utxo.Cache) *utxoView {
+	return &utxoView{
+		utxos: utxos,
+		added: make(map[proto.OutPoint]*utxo.Entry),
+		spent: make(map[proto.OutPoint]struct{}),
+	}
+}
+
+// entry returns an unspent output, or nil if there isn't one.
+func (v *utxoView) entry(op proto.OutPoint) (*utxo.Entry, error) {
+	if _, ok := v.spent[op]; ok {
+		return nil, nil
+	}
+	if entry, ok := v.added[op]; ok {
+		return entry, nil
+	}
+	return v.utxos.Entry(op)
+}
+
+// addTx adds the outputs a transaction creates.
+func (v *utxoView) addTx(tx *proto.Tx, txHash proto.Hash, height int32) {
+	for index, out := range tx.TxOut {
+		if utxo.IsUnspendable(out.PkScript) {
+			continue
+		}
+		v.added[proto.OutPoint{Hash: txHash, Index: uint32(index)}] = &utxo.Entry{
+			Amount:     out.Value,
+			PkScript:   out.PkScript,
+			Height:     height,
+			IsCoinBase: tx.IsCoinBase(),
+		}
+	}
+}
+
+// spendInputs checks a transaction spends outputs that exist and have matured, and doesn't spend
+// more than they're worth, then marks them as spent. It returns the outputs and the heights they
+// were created at, in input order, and the fee.
+func (v *utxoView) spendInputs(tx *proto.Tx, txHash proto.Hash, height int32) ([]proto.TxOut, []int32, int64, error) {
+	prevOuts := make([]proto.TxOut, len(tx.TxIn))
+	prevHeights := make([]int32, len(tx.TxIn))
+
+	var totalIn int64
+	for i, in := range tx.TxIn {
+		entry, err := v.entry(in.PreviousOutPoint)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if entry == nil {
+			return nil, nil, 0, ruleError(ErrMissingTxOut, "transaction %s input %d spends %s, which is missing or already spent", txHash, i, in.PreviousOutPoint)
+		}
+
+		if entry.IsCoinBase && height-entry.Height < COINBASE_MATURITY {
+			return nil, nil, 0, ruleError(ErrImmatureSpend, "transaction %s input %d spends coinbase output %s from height %d before it has matured", txHash, i, in.PreviousOutPoint, entry.Height)
+		}
+
+		totalIn += entry.Amount
+		if entry.Amount < 0 || entry.Amount > headerchain.MAX_MONEY || totalIn > headerchain.MAX_MONEY {
+			return nil, nil, 0, ruleError(ErrBadTxInputValue, "transaction %s input %d value is out of range", txHash, i)
+		}
+
+		prevOuts[i] = proto.TxOut{Value: entry.Amount, PkScript: entry.PkScript}
+		prevHeights[i] = entry.Height
+	}
+
+	// Output values have already been checked to be in range
+	var totalOut int64
+	for _, out := range tx.TxOut {
+		totalOut += out.Value
+	}
+	if totalIn < totalOut {
+		return nil, nil, 0, ruleError(ErrSpendTooHigh, "transaction %s spends %d but its inputs are only worth %d", txHash, totalOut, totalIn)
+	}
+
+	for _, in := range tx.TxIn {
+		v.spent[in.PreviousOutPoint] = struct{}{}
+	}
+	return prevOuts, prevHeights, totalIn - totalOut, nil
+}
@@ -0,0 +1,311 @@
+package blockstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// Block files are started afresh once they reach this size.
+	MAX_BLOCK_FILE_SIZE = 128 << 20
+
+	// The size of the magic and length that precede each block in a block file.
+	BLOCK_RECORD_HEADER_SIZE = 8
+)
+
+// Store keeps the header index and raw block data on disk. The index is an append-only log of
+// entries; a later entry for the same header supersedes an earlier one. Blocks are appended to a
+// series of flat files, as bitcoind does.
+//
+// Nothing is guaranteed to be on disk until Flush is called. If the process dies part way through
+// a write, Open recovers by dropping the incomplete index record and any block data that no entry
+// refers to.
+type Store struct {
+	mu    sync.Mutex
+	dir   string
+	magic uint32
+
+	indexFile *os.File
+	index     *bufio.Writer
+
+	blockFile     *os.File
+	blockFileNum  int32
+	blockFileSize int64
+
+	entries []IndexEntry
+}
+
+// Open opens the store in dir, creating it if need be, and recovers from any crash that happened
+// while it was last open. The magic is written before each block, as a sanity check.
+func Open(dir string, magic uint32) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create block store directory: %w", err)
+	}
+
+	s := &Store{dir: dir, magic: magic}
+	if err := s.openIndex(); err != nil {
+		return nil, err
+	}
+	if err := s.openBlockFile(); err != nil {
+		s.indexFile.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Entries returns the entries that were in the index when the store was opened, in the order
+// they were written. Where a header was written more than once, only the latest entry is kept.
+func (s *Store) Entries() []IndexEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+// openIndex reads back the index, truncating anything after the last complete record.
+func (s *Store) openIndex() error {
+	path := filepath.Join(s.dir, INDEX_FILENAME)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open index: %w", err)
+	}
+
+	valid, err := s.readIndex(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to truncate index: %w", err)
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to seek index: %w", err)
+	}
+
+	s.indexFile = f
+	s.index = bufio.NewWriter(f)
+	if valid == 0 {
+		if err := binary.Write(s.index, binary.LittleEndian, uint32(INDEX_VERSION)); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to write index version: %w", err)
+		}
+	}
+	return nil
+}
+
+// readIndex loads the entries from the index, returning how much of the file is valid.
+func (s *Store) readIndex(f *os.File) (int64, error) {
+	r := bufio.NewReader(f)
+
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		// Empty, or torn before the first record was even written
+		return 0, nil
+	}
+	if version != INDEX_VERSION {
+		return 0, fmt.Errorf("index has version %d, expected %d", version, INDEX_VERSION)
+	}
+
+	valid := int64(4)
+	positions := make(map[proto.Hash]int)
+	for {
+		entry, n, err := readIndexRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("discarding damaged index from offset %d", valid)
+			break
+		}
+		valid += int64(n)
+
+		hash := entry.Header.BlockHash()
+		if i, ok := positions[hash]; ok {
+			s.entries[i] = entry
+		} else {
+			positions[hash] = len(s.entries)
+			s.entries = append(s.entries, entry)
+		}
+	}
+	return valid, nil
+}
+
+func blockFilePath(dir string, num int32) string {
+	return filepath.Join(dir, fmt.Sprintf("blk%05d.dat", num))
+}
+
+// openBlockFile opens the latest block file for appending, discarding anything after the last
+// block the index refers to. A block whose data was written but whose index entry wasn't is lost,
+// and will have to be downloaded again.
+func (s *Store) openBlockFile() error {
+	num := int32(0)
+	for {
+		if _, err := os.Stat(blockFilePath(s.dir, num+1)); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		num++
+	}
+
+	f, err := os.OpenFile(blockFilePath(s.dir, num), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open block file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open block file: %w", err)
+	}
+
+	// Entries that point past the end of what's on disk refer to data that didn't get flushed
+	var end int64
+	for i, entry := range s.entries {
+		if entry.Data.IsZero() || entry.Data.File < num {
+			continue
+		}
+		dataEnd := int64(entry.Data.Offset) + int64(entry.Data.Size)
+		if entry.Data.File > num || dataEnd > info.Size() {
+			s.entries[i].Data = BlockLocation{}
+			continue
+		}
+		end = max(end, dataEnd)
+	}
+
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to truncate block file: %w", err)
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to seek block file: %w", err)
+	}
+
+	s.blockFile = f
+	s.blockFileNum = num
+	s.blockFileSize = end
+	return nil
+}
+
+// PutEntry appends an entry to the index, superseding any earlier one for the same header.
+func (s *Store) PutEntry(entry IndexEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeIndexRecord(s.index, entry)
+}
+
+// WriteBlock appends a block's raw data to the current block file, starting a new one if it's
+// full, and returns where it was written.
+func (s *Store) WriteBlock(raw []byte) (BlockLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blockFileSize > 0 && s.blockFileSize+BLOCK_RECORD_HEADER_SIZE+int64(len(raw)) > MAX_BLOCK_FILE_SIZE {
+		if err := s.nextBlockFile(); err != nil {
+			return BlockLocation{}, err
+		}
+	}
+
+	record := make([]byte, BLOCK_RECORD_HEADER_SIZE, BLOCK_RECORD_HEADER_SIZE+len(raw))
+	binary.LittleEndian.PutUint32(record[0:4], s.magic)
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(raw)))
+	record = append(record, raw...)
+
+	if _, err := s.blockFile.Write(record); err != nil {
+		return BlockLocation{}, fmt.Errorf("unable to write block: %w", err)
+	}
+
+	loc := BlockLocation{
+		File:   s.blockFileNum,
+		Offset: uint32(s.blockFileSize + BLOCK_RECORD_HEADER_SIZE),
+		Size:   uint32(len(raw)),
+	}
+	s.blockFileSize += int64(len(record))
+	return loc, nil
+}
+
+// nextBlockFile finishes the current block file and starts the next. The caller must hold the lock.
+func (s *Store) nextBlockFile() error {
+	if err := s.blockFile.Sync(); err != nil {
+		return fmt.Errorf("unable to sync block file: %w", err)
+	}
+	if err := s.blockFile.Close(); err != nil {
+		return fmt.Errorf("unable to close block file: %w", err)
+	}
+
+	f, err := os.OpenFile(blockFilePath(s.dir, s.blockFileNum+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to create block file: %w", err)
+	}
+	s.blockFile = f
+	s.blockFileNum++
+	s.blockFileSize = 0
+	return nil
+}
+
+// ReadBlock reads back a block's raw data.
+func (s *Store) ReadBlock(loc BlockLocation) ([]byte, error) {
+	if loc.IsZero() {
+		return nil, errors.New("block data location not set")
+	}
+
+	f, err := os.Open(blockFilePath(s.dir, loc.File))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open block file: %w", err)
+	}
+	defer f.Close()
+
+	record := make([]byte, BLOCK_RECORD_HEADER_SIZE+int(loc.Size))
+	if _, err := f.ReadAt(record, int64(loc.Offset)-BLOCK_RECORD_HEADER_SIZE); err != nil {
+		return nil, fmt.Errorf("unable to read block: %w", err)
+	}
+
+	if magic := binary.LittleEndian.Uint32(record[0:4]); magic != s.magic {
+		return nil, fmt.Errorf("block has magic %08x, expected %08x", magic, s.magic)
+	}
+	if size := binary.LittleEndian.Uint32(record[4:8]); size != loc.Size {
+		return nil, fmt.Errorf("block has size %d, expected %d", size, loc.Size)
+	}
+	return record[BLOCK_RECORD_HEADER_SIZE:], nil
+}
+
+// Flush makes sure everything written so far is on disk. Block data is synced before the index,
+// so an entry never refers to data that isn't there.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+func (s *Store) flush() error {
+	if err := s.blockFile.Sync(); err != nil {
+		return fmt.Errorf("unable to sync block file: %w", err)
+	}
+	if err := s.index.Flush(); err != nil {
+		return fmt.Errorf("unable to write index: %w", err)
+	}
+	if err := s.indexFile.Sync(); err != nil {
+		return fmt.Errorf("unable to sync index: %w", err)
+	}
+	return nil
+}
+
+// Close flushes everything to disk and closes the files.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.flush()
+	s.entries = nil
+	return errors.Join(err, s.blockFile.Close(), s.indexFile.Close())
+}
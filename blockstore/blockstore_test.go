@@ -0,0 +1,202 @@
+package blockstore_test
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pscott31/mynode/blockstore"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntry(height int32) blockstore.IndexEntry {
+	return blockstore.IndexEntry{
+		Header: proto.BlockHeader{
+			Version:   4,
+			PrevBlock: proto.DoubleSHA256([]byte{byte(height)}),
+			Timestamp: 1296688602 + uint32(height),
+			Bits:      0x207fffff,
+		},
+		Height: height,
+		Work:   big.NewInt(int64(height+1) * 2),
+		Status: 1,
+	}
+}
+
+func TestStore_Entries(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	assert.Empty(t, store.Entries())
+
+	first, second := testEntry(1), testEntry(2)
+	require.NoError(t, store.PutEntry(first))
+	require.NoError(t, store.PutEntry(second))
+
+	// A later entry for the same header replaces the earlier one, but keeps its place
+	first.Status = 3
+	require.NoError(t, store.PutEntry(first))
+	require.NoError(t, store.Close())
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, []blockstore.IndexEntry{first, second}, store.Entries())
+}
+
+func TestStore_Blocks(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+
+	loc1, err := store.WriteBlock([]byte("first block"))
+	require.NoError(t, err)
+	loc2, err := store.WriteBlock([]byte("second block"))
+	require.NoError(t, err)
+	assert.Equal(t, blockstore.BlockLocation{File: 0, Offset: 8, Size: 11}, loc1)
+	assert.Equal(t, blockstore.BlockLocation{File: 0, Offset: 27, Size: 12}, loc2)
+
+	entry := testEntry(1)
+	entry.Data = loc2
+	require.NoError(t, store.PutEntry(entry))
+	require.NoError(t, store.Close())
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	defer store.Close()
+
+	raw, err := store.ReadBlock(loc1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first block"), raw)
+	raw, err = store.ReadBlock(store.Entries()[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second block"), raw)
+
+	// New blocks go after the ones already there
+	loc3, err := store.WriteBlock([]byte("third"))
+	require.NoError(t, err)
+	assert.Equal(t, blockstore.BlockLocation{File: 0, Offset: 47, Size: 5}, loc3)
+
+	_, err = store.ReadBlock(blockstore.BlockLocation{})
+	assert.Error(t, err)
+}
+
+func TestStore_WrongMagic(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	loc, err := store.WriteBlock([]byte("block"))
+	require.NoError(t, err)
+	entry := testEntry(1)
+	entry.Data = loc
+	require.NoError(t, store.PutEntry(entry))
+	require.NoError(t, store.Close())
+
+	store, err = blockstore.Open(dir, config.MAGIC_MAIN)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.ReadBlock(loc)
+	assert.ErrorContains(t, err, "magic")
+}
+
+func TestStore_RecoversTornIndex(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	require.NoError(t, store.PutEntry(testEntry(1)))
+	require.NoError(t, store.PutEntry(testEntry(2)))
+	require.NoError(t, store.Close())
+
+	// Chop the last record in half, as if we'd crashed while writing it
+	path := filepath.Join(dir, blockstore.INDEX_FILENAME)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-10))
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	assert.Equal(t, []blockstore.IndexEntry{testEntry(1)}, store.Entries())
+
+	// Writing carries on from the last good record
+	require.NoError(t, store.PutEntry(testEntry(3)))
+	require.NoError(t, store.Close())
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, []blockstore.IndexEntry{testEntry(1), testEntry(3)}, store.Entries())
+}
+
+func TestStore_RecoversCorruptIndex(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	require.NoError(t, store.PutEntry(testEntry(1)))
+	require.NoError(t, store.PutEntry(testEntry(2)))
+	require.NoError(t, store.Close())
+
+	// Flip a bit in the last record, so its checksum doesn't match
+	path := filepath.Join(dir, blockstore.INDEX_FILENAME)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-20] ^= 1
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, []blockstore.IndexEntry{testEntry(1)}, store.Entries())
+}
+
+func TestStore_RecoversUnindexedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+
+	loc, err := store.WriteBlock([]byte("indexed"))
+	require.NoError(t, err)
+	entry := testEntry(1)
+	entry.Data = loc
+	require.NoError(t, store.PutEntry(entry))
+
+	// Written, but we crashed before its index entry was
+	_, err = store.WriteBlock([]byte("not indexed"))
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// The orphaned data is dropped, and its space reused
+	next, err := store.WriteBlock([]byte("next"))
+	require.NoError(t, err)
+	assert.Equal(t, blockstore.BlockLocation{File: 0, Offset: 23, Size: 4}, next)
+}
+
+func TestStore_RecoversMissingBlockData(t *testing.T) {
+	dir := t.TempDir()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+
+	loc, err := store.WriteBlock([]byte("lost block"))
+	require.NoError(t, err)
+	entry := testEntry(1)
+	entry.Data = loc
+	require.NoError(t, store.PutEntry(entry))
+	require.NoError(t, store.Close())
+
+	// The index made it to disk, but the block data didn't
+	require.NoError(t, os.Truncate(filepath.Join(dir, "blk00000.dat"), 0))
+
+	store, err = blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	defer store.Close()
+
+	entry.Data = blockstore.BlockLocation{}
+	assert.Equal(t, []blockstore.IndexEntry{entry}, store.Entries())
+}
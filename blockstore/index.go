@@ -0,0 +1,181 @@
+package blockstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// The name of the header index file within the store's directory.
+	INDEX_FILENAME = "index.dat"
+
+	// Bumped whenever the layout of an index record changes incompatibly.
+	INDEX_VERSION = 1
+
+	// The largest index record we'll believe when reading one back. Records are far smaller than
+	// this; anything bigger means the length was corrupted.
+	MAX_INDEX_RECORD_SIZE = 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// BlockLocation is where a block's raw data is kept in the flat files. The zero value means we
+// don't have the block's data.
+type BlockLocation struct {
+	File   int32
+	Offset uint32
+	Size   uint32
+}
+
+// IsZero reports whether the location is unset.
+func (l BlockLocation) IsZero() bool {
+	return l == BlockLocation{}
+}
+
+// IndexEntry is what we store about each header: the header itself, its place in the chain, how
+// far it has got through validation and where to find its block.
+type IndexEntry struct {
+	Header proto.BlockHeader
+	Height int32
+	Work   *big.Int // Total work of the chain up to and including this header
+	Status uint8
+	Data   BlockLocation
+}
+
+func (e IndexEntry) MarshalToWriter(w io.Writer) error {
+	if err := e.Header.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write header: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, e.Height); err != nil {
+		return fmt.Errorf("unable to write height: %w", err)
+	}
+
+	work := e.Work.Bytes()
+	if err := varBytes(work).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write work: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, e.Status); err != nil {
+		return fmt.Errorf("unable to write status: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, e.Data); err != nil {
+		return fmt.Errorf("unable to write block location: %w", err)
+	}
+
+	return nil
+}
+
+func (e *IndexEntry) UnmarshalFromReader(r io.Reader) error {
+	if err := e.Header.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read header: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &e.Height); err != nil {
+		return fmt.Errorf("unable to read height: %w", err)
+	}
+
+	var work varBytes
+	if err := work.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read work: %w", err)
+	}
+	e.Work = new(big.Int).SetBytes(work)
+
+	if err := binary.Read(r, binary.LittleEndian, &e.Status); err != nil {
+		return fmt.Errorf("unable to read status: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &e.Data); err != nil {
+		return fmt.Errorf("unable to read block location: %w", err)
+	}
+
+	return nil
+}
+
+// varBytes is a byte slice prefixed with its length as a single byte, which is plenty for the
+// cumulative work.
+type varBytes []byte
+
+func (b varBytes) MarshalToWriter(w io.Writer) error {
+	if len(b) > 255 {
+		return fmt.Errorf("too many bytes (%d when max is 255)", len(b))
+	}
+	if _, err := w.Write(append([]byte{byte(len(b))}, b...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *varBytes) UnmarshalFromReader(r io.Reader) error {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	*b = make([]byte, length[0])
+	_, err := io.ReadFull(r, *b)
+	return err
+}
+
+// writeIndexRecord appends an entry to the index, framed by its length and a checksum so that a
+// record that was only partly written before a crash can be recognised.
+func writeIndexRecord(w io.Writer, entry IndexEntry) error {
+	var payload bytes.Buffer
+	if err := entry.MarshalToWriter(&payload); err != nil {
+		return err
+	}
+
+	var frame [8]byte
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload.Bytes(), crcTable))
+	if _, err := w.Write(frame[:]); err != nil {
+		return fmt.Errorf("unable to write index record: %w", err)
+	}
+	if _, err := w.Write(payload.Bytes()); err != nil {
+		return fmt.Errorf("unable to write index record: %w", err)
+	}
+	return nil
+}
+
+// errBadRecord means the rest of the index can't be trusted, as the record was torn or corrupted.
+var errBadRecord = errors.New("bad index record")
+
+// readIndexRecord reads the next entry from the index. It returns io.EOF at a clean end of the
+// file and errBadRecord if the record is incomplete or fails its checksum.
+func readIndexRecord(r *bufio.Reader) (IndexEntry, int, error) {
+	var frame [8]byte
+	n, err := io.ReadFull(r, frame[:])
+	if err == io.EOF {
+		return IndexEntry{}, 0, io.EOF
+	}
+	if err != nil {
+		return IndexEntry{}, n, errBadRecord
+	}
+
+	length := binary.LittleEndian.Uint32(frame[0:4])
+	if length > MAX_INDEX_RECORD_SIZE {
+		return IndexEntry{}, n, errBadRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return IndexEntry{}, n, errBadRecord
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(frame[4:8]) {
+		return IndexEntry{}, n, errBadRecord
+	}
+
+	var entry IndexEntry
+	if err := entry.UnmarshalFromReader(bytes.NewReader(payload)); err != nil {
+		return IndexEntry{}, n, errBadRecord
+	}
+	return entry, len(frame) + len(payload), nil
+}
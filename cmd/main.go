@@ -1,120 +1,201 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"errors"
+	"flag"
 	"log"
-	"net"
-	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"time"
 
+	"github.com/pscott31/mynode/addrmgr"
+	"github.com/pscott31/mynode/blockchain"
+	"github.com/pscott31/mynode/blockstore"
 	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/connmgr"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/netsync"
+	"github.com/pscott31/mynode/peer"
 	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/server"
+	"github.com/pscott31/mynode/utxo"
 )
 
-func main() {
-	// Seed the random number generator so our Nonce's aren't predictable
-	// Not needed since go 1.20
-	// rand.Seed(time.Now().UnixNano())
-
-	config := config.Default()
+// node ties together the pieces that make up a running node.
+type node struct {
+	config    *config.Config
+	addrMgr   *addrmgr.AddrManager
+	syncMgr   *netsync.SyncManager
+	listeners *peer.Listeners
+}
 
-	addrPort, err := netip.ParseAddrPort(config.RemoteAddr)
+func main() {
+	config, err := config.Load(os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalln("error parsing remote address: ", err.Error())
+		log.Fatalln(err)
 	}
 
-	// Connect to remote node
-	conn, err := net.Dial("tcp", addrPort.String())
+	addrMgr, err := addrmgr.New(filepath.Join(config.NetDataDir(), "peers.json"))
 	if err != nil {
-		log.Fatalln("error dialing: ", err.Error())
+		log.Fatalln(err)
 	}
-	defer conn.Close()
-
-	log.Printf("Connected to %s", addrPort.String())
+	addrMgr.Start()
+	defer func() {
+		if err := addrMgr.Stop(); err != nil {
+			log.Println(err)
+		}
+	}()
 
-	// Make our version message
-	ourVersion, err := proto.NewVersion(config.Version, config.Services, time.Now().Unix(), addrPort)
+	// Pick up the header chain from where we left off last time
+	store, err := blockstore.Open(filepath.Join(config.NetDataDir(), "blocks"), config.Magic)
 	if err != nil {
-		log.Fatalf("error creating version message payload: %v ", err.Error())
+		log.Fatalln(err)
 	}
-
-	// Wrap it up with a message header
-	ourVersionMsg := proto.NewMessage(config.Magic, proto.MSG_VERSION, ourVersion)
-	ourVersionBytes, err := proto.MarshalToBytes(ourVersionMsg)
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	chain, err := headerchain.Load(config.ChainParams, store)
 	if err != nil {
-		log.Fatalln("error marshalling message: ", err.Error())
+		log.Fatalln(err)
 	}
-
-	// Send it down the pipe
-	log.Printf("sending our version %+v", ourVersion)
-	if _, err := conn.Write(ourVersionBytes); err != nil {
-		log.Fatalln("Error writing to connection: ", err.Error())
+	log.Printf("loaded header chain at height %d", chain.Height())
+
+	// Blocks are validated and connected on top of the UTXO set as it was when we stopped
+	// Some of the cache budget goes on keeping the index of the outputs on disk in memory, and the
+	// rest on the outputs themselves
+	dbCache := config.DBCacheMiB << 20
+	indexCache := dbCache / utxo.INDEX_CACHE_FRACTION
+	utxoDB, err := utxo.OpenDB(filepath.Join(config.NetDataDir(), "chainstate"), indexCache)
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	// Handy for debugging
-	// err = os.WriteFile("out.bin", messageBytes, 0o644)
-	// if err != nil {
-	// 	log.Fatalf("failed writing to file: %s", err)
-	// }
-
-	// Read a message back. A more complete implementation would be more specific with
-	// regards to deadlines etc.. and probably set up a goroutine to poll and dispatch messages.
-	var theirVersionMsg proto.Message
-	if err = theirVersionMsg.UnmarshalFromReader(conn); err != nil {
-		log.Fatalf("error unmarshalling version response message: %v", err)
+	defer func() {
+		if err := utxoDB.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	blockChain, err := blockchain.New(chain, utxo.NewCache(utxoDB, dbCache-indexCache), config.ScriptThreads)
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	// First check stuff in the header
-	// Magic should match
-	if theirVersionMsg.Magic != config.Magic {
-		log.Fatalf("mismatched node networks - sent %x, got %x", ourVersionMsg.Magic, theirVersionMsg.Magic)
+	defer func() {
+		if err := blockChain.Flush(); err != nil {
+			log.Println(err)
+		}
+	}()
+	log.Printf("loaded chain state at height %d", blockChain.Tip().Height)
+
+	// Unconfirmed transactions are kept in memory, dropping out as blocks confirm them
+	policy := mempool.DefaultPolicy()
+	policy.MaxSize = config.MaxMempoolMB * 1_000_000
+	policy.FullRBF = config.MempoolFullRBF
+	txPool := mempool.New(blockChain, policy)
+	blockChain.Subscribe(txPool.Listeners())
+
+	syncMgr := netsync.New(chain, blockChain)
+	if !config.BlocksOnly {
+		syncMgr.TxPool = txPool
 	}
-
-	// And they should be sending us a 'version' message in response
-	if theirVersionMsg.Command != proto.MSG_VERSION {
-		log.Fatalf("expected 'version' message in respose, got %s", theirVersionMsg.Command)
+	syncMgr.Start()
+	defer syncMgr.Stop()
+
+	n := &node{config: config, addrMgr: addrMgr, syncMgr: syncMgr}
+	n.listeners = &peer.Listeners{
+		OnAddr:       n.onAddr,
+		OnAddrV2:     n.onAddrV2,
+		OnGetAddr:    n.onGetAddr,
+		OnGetHeaders: syncMgr.OnGetHeaders,
+		OnHeaders:    syncMgr.OnHeaders,
+		OnInv:        syncMgr.OnInv,
+		OnGetData:    syncMgr.OnGetData,
+		OnNotFound:   syncMgr.OnNotFound,
+		OnBlock:      syncMgr.OnBlock,
+		OnTx:         syncMgr.OnTx,
+		OnFeeFilter:  syncMgr.OnFeeFilter,
+		OnUnknown: func(p *peer.Peer, msg proto.Message) {
+			log.Printf("received unhandled message from %s: %+v", p.Addr(), msg)
+		},
 	}
 
-	// Unmarshal the message payload into a version message
-	var theirVersion proto.Version
-	if err = theirVersion.UnmarshalFromReader(bytes.NewBuffer(theirVersionMsg.Payload)); err != nil {
-		log.Fatalf("error unmarshalling version response payload: %v", err)
+	// Shared by all our peers, so we can tell if we've connected to ourselves
+	nonces := peer.NewNonceSet()
+
+	// Accept connections from other nodes, unless asked not to
+	if config.ListenAddr != "" {
+		srv, err := server.Listen(config, nonces, n.runPeer)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer srv.Close()
+		log.Printf("Listening on %s", srv.Addr())
+
+		go func() {
+			if err := srv.Serve(); err != nil {
+				log.Fatalln(err)
+			}
+		}()
 	}
-	log.Printf("received their version: %+v\n", theirVersion)
 
-	// Check we're not connected to ourselves
-	if theirVersion.Nonce == ourVersion.Nonce {
-		log.Fatalf("nonce in response matches nonce in request (connected to self?)")
+	// Keep connections open to other nodes, starting with the one we've been told about
+	remoteAddr, err := config.RemoteAddrPort()
+	if err != nil {
+		log.Fatalln("error parsing remote address: ", err.Error())
 	}
+	addrMgr.AddManual(proto.NewNetAddressV2(uint32(time.Now().Unix()), 0, remoteAddr))
+
+	connMgr := connmgr.New(config, nonces, addrMgr, n.runOutboundPeer)
+	connMgr.Start()
+	defer connMgr.Stop()
 
-	// Check that the receiving address in the response matches our connection's sending address
-	if theirVersion.AddrRecv.IP.String() != conn.LocalAddr().String() {
-		log.Fatalf("address in response (%s) does not match address of connected peer (%s)", theirVersion.AddrRecv.IP, conn.LocalAddr())
+	// Run until interrupted
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
+
+// runOutboundPeer is run for each peer the connection manager connects to.
+func (n *node) runOutboundPeer(p *peer.Peer) {
+	log.Printf("connected to %s (%s), negotiated protocol version %d", p.Addr(), p.TheirVersion().UserAgent, p.ProtocolVersion())
+
+	// Ask for the addresses of some more nodes
+	if err := p.WriteMessage(proto.MSG_GETADDR, proto.GetAddr{}); err != nil {
+		log.Println(err)
+		return
 	}
+	n.runPeer(p)
+}
 
-	// Send a 'verack' message in response
-	ourVerAckMsg := proto.NewMessage(config.Magic, proto.MSG_VERSION, proto.VerAck{})
-	ourVerAckBytes, err := proto.MarshalToBytes(ourVerAckMsg)
-	if err != nil {
-		fmt.Println("error marshalling message: ", err.Error())
+// runPeer dispatches everything the peer sends us until the connection drops.
+func (n *node) runPeer(p *peer.Peer) {
+	n.syncMgr.NewPeer(p)
+	defer n.syncMgr.DonePeer(p)
+
+	if err := p.Run(n.listeners); err != nil {
+		log.Printf("disconnected from %s: %v", p.Addr(), err)
 	}
-	log.Printf("sending version acknowledgement")
-	if _, err := conn.Write(ourVerAckBytes); err != nil {
-		log.Fatalln("Error writing to connection: ", err.Error())
+}
+
+func (n *node) onAddr(p *peer.Peer, msg *proto.Addr) {
+	addrs := make([]proto.NetAddressV2, 0, len(msg.AddrList))
+	for _, addr := range msg.AddrList {
+		addrs = append(addrs, proto.NewNetAddressV2(addr.Time, addr.Services, addr.IP))
 	}
+	n.addrMgr.Add(addrs, p.NetAddress())
+}
 
-	for {
-		var theirMsg proto.Message
-		if err = theirMsg.UnmarshalFromReader(conn); err != nil {
-			log.Fatalf("error unmarshalling message: %v", err)
-		}
-		log.Printf("received message: %+v", theirMsg)
-		if theirMsg.Command == proto.MSG_VERACK {
-			// Once we get a VERACK message, consider our hands shaken and quit.
-			// A more complete implementation would pick the lowest compatible version
-			// number, continue to process messages et..
-			break
-		}
+func (n *node) onAddrV2(p *peer.Peer, msg *proto.AddrV2) {
+	n.addrMgr.Add(msg.AddrList, p.NetAddress())
+}
+
+func (n *node) onGetAddr(p *peer.Peer, msg *proto.GetAddr) {
+	if err := p.PushAddresses(n.addrMgr.AddressCache()); err != nil {
+		log.Printf("error sending addresses to %s: %v", p.Addr(), err)
 	}
 }
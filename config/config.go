@@ -1,28 +1,148 @@
 package config
 
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pscott31/mynode/proto"
+)
+
 const (
-	MAGIC_MAIN           uint32 = 0xD9B4BEF9
-	DEFAULT_MAGIC               = MAGIC_MAIN
-	DEFAULT_REMOTE_ADDR         = "127.0.0.1:8333"
-	DEFAULT_VERSION      int32  = 70016
-	DEFAULT_SERVICES     uint64 = 1 // NODE_NETWORK
-	DEFAULT_START_HEIGHT int32  = 0
+	MAGIC_MAIN                uint32 = 0xD9B4BEF9
+	DEFAULT_MAGIC                    = MAGIC_MAIN
+	DEFAULT_NETWORK                  = "mainnet"
+	DEFAULT_REMOTE_ADDR              = "127.0.0.1"      // The network's default port is used if none is given
+	DEFAULT_LISTEN_ADDR              = "127.0.0.1:8334" // Not the default port, so as not to clash with a local node
+	DEFAULT_TARGET_OUTBOUND          = 8
+	DEFAULT_MAX_PEERS                = 125 // As per Bitcoin Core
+	DEFAULT_MAX_INBOUND              = DEFAULT_MAX_PEERS - DEFAULT_TARGET_OUTBOUND
+	DEFAULT_VERSION           int32  = 70016
+	DEFAULT_SERVICES          uint64 = proto.NODE_NETWORK
+	DEFAULT_START_HEIGHT      int32  = 0
+	DEFAULT_HANDSHAKE_TIMEOUT        = 60 * time.Second
+	DEFAULT_PING_INTERVAL            = 2 * time.Minute
+	DEFAULT_PING_TIMEOUT             = 20 * time.Minute
+	DEFAULT_DB_CACHE_MIB             = 450 // As per Bitcoin Core
+	DEFAULT_SCRIPT_THREADS           = 0   // One per CPU
+	DEFAULT_MAX_MEMPOOL_MB           = 300 // As per Bitcoin Core
+	DEFAULT_BLOCKS_ONLY              = false
+	DEFAULT_MEMPOOL_FULL_RBF         = true // As per Bitcoin Core
 )
 
 type Config struct {
-	RemoteAddr  string
-	Magic       uint32
-	Version     int32
-	Services    uint64
-	StartHeight int32
+	ChainParams      *Params
+	DataDir          string
+	RemoteAddr       string
+	ListenAddr       string
+	TargetOutbound   int
+	MaxPeers         int
+	MaxInbound       int
+	Magic            uint32
+	Version          int32
+	Services         uint64
+	UserAgent        string
+	StartHeight      int32
+	HandshakeTimeout time.Duration
+	PingInterval     time.Duration
+	PingTimeout      time.Duration
+	DBCacheMiB       int  // Memory for the UTXO cache
+	ScriptThreads    int  // Workers checking scripts in parallel; 0 for one per CPU
+	MaxMempoolMB     int  // Memory for unconfirmed transactions
+	BlocksOnly       bool // Whether to ignore unconfirmed transactions from other nodes
+	MempoolFullRBF   bool // Whether transactions can be replaced without signalling it
 }
 
 func Default() *Config {
 	return &Config{
-		RemoteAddr:  DEFAULT_REMOTE_ADDR,
-		Magic:       DEFAULT_MAGIC,
-		Version:     DEFAULT_VERSION,
-		Services:    DEFAULT_SERVICES,
-		StartHeight: DEFAULT_START_HEIGHT,
+		ChainParams:      Networks[DEFAULT_NETWORK],
+		DataDir:          defaultDataDir(),
+		RemoteAddr:       DEFAULT_REMOTE_ADDR,
+		ListenAddr:       DEFAULT_LISTEN_ADDR,
+		TargetOutbound:   DEFAULT_TARGET_OUTBOUND,
+		MaxPeers:         DEFAULT_MAX_PEERS,
+		MaxInbound:       DEFAULT_MAX_INBOUND,
+		Magic:            DEFAULT_MAGIC,
+		Version:          DEFAULT_VERSION,
+		Services:         DEFAULT_SERVICES,
+		UserAgent:        proto.USER_AGENT,
+		StartHeight:      DEFAULT_START_HEIGHT,
+		HandshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+		PingInterval:     DEFAULT_PING_INTERVAL,
+		PingTimeout:      DEFAULT_PING_TIMEOUT,
+		DBCacheMiB:       DEFAULT_DB_CACHE_MIB,
+		ScriptThreads:    DEFAULT_SCRIPT_THREADS,
+		MaxMempoolMB:     DEFAULT_MAX_MEMPOOL_MB,
+		BlocksOnly:       DEFAULT_BLOCKS_ONLY,
+		MempoolFullRBF:   DEFAULT_MEMPOOL_FULL_RBF,
+	}
+}
+
+// defaultDataDir is ~/.mynode, or .mynode in the working directory if we can't find a home directory.
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".mynode"
+	}
+	return filepath.Join(home, ".mynode")
+}
+
+// SetNetwork switches to the named network, e.g. 'regtest'.
+func (c *Config) SetNetwork(name string) error {
+	params, err := ParamsForNetwork(name)
+	if err != nil {
+		return err
+	}
+	c.ChainParams = params
+	c.Magic = params.Magic
+	return nil
+}
+
+// NetDataDir is where data for the selected network is kept. Like Bitcoin Core, mainnet uses the
+// data directory itself and the other networks a subdirectory named after them.
+func (c *Config) NetDataDir() string {
+	if c.ChainParams == &MainNetParams {
+		return c.DataDir
+	}
+	return filepath.Join(c.DataDir, c.ChainParams.Name)
+}
+
+// ListenAddress is the address to listen on, with the network's default port added if it doesn't
+// have one. An empty host means all interfaces.
+func (c *Config) ListenAddress() string {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err == nil {
+		return c.ListenAddr
+	}
+	return net.JoinHostPort(strings.Trim(c.ListenAddr, "[]"), strconv.Itoa(int(c.ChainParams.DefaultPort)))
+}
+
+// RemoteAddrPort parses the remote address, using the network's default port if it doesn't have one.
+func (c *Config) RemoteAddrPort() (netip.AddrPort, error) {
+	return ParseAddrPort(c.RemoteAddr, c.ChainParams.DefaultPort)
+}
+
+// ParseAddrPort parses an IP address with an optional port, using defaultPort if there isn't one.
+func ParseAddrPort(s string, defaultPort uint16) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return netip.AddrPortFrom(addr, defaultPort), nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address '%s': %w", s, err)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address '%s': %w", s, err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port in address '%s': %w", s, err)
 	}
+	return netip.AddrPortFrom(addr, uint16(portNum)), nil
 }
@@ -0,0 +1,59 @@
+package config_test
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_SetNetwork(t *testing.T) {
+	cfg := config.Default()
+	assert.Equal(t, &config.MainNetParams, cfg.ChainParams)
+	assert.Equal(t, config.MAGIC_MAIN, cfg.Magic)
+	assert.Equal(t, cfg.DataDir, cfg.NetDataDir())
+
+	require.NoError(t, cfg.SetNetwork("regtest"))
+	assert.Equal(t, &config.RegTestParams, cfg.ChainParams)
+	assert.Equal(t, config.MAGIC_REGTEST, cfg.Magic)
+	assert.Equal(t, filepath.Join(cfg.DataDir, "regtest"), cfg.NetDataDir())
+
+	remoteAddr, err := cfg.RemoteAddrPort()
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("127.0.0.1:18444"), remoteAddr)
+
+	require.NoError(t, cfg.SetNetwork("testnet"))
+	assert.Equal(t, &config.TestNet3Params, cfg.ChainParams)
+
+	assert.ErrorContains(t, cfg.SetNetwork("moonnet"), "unknown network 'moonnet'")
+}
+
+func TestParseAddrPort(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"192.0.2.1", "192.0.2.1:8333"},
+		{"192.0.2.1:18444", "192.0.2.1:18444"},
+		{"2001:db8::1", "[2001:db8::1]:8333"},
+		{"[2001:db8::1]", "[2001:db8::1]:8333"},
+		{"[2001:db8::1]:18444", "[2001:db8::1]:18444"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addrPort, err := config.ParseAddrPort(tt.addr, 8333)
+			require.NoError(t, err)
+			assert.Equal(t, netip.MustParseAddrPort(tt.expected), addrPort)
+		})
+	}
+
+	_, err := config.ParseAddrPort("not an address", 8333)
+	assert.Error(t, err)
+
+	_, err = config.ParseAddrPort("192.0.2.1:99999", 8333)
+	assert.ErrorContains(t, err, "invalid port")
+}
@@ -0,0 +1,379 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONFIG_FILENAME = "mynode.conf"
+	ENV_PREFIX      = "MYNODE_"
+
+	// Bitcoin Core won't accept a user agent longer than this.
+	MAX_USER_AGENT_LENGTH = 256
+
+	// The least memory the UTXO cache can make do with.
+	MIN_DB_CACHE_MIB = 4
+
+	// The most memory the UTXO cache can have. Everything it holds is written out as one record of
+	// the chainstate log when it fills up, and a record can't be 4 GiB or more; outputs take up less
+	// space on disk than they're counted as taking in memory, so this leaves plenty of room.
+	MAX_DB_CACHE_MIB = 3072
+
+	// The smallest mempool we allow, as per Bitcoin Core.
+	MIN_MAX_MEMPOOL_MB = 5
+)
+
+// ValidationError says which setting was wrong, and why.
+type ValidationError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid value '%s' for %s: %v", e.Value, e.Field, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// option is a setting that can be given on the command line, in the environment or in the config file.
+type option struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var options = []option{
+	{"network", "network to connect to: mainnet, testnet3, testnet4, signet or regtest", func(c *Config, v string) error {
+		return c.SetNetwork(v)
+	}},
+	{"connect", "address of the node to connect to first; the network's default port is used if none is given", func(c *Config, v string) error {
+		c.RemoteAddr = v
+		return nil
+	}},
+	{"listen", "address to accept connections from other nodes on; empty to not listen", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"datadir", "directory to keep data in", func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"useragent", "user agent to advertise to other nodes", func(c *Config, v string) error {
+		c.UserAgent = v
+		return nil
+	}},
+	{"maxpeers", "maximum number of peers, inbound and outbound", func(c *Config, v string) error {
+		return parseInt(v, &c.MaxPeers)
+	}},
+	{"maxoutbound", "number of outbound peers to keep connected to", func(c *Config, v string) error {
+		return parseInt(v, &c.TargetOutbound)
+	}},
+	{"dbcache", "memory to cache unspent outputs in, in MiB", func(c *Config, v string) error {
+		return parseInt(v, &c.DBCacheMiB)
+	}},
+	{"par", "number of threads checking scripts; 0 for one per CPU", func(c *Config, v string) error {
+		return parseInt(v, &c.ScriptThreads)
+	}},
+	{"maxmempool", "memory to keep unconfirmed transactions in, in MB", func(c *Config, v string) error {
+		return parseInt(v, &c.MaxMempoolMB)
+	}},
+	{"blocksonly", "whether to ignore unconfirmed transactions from other nodes: 1 or 0", func(c *Config, v string) error {
+		return parseBool(v, &c.BlocksOnly)
+	}},
+	{"mempoolfullrbf", "whether to let transactions replace those that don't signal they're replaceable (BIP125): 1 or 0", func(c *Config, v string) error {
+		return parseBool(v, &c.MempoolFullRBF)
+	}},
+}
+
+func parseInt(s string, dst *int) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("not a whole number")
+	}
+	*dst = n
+	return nil
+}
+
+// parseBool accepts 1 and 0 as Bitcoin Core does, as well as the spellings strconv knows.
+func parseBool(s string, dst *bool) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("not 1 or 0")
+	}
+	*dst = b
+	return nil
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func lookupOption(name string) (option, bool) {
+	for _, opt := range options {
+		if opt.name == name {
+			return opt, true
+		}
+	}
+	return option{}, false
+}
+
+// Load builds the configuration from the defaults, an optional config file, environment variables
+// and command line arguments, each overriding those before it. Environment variables are named
+// after the flags, upper case and prefixed with MYNODE_ (e.g. MYNODE_NETWORK). The config file is
+// mynode.conf in the data directory unless -conf says otherwise.
+func Load(args []string, lookupEnv func(string) (string, bool), usageOutput io.Writer) (*Config, error) {
+	flagValues, err := parseFlags(args, usageOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	envValues := map[string]string{}
+	for _, name := range append(optionNames(), "conf") {
+		if value, ok := lookupEnv(ENV_PREFIX + strings.ToUpper(name)); ok {
+			envValues[name] = value
+		}
+	}
+
+	cfg := Default()
+
+	// Work out where the config file is before reading it
+	confPath, confRequired := "", false
+	if value, ok := firstOf("conf", flagValues, envValues); ok {
+		confPath, confRequired = value, true
+	} else {
+		dataDir := cfg.DataDir
+		if value, ok := firstOf("datadir", flagValues, envValues); ok {
+			dataDir = value
+		}
+		confPath = filepath.Join(dataDir, CONFIG_FILENAME)
+	}
+
+	fileValues, err := readConfigFile(confPath, confRequired)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, values := range []map[string]string{fileValues, envValues, flagValues} {
+		for _, opt := range options {
+			value, ok := values[opt.name]
+			if !ok {
+				continue
+			}
+			if err := opt.set(cfg, value); err != nil {
+				return nil, &ValidationError{Field: opt.name, Value: value, Err: err}
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func optionNames() []string {
+	names := make([]string, 0, len(options))
+	for _, opt := range options {
+		names = append(names, opt.name)
+	}
+	return names
+}
+
+// firstOf returns the value of the named setting from the first of the sources that has it.
+func firstOf(name string, sources ...map[string]string) (string, bool) {
+	for _, source := range sources {
+		if value, ok := source[name]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// parseFlags returns the values of the flags that were actually given on the command line.
+func parseFlags(args []string, usageOutput io.Writer) (map[string]string, error) {
+	values := map[string]string{}
+	defaults := Default()
+
+	fs := flag.NewFlagSet("mynode", flag.ContinueOnError)
+	fs.SetOutput(usageOutput)
+	for _, opt := range options {
+		name := opt.name
+		usage := opt.usage
+		if defaultValue := defaults.valueOf(name); defaultValue != "" {
+			usage += fmt.Sprintf(" (default %q)", defaultValue)
+		}
+		fs.Func(name, usage, func(value string) error {
+			values[name] = value
+			return nil
+		})
+	}
+	fs.Func("conf", fmt.Sprintf("path of the config file (default %q in the data directory)", CONFIG_FILENAME), func(value string) error {
+		values["conf"] = value
+		return nil
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+	return values, nil
+}
+
+// valueOf formats the current value of a setting, for showing defaults in the usage message.
+func (c *Config) valueOf(name string) string {
+	switch name {
+	case "network":
+		return c.ChainParams.Name
+	case "connect":
+		return c.RemoteAddr
+	case "listen":
+		return c.ListenAddr
+	case "datadir":
+		return c.DataDir
+	case "useragent":
+		return c.UserAgent
+	case "maxpeers":
+		return strconv.Itoa(c.MaxPeers)
+	case "maxoutbound":
+		return strconv.Itoa(c.TargetOutbound)
+	case "dbcache":
+		return strconv.Itoa(c.DBCacheMiB)
+	case "par":
+		return strconv.Itoa(c.ScriptThreads)
+	case "maxmempool":
+		return strconv.Itoa(c.MaxMempoolMB)
+	case "blocksonly":
+		return formatBool(c.BlocksOnly)
+	case "mempoolfullrbf":
+		return formatBool(c.MempoolFullRBF)
+	}
+	return ""
+}
+
+// readConfigFile reads 'key = value' settings, one per line. Blank lines and those starting with
+// '#' or ';' are ignored, and values may be double quoted, so simple TOML files work too. It's only
+// an error for the file not to exist if it was asked for explicitly.
+func readConfigFile(path string, required bool) (map[string]string, error) {
+	values := map[string]string{}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return values, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open config file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected 'key = value'", path, lineNum)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		}
+
+		if _, ok := lookupOption(key); !ok {
+			return nil, fmt.Errorf("%s:%d: unknown setting '%s'", path, lineNum, key)
+		}
+		values[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	return values, nil
+}
+
+// Validate checks the settings make sense together, and fills in those derived from others.
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return &ValidationError{Field: "datadir", Value: c.DataDir, Err: errors.New("must not be empty")}
+	}
+
+	if _, err := c.RemoteAddrPort(); err != nil {
+		return &ValidationError{Field: "connect", Value: c.RemoteAddr, Err: err}
+	}
+
+	if c.ListenAddr != "" {
+		if err := validateListenAddress(c.ListenAddress()); err != nil {
+			return &ValidationError{Field: "listen", Value: c.ListenAddr, Err: err}
+		}
+	}
+
+	if len(c.UserAgent) > MAX_USER_AGENT_LENGTH {
+		return &ValidationError{Field: "useragent", Value: c.UserAgent, Err: fmt.Errorf("longer than %d characters", MAX_USER_AGENT_LENGTH)}
+	}
+
+	if c.TargetOutbound < 0 {
+		return &ValidationError{Field: "maxoutbound", Value: strconv.Itoa(c.TargetOutbound), Err: errors.New("must not be negative")}
+	}
+
+	if c.MaxPeers < c.TargetOutbound {
+		return &ValidationError{Field: "maxpeers", Value: strconv.Itoa(c.MaxPeers), Err: fmt.Errorf("must be at least the number of outbound peers (%d)", c.TargetOutbound)}
+	}
+	c.MaxInbound = c.MaxPeers - c.TargetOutbound
+
+	if c.DBCacheMiB < MIN_DB_CACHE_MIB {
+		return &ValidationError{Field: "dbcache", Value: strconv.Itoa(c.DBCacheMiB), Err: fmt.Errorf("must be at least %d", MIN_DB_CACHE_MIB)}
+	}
+	if c.DBCacheMiB > MAX_DB_CACHE_MIB {
+		return &ValidationError{Field: "dbcache", Value: strconv.Itoa(c.DBCacheMiB), Err: fmt.Errorf("must be at most %d", MAX_DB_CACHE_MIB)}
+	}
+
+	if c.ScriptThreads < 0 {
+		return &ValidationError{Field: "par", Value: strconv.Itoa(c.ScriptThreads), Err: errors.New("must not be negative")}
+	}
+
+	if c.MaxMempoolMB < MIN_MAX_MEMPOOL_MB {
+		return &ValidationError{Field: "maxmempool", Value: strconv.Itoa(c.MaxMempoolMB), Err: fmt.Errorf("must be at least %d", MIN_MAX_MEMPOOL_MB)}
+	}
+
+	return nil
+}
+
+// validateListenAddress checks for an IP address (or nothing, meaning all interfaces) and a port.
+func validateListenAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return err
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+	return nil
+}
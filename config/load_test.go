@@ -0,0 +1,134 @@
+package config_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func envFrom(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, config.CONFIG_FILENAME)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	dataDir := t.TempDir()
+
+	cfg, err := config.Load([]string{"-datadir", dataDir}, envFrom(nil), io.Discard)
+	require.NoError(t, err)
+
+	expected := config.Default()
+	expected.DataDir = dataDir
+	assert.Equal(t, expected, cfg)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	dataDir := t.TempDir()
+	writeConfigFile(t, dataDir, `
+# Settings from the file are overridden by the environment, then flags
+network = regtest
+connect = "192.0.2.1"
+useragent = /from-file/
+maxoutbound = 4
+dbcache = 1000
+blocksonly = 1
+mempoolfullrbf = 0
+`)
+
+	env := map[string]string{
+		"MYNODE_DATADIR":   dataDir,
+		"MYNODE_USERAGENT": "/from-env/",
+		"MYNODE_CONNECT":   "192.0.2.2",
+	}
+
+	cfg, err := config.Load([]string{"-connect", "192.0.2.3:1234", "-maxpeers=10"}, envFrom(env), io.Discard)
+	require.NoError(t, err)
+
+	assert.Equal(t, &config.RegTestParams, cfg.ChainParams)
+	assert.Equal(t, config.MAGIC_REGTEST, cfg.Magic)
+	assert.Equal(t, "/from-env/", cfg.UserAgent)
+	assert.Equal(t, "192.0.2.3:1234", cfg.RemoteAddr)
+	assert.Equal(t, 4, cfg.TargetOutbound)
+	assert.Equal(t, 10, cfg.MaxPeers)
+	assert.Equal(t, 6, cfg.MaxInbound)
+	assert.Equal(t, 1000, cfg.DBCacheMiB)
+	assert.True(t, cfg.BlocksOnly)
+	assert.False(t, cfg.MempoolFullRBF)
+}
+
+func TestLoad_ExplicitConfigFile(t *testing.T) {
+	path := writeConfigFile(t, t.TempDir(), `network = "signet"`)
+
+	cfg, err := config.Load([]string{"-conf", path, "-datadir", t.TempDir()}, envFrom(nil), io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, &config.SigNetParams, cfg.ChainParams)
+
+	// A config file that was asked for must exist
+	_, err = config.Load([]string{"-conf", filepath.Join(t.TempDir(), "missing.conf")}, envFrom(nil), io.Discard)
+	assert.ErrorContains(t, err, "unable to open config file")
+}
+
+func TestLoad_BadConfigFile(t *testing.T) {
+	dataDir := t.TempDir()
+
+	writeConfigFile(t, dataDir, "rpcpassword = hunter2")
+	_, err := config.Load([]string{"-datadir", dataDir}, envFrom(nil), io.Discard)
+	assert.ErrorContains(t, err, "unknown setting 'rpcpassword'")
+
+	writeConfigFile(t, dataDir, "network")
+	_, err = config.Load([]string{"-datadir", dataDir}, envFrom(nil), io.Discard)
+	assert.ErrorContains(t, err, ":1: expected 'key = value'")
+}
+
+func TestLoad_ValidationErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		field string
+	}{
+		{"unknown network", []string{"-network", "moonnet"}, "network"},
+		{"bad connect address", []string{"-connect", "not-an-ip"}, "connect"},
+		{"bad listen address", []string{"-listen", "127.0.0.1:http"}, "listen"},
+		{"non-numeric max peers", []string{"-maxpeers", "lots"}, "maxpeers"},
+		{"too few max peers", []string{"-maxpeers", "2"}, "maxpeers"},
+		{"negative outbound", []string{"-maxoutbound", "-1"}, "maxoutbound"},
+		{"tiny db cache", []string{"-dbcache", "1"}, "dbcache"},
+		{"huge db cache", []string{"-dbcache", "100000"}, "dbcache"},
+		{"negative script threads", []string{"-par", "-2"}, "par"},
+		{"tiny mempool", []string{"-maxmempool", "1"}, "maxmempool"},
+		{"blocks only not a boolean", []string{"-blocksonly", "sometimes"}, "blocksonly"},
+		{"long user agent", []string{"-useragent", string(make([]byte, 300))}, "useragent"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-datadir", t.TempDir()}, tt.args...)
+			_, err := config.Load(args, envFrom(nil), io.Discard)
+
+			var validationErr *config.ValidationError
+			require.True(t, errors.As(err, &validationErr), "expected a validation error, got %v", err)
+			assert.Equal(t, tt.field, validationErr.Field)
+			assert.Contains(t, err.Error(), tt.field)
+		})
+	}
+}
+
+func TestLoad_UnexpectedArgument(t *testing.T) {
+	_, err := config.Load([]string{"-datadir", t.TempDir(), "extra"}, envFrom(nil), io.Discard)
+	assert.ErrorContains(t, err, "unexpected argument 'extra'")
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// Difficulty is retargeted every two weeks' worth of ten minute blocks.
+	TARGET_TIMESPAN = 14 * 24 * time.Hour
+	TARGET_SPACING  = 10 * time.Minute
+)
+
+const (
+	MAGIC_TESTNET3 uint32 = 0x0709110B
+	MAGIC_TESTNET4 uint32 = 0x283F161C
+	MAGIC_SIGNET   uint32 = 0x40CF030A
+	MAGIC_REGTEST  uint32 = 0xDAB5BFFA
+)
+
+// Params are the parameters that distinguish one bitcoin network from another.
+type Params struct {
+	Name          string
+	Magic         uint32
+	DefaultPort   uint16
+	GenesisHeader proto.BlockHeader
+	GenesisHash   proto.Hash
+	DNSSeeds      []string
+
+	// The easiest proof of work target allowed, and its compact encoding
+	PowLimit     *big.Int
+	PowLimitBits uint32
+
+	// How the proof of work target is adjusted. Test networks allow a block at the minimum
+	// difficulty if none has been found for twice the target spacing. Testnet4 also enforces
+	// BIP94's fixes for the timewarp attack and the difficulty 'blockstorm' exploit.
+	TargetTimespan           time.Duration
+	TargetSpacing            time.Duration
+	AllowMinDifficultyBlocks bool
+	NoRetargeting            bool
+	EnforceBIP94             bool
+
+	// Heights from which soft forks are enforced. Zero means active from genesis.
+	BIP34Height   int32 // Block height in coinbase
+	BIP65Height   int32 // OP_CHECKLOCKTIMEVERIFY
+	BIP66Height   int32 // Strict DER signatures
+	CSVHeight     int32 // BIP68, BIP112 and BIP113: relative lock times
+	SegwitHeight  int32 // BIP141, BIP143 and BIP147
+	TaprootHeight int32 // BIP341 and BIP342
+
+	// Blocks from before BIP16 was enforced that break it, and so are exempt, and blocks from
+	// before BIP30 that duplicate an earlier transaction that's still unspent.
+	BIP16Exceptions []proto.Hash
+	BIP30Exceptions []proto.Hash
+
+	// The block subsidy halves every this many blocks.
+	SubsidyHalvingInterval int32
+}
+
+// hexToBig parses a hard-coded hex constant.
+func hexToBig(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex constant " + s)
+	}
+	return n
+}
+
+var MainNetParams = Params{
+	Name:        "mainnet",
+	Magic:       MAGIC_MAIN,
+	DefaultPort: 8333,
+	GenesisHeader: proto.BlockHeader{
+		Version:    1,
+		MerkleRoot: proto.MustHashFromStr("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"),
+		Timestamp:  1231006505,
+		Bits:       0x1d00ffff,
+		Nonce:      2083236893,
+	},
+	GenesisHash: proto.MustHashFromStr("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"),
+	DNSSeeds: []string{
+		"seed.bitcoin.sipa.be",
+		"dnsseed.bluematt.me",
+		"dnsseed.bitcoin.dashjr-list-of-p2p-nodes.us",
+		"seed.bitcoinstats.com",
+		"seed.bitcoin.jonasschnelli.ch",
+		"seed.btc.petertodd.net",
+		"seed.bitcoin.sprovoost.nl",
+		"dnsseed.emzy.de",
+		"seed.bitcoin.wiz.biz",
+		"seed.mainnet.achownodes.xyz",
+	},
+	PowLimit:                 hexToBig("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits:             0x1d00ffff,
+	TargetTimespan:           TARGET_TIMESPAN,
+	TargetSpacing:            TARGET_SPACING,
+	AllowMinDifficultyBlocks: false,
+	NoRetargeting:            false,
+	EnforceBIP94:             false,
+	BIP34Height:              227931,
+	BIP65Height:              388381,
+	BIP66Height:              363725,
+	CSVHeight:                419328,
+	SegwitHeight:             481824,
+	TaprootHeight:            709632,
+	BIP16Exceptions: []proto.Hash{
+		proto.MustHashFromStr("00000000000002dc756eebf4f49723ed8d30cc28a5f108eb94b1ba88ac4f9c22"),
+	},
+	BIP30Exceptions: []proto.Hash{
+		proto.MustHashFromStr("00000000000a4d0a398161ffc163c503763b1f4360639393e0e4c8e300e0caec"),
+		proto.MustHashFromStr("00000000000743f190a18c5577a3c2d2a1f610ae9601ac046a38084ccb7cd721"),
+	},
+	SubsidyHalvingInterval: 210_000,
+}
+
+var TestNet3Params = Params{
+	Name:        "testnet3",
+	Magic:       MAGIC_TESTNET3,
+	DefaultPort: 18333,
+	GenesisHeader: proto.BlockHeader{
+		Version:    1,
+		MerkleRoot: proto.MustHashFromStr("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"),
+		Timestamp:  1296688602,
+		Bits:       0x1d00ffff,
+		Nonce:      414098458,
+	},
+	GenesisHash: proto.MustHashFromStr("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943"),
+	DNSSeeds: []string{
+		"testnet-seed.bitcoin.jonasschnelli.ch",
+		"seed.tbtc.petertodd.net",
+		"seed.testnet.bitcoin.sprovoost.nl",
+		"testnet-seed.bluematt.me",
+	},
+	PowLimit:                 hexToBig("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits:             0x1d00ffff,
+	TargetTimespan:           TARGET_TIMESPAN,
+	TargetSpacing:            TARGET_SPACING,
+	AllowMinDifficultyBlocks: true,
+	NoRetargeting:            false,
+	EnforceBIP94:             false,
+	BIP34Height:              21111,
+	BIP65Height:              581885,
+	BIP66Height:              330776,
+	CSVHeight:                770112,
+	SegwitHeight:             834624,
+	// Taproot was activated by version bits on testnet3, rather than being buried at a height;
+	// this is the start of the retarget period in which it became active.
+	TaprootHeight: 2011968,
+	BIP16Exceptions: []proto.Hash{
+		proto.MustHashFromStr("00000000dd30457c001f4095d208cc1296b0eed002427aa599874af7a432b105"),
+	},
+	SubsidyHalvingInterval: 210_000,
+}
+
+var TestNet4Params = Params{
+	Name:        "testnet4",
+	Magic:       MAGIC_TESTNET4,
+	DefaultPort: 48333,
+	GenesisHeader: proto.BlockHeader{
+		Version:    1,
+		MerkleRoot: proto.MustHashFromStr("7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e"),
+		Timestamp:  1714777860,
+		Bits:       0x1d00ffff,
+		Nonce:      393743547,
+	},
+	GenesisHash: proto.MustHashFromStr("00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043"),
+	DNSSeeds: []string{
+		"seed.testnet4.bitcoin.sprovoost.nl",
+		"seed.testnet4.wiz.biz",
+	},
+	PowLimit:                 hexToBig("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits:             0x1d00ffff,
+	TargetTimespan:           TARGET_TIMESPAN,
+	TargetSpacing:            TARGET_SPACING,
+	AllowMinDifficultyBlocks: true,
+	NoRetargeting:            false,
+	EnforceBIP94:             true,
+	BIP34Height:              1,
+	BIP65Height:              1,
+	BIP66Height:              1,
+	CSVHeight:                1,
+	SegwitHeight:             1,
+	TaprootHeight:            0,
+	SubsidyHalvingInterval:   210_000,
+}
+
+// SigNetParams are for the default public signet. Custom signets with their own challenge have a
+// different magic and aren't supported.
+var SigNetParams = Params{
+	Name:        "signet",
+	Magic:       MAGIC_SIGNET,
+	DefaultPort: 38333,
+	GenesisHeader: proto.BlockHeader{
+		Version:    1,
+		MerkleRoot: proto.MustHashFromStr("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"),
+		Timestamp:  1598918400,
+		Bits:       0x1e0377ae,
+		Nonce:      52613770,
+	},
+	GenesisHash: proto.MustHashFromStr("00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6"),
+	DNSSeeds: []string{
+		"seed.signet.bitcoin.sprovoost.nl",
+		"seed.signet.achownodes.xyz",
+	},
+	PowLimit:                 hexToBig("00000377ae000000000000000000000000000000000000000000000000000000"),
+	PowLimitBits:             0x1e0377ae,
+	TargetTimespan:           TARGET_TIMESPAN,
+	TargetSpacing:            TARGET_SPACING,
+	AllowMinDifficultyBlocks: false,
+	NoRetargeting:            false,
+	EnforceBIP94:             false,
+	BIP34Height:              1,
+	BIP65Height:              1,
+	BIP66Height:              1,
+	CSVHeight:                1,
+	SegwitHeight:             1,
+	TaprootHeight:            0,
+	SubsidyHalvingInterval:   210_000,
+}
+
+var RegTestParams = Params{
+	Name:        "regtest",
+	Magic:       MAGIC_REGTEST,
+	DefaultPort: 18444,
+	GenesisHeader: proto.BlockHeader{
+		Version:    1,
+		MerkleRoot: proto.MustHashFromStr("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"),
+		Timestamp:  1296688602,
+		Bits:       0x207fffff,
+		Nonce:      2,
+	},
+	GenesisHash:              proto.MustHashFromStr("0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206"),
+	DNSSeeds:                 nil,
+	PowLimit:                 hexToBig("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+	PowLimitBits:             0x207fffff,
+	TargetTimespan:           TARGET_TIMESPAN,
+	TargetSpacing:            TARGET_SPACING,
+	AllowMinDifficultyBlocks: true,
+	NoRetargeting:            true,
+	EnforceBIP94:             false,
+	BIP34Height:              1,
+	BIP65Height:              1,
+	BIP66Height:              1,
+	CSVHeight:                1,
+	SegwitHeight:             0,
+	TaprootHeight:            0,
+	SubsidyHalvingInterval:   150,
+}
+
+// Networks are all the networks we know about, keyed by name.
+var Networks = map[string]*Params{
+	MainNetParams.Name:  &MainNetParams,
+	TestNet3Params.Name: &TestNet3Params,
+	TestNet4Params.Name: &TestNet4Params,
+	SigNetParams.Name:   &SigNetParams,
+	RegTestParams.Name:  &RegTestParams,
+}
+
+// ParamsForNetwork looks up the parameters of a network by name. 'main' and 'testnet' are accepted
+// as aliases for mainnet and testnet3.
+func ParamsForNetwork(name string) (*Params, error) {
+	switch name = strings.ToLower(name); name {
+	case "main":
+		name = MainNetParams.Name
+	case "testnet", "test":
+		name = TestNet3Params.Name
+	}
+
+	params, ok := Networks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown network '%s'", name)
+	}
+	return params, nil
+}
@@ -0,0 +1,17 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParams_GenesisHeaderMatchesHash(t *testing.T) {
+	for name, params := range config.Networks {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, params.GenesisHash, params.GenesisHeader.BlockHash())
+			assert.Equal(t, params.PowLimitBits, params.GenesisHeader.Bits)
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package connmgr
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pscott31/mynode/addrmgr"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// How long to wait before retrying after a failed or dropped connection. The wait doubles with
+	// each consecutive failure, up to the maximum.
+	INITIAL_BACKOFF = time.Second
+	MAX_BACKOFF     = 5 * time.Minute
+
+	// A connection that lasts at least this long counts as a success, and resets the backoff.
+	STABLE_CONNECTION_TIME = time.Minute
+)
+
+// AddressSource is where the connection manager finds addresses to connect to, and reports back
+// on how it got on. It's satisfied by *addrmgr.AddrManager.
+type AddressSource interface {
+	Select(excludeGroups map[string]bool) *addrmgr.KnownAddress
+	Attempt(na proto.NetAddressV2)
+	Good(na proto.NetAddressV2)
+	Connected(na proto.NetAddressV2)
+}
+
+// PeerHandler is called for each outbound peer once the handshake has completed, and should run
+// until the peer disconnects.
+type PeerHandler func(p *peer.Peer)
+
+// PeerInfo is a snapshot of what we know about a connected peer.
+type PeerInfo struct {
+	Addr            string
+	UserAgent       string
+	ProtocolVersion int32
+	Services        uint64
+	StartHeight     int32
+	ConnectedAt     time.Time
+	PingRTT         time.Duration
+}
+
+// ConnManager keeps the configured number of outbound connections open, each to a different
+// network group.
+type ConnManager struct {
+	// Dial opens the connection to an address. It defaults to a plain TCP dial, and can be
+	// replaced before Start is called.
+	Dial func(addr netip.AddrPort) (net.Conn, error)
+
+	cfg     *config.Config
+	nonces  *peer.NonceSet
+	addrs   AddressSource
+	handler PeerHandler
+
+	mu     sync.Mutex
+	peers  map[*peer.Peer]*connection
+	groups map[string]int // Network groups we're connected to (or connecting to), and how many times
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type connection struct {
+	na          proto.NetAddressV2
+	connectedAt time.Time
+}
+
+// New creates a connection manager that picks addresses from addrs and hands connected peers to handler.
+// The nonces are those shared by all the node's peers.
+func New(cfg *config.Config, nonces *peer.NonceSet, addrs AddressSource, handler PeerHandler) *ConnManager {
+	return &ConnManager{
+		Dial: func(addr netip.AddrPort) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr.String(), cfg.HandshakeTimeout)
+		},
+		cfg:     cfg,
+		nonces:  nonces,
+		addrs:   addrs,
+		handler: handler,
+		peers:   map[*peer.Peer]*connection{},
+		groups:  map[string]int{},
+	}
+}
+
+// Start opens the outbound connections, and keeps them open until Stop is called.
+func (cm *ConnManager) Start() {
+	cm.quit = make(chan struct{})
+	for i := 0; i < cm.cfg.TargetOutbound; i++ {
+		cm.wg.Add(1)
+		go cm.maintainConnection()
+	}
+}
+
+// Stop disconnects all outbound peers and waits for them to finish.
+func (cm *ConnManager) Stop() {
+	close(cm.quit)
+
+	cm.mu.Lock()
+	for p := range cm.peers {
+		p.Close()
+	}
+	cm.mu.Unlock()
+
+	cm.wg.Wait()
+}
+
+// Peers returns information about each connected outbound peer, in order of address.
+func (cm *ConnManager) Peers() []PeerInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	infos := make([]PeerInfo, 0, len(cm.peers))
+	for p, conn := range cm.peers {
+		// Still shaking hands
+		if conn.connectedAt.IsZero() {
+			continue
+		}
+
+		theirVersion := p.TheirVersion()
+		infos = append(infos, PeerInfo{
+			Addr:            conn.na.String(),
+			UserAgent:       string(theirVersion.UserAgent),
+			ProtocolVersion: p.ProtocolVersion(),
+			Services:        theirVersion.Services,
+			StartHeight:     theirVersion.StartHeight,
+			ConnectedAt:     conn.connectedAt,
+			PingRTT:         p.LastPingRTT(),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos
+}
+
+// maintainConnection looks after one outbound connection slot, reconnecting whenever the
+// connection fails or drops.
+func (cm *ConnManager) maintainConnection() {
+	defer cm.wg.Done()
+
+	backoff := INITIAL_BACKOFF
+	for {
+		stable := cm.connectOnce()
+		if stable {
+			backoff = INITIAL_BACKOFF
+		}
+
+		select {
+		case <-cm.quit:
+			return
+		case <-time.After(backoff):
+		}
+
+		if !stable {
+			backoff = min(backoff*2, MAX_BACKOFF)
+		}
+	}
+}
+
+// connectOnce connects to a new address and runs the peer until it disconnects. It returns true if
+// the connection was stable enough that we shouldn't back off any further.
+func (cm *ConnManager) connectOnce() bool {
+	na, ok := cm.reserveAddress()
+	if !ok {
+		return false
+	}
+	group := addrmgr.GroupKey(na)
+	defer cm.releaseGroup(group)
+
+	addrPort, _ := na.AddrPort()
+	cm.addrs.Attempt(na)
+
+	conn, err := cm.Dial(addrPort)
+	if err != nil {
+		log.Printf("error connecting to %s: %v", na, err)
+		return false
+	}
+
+	p := peer.NewOutbound(cm.cfg, cm.nonces, conn)
+	defer p.Close()
+
+	// Register before the handshake so that Stop can interrupt it
+	if !cm.addPeer(p, na) {
+		return false
+	}
+	defer cm.removePeer(p)
+
+	if err := p.Handshake(); err != nil {
+		log.Printf("handshake with %s failed: %v", na, err)
+		return false
+	}
+	cm.addrs.Good(na)
+	cm.setConnected(p)
+
+	connectedAt := time.Now()
+	cm.handler(p)
+	cm.addrs.Connected(na)
+
+	return time.Since(connectedAt) >= STABLE_CONNECTION_TIME
+}
+
+// reserveAddress picks an address in a network group we're not yet connected to, and claims that group.
+func (cm *ConnManager) reserveAddress() (proto.NetAddressV2, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	exclude := make(map[string]bool, len(cm.groups))
+	for group := range cm.groups {
+		exclude[group] = true
+	}
+
+	ka := cm.addrs.Select(exclude)
+	if ka == nil {
+		return proto.NetAddressV2{}, false
+	}
+
+	cm.groups[addrmgr.GroupKey(ka.Addr)]++
+	return ka.Addr, true
+}
+
+func (cm *ConnManager) releaseGroup(group string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.groups[group]--
+	if cm.groups[group] <= 0 {
+		delete(cm.groups, group)
+	}
+}
+
+// addPeer registers a peer we're connecting to, returning false if we're shutting down.
+func (cm *ConnManager) addPeer(p *peer.Peer, na proto.NetAddressV2) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	select {
+	case <-cm.quit:
+		return false
+	default:
+	}
+
+	cm.peers[p] = &connection{na: na}
+	return true
+}
+
+func (cm *ConnManager) setConnected(p *peer.Peer) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.peers[p].connectedAt = time.Now()
+}
+
+func (cm *ConnManager) removePeer(p *peer.Peer) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.peers, p)
+}
@@ -0,0 +1,136 @@
+package connmgr_test
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/addrmgr"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/connmgr"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNetwork runs a number of local nodes, each standing in for a node at a public address.
+type testNetwork struct {
+	servers map[netip.AddrPort]*server.Server
+	accepts atomic.Int32
+}
+
+func newTestNetwork(t *testing.T, handler server.PeerHandler, publicAddrs ...string) *testNetwork {
+	t.Helper()
+	tn := &testNetwork{servers: map[netip.AddrPort]*server.Server{}}
+
+	for _, publicAddr := range publicAddrs {
+		cfg := config.Default()
+		cfg.ListenAddr = "127.0.0.1:0"
+		cfg.StartHeight = 1234
+
+		srv, err := server.Listen(cfg, peer.NewNonceSet(), func(p *peer.Peer) {
+			tn.accepts.Add(1)
+			handler(p)
+		})
+		require.NoError(t, err)
+		go srv.Serve()
+		t.Cleanup(func() { srv.Close() })
+
+		tn.servers[netip.MustParseAddrPort(publicAddr)] = srv
+	}
+	return tn
+}
+
+// dial connects to the local node standing in for the public address.
+func (tn *testNetwork) dial(addr netip.AddrPort) (net.Conn, error) {
+	srv, ok := tn.servers[addr]
+	if !ok {
+		return nil, fmt.Errorf("no route to %s", addr)
+	}
+	return net.Dial("tcp", srv.Addr().String())
+}
+
+func newAddrManager(t *testing.T, addrs ...string) *addrmgr.AddrManager {
+	t.Helper()
+	a, err := addrmgr.New(filepath.Join(t.TempDir(), "peers.json"))
+	require.NoError(t, err)
+
+	for _, addr := range addrs {
+		a.AddManual(proto.NewNetAddressV2(0, 1, netip.MustParseAddrPort(addr)))
+	}
+	return a
+}
+
+// runUntilClosed keeps a peer connected until the other end goes away.
+func runUntilClosed(p *peer.Peer) {
+	p.Run(&peer.Listeners{})
+}
+
+func TestConnManager_MaintainsTargetOutbound(t *testing.T) {
+	addrs := []string{"1.1.1.1:8333", "2.2.2.2:8333", "3.3.3.3:8333"}
+	tn := newTestNetwork(t, runUntilClosed, addrs...)
+
+	cfg := config.Default()
+	cfg.TargetOutbound = 2
+
+	cm := connmgr.New(cfg, peer.NewNonceSet(), newAddrManager(t, addrs...), runUntilClosed)
+	cm.Dial = tn.dial
+	cm.Start()
+	defer cm.Stop()
+
+	require.Eventually(t, func() bool { return len(cm.Peers()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// Give it a moment to make sure it doesn't go over the target
+	time.Sleep(50 * time.Millisecond)
+	infos := cm.Peers()
+	require.Len(t, infos, 2)
+	assert.NotEqual(t, infos[0].Addr, infos[1].Addr)
+
+	for _, info := range infos {
+		assert.Contains(t, addrs, info.Addr)
+		assert.Equal(t, proto.USER_AGENT, info.UserAgent)
+		assert.Equal(t, config.DEFAULT_VERSION, info.ProtocolVersion)
+		assert.Equal(t, config.DEFAULT_SERVICES, info.Services)
+		assert.Equal(t, int32(1234), info.StartHeight)
+		assert.False(t, info.ConnectedAt.IsZero())
+	}
+}
+
+func TestConnManager_OnePeerPerNetGroup(t *testing.T) {
+	// Both addresses are in the same /16
+	addrs := []string{"1.2.3.4:8333", "1.2.5.6:8333"}
+	tn := newTestNetwork(t, runUntilClosed, addrs...)
+
+	cfg := config.Default()
+	cfg.TargetOutbound = 2
+
+	cm := connmgr.New(cfg, peer.NewNonceSet(), newAddrManager(t, addrs...), runUntilClosed)
+	cm.Dial = tn.dial
+	cm.Start()
+	defer cm.Stop()
+
+	require.Eventually(t, func() bool { return len(cm.Peers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, cm.Peers(), 1)
+}
+
+func TestConnManager_Reconnects(t *testing.T) {
+	// The remote node hangs up on us straight after the handshake
+	tn := newTestNetwork(t, func(p *peer.Peer) {}, "1.1.1.1:8333")
+
+	cfg := config.Default()
+	cfg.TargetOutbound = 1
+
+	cm := connmgr.New(cfg, peer.NewNonceSet(), newAddrManager(t, "1.1.1.1:8333"), runUntilClosed)
+	cm.Dial = tn.dial
+	cm.Start()
+	defer cm.Stop()
+
+	assert.Eventually(t, func() bool { return tn.accepts.Load() >= 2 }, 5*time.Second, 10*time.Millisecond)
+}
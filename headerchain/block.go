@@ -0,0 +1,196 @@
+package headerchain
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// BIP141: the most weight a block may have.
+	MAX_BLOCK_WEIGHT = 4_000_000
+
+	// The most satoshis there will ever be, and so the most any output (or all of them) can be worth.
+	MAX_MONEY = 21_000_000 * 100_000_000
+
+	// The limits on the size of a coinbase's signature script.
+	MIN_COINBASE_SCRIPT_LEN = 2
+	MAX_COINBASE_SCRIPT_LEN = 100
+
+	// BIP141: the witness commitment is in an output whose script starts with OP_RETURN, a 36 byte
+	// push and these four bytes, followed by the 32 byte commitment.
+	WITNESS_COMMITMENT_SIZE = 38
+)
+
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// CheckTransactionSanity checks the rules a transaction must follow regardless of where it is in
+// the chain or what it spends.
+func CheckTransactionSanity(tx *proto.Tx) error {
+	txHash := tx.TxHash()
+	if len(tx.TxIn) == 0 {
+		return ruleError(ErrNoTxInputs, "transaction %s has no inputs", txHash)
+	}
+	if len(tx.TxOut) == 0 {
+		return ruleError(ErrNoTxOutputs, "transaction %s has no outputs", txHash)
+	}
+
+	if size := tx.StrippedSize(); size*proto.WITNESS_SCALE_FACTOR > MAX_BLOCK_WEIGHT {
+		return ruleError(ErrTxTooBig, "transaction %s is too big to fit in a block (%d bytes)", txHash, size)
+	}
+
+	var total int64
+	for i, out := range tx.TxOut {
+		if out.Value < 0 || out.Value > MAX_MONEY {
+			return ruleError(ErrBadTxOutValue, "transaction %s output %d has value %d out of range", txHash, i, out.Value)
+		}
+		total += out.Value
+		if total > MAX_MONEY {
+			return ruleError(ErrBadTxOutValue, "transaction %s outputs total more than the maximum", txHash)
+		}
+	}
+
+	spent := make(map[proto.OutPoint]struct{}, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		if _, ok := spent[in.PreviousOutPoint]; ok {
+			return ruleError(ErrDuplicateTxInput, "transaction %s spends %s more than once", txHash, in.PreviousOutPoint)
+		}
+		spent[in.PreviousOutPoint] = struct{}{}
+	}
+
+	if tx.IsCoinBase() {
+		if l := len(tx.TxIn[0].SignatureScript); l < MIN_COINBASE_SCRIPT_LEN || l > MAX_COINBASE_SCRIPT_LEN {
+			return ruleError(ErrBadCoinbaseScriptLen, "coinbase %s has a signature script of %d bytes", txHash, l)
+		}
+	} else {
+		for i, in := range tx.TxIn {
+			if in.PreviousOutPoint.IsNull() {
+				return ruleError(ErrBadTxInput, "transaction %s input %d spends the null outpoint", txHash, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckBlockSanity checks a block is internally consistent: its transactions are sane and match
+// the merkle root in its header, and it's not too big. Failing these doesn't make the header
+// invalid, as a peer could have tampered with the transactions.
+func CheckBlockSanity(block *proto.Block) error {
+	hash := block.BlockHash()
+	txs := block.Transactions
+	if len(txs) == 0 {
+		return ruleError(ErrNoTransactions, "block %s has no transactions", hash)
+	}
+
+	// Cheap checks on the size first, before hashing everything
+	if len(txs)*proto.WITNESS_SCALE_FACTOR > MAX_BLOCK_WEIGHT || block.StrippedSize()*proto.WITNESS_SCALE_FACTOR > MAX_BLOCK_WEIGHT {
+		return ruleError(ErrBlockTooBig, "block %s is too big", hash)
+	}
+
+	root, mutated := block.MerkleRoot()
+	if root != block.Header.MerkleRoot {
+		return ruleError(ErrBadMerkleRoot, "block %s has merkle root %s, expected %s", hash, root, block.Header.MerkleRoot)
+	}
+	if mutated {
+		return ruleError(ErrMutatedBlock, "block %s has duplicate transactions in its merkle tree", hash)
+	}
+
+	if !txs[0].IsCoinBase() {
+		return ruleError(ErrFirstTxNotCoinbase, "first transaction in block %s is not a coinbase", hash)
+	}
+	for i := range txs {
+		if i > 0 && txs[i].IsCoinBase() {
+			return ruleError(ErrMultipleCoinbases, "block %s has a second coinbase at index %d", hash, i)
+		}
+		if err := CheckTransactionSanity(&txs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// witnessCommitment finds the BIP141 commitment in the coinbase, which is in the last output that
+// looks like one.
+func witnessCommitment(coinbase *proto.Tx) (proto.Hash, bool) {
+	for i := len(coinbase.TxOut) - 1; i >= 0; i-- {
+		script := coinbase.TxOut[i].PkScript
+		if len(script) >= WITNESS_COMMITMENT_SIZE && bytes.HasPrefix(script, witnessCommitmentHeader) {
+			var commitment proto.Hash
+			copy(commitment[:], script[len(witnessCommitmentHeader):WITNESS_COMMITMENT_SIZE])
+			return commitment, true
+		}
+	}
+	return proto.Hash{}, false
+}
+
+// CheckWitnessCommitment checks the coinbase commits to the witness data in the block. Before
+// segwit activated, and in blocks without a commitment, there mustn't be any witness data.
+func CheckWitnessCommitment(block *proto.Block, segwitActive bool) error {
+	hash := block.BlockHash()
+	coinbase := &block.Transactions[0]
+
+	if commitment, ok := witnessCommitment(coinbase); ok && segwitActive {
+		// The coinbase's witness is the reserved value that goes into the commitment
+		witness := coinbase.TxIn[0].Witness
+		if len(witness) != 1 || len(witness[0]) != proto.HASH_SIZE {
+			return ruleError(ErrBadWitnessCommitment, "block %s coinbase witness is not a single 32 byte value", hash)
+		}
+
+		root := block.WitnessMerkleRoot()
+		expected := proto.DoubleSHA256(append(root[:], witness[0]...))
+		if commitment != expected {
+			return ruleError(ErrBadWitnessCommitment, "block %s has witness commitment %x, expected %x", hash, commitment[:], expected[:])
+		}
+		return nil
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.HasWitness() {
+			return ruleError(ErrUnexpectedWitness, "block %s has witness data but no commitment to it", hash)
+		}
+	}
+	return nil
+}
+
+// CheckBlock checks a block for a header we know about is consistent with it, given where it is
+// in the chain.
+func (c *HeaderChain) CheckBlock(block *proto.Block) error {
+	hash := block.BlockHash()
+	node := c.LookupNode(hash)
+	if node == nil {
+		return fmt.Errorf("block %s has no known header", hash)
+	}
+	if node.Status&STATUS_INVALID != 0 {
+		return ruleError(ErrDuplicateHeader, "block %s has a header that was found to be invalid", hash)
+	}
+
+	if err := CheckBlockSanity(block); err != nil {
+		return err
+	}
+
+	if err := CheckWitnessCommitment(block, node.Height >= c.params.SegwitHeight); err != nil {
+		return err
+	}
+
+	if weight := block.Weight(); weight > MAX_BLOCK_WEIGHT {
+		return ruleError(ErrBlockWeightTooHigh, "block %s has weight %d, more than the maximum %d", hash, weight, MAX_BLOCK_WEIGHT)
+	}
+
+	return nil
+}
+
+// AcceptBlock checks a block with CheckBlock and, if it passes, saves it to the block store.
+func (c *HeaderChain) AcceptBlock(block *proto.Block) error {
+	if err := c.CheckBlock(block); err != nil {
+		return err
+	}
+
+	raw, err := proto.MarshalToBytes(block)
+	if err != nil {
+		return fmt.Errorf("unable to serialize block %s: %w", block.BlockHash(), err)
+	}
+	return c.StoreBlock(block.BlockHash(), raw)
+}
@@ -0,0 +1,239 @@
+package headerchain_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func coinbaseTx(height byte) proto.Tx {
+	return proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX},
+			SignatureScript:  []byte{0x01, height},
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{{Value: 50 * 100_000_000, PkScript: []byte{0x51}}},
+	}
+}
+
+func spendTx(tag byte, witness proto.TxWitness) proto.Tx {
+	return proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Hash: proto.DoubleSHA256([]byte{tag}), Index: 0},
+			SignatureScript:  []byte{},
+			Witness:          witness,
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{{Value: 1000, PkScript: []byte{0x51}}},
+	}
+}
+
+// addWitnessCommitment adds the BIP141 commitment to the block's coinbase.
+func addWitnessCommitment(block *proto.Block) {
+	reserved := make([]byte, proto.HASH_SIZE)
+	block.Transactions[0].TxIn[0].Witness = proto.TxWitness{reserved}
+	root := block.WitnessMerkleRoot()
+	commitment := proto.DoubleSHA256(append(root[:], reserved...))
+	script := append([]byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}, commitment[:]...)
+	block.Transactions[0].TxOut = append(block.Transactions[0].TxOut, proto.TxOut{PkScript: script})
+}
+
+// newBlock builds a block on genesis with the transactions, ready to be sealed.
+func newBlock(txs ...proto.Tx) proto.Block {
+	params := &config.RegTestParams
+	block := proto.Block{
+		Header: proto.BlockHeader{
+			Version:   4,
+			PrevBlock: params.GenesisHash,
+			Timestamp: params.GenesisHeader.Timestamp + 600,
+			Bits:      params.PowLimitBits,
+		},
+		Transactions: txs,
+	}
+	return block
+}
+
+// sealBlock sets the block's merkle root and mines it.
+func sealBlock(t *testing.T, block proto.Block) proto.Block {
+	t.Helper()
+	block.Header.MerkleRoot, _ = block.MerkleRoot()
+	block.Header = mineHeader(t, block.Header, &config.RegTestParams)
+	return block
+}
+
+// acceptBlock adds the block's header to a fresh chain and then tries to accept the block.
+func acceptBlock(t *testing.T, block proto.Block) (*headerchain.HeaderChain, error) {
+	t.Helper()
+	store := openStore(t, t.TempDir())
+	t.Cleanup(func() { store.Close() })
+	chain, err := headerchain.Load(&config.RegTestParams, store)
+	require.NoError(t, err)
+
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{block.Header})
+	require.NoError(t, err)
+	return chain, chain.AcceptBlock(&block)
+}
+
+func TestHeaderChain_AcceptBlock(t *testing.T) {
+	block := newBlock(coinbaseTx(1), spendTx(1, nil))
+	block = sealBlock(t, block)
+
+	chain, err := acceptBlock(t, block)
+	require.NoError(t, err)
+
+	node := chain.LookupNode(block.BlockHash())
+	assert.NotZero(t, node.Status&headerchain.STATUS_HAVE_DATA)
+
+	raw, err := chain.ReadBlock(block.BlockHash())
+	require.NoError(t, err)
+	var gotBlock proto.Block
+	require.NoError(t, gotBlock.UnmarshalFromReader(bytes.NewReader(raw)))
+	assert.Equal(t, block, gotBlock)
+}
+
+func TestHeaderChain_AcceptBlockUnknownHeader(t *testing.T) {
+	chain := headerchain.New(&config.RegTestParams)
+	block := sealBlock(t, newBlock(coinbaseTx(1)))
+	assert.ErrorContains(t, chain.AcceptBlock(&block), "no known header")
+}
+
+func TestHeaderChain_AcceptBlockWitness(t *testing.T) {
+	witness := proto.TxWitness{[]byte{0x01}, []byte{0x02}}
+
+	block := newBlock(coinbaseTx(1), spendTx(1, witness))
+	addWitnessCommitment(&block)
+	_, err := acceptBlock(t, sealBlock(t, block))
+	require.NoError(t, err)
+
+	// Changing the witness data after committing to it
+	block.Transactions[1].TxIn[0].Witness = proto.TxWitness{[]byte{0x03}}
+	_, err = acceptBlock(t, sealBlock(t, block))
+	assertRuleError(t, err, headerchain.ErrBadWitnessCommitment)
+
+	// A commitment with the wrong sort of reserved value
+	block = newBlock(coinbaseTx(1), spendTx(1, witness))
+	addWitnessCommitment(&block)
+	block.Transactions[0].TxIn[0].Witness = proto.TxWitness{{0x00}}
+	_, err = acceptBlock(t, sealBlock(t, block))
+	assertRuleError(t, err, headerchain.ErrBadWitnessCommitment)
+
+	// Witness data without any commitment
+	block = newBlock(coinbaseTx(1), spendTx(1, witness))
+	_, err = acceptBlock(t, sealBlock(t, block))
+	assertRuleError(t, err, headerchain.ErrUnexpectedWitness)
+}
+
+func TestCheckBlockSanity(t *testing.T) {
+	tests := []struct {
+		name  string
+		block func() proto.Block
+		code  headerchain.ErrorCode
+	}{
+		{"no transactions", func() proto.Block {
+			return newBlock()
+		}, headerchain.ErrNoTransactions},
+		{"bad merkle root", func() proto.Block {
+			block := sealBlock(t, newBlock(coinbaseTx(1)))
+			block.Transactions = append(block.Transactions, spendTx(1, nil))
+			return block
+		}, headerchain.ErrBadMerkleRoot},
+		{"duplicated transactions", func() proto.Block {
+			// Has the same merkle root as the block without the last transaction
+			block := sealBlock(t, newBlock(coinbaseTx(1), spendTx(1, nil), spendTx(2, nil)))
+			block.Transactions = append(block.Transactions, spendTx(2, nil))
+			return block
+		}, headerchain.ErrMutatedBlock},
+		{"first transaction not a coinbase", func() proto.Block {
+			return sealBlock(t, newBlock(spendTx(1, nil)))
+		}, headerchain.ErrFirstTxNotCoinbase},
+		{"two coinbases", func() proto.Block {
+			return sealBlock(t, newBlock(coinbaseTx(1), coinbaseTx(2)))
+		}, headerchain.ErrMultipleCoinbases},
+		{"insane transaction", func() proto.Block {
+			tx := spendTx(1, nil)
+			tx.TxOut = nil
+			return sealBlock(t, newBlock(coinbaseTx(1), tx))
+		}, headerchain.ErrNoTxOutputs},
+		{"too big", func() proto.Block {
+			tx := spendTx(1, nil)
+			tx.TxIn[0].SignatureScript = make([]byte, headerchain.MAX_BLOCK_WEIGHT/4)
+			return sealBlock(t, newBlock(coinbaseTx(1), tx))
+		}, headerchain.ErrBlockTooBig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := tt.block()
+			assertRuleError(t, headerchain.CheckBlockSanity(&block), tt.code)
+		})
+	}
+}
+
+func TestCheckTransactionSanity(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   func() proto.Tx
+		code headerchain.ErrorCode
+	}{
+		{"no inputs", func() proto.Tx {
+			tx := spendTx(1, nil)
+			tx.TxIn = nil
+			return tx
+		}, headerchain.ErrNoTxInputs},
+		{"no outputs", func() proto.Tx {
+			tx := spendTx(1, nil)
+			tx.TxOut = nil
+			return tx
+		}, headerchain.ErrNoTxOutputs},
+		{"negative output", func() proto.Tx {
+			tx := spendTx(1, nil)
+			tx.TxOut[0].Value = -1
+			return tx
+		}, headerchain.ErrBadTxOutValue},
+		{"outputs total too much", func() proto.Tx {
+			tx := spendTx(1, nil)
+			tx.TxOut = []proto.TxOut{{Value: headerchain.MAX_MONEY}, {Value: 1}}
+			return tx
+		}, headerchain.ErrBadTxOutValue},
+		{"duplicate inputs", func() proto.Tx {
+			tx := spendTx(1, nil)
+			tx.TxIn = append(tx.TxIn, tx.TxIn[0])
+			return tx
+		}, headerchain.ErrDuplicateTxInput},
+		{"coinbase script too short", func() proto.Tx {
+			tx := coinbaseTx(1)
+			tx.TxIn[0].SignatureScript = []byte{0x01}
+			return tx
+		}, headerchain.ErrBadCoinbaseScriptLen},
+		{"coinbase script too long", func() proto.Tx {
+			tx := coinbaseTx(1)
+			tx.TxIn[0].SignatureScript = make([]byte, 101)
+			return tx
+		}, headerchain.ErrBadCoinbaseScriptLen},
+		{"spends null outpoint", func() proto.Tx {
+			tx := spendTx(1, nil)
+			tx.TxIn = append(tx.TxIn, proto.TxIn{PreviousOutPoint: proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX}})
+			return tx
+		}, headerchain.ErrBadTxInput},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := tt.tx()
+			assertRuleError(t, headerchain.CheckTransactionSanity(&tx), tt.code)
+		})
+	}
+
+	tx := coinbaseTx(1)
+	assert.NoError(t, headerchain.CheckTransactionSanity(&tx))
+	tx = spendTx(1, nil)
+	assert.NoError(t, headerchain.CheckTransactionSanity(&tx))
+}
@@ -0,0 +1,138 @@
+package headerchain
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+)
+
+var (
+	bigOne = big.NewInt(1)
+
+	// 2^256, for converting targets into amounts of work
+	oneLsh256 = new(big.Int).Lsh(bigOne, 256)
+)
+
+// CompactToBig converts the compact 'bits' encoding of a target into the full number. The compact
+// form is like floating point: the top byte is the length of the number in bytes, and the lower
+// three bytes the most significant digits. Bit 23 is a sign bit.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		n = big.NewInt(int64(mantissa))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+
+	if negative {
+		n.Neg(n)
+	}
+	return n
+}
+
+// BigToCompact converts a target into its compact 'bits' encoding, losing all but the most
+// significant three bytes of precision.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+
+	// The mantissa is signed, so if its top bit is set, shift it down and make the number longer
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// CalcWork is the expected number of hashes needed to find a block with the given target bits,
+// which is 2^256 / (target + 1).
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	denominator := new(big.Int).Add(target, bigOne)
+	return new(big.Int).Div(oneLsh256, denominator)
+}
+
+// retargetInterval is the number of blocks between difficulty adjustments.
+func retargetInterval(params *config.Params) int32 {
+	return int32(params.TargetTimespan / params.TargetSpacing)
+}
+
+// calcNextRequiredBits works out the target bits the block after prev must have.
+func (c *HeaderChain) calcNextRequiredBits(prev *HeaderNode, newBlockTime time.Time) uint32 {
+	params := c.params
+	interval := retargetInterval(params)
+
+	// Only change once per difficulty adjustment interval
+	if (prev.Height+1)%interval != 0 {
+		if params.AllowMinDifficultyBlocks {
+			// If the new block's timestamp is more than twice the target spacing after the last
+			// one, it's allowed to be mined at the minimum difficulty
+			if newBlockTime.After(prev.Header.Time().Add(2 * params.TargetSpacing)) {
+				return params.PowLimitBits
+			}
+
+			// Otherwise it has the difficulty of the last block that wasn't a minimum difficulty one
+			node := prev
+			for node.Parent != nil && node.Height%interval != 0 && node.Header.Bits == params.PowLimitBits {
+				node = node.Parent
+			}
+			return node.Header.Bits
+		}
+		return prev.Header.Bits
+	}
+
+	if params.NoRetargeting {
+		return prev.Header.Bits
+	}
+
+	// Go back to the first block of the period. This is famously one block short of the whole
+	// period, but fixing it would be a hard fork.
+	first := c.ancestor(prev, prev.Height-(interval-1))
+
+	actualTimespan := prev.Header.Time().Sub(first.Header.Time())
+	actualTimespan = max(actualTimespan, params.TargetTimespan/4)
+	actualTimespan = min(actualTimespan, params.TargetTimespan*4)
+
+	// BIP94 retargets from the first block of the period, rather than the last, so a run of
+	// minimum difficulty blocks at the end of a period can't drag the real difficulty down
+	oldBits := prev.Header.Bits
+	if params.EnforceBIP94 {
+		oldBits = first.Header.Bits
+	}
+
+	newTarget := CompactToBig(oldBits)
+	newTarget.Mul(newTarget, big.NewInt(int64(actualTimespan/time.Second)))
+	newTarget.Div(newTarget, big.NewInt(int64(params.TargetTimespan/time.Second)))
+
+	if newTarget.Cmp(params.PowLimit) > 0 {
+		newTarget.Set(params.PowLimit)
+	}
+	return BigToCompact(newTarget)
+}
@@ -0,0 +1,125 @@
+package headerchain_test
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactToBig(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+		{0x1b0404cb, "404cb000000000000000000000000000000000000000000000000"},
+		{0x03123456, "123456"},
+		{0x02123456, "1234"},
+		{0x01003456, "0"},
+	}
+
+	for _, tt := range tests {
+		target, ok := new(big.Int).SetString(tt.target, 16)
+		require.True(t, ok)
+		assert.Zero(t, target.Cmp(headerchain.CompactToBig(tt.compact)), "%08x", tt.compact)
+	}
+
+	// The sign bit makes the target negative
+	assert.Zero(t, big.NewInt(-0x123456).Cmp(headerchain.CompactToBig(0x03923456)))
+}
+
+func TestBigToCompact(t *testing.T) {
+	for _, compact := range []uint32{0x1d00ffff, 0x207fffff, 0x1b0404cb, 0x03123456, 0x1e0377ae} {
+		assert.Equal(t, compact, headerchain.BigToCompact(headerchain.CompactToBig(compact)), "%08x", compact)
+	}
+
+	// A mantissa with its top bit set has to be shifted down, to keep it positive
+	assert.Equal(t, uint32(0x02008000), headerchain.BigToCompact(big.NewInt(0x80)))
+	assert.Equal(t, uint32(0), headerchain.BigToCompact(big.NewInt(0)))
+}
+
+func TestCalcWork(t *testing.T) {
+	// The genesis block's work is well known
+	assert.Equal(t, big.NewInt(0x100010001), headerchain.CalcWork(0x1d00ffff))
+	assert.Equal(t, big.NewInt(2), headerchain.CalcWork(0x207fffff))
+}
+
+func TestHeaderChain_Retarget(t *testing.T) {
+	// A network that retargets every ten blocks, with an easy enough limit that we can mine for it
+	params := config.RegTestParams
+	params.AllowMinDifficultyBlocks = false
+	params.NoRetargeting = false
+	params.TargetTimespan = 10 * params.TargetSpacing
+	params.PowLimit = headerchain.CompactToBig(0x207fffff)
+
+	chain := headerchain.New(&params)
+
+	// Blocks found twice as fast as they should be, so difficulty should double
+	headers := buildHeaders(t, &params, params.GenesisHeader, 9, params.TargetSpacing/2, 0)
+	_, err := chain.ProcessHeaders(headers)
+	require.NoError(t, err)
+
+	// The first nine periods' worth of time is measured from block 0 to block 9
+	expected := headerchain.CompactToBig(0x207fffff)
+	expected.Mul(expected, big.NewInt(int64(9*params.TargetSpacing/2/time.Second)))
+	expected.Div(expected, big.NewInt(int64(params.TargetTimespan/time.Second)))
+	expectedBits := headerchain.BigToCompact(expected)
+
+	next := proto.BlockHeader{
+		Version:   4,
+		PrevBlock: headers[8].BlockHash(),
+		Timestamp: headers[8].Timestamp + 300,
+		Bits:      0x207fffff,
+	}
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{mineHeader(t, next, &params)})
+	assertRuleError(t, err, headerchain.ErrUnexpectedDifficulty)
+
+	next.Bits = expectedBits
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{mineHeader(t, next, &params)})
+	require.NoError(t, err)
+	assert.Equal(t, int32(10), chain.Height())
+}
+
+func TestHeaderChain_MinDifficultyBlocks(t *testing.T) {
+	params := config.RegTestParams
+	params.NoRetargeting = false
+	params.TargetTimespan = 10 * params.TargetSpacing
+	params.PowLimit = headerchain.CompactToBig(0x207fffff)
+	params.PowLimitBits = 0x207fffff
+	chain := headerchain.New(&params)
+
+	// Get a harder difficulty going
+	headers := buildHeaders(t, &params, params.GenesisHeader, 9, params.TargetSpacing/4, 0)
+	_, err := chain.ProcessHeaders(headers)
+	require.NoError(t, err)
+	harder := headers[8]
+	harder.PrevBlock = harder.BlockHash()
+	harder.Timestamp += 60
+	harder.Bits = 0x201fffff
+	harder = mineHeader(t, harder, &params)
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{harder})
+	require.NoError(t, err)
+
+	// More than 20 minutes later, a block can drop to the minimum difficulty
+	easy := proto.BlockHeader{Version: 4, PrevBlock: harder.BlockHash(), Timestamp: harder.Timestamp + 1201, Bits: 0x207fffff}
+	easy = mineHeader(t, easy, &params)
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{easy})
+	require.NoError(t, err)
+
+	// But the one after that has to go back to the real difficulty
+	next := proto.BlockHeader{Version: 4, PrevBlock: easy.BlockHash(), Timestamp: easy.Timestamp + 60, Bits: 0x207fffff}
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{mineHeader(t, next, &params)})
+	assertRuleError(t, err, headerchain.ErrUnexpectedDifficulty)
+
+	next.Bits = 0x201fffff
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{mineHeader(t, next, &params)})
+	require.NoError(t, err)
+	assert.Equal(t, int32(12), chain.Height())
+}
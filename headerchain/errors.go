@@ -0,0 +1,86 @@
+package headerchain
+
+import "fmt"
+
+// ErrorCode identifies which consensus rule a header or block broke.
+type ErrorCode int
+
+const (
+	ErrDuplicateHeader ErrorCode = iota
+	ErrOrphanHeader
+	ErrInvalidAncestor
+	ErrBadTarget
+	ErrHighHash
+	ErrUnexpectedDifficulty
+	ErrTimeTooOld
+	ErrTimeTooNew
+	ErrTimewarpAttack
+	ErrObsoleteVersion
+	ErrNoTransactions
+	ErrBlockTooBig
+	ErrBlockWeightTooHigh
+	ErrFirstTxNotCoinbase
+	ErrMultipleCoinbases
+	ErrBadMerkleRoot
+	ErrMutatedBlock
+	ErrBadWitnessCommitment
+	ErrUnexpectedWitness
+	ErrNoTxInputs
+	ErrNoTxOutputs
+	ErrTxTooBig
+	ErrBadTxOutValue
+	ErrDuplicateTxInput
+	ErrBadCoinbaseScriptLen
+	ErrBadTxInput
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrDuplicateHeader:      "ErrDuplicateHeader",
+	ErrOrphanHeader:         "ErrOrphanHeader",
+	ErrInvalidAncestor:      "ErrInvalidAncestor",
+	ErrBadTarget:            "ErrBadTarget",
+	ErrHighHash:             "ErrHighHash",
+	ErrUnexpectedDifficulty: "ErrUnexpectedDifficulty",
+	ErrTimeTooOld:           "ErrTimeTooOld",
+	ErrTimeTooNew:           "ErrTimeTooNew",
+	ErrTimewarpAttack:       "ErrTimewarpAttack",
+	ErrObsoleteVersion:      "ErrObsoleteVersion",
+	ErrNoTransactions:       "ErrNoTransactions",
+	ErrBlockTooBig:          "ErrBlockTooBig",
+	ErrBlockWeightTooHigh:   "ErrBlockWeightTooHigh",
+	ErrFirstTxNotCoinbase:   "ErrFirstTxNotCoinbase",
+	ErrMultipleCoinbases:    "ErrMultipleCoinbases",
+	ErrBadMerkleRoot:        "ErrBadMerkleRoot",
+	ErrMutatedBlock:         "ErrMutatedBlock",
+	ErrBadWitnessCommitment: "ErrBadWitnessCommitment",
+	ErrUnexpectedWitness:    "ErrUnexpectedWitness",
+	ErrNoTxInputs:           "ErrNoTxInputs",
+	ErrNoTxOutputs:          "ErrNoTxOutputs",
+	ErrTxTooBig:             "ErrTxTooBig",
+	ErrBadTxOutValue:        "ErrBadTxOutValue",
+	ErrDuplicateTxInput:     "ErrDuplicateTxInput",
+	ErrBadCoinbaseScriptLen: "ErrBadCoinbaseScriptLen",
+	ErrBadTxInput:           "ErrBadTxInput",
+}
+
+func (e ErrorCode) String() string {
+	if s, ok := errorCodeStrings[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// RuleError is returned when a header or block breaks a consensus rule, as opposed to something going
+// wrong on our side.
+type RuleError struct {
+	Code        ErrorCode
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+func ruleError(code ErrorCode, format string, args ...any) RuleError {
+	return RuleError{Code: code, Description: fmt.Sprintf(format, args...)}
+}
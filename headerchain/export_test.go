@@ -0,0 +1,10 @@
+package headerchain
+
+import "time"
+
+// SetNow replaces the clock the chain checks header timestamps against.
+func (c *HeaderChain) SetNow(now func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
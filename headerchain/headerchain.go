@@ -0,0 +1,333 @@
+package headerchain
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pscott31/mynode/blockstore"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// How far in the future a header's timestamp may be.
+	MAX_FUTURE_BLOCK_TIME = 2 * time.Hour
+
+	// The number of previous blocks whose median timestamp a new block must be after.
+	MEDIAN_TIME_BLOCKS = 11
+
+	// BIP94: how far the first block of a difficulty period may be behind the last of the previous one.
+	MAX_TIMEWARP = 600 * time.Second
+)
+
+// Status records how far a header (and later, its block) has got through validation.
+type Status uint8
+
+const (
+	STATUS_VALID_HEADER Status = 1 << iota
+	STATUS_INVALID
+	STATUS_HAVE_DATA // The block's raw data is in the block store
+)
+
+// HeaderNode is a header in the index, along with what we've worked out about it.
+type HeaderNode struct {
+	Header proto.BlockHeader
+	Hash   proto.Hash
+	Height int32
+	Work   *big.Int // Total work of the chain up to and including this header
+	Parent *HeaderNode
+	Status Status
+	Data   blockstore.BlockLocation // Where the block's data is, if we have it
+}
+
+// HeaderChain is an index of every valid header we know about, tracking which chain of them has
+// the most cumulative proof of work.
+type HeaderChain struct {
+	mu     sync.RWMutex
+	params *config.Params
+	now    func() time.Time
+
+	index     map[proto.Hash]*HeaderNode
+	bestChain []*HeaderNode // The chain with the most work, indexed by height
+
+	// Where headers are persisted, if anywhere.
+	store *blockstore.Store
+}
+
+// New creates a header chain containing just the network's genesis header, which is only kept in
+// memory. Use Load for one that persists.
+func New(params *config.Params) *HeaderChain {
+	genesis := &HeaderNode{
+		Header: params.GenesisHeader,
+		Hash:   params.GenesisHash,
+		Height: 0,
+		Work:   CalcWork(params.GenesisHeader.Bits),
+		Status: STATUS_VALID_HEADER,
+	}
+
+	return &HeaderChain{
+		params:    params,
+		now:       time.Now,
+		index:     map[proto.Hash]*HeaderNode{genesis.Hash: genesis},
+		bestChain: []*HeaderNode{genesis},
+	}
+}
+
+// Params are the parameters of the network the chain is for.
+func (c *HeaderChain) Params() *config.Params {
+	return c.params
+}
+
+// Tip is the last header of the chain with the most work.
+func (c *HeaderChain) Tip() *HeaderNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bestChain[len(c.bestChain)-1]
+}
+
+// Height is the height of the tip of the chain with the most work.
+func (c *HeaderChain) Height() int32 {
+	return c.Tip().Height
+}
+
+// LookupNode finds a header by its hash, returning nil if we don't know about it.
+func (c *HeaderChain) LookupNode(hash proto.Hash) *HeaderNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.index[hash]
+}
+
+// NodeAtHeight returns the header at the given height on the chain with the most work, or nil if
+// the chain isn't that long.
+func (c *HeaderChain) NodeAtHeight(height int32) *HeaderNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if height < 0 || int(height) >= len(c.bestChain) {
+		return nil
+	}
+	return c.bestChain[height]
+}
+
+// InBestChain reports whether the header is part of the chain with the most work.
+func (c *HeaderChain) InBestChain(node *HeaderNode) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inBestChain(node)
+}
+
+func (c *HeaderChain) inBestChain(node *HeaderNode) bool {
+	return int(node.Height) < len(c.bestChain) && c.bestChain[node.Height] == node
+}
+
+// BlockLocator describes the chain with the most work to another node, so it can work out where
+// our chains diverge. It lists the last ten hashes, then exponentially further apart, ending with
+// the genesis block.
+func (c *HeaderChain) BlockLocator() []proto.Hash {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var locator []proto.Hash
+	step := int32(1)
+	for height := int32(len(c.bestChain) - 1); height > 0; height -= step {
+		locator = append(locator, c.bestChain[height].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, c.bestChain[0].Hash)
+}
+
+// FindFork returns the first header in the locator that's on the chain with the most work, or the
+// genesis header if there isn't one.
+func (c *HeaderChain) FindFork(locator []proto.Hash) *HeaderNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, hash := range locator {
+		if node, ok := c.index[hash]; ok && c.inBestChain(node) {
+			return node
+		}
+	}
+	return c.bestChain[0]
+}
+
+// LocateHeaders returns the best chain headers following the fork point with the locator, up to
+// and including hashStop or maxHeaders of them, whichever comes first. It's what we send in reply
+// to a 'getheaders'.
+func (c *HeaderChain) LocateHeaders(locator []proto.Hash, hashStop proto.Hash, maxHeaders int) []proto.BlockHeader {
+	fork := c.FindFork(locator)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// The best chain may have changed since we found the fork, in which case start from genesis
+	if !c.inBestChain(fork) {
+		fork = c.bestChain[0]
+	}
+
+	var headers []proto.BlockHeader
+	for height := int(fork.Height) + 1; height < len(c.bestChain) && len(headers) < maxHeaders; height++ {
+		node := c.bestChain[height]
+		headers = append(headers, node.Header)
+		if node.Hash == hashStop {
+			break
+		}
+	}
+	return headers
+}
+
+// ProcessHeaders validates headers and adds them to the index, switching to a new best chain if they
+// give one with more work. Headers must be in order and connect to one we already know about. It
+// returns the number of headers that were new to us; if a header is invalid, it stops there and
+// returns a RuleError.
+func (c *HeaderChain) ProcessHeaders(headers []proto.BlockHeader) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added := 0
+	for _, header := range headers {
+		isNew, err := c.processHeader(header)
+		if err != nil {
+			return added, errors.Join(err, c.flush())
+		}
+		if isNew {
+			added++
+		}
+	}
+	return added, c.flush()
+}
+
+func (c *HeaderChain) processHeader(header proto.BlockHeader) (bool, error) {
+	hash := header.BlockHash()
+	if existing, ok := c.index[hash]; ok {
+		if existing.Status&STATUS_INVALID != 0 {
+			return false, ruleError(ErrDuplicateHeader, "header %s was previously found to be invalid", hash)
+		}
+		return false, nil
+	}
+
+	prev, ok := c.index[header.PrevBlock]
+	if !ok {
+		return false, ruleError(ErrOrphanHeader, "previous header %s of header %s is unknown", header.PrevBlock, hash)
+	}
+
+	node := &HeaderNode{
+		Header: header,
+		Hash:   hash,
+		Height: prev.Height + 1,
+		Work:   new(big.Int).Add(prev.Work, CalcWork(header.Bits)),
+		Parent: prev,
+	}
+
+	if err := c.checkHeader(node); err != nil {
+		// A header from too far in the future may be fine once the time catches up with it, so it
+		// isn't kept
+		var ruleErr RuleError
+		if errors.As(err, &ruleErr) && ruleErr.Code == ErrTimeTooNew {
+			return false, err
+		}
+
+		// Otherwise remember that it's bad, so we don't bother with it or its descendants again
+		node.Status = STATUS_INVALID
+		c.index[hash] = node
+		return false, errors.Join(err, c.putNode(node))
+	}
+
+	node.Status = STATUS_VALID_HEADER
+	c.index[hash] = node
+	if err := c.putNode(node); err != nil {
+		return false, err
+	}
+
+	if node.Work.Cmp(c.bestChain[len(c.bestChain)-1].Work) > 0 {
+		c.setTip(node)
+	}
+	return true, nil
+}
+
+// InvalidateBlock records that a block broke the consensus rules, which makes every block built
+// on it invalid too, and moves the best chain to the valid header with the most work.
+func (c *HeaderChain) InvalidateBlock(node *HeaderNode) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, n := range c.index {
+		if n.Status&STATUS_INVALID != 0 || n.Height < node.Height || c.ancestor(n, node.Height) != node {
+			continue
+		}
+		n.Status |= STATUS_INVALID
+		if err := c.putNode(n); err != nil {
+			return err
+		}
+	}
+
+	// Prefer what's left of the current best chain if nothing else has more work
+	best := node.Parent
+	for _, n := range c.index {
+		if n.Status&STATUS_INVALID == 0 && n.Work.Cmp(best.Work) > 0 {
+			best = n
+		}
+	}
+	c.setTip(best)
+	return c.flush()
+}
+
+// setTip makes node the tip of the best chain, replacing any headers after the fork point.
+func (c *HeaderChain) setTip(node *HeaderNode) {
+	// Walk back to where the new chain joins the current one
+	var branch []*HeaderNode
+	for n := node; !c.inBestChain(n); n = n.Parent {
+		branch = append(branch, n)
+	}
+
+	forkHeight := node.Height - int32(len(branch))
+	c.bestChain = c.bestChain[:forkHeight+1]
+	for i := len(branch) - 1; i >= 0; i-- {
+		c.bestChain = append(c.bestChain, branch[i])
+	}
+}
+
+// Ancestor returns the header at the given height on the chain leading up to node, or nil if the
+// height is out of range.
+func (c *HeaderChain) Ancestor(node *HeaderNode, height int32) *HeaderNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ancestor(node, height)
+}
+
+// ancestor walks back from node to the header at the given height.
+func (c *HeaderChain) ancestor(node *HeaderNode, height int32) *HeaderNode {
+	if height < 0 || height > node.Height {
+		return nil
+	}
+
+	// Headers on the best chain can be looked up directly, which is the usual case while syncing
+	for node.Height > height {
+		if c.inBestChain(node) {
+			return c.bestChain[height]
+		}
+		node = node.Parent
+	}
+	return node
+}
+
+// medianTimePast is the median timestamp of the header and the ones before it.
+func medianTimePast(node *HeaderNode) time.Time {
+	timestamps := make([]uint32, 0, MEDIAN_TIME_BLOCKS)
+	for n := node; n != nil && len(timestamps) < MEDIAN_TIME_BLOCKS; n = n.Parent {
+		timestamps = append(timestamps, n.Header.Timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return time.Unix(int64(timestamps[len(timestamps)/2]), 0)
+}
+
+// MedianTimePast is the median timestamp of the header and the ten before it, which the next
+// block's timestamp must be after.
+func (n *HeaderNode) MedianTimePast() time.Time {
+	return medianTimePast(n)
+}
@@ -0,0 +1,277 @@
+package headerchain_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mineHeader finds a nonce that gives the header a hash below its target. With regtest's
+// difficulty this takes a couple of goes on average.
+func mineHeader(t *testing.T, header proto.BlockHeader, powLimit *config.Params) proto.BlockHeader {
+	t.Helper()
+	for nonce := uint32(0); ; nonce++ {
+		header.Nonce = nonce
+		if headerchain.CheckProofOfWork(header, powLimit.PowLimit) == nil {
+			return header
+		}
+		require.Less(t, nonce, uint32(1_000_000), "unable to mine header")
+	}
+}
+
+// buildHeaders mines n headers on top of prev, spaced spacing apart.
+func buildHeaders(t *testing.T, params *config.Params, prev proto.BlockHeader, n int, spacing time.Duration, tag byte) []proto.BlockHeader {
+	t.Helper()
+	headers := make([]proto.BlockHeader, 0, n)
+	for i := 0; i < n; i++ {
+		header := proto.BlockHeader{
+			Version:    4,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: proto.DoubleSHA256([]byte{tag, byte(i)}),
+			Timestamp:  prev.Timestamp + uint32(spacing/time.Second),
+			Bits:       prev.Bits,
+		}
+		header = mineHeader(t, header, params)
+		headers = append(headers, header)
+		prev = header
+	}
+	return headers
+}
+
+func TestHeaderChain_Genesis(t *testing.T) {
+	chain := headerchain.New(&config.RegTestParams)
+
+	tip := chain.Tip()
+	assert.Equal(t, config.RegTestParams.GenesisHash, tip.Hash)
+	assert.Equal(t, int32(0), tip.Height)
+	assert.Equal(t, []proto.Hash{config.RegTestParams.GenesisHash}, chain.BlockLocator())
+}
+
+func TestHeaderChain_ProcessHeaders(t *testing.T) {
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	headers := buildHeaders(t, params, params.GenesisHeader, 30, 10*time.Minute, 0)
+	added, err := chain.ProcessHeaders(headers)
+	require.NoError(t, err)
+	assert.Equal(t, 30, added)
+
+	tip := chain.Tip()
+	assert.Equal(t, int32(30), tip.Height)
+	assert.Equal(t, headers[29].BlockHash(), tip.Hash)
+	assert.Equal(t, headers[9].BlockHash(), chain.NodeAtHeight(10).Hash)
+	assert.Nil(t, chain.NodeAtHeight(31))
+
+	// Processing them again is harmless
+	added, err = chain.ProcessHeaders(headers)
+	require.NoError(t, err)
+	assert.Equal(t, 0, added)
+
+	// The locator has the last ten, then exponentially spaced hashes back to genesis
+	locator := chain.BlockLocator()
+	expectedHeights := []int32{30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0}
+	require.Len(t, locator, len(expectedHeights))
+	for i, height := range expectedHeights {
+		assert.Equal(t, chain.NodeAtHeight(height).Hash, locator[i], "locator entry %d", i)
+	}
+
+	assert.Equal(t, chain.NodeAtHeight(21), chain.FindFork([]proto.Hash{proto.DoubleSHA256([]byte("unknown")), locator[9]}))
+	assert.Equal(t, chain.NodeAtHeight(0), chain.FindFork(nil))
+}
+
+func TestHeaderChain_Reorg(t *testing.T) {
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	mainChain := buildHeaders(t, params, params.GenesisHeader, 10, 10*time.Minute, 0)
+	_, err := chain.ProcessHeaders(mainChain)
+	require.NoError(t, err)
+
+	// A shorter fork doesn't take over
+	fork := buildHeaders(t, params, mainChain[4], 3, 9*time.Minute, 1)
+	_, err = chain.ProcessHeaders(fork)
+	require.NoError(t, err)
+	assert.Equal(t, mainChain[9].BlockHash(), chain.Tip().Hash)
+	assert.False(t, chain.InBestChain(chain.LookupNode(fork[0].BlockHash())))
+
+	// But once it has more work, it does
+	fork = append(fork, buildHeaders(t, params, fork[2], 3, 9*time.Minute, 1)...)
+	_, err = chain.ProcessHeaders(fork[3:])
+	require.NoError(t, err)
+	assert.Equal(t, fork[5].BlockHash(), chain.Tip().Hash)
+	assert.Equal(t, int32(11), chain.Height())
+	assert.Equal(t, mainChain[4].BlockHash(), chain.NodeAtHeight(5).Hash)
+	assert.Equal(t, fork[0].BlockHash(), chain.NodeAtHeight(6).Hash)
+	assert.True(t, chain.InBestChain(chain.LookupNode(fork[0].BlockHash())))
+	assert.False(t, chain.InBestChain(chain.LookupNode(mainChain[5].BlockHash())))
+
+	// Ancestors are found on the stale branch as well as the best chain
+	stale := chain.LookupNode(mainChain[9].BlockHash())
+	assert.Equal(t, mainChain[6].BlockHash(), chain.Ancestor(stale, 7).Hash)
+	assert.Equal(t, mainChain[2].BlockHash(), chain.Ancestor(stale, 3).Hash)
+	assert.Equal(t, fork[1].BlockHash(), chain.Ancestor(chain.Tip(), 7).Hash)
+	assert.Nil(t, chain.Ancestor(stale, 11))
+}
+
+func assertRuleError(t *testing.T, err error, code headerchain.ErrorCode) {
+	t.Helper()
+	var ruleErr headerchain.RuleError
+	require.True(t, errors.As(err, &ruleErr), "expected a rule error, got %v", err)
+	assert.Equal(t, code, ruleErr.Code, ruleErr.Description)
+}
+
+func TestHeaderChain_InvalidHeaders(t *testing.T) {
+	params := &config.RegTestParams
+	genesis := params.GenesisHeader
+	valid := buildHeaders(t, params, genesis, 1, 10*time.Minute, 0)[0]
+
+	tests := []struct {
+		name   string
+		header func() proto.BlockHeader
+		code   headerchain.ErrorCode
+	}{
+		{"orphan", func() proto.BlockHeader {
+			h := valid
+			h.PrevBlock = proto.DoubleSHA256([]byte("unknown"))
+			return h
+		}, headerchain.ErrOrphanHeader},
+		{"hash above target", func() proto.BlockHeader {
+			h := valid
+			for headerchain.CheckProofOfWork(h, params.PowLimit) == nil {
+				h.Nonce++
+			}
+			return h
+		}, headerchain.ErrHighHash},
+		{"target easier than limit", func() proto.BlockHeader {
+			h := valid
+			h.Bits = 0x2100ffff
+			return h
+		}, headerchain.ErrBadTarget},
+		{"unexpected difficulty", func() proto.BlockHeader {
+			h := valid
+			h.Bits = 0x1f7fffff
+			return mineHeader(t, h, params)
+		}, headerchain.ErrUnexpectedDifficulty},
+		{"timestamp not after median time past", func() proto.BlockHeader {
+			h := valid
+			h.Timestamp = genesis.Timestamp
+			return mineHeader(t, h, params)
+		}, headerchain.ErrTimeTooOld},
+		{"timestamp too far in the future", func() proto.BlockHeader {
+			h := valid
+			h.Timestamp = uint32(time.Now().Add(3 * time.Hour).Unix())
+			return mineHeader(t, h, params)
+		}, headerchain.ErrTimeTooNew},
+		{"obsolete version", func() proto.BlockHeader {
+			h := valid
+			h.Version = 1
+			return mineHeader(t, h, params)
+		}, headerchain.ErrObsoleteVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := headerchain.New(params)
+			added, err := chain.ProcessHeaders([]proto.BlockHeader{tt.header()})
+			assert.Equal(t, 0, added)
+			assertRuleError(t, err, tt.code)
+			assert.Equal(t, int32(0), chain.Height())
+		})
+	}
+}
+
+func TestHeaderChain_InvalidAncestor(t *testing.T) {
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	bad := params.GenesisHeader
+	bad.PrevBlock = params.GenesisHash
+	bad.Version = 1
+	bad.Timestamp += 600
+	bad = mineHeader(t, bad, params)
+
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{bad})
+	assertRuleError(t, err, headerchain.ErrObsoleteVersion)
+
+	// The bad header is remembered, as are its descendants
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{bad})
+	assertRuleError(t, err, headerchain.ErrDuplicateHeader)
+
+	child := buildHeaders(t, params, bad, 1, 10*time.Minute, 0)
+	_, err = chain.ProcessHeaders(child)
+	assertRuleError(t, err, headerchain.ErrInvalidAncestor)
+}
+
+func TestHeaderChain_FutureHeader(t *testing.T) {
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	header := buildHeaders(t, params, params.GenesisHeader, 1, 10*time.Minute, 0)[0]
+	header.Timestamp = uint32(time.Now().Add(3 * time.Hour).Unix())
+	header = mineHeader(t, header, params)
+
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{header})
+	assertRuleError(t, err, headerchain.ErrTimeTooNew)
+	assert.Nil(t, chain.LookupNode(header.BlockHash()))
+
+	// It isn't held against it once the time catches up
+	chain.SetNow(func() time.Time { return time.Now().Add(2 * time.Hour) })
+	added, err := chain.ProcessHeaders([]proto.BlockHeader{header})
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, header.BlockHash(), chain.Tip().Hash)
+}
+
+func TestHeaderChain_InvalidateBlock(t *testing.T) {
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	mainChain := buildHeaders(t, params, params.GenesisHeader, 6, 10*time.Minute, 0)
+	fork := buildHeaders(t, params, mainChain[1], 3, 9*time.Minute, 1)
+	_, err := chain.ProcessHeaders(append(mainChain, fork...))
+	require.NoError(t, err)
+	require.Equal(t, mainChain[5].BlockHash(), chain.Tip().Hash)
+
+	// The best chain falls back to the fork, which now has the most work
+	bad := chain.LookupNode(mainChain[3].BlockHash())
+	require.NoError(t, chain.InvalidateBlock(bad))
+	assert.Equal(t, fork[2].BlockHash(), chain.Tip().Hash)
+	assert.Equal(t, int32(5), chain.Height())
+	assert.NotZero(t, chain.LookupNode(mainChain[5].BlockHash()).Status&headerchain.STATUS_INVALID)
+	assert.Zero(t, chain.LookupNode(mainChain[2].BlockHash()).Status&headerchain.STATUS_INVALID)
+
+	// Nothing can be built on the invalid block
+	child := buildHeaders(t, params, mainChain[5], 1, 10*time.Minute, 2)
+	_, err = chain.ProcessHeaders(child)
+	assertRuleError(t, err, headerchain.ErrInvalidAncestor)
+
+	// Invalidating the fork leaves what's left of the original chain
+	require.NoError(t, chain.InvalidateBlock(chain.LookupNode(fork[0].BlockHash())))
+	assert.Equal(t, mainChain[2].BlockHash(), chain.Tip().Hash)
+}
+
+func TestHeaderChain_LocateHeaders(t *testing.T) {
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	headers := buildHeaders(t, params, params.GenesisHeader, 10, 10*time.Minute, 0)
+	_, err := chain.ProcessHeaders(headers)
+	require.NoError(t, err)
+
+	// Starting from genesis
+	assert.Equal(t, headers, chain.LocateHeaders(nil, proto.Hash{}, proto.MAX_HEADERS_RESULTS))
+
+	// Starting from part way along, limited in number or by the stop hash
+	locator := []proto.Hash{headers[3].BlockHash()}
+	assert.Equal(t, headers[4:6], chain.LocateHeaders(locator, proto.Hash{}, 2))
+	assert.Equal(t, headers[4:8], chain.LocateHeaders(locator, headers[7].BlockHash(), proto.MAX_HEADERS_RESULTS))
+
+	// When they're up to date, there's nothing to send
+	assert.Empty(t, chain.LocateHeaders([]proto.Hash{headers[9].BlockHash()}, proto.Hash{}, proto.MAX_HEADERS_RESULTS))
+}
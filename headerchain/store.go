@@ -0,0 +1,153 @@
+package headerchain
+
+import (
+	"fmt"
+
+	"github.com/pscott31/mynode/blockstore"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/proto"
+)
+
+// Load creates a header chain that persists to the store, starting with whatever headers were
+// saved there last time.
+func Load(params *config.Params, store *blockstore.Store) (*HeaderChain, error) {
+	c := New(params)
+	c.store = store
+
+	entries := store.Entries()
+	if len(entries) == 0 {
+		// A fresh store, so start it off with the genesis header
+		if err := c.putNode(c.bestChain[0]); err != nil {
+			return nil, err
+		}
+		return c, c.flush()
+	}
+
+	if hash := entries[0].Header.BlockHash(); hash != params.GenesisHash {
+		return nil, fmt.Errorf("block store starts with %s rather than the %s genesis block", hash, params.Name)
+	}
+	genesis := c.bestChain[0]
+	genesis.Status = Status(entries[0].Status)
+	genesis.Data = entries[0].Data
+
+	// Headers are always stored after their parent, so each can be linked up as it's read
+	best := genesis
+	for _, entry := range entries[1:] {
+		hash := entry.Header.BlockHash()
+		parent, ok := c.index[entry.Header.PrevBlock]
+		if !ok {
+			return nil, fmt.Errorf("stored header %s has unknown parent %s", hash, entry.Header.PrevBlock)
+		}
+		if entry.Height != parent.Height+1 {
+			return nil, fmt.Errorf("stored header %s has height %d but its parent has %d", hash, entry.Height, parent.Height)
+		}
+
+		node := &HeaderNode{
+			Header: entry.Header,
+			Hash:   hash,
+			Height: entry.Height,
+			Work:   entry.Work,
+			Parent: parent,
+			Status: Status(entry.Status),
+			Data:   entry.Data,
+		}
+		if node.Data.IsZero() {
+			// The data didn't make it to disk before a crash
+			node.Status &^= STATUS_HAVE_DATA
+		}
+		c.index[hash] = node
+
+		if node.Status&STATUS_INVALID == 0 && node.Work.Cmp(best.Work) > 0 {
+			best = node
+		}
+	}
+
+	c.setTip(best)
+	return c, nil
+}
+
+// putNode saves the header to the store, if there is one. It's not guaranteed to be on disk until
+// flush is called.
+func (c *HeaderChain) putNode(node *HeaderNode) error {
+	if c.store == nil {
+		return nil
+	}
+
+	entry := blockstore.IndexEntry{
+		Header: node.Header,
+		Height: node.Height,
+		Work:   node.Work,
+		Status: uint8(node.Status),
+		Data:   node.Data,
+	}
+	if err := c.store.PutEntry(entry); err != nil {
+		return fmt.Errorf("unable to store header %s: %w", node.Hash, err)
+	}
+	return nil
+}
+
+// flush makes sure everything stored so far is on disk.
+func (c *HeaderChain) flush() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Flush()
+}
+
+// StoreBlock saves a block's raw data, which must be for a header we already know about.
+func (c *HeaderChain) StoreBlock(hash proto.Hash, raw []byte) error {
+	if c.store == nil {
+		return fmt.Errorf("no block store to save block %s in", hash)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.index[hash]
+	if !ok {
+		return fmt.Errorf("block %s has no known header", hash)
+	}
+	if node.Status&STATUS_HAVE_DATA != 0 {
+		return nil
+	}
+
+	loc, err := c.store.WriteBlock(raw)
+	if err != nil {
+		return err
+	}
+	node.Data = loc
+	node.Status |= STATUS_HAVE_DATA
+
+	if err := c.putNode(node); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// HaveBlock reports whether we have the block's data.
+func (c *HeaderChain) HaveBlock(hash proto.Hash) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	node, ok := c.index[hash]
+	return ok && node.Status&STATUS_HAVE_DATA != 0
+}
+
+// ReadBlock returns a block's raw data, if we have it.
+func (c *HeaderChain) ReadBlock(hash proto.Hash) ([]byte, error) {
+	if c.store == nil {
+		return nil, fmt.Errorf("no block store to read block %s from", hash)
+	}
+
+	c.mu.RLock()
+	node, ok := c.index[hash]
+	var loc blockstore.BlockLocation
+	if ok {
+		loc = node.Data
+	}
+	c.mu.RUnlock()
+
+	if !ok || loc.IsZero() {
+		return nil, fmt.Errorf("don't have block %s", hash)
+	}
+	return c.store.ReadBlock(loc)
+}
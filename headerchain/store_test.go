@@ -0,0 +1,93 @@
+package headerchain_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/blockstore"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T, dir string) *blockstore.Store {
+	t.Helper()
+	store, err := blockstore.Open(dir, config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	return store
+}
+
+func TestLoad_ResumesChain(t *testing.T) {
+	params := &config.RegTestParams
+	dir := t.TempDir()
+
+	store := openStore(t, dir)
+	chain, err := headerchain.Load(params, store)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), chain.Height())
+
+	// A main chain, a shorter fork off it and an invalid header
+	mainChain := buildHeaders(t, params, params.GenesisHeader, 10, 10*time.Minute, 0)
+	_, err = chain.ProcessHeaders(mainChain)
+	require.NoError(t, err)
+	fork := buildHeaders(t, params, mainChain[4], 3, 9*time.Minute, 1)
+	_, err = chain.ProcessHeaders(fork)
+	require.NoError(t, err)
+	bad := mainChain[9]
+	bad.PrevBlock = mainChain[9].BlockHash()
+	bad.Version = 1
+	bad = mineHeader(t, bad, params)
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{bad})
+	assertRuleError(t, err, headerchain.ErrObsoleteVersion)
+
+	require.NoError(t, chain.StoreBlock(mainChain[0].BlockHash(), []byte("raw block")))
+	require.NoError(t, store.Close())
+
+	// Everything is as we left it
+	store = openStore(t, dir)
+	defer store.Close()
+	chain, err = headerchain.Load(params, store)
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(10), chain.Height())
+	assert.Equal(t, mainChain[9].BlockHash(), chain.Tip().Hash)
+	assert.Equal(t, mainChain[3].BlockHash(), chain.NodeAtHeight(4).Hash)
+
+	forkTip := chain.LookupNode(fork[2].BlockHash())
+	require.NotNil(t, forkTip)
+	assert.Equal(t, int32(8), forkTip.Height)
+	assert.False(t, chain.InBestChain(forkTip))
+
+	_, err = chain.ProcessHeaders([]proto.BlockHeader{bad})
+	assertRuleError(t, err, headerchain.ErrDuplicateHeader)
+
+	node := chain.LookupNode(mainChain[0].BlockHash())
+	assert.Equal(t, headerchain.STATUS_VALID_HEADER|headerchain.STATUS_HAVE_DATA, node.Status)
+	raw, err := chain.ReadBlock(node.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("raw block"), raw)
+
+	_, err = chain.ReadBlock(mainChain[1].BlockHash())
+	assert.Error(t, err)
+
+	// And carries on from there
+	more := buildHeaders(t, params, mainChain[9], 2, 10*time.Minute, 2)
+	_, err = chain.ProcessHeaders(more)
+	require.NoError(t, err)
+	assert.Equal(t, int32(12), chain.Height())
+}
+
+func TestLoad_WrongNetwork(t *testing.T) {
+	dir := t.TempDir()
+	store := openStore(t, dir)
+	_, err := headerchain.Load(&config.RegTestParams, store)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store = openStore(t, dir)
+	defer store.Close()
+	_, err = headerchain.Load(&config.TestNet3Params, store)
+	assert.ErrorContains(t, err, "genesis")
+}
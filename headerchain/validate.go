@@ -0,0 +1,88 @@
+package headerchain
+
+import (
+	"math/big"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+// HashToBig interprets a hash as a little endian number, for comparing against a target.
+func HashToBig(hash proto.Hash) *big.Int {
+	var reversed proto.Hash
+	for i := range hash {
+		reversed[i] = hash[proto.HASH_SIZE-1-i]
+	}
+	return new(big.Int).SetBytes(reversed[:])
+}
+
+// CheckProofOfWork checks the header's hash meets the target in its bits, and that the target is
+// no easier than the network allows.
+func CheckProofOfWork(header proto.BlockHeader, powLimit *big.Int) error {
+	target := CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return ruleError(ErrBadTarget, "target %064x is not positive", target)
+	}
+	if target.Cmp(powLimit) > 0 {
+		return ruleError(ErrBadTarget, "target %064x is easier than the network's limit %064x", target, powLimit)
+	}
+
+	hash := header.BlockHash()
+	if HashToBig(hash).Cmp(target) > 0 {
+		return ruleError(ErrHighHash, "hash %s is above the target %064x", hash, target)
+	}
+	return nil
+}
+
+// checkHeader checks a new header against the consensus rules, both on its own and in the context
+// of the chain it's building on.
+func (c *HeaderChain) checkHeader(node *HeaderNode) error {
+	header := node.Header
+	prev := node.Parent
+
+	if prev.Status&STATUS_INVALID != 0 {
+		return ruleError(ErrInvalidAncestor, "header %s builds on invalid header %s", node.Hash, prev.Hash)
+	}
+
+	if err := CheckProofOfWork(header, c.params.PowLimit); err != nil {
+		return err
+	}
+
+	// The difficulty must be exactly what the retargeting rules say
+	expectedBits := c.calcNextRequiredBits(prev, header.Time())
+	if header.Bits != expectedBits {
+		return ruleError(ErrUnexpectedDifficulty, "header %s at height %d has bits %08x, expected %08x", node.Hash, node.Height, header.Bits, expectedBits)
+	}
+
+	// Timestamps must move forward, at least on average
+	if mtp := medianTimePast(prev); !header.Time().After(mtp) {
+		return ruleError(ErrTimeTooOld, "header %s timestamp %v is not after median time past %v", node.Hash, header.Time(), mtp)
+	}
+
+	if maxTime := c.now().Add(MAX_FUTURE_BLOCK_TIME); header.Time().After(maxTime) {
+		return ruleError(ErrTimeTooNew, "header %s timestamp %v is too far in the future", node.Hash, header.Time())
+	}
+
+	// BIP94: the first block of a difficulty period can't be dated much before the last one of the
+	// previous period, which would let miners stretch the apparent length of the period
+	if c.params.EnforceBIP94 && node.Height%retargetInterval(c.params) == 0 {
+		if header.Time().Before(prev.Header.Time().Add(-MAX_TIMEWARP)) {
+			return ruleError(ErrTimewarpAttack, "header %s timestamp %v is too far before its parent's", node.Hash, header.Time())
+		}
+	}
+
+	// Once BIP34, BIP66 and BIP65 activated, blocks had to signal a version at least as new
+	for _, fork := range []struct {
+		height  int32
+		version int32
+	}{
+		{c.params.BIP34Height, 2},
+		{c.params.BIP66Height, 3},
+		{c.params.BIP65Height, 4},
+	} {
+		if node.Height >= fork.height && header.Version < fork.version {
+			return ruleError(ErrObsoleteVersion, "header %s at height %d has obsolete version %d", node.Hash, node.Height, header.Version)
+		}
+	}
+
+	return nil
+}
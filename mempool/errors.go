@@ -0,0 +1,55 @@
+package mempool
+
+import "fmt"
+
+// ErrorCode identifies why a transaction wasn't accepted into the pool.
+type ErrorCode int
+
+const (
+	ErrInvalid ErrorCode = iota
+	ErrNonStandard
+	ErrNonFinal
+	ErrDuplicate
+	ErrConflict
+	ErrReplacement
+	ErrMissingInputs
+	ErrInsufficientFee
+	ErrTooLongChain
+	ErrMempoolFull
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrInvalid:         "ErrInvalid",
+	ErrNonStandard:     "ErrNonStandard",
+	ErrNonFinal:        "ErrNonFinal",
+	ErrDuplicate:       "ErrDuplicate",
+	ErrConflict:        "ErrConflict",
+	ErrReplacement:     "ErrReplacement",
+	ErrMissingInputs:   "ErrMissingInputs",
+	ErrInsufficientFee: "ErrInsufficientFee",
+	ErrTooLongChain:    "ErrTooLongChain",
+	ErrMempoolFull:     "ErrMempoolFull",
+}
+
+func (e ErrorCode) String() string {
+	if s, ok := errorCodeStrings[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// RuleError is returned when a transaction is rejected, either because it breaks the consensus
+// rules or because it doesn't meet our policy for what to relay, as opposed to something going
+// wrong on our side.
+type RuleError struct {
+	Code        ErrorCode
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+func ruleError(code ErrorCode, format string, args ...any) RuleError {
+	return RuleError{Code: code, Description: fmt.Sprintf(format, args...)}
+}
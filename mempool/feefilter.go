@@ -0,0 +1,41 @@
+package mempool
+
+import (
+	"math/rand"
+	"sort"
+)
+
+const (
+	// The fee filters we send are rounded to one of a set of values, each this much more than the
+	// last, up to MAX_FEEFILTER_RATE, as per Bitcoin Core.
+	FEEFILTER_SPACING  = 1.1
+	MAX_FEEFILTER_RATE = 10_000_000
+)
+
+// FeeFilterRounder rounds the fee filters we send to peers, so that they don't give away exactly
+// what's in our pool: down to the nearest of a fixed set of rates, and usually one more step down
+// from there at random, as per Bitcoin Core.
+type FeeFilterRounder struct {
+	rates []FeeRate
+}
+
+// NewFeeFilterRounder creates a rounder whose smallest non-zero rate is half the incremental relay
+// fee rate.
+func NewFeeFilterRounder(incrementalFee FeeRate) *FeeFilterRounder {
+	rates := []FeeRate{0}
+	for rate := float64(max(1, incrementalFee/2)); rate <= MAX_FEEFILTER_RATE; rate *= FEEFILTER_SPACING {
+		if FeeRate(rate) > rates[len(rates)-1] {
+			rates = append(rates, FeeRate(rate))
+		}
+	}
+	return &FeeFilterRounder{rates: rates}
+}
+
+// Round returns the fee filter to send for the pool's minimum fee rate.
+func (r *FeeFilterRounder) Round(minFee FeeRate) FeeRate {
+	i := sort.Search(len(r.rates), func(i int) bool { return r.rates[i] >= minFee })
+	if i == len(r.rates) || (i > 0 && rand.Intn(3) != 0) {
+		i--
+	}
+	return r.rates[i]
+}
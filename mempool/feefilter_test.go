@@ -0,0 +1,29 @@
+package mempool_test
+
+import (
+	"testing"
+
+	"github.com/pscott31/mynode/mempool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeFilterRounder_Round(t *testing.T) {
+	rounder := mempool.NewFeeFilterRounder(mempool.INCREMENTAL_RELAY_FEE)
+
+	assert.Equal(t, mempool.FeeRate(0), rounder.Round(0))
+
+	// Rates beyond the largest always round down to it
+	largest := rounder.Round(mempool.MAX_FEEFILTER_RATE * 2)
+	assert.LessOrEqual(t, largest, mempool.FeeRate(mempool.MAX_FEEFILTER_RATE))
+	assert.Equal(t, largest, rounder.Round(mempool.MAX_FEEFILTER_RATE*3))
+
+	// Otherwise it's usually a step below the rate, but sometimes the rate itself, rounded up
+	seen := make(map[mempool.FeeRate]int)
+	for i := 0; i < 300; i++ {
+		seen[rounder.Round(1000)]++
+	}
+	assert.Len(t, seen, 2)
+	for rate := range seen {
+		assert.InDelta(t, 1000, float64(rate), 1000*0.21)
+	}
+}
@@ -0,0 +1,692 @@
+// Package mempool keeps the unconfirmed transactions we'd relay: those that would be valid in the
+// next block, and meet our policy for what's worth relaying. Transactions may spend the outputs of
+// others in the pool, so it tracks the packages they form, limiting how big they can get and
+// evicting the packages paying the lowest fee rate when it's full. A transaction that conflicts
+// with others in the pool replaces them if it pays enough more, as per BIP125, either only when
+// they signal they're replaceable or always (full-RBF).
+package mempool
+
+import (
+	"cmp"
+	"container/heap"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pscott31/mynode/blockchain"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/pscott31/mynode/utxo"
+)
+
+const (
+	// How much memory the pool may use by default, as per Bitcoin Core.
+	DEFAULT_MAX_MEMPOOL_SIZE = 300_000_000
+
+	// Limits on the packages of unconfirmed transactions, each counting the transaction itself: how
+	// many ancestors a transaction may have in the pool and their total virtual size, and likewise
+	// for the descendants of each of them.
+	DEFAULT_ANCESTOR_LIMIT        = 25
+	DEFAULT_ANCESTOR_SIZE_LIMIT   = 101_000
+	DEFAULT_DESCENDANT_LIMIT      = 25
+	DEFAULT_DESCENDANT_SIZE_LIMIT = 101_000
+
+	// Roughly how much memory each transaction in the pool takes besides its serialization.
+	TX_DESC_OVERHEAD = 400
+
+	// Each signature check counts as at least this many virtual bytes, so transactions can't
+	// fill blocks with checks cheaply.
+	DEFAULT_BYTES_PER_SIGOP = 20
+
+	// When the pool is full, the fee rate needed to get in is raised this much above that of what
+	// was evicted. Once blocks are being found, it halves every ROLLING_FEE_HALFLIFE, faster if
+	// the pool has emptied out.
+	INCREMENTAL_RELAY_FEE FeeRate = 1000
+	ROLLING_FEE_HALFLIFE          = 12 * time.Hour
+
+	// Whether to allow replacing transactions that don't signal for it, as per Bitcoin Core.
+	DEFAULT_FULL_RBF = true
+)
+
+// Chain is what the pool needs to know about the chain of validated blocks.
+type Chain interface {
+	Tip() *headerchain.HeaderNode
+	Params() *config.Params
+
+	// FetchUTXO returns an unspent output as of the tip, or nil if there isn't one.
+	FetchUTXO(op proto.OutPoint) (*utxo.Entry, error)
+
+	// SequenceLocksMet reports whether the transaction's BIP68 relative lock times would let it
+	// into the next block, given the heights of the outputs it spends.
+	SequenceLocksMet(tx *proto.Tx, prevHeights []int32) bool
+}
+
+// Policy is what the pool accepts beyond what the consensus rules require.
+type Policy struct {
+	MaxSize     int     // Roughly how much memory the pool may use, in bytes
+	MinRelayFee FeeRate // The lowest fee rate we'll accept, however empty the pool is
+	FullRBF     bool    // Whether transactions can be replaced without signalling it, per BIP125
+}
+
+// DefaultPolicy is Bitcoin Core's default policy.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxSize:     DEFAULT_MAX_MEMPOOL_SIZE,
+		MinRelayFee: DEFAULT_MIN_RELAY_TX_FEE,
+		FullRBF:     DEFAULT_FULL_RBF,
+	}
+}
+
+// TxDesc is a transaction in the pool.
+type TxDesc struct {
+	Tx          *proto.Tx
+	Hash        proto.Hash
+	WitnessHash proto.Hash
+	Fee         int64
+	VSize       int   // Including any penalty for signature checks
+	Height      int32 // The height of the tip when it was added
+	Added       time.Time
+
+	order     uint64 // When it was added relative to the others, as times can be equal
+	usage     int
+	parents   map[*TxDesc]struct{}
+	heapIndex int // Where it is in the pool's eviction order
+
+	// The transactions in the pool that spend its outputs, and totals for it and all its
+	// descendants
+	children        map[*TxDesc]struct{}
+	descendantCount int
+	descendantSize  int
+	descendantFees  int64
+}
+
+// FeeRate is the rate at which the transaction pays its fee.
+func (d *TxDesc) FeeRate() FeeRate {
+	return NewFeeRate(d.Fee, d.VSize)
+}
+
+// descendantFeeRate is the fee rate of the transaction together with its descendants, which is
+// what a miner would get for including them.
+func (d *TxDesc) descendantFeeRate() FeeRate {
+	return NewFeeRate(d.descendantFees, d.descendantSize)
+}
+
+// evictionOrder is a heap of the transactions in the pool with the one whose package pays the
+// lowest fee rate at the top, and of those paying the same, the one that arrived last.
+type evictionOrder []*TxDesc
+
+func (h evictionOrder) Len() int { return len(h) }
+
+func (h evictionOrder) Less(i, j int) bool {
+	if a, b := h[i].descendantFeeRate(), h[j].descendantFeeRate(); a != b {
+		return a < b
+	}
+	return h[i].order > h[j].order
+}
+
+func (h evictionOrder) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *evictionOrder) Push(x any) {
+	desc := x.(*TxDesc)
+	desc.heapIndex = len(*h)
+	*h = append(*h, desc)
+}
+
+func (h *evictionOrder) Pop() any {
+	old := *h
+	desc := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return desc
+}
+
+// TxPool is the pool of unconfirmed transactions. It follows the chain through the listeners
+// returned by Listeners, dropping transactions as they're confirmed or conflict with those that
+// are. It's safe for concurrent use.
+type TxPool struct {
+	chain  Chain
+	policy Policy
+	now    func() time.Time
+
+	mu            sync.Mutex
+	pool          map[proto.Hash]*TxDesc
+	byWitnessHash map[proto.Hash]*TxDesc
+	spent         map[proto.OutPoint]*TxDesc // Which transaction in the pool spends each output
+	byDescendants evictionOrder
+	usage         int
+	nextOrder     uint64
+
+	// The fee rate needed to get in since the pool was last full, and when it last decayed. It
+	// only starts decaying once a block has been found since it was raised.
+	rollingMinFee     FeeRate
+	rollingFeeUpdated time.Time
+	blockSinceBump    bool
+
+	// Blocks disconnected during a reorg, whose transactions go back in the pool once it's done
+	disconnected []*proto.Block
+}
+
+// New creates an empty pool of transactions that would be valid on top of the chain's tip.
+func New(chain Chain, policy Policy) *TxPool {
+	return &TxPool{
+		chain:         chain,
+		policy:        policy,
+		now:           time.Now,
+		pool:          make(map[proto.Hash]*TxDesc),
+		byWitnessHash: make(map[proto.Hash]*TxDesc),
+		spent:         make(map[proto.OutPoint]*TxDesc),
+	}
+}
+
+// Count is the number of transactions in the pool.
+func (mp *TxPool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.pool)
+}
+
+// Usage is roughly how much memory the transactions in the pool take, in bytes.
+func (mp *TxPool) Usage() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.usage
+}
+
+// HaveTransaction reports whether the pool has the transaction with the given txid or wtxid.
+func (mp *TxPool) HaveTransaction(hash proto.Hash) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	_, ok := mp.pool[hash]
+	if !ok {
+		_, ok = mp.byWitnessHash[hash]
+	}
+	return ok
+}
+
+// Lookup returns the transaction in the pool with the given txid or wtxid, or nil if there isn't
+// one.
+func (mp *TxPool) Lookup(hash proto.Hash) *TxDesc {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if desc, ok := mp.pool[hash]; ok {
+		return desc
+	}
+	return mp.byWitnessHash[hash]
+}
+
+// MinFee is the lowest fee rate a transaction must pay to be accepted: the minimum relay fee,
+// or more if the pool has recently been full.
+func (mp *TxPool) MinFee() FeeRate {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.minFee()
+}
+
+// MinRelayFee is the lowest fee rate a transaction must pay to be accepted, however empty the pool
+// is.
+func (mp *TxPool) MinRelayFee() FeeRate {
+	return mp.policy.MinRelayFee
+}
+
+func (mp *TxPool) minFee() FeeRate {
+	if mp.rollingMinFee == 0 || !mp.blockSinceBump {
+		return max(mp.rollingMinFee, mp.policy.MinRelayFee)
+	}
+
+	now := mp.now()
+	if elapsed := now.Sub(mp.rollingFeeUpdated); elapsed > 10*time.Second {
+		halflife := ROLLING_FEE_HALFLIFE
+		if mp.usage < mp.policy.MaxSize/4 {
+			halflife /= 4
+		} else if mp.usage < mp.policy.MaxSize/2 {
+			halflife /= 2
+		}
+
+		mp.rollingMinFee = FeeRate(float64(mp.rollingMinFee) / math.Pow(2, elapsed.Seconds()/halflife.Seconds()))
+		mp.rollingFeeUpdated = now
+		if mp.rollingMinFee < INCREMENTAL_RELAY_FEE/2 {
+			mp.rollingMinFee = 0
+		}
+	}
+	return max(mp.rollingMinFee, mp.policy.MinRelayFee)
+}
+
+// AcceptTransaction checks a transaction would be valid in the next block and meets our policy,
+// and if so adds it to the pool, evicting any it replaces. A transaction that isn't accepted gets
+// a RuleError saying why.
+func (mp *TxPool) AcceptTransaction(tx *proto.Tx) (*TxDesc, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.accept(tx)
+}
+
+func (mp *TxPool) accept(tx *proto.Tx) (*TxDesc, error) {
+	txHash := tx.TxHash()
+	if err := headerchain.CheckTransactionSanity(tx); err != nil {
+		return nil, ruleError(ErrInvalid, "%v", err)
+	}
+	if tx.IsCoinBase() {
+		return nil, ruleError(ErrInvalid, "transaction %s is a coinbase, which is only valid in a block", txHash)
+	}
+	if err := checkTransactionStandard(tx, txHash); err != nil {
+		return nil, err
+	}
+
+	tip := mp.chain.Tip()
+	nextHeight := tip.Height + 1
+	if !blockchain.IsFinalTx(tx, nextHeight, tip.MedianTimePast()) {
+		return nil, ruleError(ErrNonFinal, "transaction %s is locked until after the next block", txHash)
+	}
+
+	if _, ok := mp.pool[txHash]; ok {
+		return nil, ruleError(ErrDuplicate, "already have transaction %s", txHash)
+	}
+	conflicts, err := mp.conflictsOf(tx, txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	prevOuts, prevHeights, parents, fee, err := mp.fetchInputs(tx, txHash, nextHeight)
+	if err != nil {
+		return nil, err
+	}
+	if !mp.chain.SequenceLocksMet(tx, prevHeights) {
+		return nil, ruleError(ErrNonFinal, "transaction %s has a relative lock time that hasn't passed", txHash)
+	}
+	if err := checkInputsStandard(tx, txHash, prevOuts); err != nil {
+		return nil, err
+	}
+
+	sigOpCost := blockchain.TxSigOpCost(tx, prevOuts, STANDARD_SCRIPT_VERIFY_FLAGS)
+	if sigOpCost > MAX_STANDARD_TX_SIGOPS_COST {
+		return nil, ruleError(ErrNonStandard, "transaction %s has signature check cost %d, more than the standard %d", txHash, sigOpCost, MAX_STANDARD_TX_SIGOPS_COST)
+	}
+	vsize := max(tx.VSize(), (sigOpCost*DEFAULT_BYTES_PER_SIGOP+proto.WITNESS_SCALE_FACTOR-1)/proto.WITNESS_SCALE_FACTOR)
+
+	if minFee := mp.minFee(); fee < minFee.Fee(vsize) {
+		return nil, ruleError(ErrInsufficientFee, "transaction %s pays a fee of %d, less than the %d needed at %s", txHash, fee, minFee.Fee(vsize), minFee)
+	}
+
+	ancestors := mp.ancestorsOf(parents)
+	var evicted map[*TxDesc]struct{}
+	if len(conflicts) > 0 {
+		if evicted, err = mp.checkReplacement(txHash, fee, vsize, conflicts, parents, ancestors); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPackageLimits(txHash, vsize, ancestors); err != nil {
+		return nil, err
+	}
+
+	if err := mp.verifyScripts(tx, txHash, prevOuts, nextHeight); err != nil {
+		return nil, err
+	}
+
+	desc := &TxDesc{
+		Tx:          tx,
+		Hash:        txHash,
+		WitnessHash: tx.WitnessHash(),
+		Fee:         fee,
+		VSize:       vsize,
+		Height:      tip.Height,
+		Added:       mp.now(),
+		parents:     parents,
+	}
+	if len(evicted) > 0 {
+		var evictedFees int64
+		for replaced := range evicted {
+			evictedFees += replaced.Fee
+		}
+		for conflict := range conflicts {
+			if _, ok := mp.pool[conflict.Hash]; ok {
+				// It may have gone already, as a descendant of another
+				mp.removeWithDescendants(conflict)
+			}
+		}
+		log.Printf("transaction %s replaced %d transactions in the mempool, paying %d more in fees", txHash, len(evicted), fee-evictedFees)
+	}
+	mp.addTx(desc, ancestors)
+
+	mp.trimToSize()
+	if _, ok := mp.pool[txHash]; !ok {
+		return nil, ruleError(ErrMempoolFull, "mempool is full, and transaction %s doesn't pay enough to stay in it", txHash)
+	}
+	return desc, nil
+}
+
+// fetchInputs finds the outputs a transaction spends, in the pool or the UTXO set, and checks it
+// doesn't spend more than they're worth. It returns the outputs and the heights they were created
+// at, in input order, the transactions in the pool it spends, and the fee.
+func (mp *TxPool) fetchInputs(tx *proto.Tx, txHash proto.Hash, nextHeight int32) ([]proto.TxOut, []int32, map[*TxDesc]struct{}, int64, error) {
+	prevOuts := make([]proto.TxOut, len(tx.TxIn))
+	prevHeights := make([]int32, len(tx.TxIn))
+	parents := make(map[*TxDesc]struct{})
+
+	var totalIn int64
+	for i, in := range tx.TxIn {
+		op := in.PreviousOutPoint
+		if parent, ok := mp.pool[op.Hash]; ok {
+			if int(op.Index) >= len(parent.Tx.TxOut) {
+				return nil, nil, nil, 0, ruleError(ErrMissingInputs, "transaction %s input %d spends %s, which doesn't exist", txHash, i, op)
+			}
+			prevOuts[i] = parent.Tx.TxOut[op.Index]
+			prevHeights[i] = nextHeight
+			parents[parent] = struct{}{}
+		} else {
+			entry, err := mp.chain.FetchUTXO(op)
+			if err != nil {
+				return nil, nil, nil, 0, err
+			}
+			if entry == nil {
+				return nil, nil, nil, 0, mp.missingInput(tx, txHash, i)
+			}
+			if entry.IsCoinBase && nextHeight-entry.Height < blockchain.COINBASE_MATURITY {
+				return nil, nil, nil, 0, ruleError(ErrInvalid, "transaction %s input %d spends coinbase output %s from height %d before it has matured", txHash, i, op, entry.Height)
+			}
+			prevOuts[i] = proto.TxOut{Value: entry.Amount, PkScript: entry.PkScript}
+			prevHeights[i] = entry.Height
+		}
+
+		totalIn += prevOuts[i].Value
+		if prevOuts[i].Value < 0 || prevOuts[i].Value > headerchain.MAX_MONEY || totalIn > headerchain.MAX_MONEY {
+			return nil, nil, nil, 0, ruleError(ErrInvalid, "transaction %s input %d value is out of range", txHash, i)
+		}
+	}
+
+	// Output values have already been checked to be in range
+	var totalOut int64
+	for _, out := range tx.TxOut {
+		totalOut += out.Value
+	}
+	if totalIn < totalOut {
+		return nil, nil, nil, 0, ruleError(ErrInvalid, "transaction %s spends %d but its inputs are only worth %d", txHash, totalOut, totalIn)
+	}
+	return prevOuts, prevHeights, parents, totalIn - totalOut, nil
+}
+
+// missingInput explains why an input's output couldn't be found: usually we just haven't seen the
+// transaction it's from, but the transaction may itself already be confirmed.
+func (mp *TxPool) missingInput(tx *proto.Tx, txHash proto.Hash, idx int) error {
+	for i := range tx.TxOut {
+		entry, err := mp.chain.FetchUTXO(proto.OutPoint{Hash: txHash, Index: uint32(i)})
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			return ruleError(ErrDuplicate, "transaction %s is already confirmed", txHash)
+		}
+	}
+	return ruleError(ErrMissingInputs, "transaction %s input %d spends %s, which is missing or already spent", txHash, idx, tx.TxIn[idx].PreviousOutPoint)
+}
+
+// checkPackageLimits checks that adding a transaction wouldn't make too big a package, either of
+// it and its ancestors or of any of those ancestors and their descendants.
+func checkPackageLimits(txHash proto.Hash, vsize int, ancestors map[*TxDesc]struct{}) error {
+	if count := len(ancestors) + 1; count > DEFAULT_ANCESTOR_LIMIT {
+		return ruleError(ErrTooLongChain, "transaction %s would have %d unconfirmed ancestors, more than the limit of %d", txHash, count, DEFAULT_ANCESTOR_LIMIT)
+	}
+
+	size := vsize
+	for ancestor := range ancestors {
+		size += ancestor.VSize
+		if ancestor.descendantCount+1 > DEFAULT_DESCENDANT_LIMIT {
+			return ruleError(ErrTooLongChain, "transaction %s would give %s more than %d unconfirmed descendants", txHash, ancestor.Hash, DEFAULT_DESCENDANT_LIMIT)
+		}
+		if ancestor.descendantSize+vsize > DEFAULT_DESCENDANT_SIZE_LIMIT {
+			return ruleError(ErrTooLongChain, "transaction %s would give %s unconfirmed descendants of more than %d virtual bytes", txHash, ancestor.Hash, DEFAULT_DESCENDANT_SIZE_LIMIT)
+		}
+	}
+	if size > DEFAULT_ANCESTOR_SIZE_LIMIT {
+		return ruleError(ErrTooLongChain, "transaction %s and its unconfirmed ancestors would be %d virtual bytes, more than the limit of %d", txHash, size, DEFAULT_ANCESTOR_SIZE_LIMIT)
+	}
+	return nil
+}
+
+// verifyScripts checks each input satisfies the output it spends. If it only fails our policy
+// rules, and would pass in a block, it's non-standard rather than invalid.
+func (mp *TxPool) verifyScripts(tx *proto.Tx, txHash proto.Hash, prevOuts []proto.TxOut, nextHeight int32) error {
+	midstate := proto.NewSigHashMidstate(*tx, prevOuts)
+	for i := range tx.TxIn {
+		err := txscript.VerifyScript(tx, i, prevOuts, STANDARD_SCRIPT_VERIFY_FLAGS, midstate)
+		if err == nil {
+			continue
+		}
+
+		consensusFlags := blockchain.BlockScriptFlags(mp.chain.Params(), nextHeight, proto.Hash{})
+		if txscript.VerifyScript(tx, i, prevOuts, consensusFlags, midstate) == nil {
+			return ruleError(ErrNonStandard, "transaction %s input %d fails policy script checks: %v", txHash, i, err)
+		}
+		return ruleError(ErrInvalid, "transaction %s input %d failed script validation: %v", txHash, i, err)
+	}
+	return nil
+}
+
+// ancestorsOf returns the given transactions and all their ancestors in the pool.
+func (mp *TxPool) ancestorsOf(parents map[*TxDesc]struct{}) map[*TxDesc]struct{} {
+	ancestors := make(map[*TxDesc]struct{}, len(parents))
+	queue := make([]*TxDesc, 0, len(parents))
+	for parent := range parents {
+		ancestors[parent] = struct{}{}
+		queue = append(queue, parent)
+	}
+	for len(queue) > 0 {
+		desc := queue[0]
+		queue = queue[1:]
+		for parent := range desc.parents {
+			if _, ok := ancestors[parent]; !ok {
+				ancestors[parent] = struct{}{}
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return ancestors
+}
+
+// addTx adds a transaction that's passed all the checks to the pool.
+func (mp *TxPool) addTx(desc *TxDesc, ancestors map[*TxDesc]struct{}) {
+	desc.order = mp.nextOrder
+	mp.nextOrder++
+	desc.usage = desc.Tx.SerializeSize() + TX_DESC_OVERHEAD
+	desc.children = make(map[*TxDesc]struct{})
+	desc.descendantCount = 1
+	desc.descendantSize = desc.VSize
+	desc.descendantFees = desc.Fee
+
+	for parent := range desc.parents {
+		parent.children[desc] = struct{}{}
+	}
+	for ancestor := range ancestors {
+		ancestor.descendantCount++
+		ancestor.descendantSize += desc.VSize
+		ancestor.descendantFees += desc.Fee
+		heap.Fix(&mp.byDescendants, ancestor.heapIndex)
+	}
+	heap.Push(&mp.byDescendants, desc)
+
+	for _, in := range desc.Tx.TxIn {
+		mp.spent[in.PreviousOutPoint] = desc
+	}
+	mp.pool[desc.Hash] = desc
+	mp.byWitnessHash[desc.WitnessHash] = desc
+	mp.usage += desc.usage
+}
+
+// removeTx removes a transaction from the pool. Any descendants must have been removed first,
+// unless it's been confirmed, in which case they stay.
+func (mp *TxPool) removeTx(desc *TxDesc) {
+	for ancestor := range mp.ancestorsOf(desc.parents) {
+		ancestor.descendantCount--
+		ancestor.descendantSize -= desc.VSize
+		ancestor.descendantFees -= desc.Fee
+		heap.Fix(&mp.byDescendants, ancestor.heapIndex)
+	}
+	heap.Remove(&mp.byDescendants, desc.heapIndex)
+	for parent := range desc.parents {
+		delete(parent.children, desc)
+	}
+	for child := range desc.children {
+		delete(child.parents, desc)
+	}
+
+	for _, in := range desc.Tx.TxIn {
+		delete(mp.spent, in.PreviousOutPoint)
+	}
+	delete(mp.pool, desc.Hash)
+	delete(mp.byWitnessHash, desc.WitnessHash)
+	mp.usage -= desc.usage
+}
+
+// removeWithDescendants removes a transaction and everything in the pool that spends its outputs,
+// returning what it removed.
+func (mp *TxPool) removeWithDescendants(desc *TxDesc) []*TxDesc {
+	var removed []*TxDesc
+	for child := range desc.children {
+		removed = append(removed, mp.removeWithDescendants(child)...)
+	}
+	mp.removeTx(desc)
+	return append(removed, desc)
+}
+
+// trimToSize evicts the packages paying the lowest fee rate until the pool fits in its memory
+// budget, raising the fee rate needed to get back in.
+func (mp *TxPool) trimToSize() {
+	for mp.usage > mp.policy.MaxSize && len(mp.pool) > 0 {
+		worst := mp.byDescendants[0]
+		if rate := worst.descendantFeeRate() + INCREMENTAL_RELAY_FEE; rate > mp.rollingMinFee {
+			mp.rollingMinFee = rate
+			mp.blockSinceBump = false
+		}
+		mp.rollingFeeUpdated = mp.now()
+		mp.removeWithDescendants(worst)
+	}
+}
+
+// Listeners returns the listeners that keep the pool in step with the chain, for
+// blockchain.Chain.Subscribe.
+func (mp *TxPool) Listeners() *blockchain.Listeners {
+	return &blockchain.Listeners{
+		OnBlockConnected:    mp.blockConnected,
+		OnBlockDisconnected: mp.blockDisconnected,
+		OnReorg:             mp.reorganized,
+	}
+}
+
+// blockConnected removes the block's transactions from the pool, along with any others that spend
+// the same outputs and their descendants.
+func (mp *TxPool) blockConnected(node *headerchain.HeaderNode, block *proto.Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		if desc, ok := mp.pool[tx.TxHash()]; ok {
+			mp.removeTx(desc)
+		}
+		for _, in := range tx.TxIn {
+			if conflict, ok := mp.spent[in.PreviousOutPoint]; ok {
+				mp.removeWithDescendants(conflict)
+			}
+		}
+	}
+
+	mp.rollingFeeUpdated = mp.now()
+	mp.blockSinceBump = true
+}
+
+// blockDisconnected remembers the block, so its transactions can go back in the pool once the
+// reorg is over.
+func (mp *TxPool) blockDisconnected(node *headerchain.HeaderNode, block *proto.Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.disconnected = append(mp.disconnected, block)
+}
+
+// reorganized brings the pool in line with the new branch. Transactions that are no longer valid
+// are removed, then those from the disconnected blocks that aren't on the new branch are put
+// back, and finally whatever was removed is tried again, as it may have just lost its parents.
+func (mp *TxPool) reorganized(reorg *blockchain.Reorg) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	removed := mp.removeInvalid()
+
+	// Blocks were disconnected from the old tip down, so go back through them oldest first
+	var txs []*proto.Tx
+	for i := len(mp.disconnected) - 1; i >= 0; i-- {
+		block := mp.disconnected[i]
+		for j := 1; j < len(block.Transactions); j++ {
+			txs = append(txs, &block.Transactions[j])
+		}
+	}
+	mp.disconnected = nil
+	for _, desc := range removed {
+		txs = append(txs, desc.Tx)
+	}
+
+	var added int
+	for _, tx := range txs {
+		if _, err := mp.accept(tx); err == nil {
+			added++
+		}
+	}
+	log.Printf("%d transactions removed from the mempool and %d put back after the reorg to %s", len(removed), added, reorg.NewTip.Hash)
+}
+
+// removeInvalid removes the transactions that are no longer valid on top of the tip, with their
+// descendants, returning them in the order they were added.
+func (mp *TxPool) removeInvalid() []*TxDesc {
+	tip := mp.chain.Tip()
+	var removed []*TxDesc
+	for _, desc := range mp.pool {
+		if _, ok := mp.pool[desc.Hash]; !ok {
+			// Already removed as a descendant of another
+			continue
+		}
+
+		valid, err := mp.stillValid(desc, tip)
+		if err != nil {
+			log.Printf("unable to recheck transaction %s: %v", desc.Hash, err)
+		}
+		if !valid {
+			removed = append(removed, mp.removeWithDescendants(desc)...)
+		}
+	}
+
+	slices.SortFunc(removed, func(a, b *TxDesc) int { return cmp.Compare(a.order, b.order) })
+	return removed
+}
+
+// stillValid reports whether a transaction in the pool can still go in the next block: the outputs
+// it spends that aren't in the pool are still unspent, and its lock times have passed.
+func (mp *TxPool) stillValid(desc *TxDesc, tip *headerchain.HeaderNode) (bool, error) {
+	nextHeight := tip.Height + 1
+	if !blockchain.IsFinalTx(desc.Tx, nextHeight, tip.MedianTimePast()) {
+		return false, nil
+	}
+
+	prevHeights := make([]int32, len(desc.Tx.TxIn))
+	for i, in := range desc.Tx.TxIn {
+		if _, ok := mp.pool[in.PreviousOutPoint.Hash]; ok {
+			prevHeights[i] = nextHeight
+			continue
+		}
+
+		entry, err := mp.chain.FetchUTXO(in.PreviousOutPoint)
+		if err != nil {
+			return false, err
+		}
+		if entry == nil || (entry.IsCoinBase && nextHeight-entry.Height < blockchain.COINBASE_MATURITY) {
+			return false, nil
+		}
+		prevHeights[i] = entry.Height
+	}
+	return mp.chain.SequenceLocksMet(desc.Tx, prevHeights), nil
+}
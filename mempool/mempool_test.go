@@ -0,0 +1,366 @@
+package mempool_test
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/pscott31/mynode/blockchain"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/ripemd160"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/pscott31/mynode/utxo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChain has a tip at height 200 and whatever outputs the test gives it.
+type fakeChain struct {
+	mu     sync.Mutex
+	tip    *headerchain.HeaderNode
+	utxos  map[proto.OutPoint]*utxo.Entry
+	locked bool // Whether relative lock times are unmet
+}
+
+func newFakeChain() *fakeChain {
+	return &fakeChain{
+		tip:   &headerchain.HeaderNode{Height: 200, Header: proto.BlockHeader{Timestamp: 1_600_000_000}},
+		utxos: make(map[proto.OutPoint]*utxo.Entry),
+	}
+}
+
+func (c *fakeChain) Tip() *headerchain.HeaderNode { return c.tip }
+func (c *fakeChain) Params() *config.Params       { return &config.RegTestParams }
+
+func (c *fakeChain) FetchUTXO(op proto.OutPoint) (*utxo.Entry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.utxos[op], nil
+}
+
+func (c *fakeChain) SequenceLocksMet(tx *proto.Tx, prevHeights []int32) bool {
+	return !c.locked
+}
+
+// Outputs in the tests are P2SH outputs anyone can spend by giving the redeem script OP_TRUE.
+var (
+	redeemScript = []byte{txscript.OP_TRUE}
+	sigScript    = []byte{0x01, txscript.OP_TRUE}
+	anyoneScript = p2sh(redeemScript)
+)
+
+func p2sh(script []byte) []byte {
+	sha := sha256.Sum256(script)
+	hash := ripemd160.Sum(sha[:])
+	return append(append([]byte{txscript.OP_HASH160, 0x14}, hash[:]...), txscript.OP_EQUAL)
+}
+
+// fund adds a confirmed output to the chain for a test transaction to spend.
+func (c *fakeChain) fund(value int64) proto.OutPoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	op := proto.OutPoint{Hash: proto.DoubleSHA256([]byte{byte(len(c.utxos)), byte(len(c.utxos) >> 8)}), Index: 0}
+	c.utxos[op] = &utxo.Entry{Amount: value, PkScript: anyoneScript, Height: 1}
+	return op
+}
+
+// spendTx spends the outputs, paying value to a single output.
+func spendTx(value int64, ops ...proto.OutPoint) *proto.Tx {
+	tx := &proto.Tx{Version: 2, TxOut: []proto.TxOut{{Value: value, PkScript: anyoneScript}}}
+	for _, op := range ops {
+		tx.TxIn = append(tx.TxIn, proto.TxIn{PreviousOutPoint: op, SignatureScript: sigScript, Sequence: proto.MAX_TX_IN_SEQUENCE})
+	}
+	return tx
+}
+
+func outPoint(tx *proto.Tx, index uint32) proto.OutPoint {
+	return proto.OutPoint{Hash: tx.TxHash(), Index: index}
+}
+
+func requireRuleError(t *testing.T, err error, code mempool.ErrorCode) {
+	t.Helper()
+	var ruleErr mempool.RuleError
+	require.True(t, errors.As(err, &ruleErr), "expected a rule error, got %v", err)
+	assert.Equal(t, code, ruleErr.Code, ruleErr.Description)
+}
+
+func TestTxPool_AcceptsChainsOfTransactions(t *testing.T) {
+	chain := newFakeChain()
+	pool := mempool.New(chain, mempool.DefaultPolicy())
+
+	parent := spendTx(99_000, chain.fund(100_000))
+	desc, err := pool.AcceptTransaction(parent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), desc.Fee)
+	assert.Equal(t, parent.VSize(), desc.VSize)
+	assert.Equal(t, int32(200), desc.Height)
+
+	child := spendTx(98_000, outPoint(parent, 0))
+	_, err = pool.AcceptTransaction(child)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, pool.Count())
+	assert.True(t, pool.HaveTransaction(child.TxHash()))
+	assert.True(t, pool.HaveTransaction(child.WitnessHash()))
+	assert.Equal(t, child, pool.Lookup(child.TxHash()).Tx)
+	assert.Equal(t, mempool.DEFAULT_MIN_RELAY_TX_FEE, pool.MinFee())
+}
+
+func TestTxPool_RejectsTransactions(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   func(c *fakeChain) *proto.Tx
+		code mempool.ErrorCode
+	}{
+		{"coinbase", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(1000, proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX})
+			tx.TxIn[0].SignatureScript = []byte{0x01, 0x02}
+			return tx
+		}, mempool.ErrInvalid},
+		{"spends more than its inputs", func(c *fakeChain) *proto.Tx {
+			return spendTx(100_001, c.fund(100_000))
+		}, mempool.ErrInvalid},
+		{"immature coinbase", func(c *fakeChain) *proto.Tx {
+			op := c.fund(100_000)
+			c.utxos[op].IsCoinBase = true
+			c.utxos[op].Height = 150
+			return spendTx(99_000, op)
+		}, mempool.ErrInvalid},
+		{"failing script", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.TxIn[0].SignatureScript = []byte{0x01, txscript.OP_2}
+			return tx
+		}, mempool.ErrInvalid},
+		{"script failing only policy checks", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.TxIn[0].SignatureScript = append([]byte{0x01, 0x07}, sigScript...)
+			return tx
+		}, mempool.ErrNonStandard},
+		{"unknown version", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.Version = 3
+			return tx
+		}, mempool.ErrNonStandard},
+		{"non-standard output", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.TxOut[0].PkScript = []byte{txscript.OP_TRUE}
+			return tx
+		}, mempool.ErrNonStandard},
+		{"dust output", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.TxOut = append(tx.TxOut, proto.TxOut{Value: 100, PkScript: anyoneScript})
+			return tx
+		}, mempool.ErrNonStandard},
+		{"two data outputs", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			data := proto.TxOut{PkScript: []byte{txscript.OP_RETURN, 0x01, 0x01}}
+			tx.TxOut = append(tx.TxOut, data, data)
+			return tx
+		}, mempool.ErrNonStandard},
+		{"signature script does more than push", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.TxIn[0].SignatureScript = append([]byte{txscript.OP_NOP}, sigScript...)
+			return tx
+		}, mempool.ErrNonStandard},
+		{"spends non-standard output", func(c *fakeChain) *proto.Tx {
+			op := c.fund(100_000)
+			c.utxos[op].PkScript = []byte{txscript.OP_TRUE}
+			tx := spendTx(99_000, op)
+			tx.TxIn[0].SignatureScript = nil
+			return tx
+		}, mempool.ErrNonStandard},
+		{"lock time in the future", func(c *fakeChain) *proto.Tx {
+			tx := spendTx(99_000, c.fund(100_000))
+			tx.LockTime = 201
+			tx.TxIn[0].Sequence = 0
+			return tx
+		}, mempool.ErrNonFinal},
+		{"relative lock time not met", func(c *fakeChain) *proto.Tx {
+			c.locked = true
+			return spendTx(99_000, c.fund(100_000))
+		}, mempool.ErrNonFinal},
+		{"missing input", func(c *fakeChain) *proto.Tx {
+			return spendTx(99_000, proto.OutPoint{Hash: proto.DoubleSHA256([]byte("nothing"))})
+		}, mempool.ErrMissingInputs},
+		{"fee too low", func(c *fakeChain) *proto.Tx {
+			return spendTx(99_990, c.fund(100_000))
+		}, mempool.ErrInsufficientFee},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newFakeChain()
+			pool := mempool.New(chain, mempool.DefaultPolicy())
+			_, err := pool.AcceptTransaction(tt.tx(chain))
+			requireRuleError(t, err, tt.code)
+			assert.Zero(t, pool.Count())
+		})
+	}
+}
+
+func TestTxPool_RejectsDuplicatesAndConflicts(t *testing.T) {
+	chain := newFakeChain()
+	policy := mempool.DefaultPolicy()
+	policy.FullRBF = false
+	pool := mempool.New(chain, policy)
+	funding := chain.fund(100_000)
+
+	tx := spendTx(99_000, funding)
+	_, err := pool.AcceptTransaction(tx)
+	require.NoError(t, err)
+
+	_, err = pool.AcceptTransaction(tx)
+	requireRuleError(t, err, mempool.ErrDuplicate)
+	_, err = pool.AcceptTransaction(spendTx(98_000, funding))
+	requireRuleError(t, err, mempool.ErrConflict)
+
+	// One whose inputs are spent because it's been confirmed
+	confirmed := spendTx(99_000, proto.OutPoint{Hash: proto.DoubleSHA256([]byte("spent"))})
+	chain.utxos[outPoint(confirmed, 0)] = &utxo.Entry{Amount: 99_000, PkScript: anyoneScript, Height: 200}
+	_, err = pool.AcceptTransaction(confirmed)
+	requireRuleError(t, err, mempool.ErrDuplicate)
+}
+
+func TestTxPool_LimitsUnconfirmedChains(t *testing.T) {
+	chain := newFakeChain()
+	pool := mempool.New(chain, mempool.DefaultPolicy())
+
+	op, value := chain.fund(1_000_000), int64(1_000_000)
+	for i := 0; i < mempool.DEFAULT_ANCESTOR_LIMIT; i++ {
+		value -= 1000
+		tx := spendTx(value, op)
+		_, err := pool.AcceptTransaction(tx)
+		require.NoError(t, err, "transaction %d", i)
+		op = outPoint(tx, 0)
+	}
+
+	_, err := pool.AcceptTransaction(spendTx(value-1000, op))
+	requireRuleError(t, err, mempool.ErrTooLongChain)
+}
+
+func TestTxPool_EvictsLowestFeeRatePackages(t *testing.T) {
+	chain := newFakeChain()
+	usage := spendTx(0, proto.OutPoint{}).SerializeSize() + mempool.TX_DESC_OVERHEAD
+	pool := mempool.New(chain, mempool.Policy{MaxSize: 3 * usage, MinRelayFee: mempool.DEFAULT_MIN_RELAY_TX_FEE})
+
+	// A parent paying little, whose child doesn't pay enough to make up for it
+	parent := spendTx(99_800, chain.fund(100_000))
+	child := spendTx(99_550, outPoint(parent, 0))
+	other := spendTx(95_000, chain.fund(100_000))
+	for _, tx := range []*proto.Tx{parent, child, other} {
+		_, err := pool.AcceptTransaction(tx)
+		require.NoError(t, err)
+	}
+	packageRate := mempool.NewFeeRate(450, parent.VSize()+child.VSize())
+
+	_, err := pool.AcceptTransaction(spendTx(90_000, chain.fund(100_000)))
+	require.NoError(t, err)
+	assert.Equal(t, 2, pool.Count())
+	assert.False(t, pool.HaveTransaction(parent.TxHash()))
+	assert.False(t, pool.HaveTransaction(child.TxHash()))
+	assert.True(t, pool.HaveTransaction(other.TxHash()))
+
+	// Getting back in now costs more than what was evicted paid
+	assert.Equal(t, packageRate+mempool.INCREMENTAL_RELAY_FEE, pool.MinFee())
+	_, err = pool.AcceptTransaction(spendTx(99_800, chain.fund(100_000)))
+	requireRuleError(t, err, mempool.ErrInsufficientFee)
+}
+
+func TestTxPool_EvictsByPackageFeeRate(t *testing.T) {
+	chain := newFakeChain()
+	usage := spendTx(0, proto.OutPoint{}).SerializeSize() + mempool.TX_DESC_OVERHEAD
+	pool := mempool.New(chain, mempool.Policy{MaxSize: 4 * usage, MinRelayFee: mempool.DEFAULT_MIN_RELAY_TX_FEE})
+
+	// The parent pays the least on its own, but its child pays enough for both of them
+	parent := spendTx(99_800, chain.fund(100_000))
+	cheap := spendTx(99_000, chain.fund(100_000))
+	cheaper := spendTx(99_500, chain.fund(100_000))
+	for _, tx := range []*proto.Tx{parent, cheap, cheaper} {
+		_, err := pool.AcceptTransaction(tx)
+		require.NoError(t, err)
+	}
+	child := spendTx(90_000, outPoint(parent, 0))
+	_, err := pool.AcceptTransaction(child)
+	require.NoError(t, err)
+
+	// Each new transaction evicts the worst of what's left
+	_, err = pool.AcceptTransaction(spendTx(95_000, chain.fund(100_000)))
+	require.NoError(t, err)
+	assert.False(t, pool.HaveTransaction(cheaper.TxHash()))
+	assert.True(t, pool.HaveTransaction(cheap.TxHash()))
+
+	_, err = pool.AcceptTransaction(spendTx(95_000, chain.fund(100_000)))
+	require.NoError(t, err)
+	assert.False(t, pool.HaveTransaction(cheap.TxHash()))
+	assert.True(t, pool.HaveTransaction(parent.TxHash()))
+	assert.True(t, pool.HaveTransaction(child.TxHash()))
+}
+
+func TestTxPool_RemovesConfirmedAndConflicting(t *testing.T) {
+	chain := newFakeChain()
+	pool := mempool.New(chain, mempool.DefaultPolicy())
+	listeners := pool.Listeners()
+
+	confirmed := spendTx(99_000, chain.fund(100_000))
+	child := spendTx(98_000, outPoint(confirmed, 0))
+	unrelated := spendTx(99_000, chain.fund(100_000))
+	conflictedOutput := chain.fund(100_000)
+	conflicted := spendTx(99_000, conflictedOutput)
+	conflictedChild := spendTx(98_000, outPoint(conflicted, 0))
+	for _, tx := range []*proto.Tx{confirmed, child, unrelated, conflicted, conflictedChild} {
+		_, err := pool.AcceptTransaction(tx)
+		require.NoError(t, err)
+	}
+
+	coinbase := spendTx(50_000, proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX})
+	block := &proto.Block{Transactions: []proto.Tx{*coinbase, *confirmed, *spendTx(90_000, conflictedOutput)}}
+	listeners.OnBlockConnected(nil, block)
+
+	assert.Equal(t, 2, pool.Count())
+	assert.True(t, pool.HaveTransaction(child.TxHash()))
+	assert.True(t, pool.HaveTransaction(unrelated.TxHash()))
+
+	// The child now heads its own chain
+	chain.utxos[outPoint(confirmed, 0)] = &utxo.Entry{Amount: 99_000, PkScript: anyoneScript, Height: 201}
+	_, err := pool.AcceptTransaction(spendTx(97_000, outPoint(child, 0)))
+	require.NoError(t, err)
+}
+
+func TestTxPool_FollowsReorg(t *testing.T) {
+	chain := newFakeChain()
+	pool := mempool.New(chain, mempool.DefaultPolicy())
+	listeners := pool.Listeners()
+
+	// A transaction confirmed on the old branch, and one in the pool spending it
+	funding := chain.fund(100_000)
+	confirmed := spendTx(99_000, funding)
+	chain.utxos[outPoint(confirmed, 0)] = &utxo.Entry{Amount: 99_000, PkScript: anyoneScript, Height: 200}
+	delete(chain.utxos, funding)
+	child := spendTx(98_000, outPoint(confirmed, 0))
+	_, err := pool.AcceptTransaction(child)
+	require.NoError(t, err)
+
+	// And one spending an output the new branch spends differently
+	doubleSpent := chain.fund(100_000)
+	conflicted := spendTx(99_000, doubleSpent)
+	_, err = pool.AcceptTransaction(conflicted)
+	require.NoError(t, err)
+
+	// The reorg undoes the first and spends the second output
+	delete(chain.utxos, outPoint(confirmed, 0))
+	chain.utxos[funding] = &utxo.Entry{Amount: 100_000, PkScript: anyoneScript, Height: 1}
+	delete(chain.utxos, doubleSpent)
+
+	coinbase := spendTx(50_000, proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX})
+	listeners.OnBlockDisconnected(nil, &proto.Block{Transactions: []proto.Tx{*coinbase, *confirmed}})
+	listeners.OnReorg(&blockchain.Reorg{Depth: 1, NewTip: chain.tip})
+
+	assert.Equal(t, 2, pool.Count())
+	assert.True(t, pool.HaveTransaction(confirmed.TxHash()))
+	assert.True(t, pool.HaveTransaction(child.TxHash()))
+	assert.False(t, pool.HaveTransaction(conflicted.TxHash()))
+}
@@ -0,0 +1,241 @@
+package mempool
+
+import (
+	"fmt"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+)
+
+// Policy limits, as per Bitcoin Core. None of these are consensus rules: a block can contain
+// transactions that break them, but we won't relay such transactions ourselves.
+const (
+	// The newest transaction version we relay.
+	MAX_STANDARD_VERSION = 2
+
+	// The largest transaction we relay, leaving plenty of room in a block for others.
+	MAX_STANDARD_TX_WEIGHT = 400_000
+
+	// Transactions smaller than this without their witness data could be confused with a 64 byte
+	// inner node of a merkle tree.
+	MIN_STANDARD_TX_NONWITNESS_SIZE = 65
+
+	// Big enough for a P2SH spend of a 15 of 15 multisig with compressed keys.
+	MAX_STANDARD_SCRIPTSIG_SIZE = 1650
+
+	// The most signature checks a P2SH redeem script may have.
+	MAX_P2SH_SIGOPS = 15
+
+	// The most signature check cost a transaction may have, a fifth of a block's.
+	MAX_STANDARD_TX_SIGOPS_COST = 16_000
+
+	// The most bare multisig keys we relay outputs to.
+	MAX_STANDARD_MULTISIG_KEYS = 3
+
+	// The largest OP_RETURN output script we relay, which is room for 80 bytes of data.
+	MAX_OP_RETURN_RELAY = 83
+
+	// Limits on a P2WSH spend's witness: the size of the script, how many items it's given and how
+	// big each of them can be.
+	MAX_STANDARD_P2WSH_SCRIPT_SIZE         = 3600
+	MAX_STANDARD_P2WSH_STACK_ITEMS         = 100
+	MAX_STANDARD_P2WSH_STACK_ITEM_SIZE     = 80
+	MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE = 80
+
+	// The fee rate below which we don't bother relaying transactions.
+	DEFAULT_MIN_RELAY_TX_FEE FeeRate = 1000
+
+	// The fee rate that spending an output has to be worth for it not to be dust.
+	DUST_RELAY_TX_FEE FeeRate = 3000
+
+	// Script checks for unconfirmed transactions: everything consensus requires, plus the rules
+	// reserved for future soft forks and those that stop third parties malleating transactions.
+	STANDARD_SCRIPT_VERIFY_FLAGS = txscript.SCRIPT_VERIFY_P2SH |
+		txscript.SCRIPT_VERIFY_DERSIG |
+		txscript.SCRIPT_VERIFY_NULLDUMMY |
+		txscript.SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY |
+		txscript.SCRIPT_VERIFY_CHECKSEQUENCEVERIFY |
+		txscript.SCRIPT_VERIFY_WITNESS |
+		txscript.SCRIPT_VERIFY_TAPROOT |
+		txscript.SCRIPT_VERIFY_STRICTENC |
+		txscript.SCRIPT_VERIFY_MINIMALDATA |
+		txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS |
+		txscript.SCRIPT_VERIFY_CLEANSTACK |
+		txscript.SCRIPT_VERIFY_MINIMALIF |
+		txscript.SCRIPT_VERIFY_NULLFAIL |
+		txscript.SCRIPT_VERIFY_LOW_S |
+		txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM |
+		txscript.SCRIPT_VERIFY_WITNESS_PUBKEYTYPE |
+		txscript.SCRIPT_VERIFY_CONST_SCRIPTCODE |
+		txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION |
+		txscript.SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS |
+		txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE
+)
+
+// FeeRate is a fee per 1000 virtual bytes, in satoshis.
+type FeeRate int64
+
+// NewFeeRate is the rate at which a transaction of the given virtual size pays the fee.
+func NewFeeRate(fee int64, vsize int) FeeRate {
+	if vsize <= 0 {
+		return 0
+	}
+	return FeeRate(fee * 1000 / int64(vsize))
+}
+
+// Fee is what a transaction of the given virtual size pays at this rate, rounded up.
+func (r FeeRate) Fee(vsize int) int64 {
+	return (int64(r)*int64(vsize) + 999) / 1000
+}
+
+func (r FeeRate) String() string {
+	return fmt.Sprintf("%d.%03d sat/vB", r/1000, r%1000)
+}
+
+// DustThreshold is the smallest value an output can have without being dust: worth less than it
+// would cost to spend at the dust relay fee rate.
+func DustThreshold(out proto.TxOut) int64 {
+	if len(out.PkScript) > 0 && out.PkScript[0] == txscript.OP_RETURN {
+		return 0
+	}
+
+	// The output itself, plus a typical input spending it: the outpoint, sequence and a
+	// signature script with a signature and a key, which witness spends get at a discount
+	raw, _ := proto.MarshalToBytes(out) // Writing to memory can't fail
+	size := len(raw)
+	if _, _, ok := txscript.IsWitnessProgram(out.PkScript); ok {
+		size += 32 + 4 + 1 + 107/proto.WITNESS_SCALE_FACTOR + 4
+	} else {
+		size += 32 + 4 + 1 + 107 + 4
+	}
+	return DUST_RELAY_TX_FEE.Fee(size)
+}
+
+// checkTransactionStandard checks the rules for what we relay that only depend on the
+// transaction itself.
+func checkTransactionStandard(tx *proto.Tx, txHash proto.Hash) error {
+	if tx.Version < 1 || tx.Version > MAX_STANDARD_VERSION {
+		return ruleError(ErrNonStandard, "transaction %s has version %d", txHash, tx.Version)
+	}
+
+	if weight := tx.Weight(); weight > MAX_STANDARD_TX_WEIGHT {
+		return ruleError(ErrNonStandard, "transaction %s has weight %d, more than the standard %d", txHash, weight, MAX_STANDARD_TX_WEIGHT)
+	}
+	if size := tx.StrippedSize(); size < MIN_STANDARD_TX_NONWITNESS_SIZE {
+		return ruleError(ErrNonStandard, "transaction %s is only %d bytes without its witness", txHash, size)
+	}
+
+	for i, in := range tx.TxIn {
+		if len(in.SignatureScript) > MAX_STANDARD_SCRIPTSIG_SIZE {
+			return ruleError(ErrNonStandard, "transaction %s input %d signature script is %d bytes", txHash, i, len(in.SignatureScript))
+		}
+		if !txscript.IsPushOnly(in.SignatureScript) {
+			return ruleError(ErrNonStandard, "transaction %s input %d signature script does more than push data", txHash, i)
+		}
+	}
+
+	var dataOutputs int
+	for i, out := range tx.TxOut {
+		switch txscript.GetScriptClass(out.PkScript) {
+		case txscript.NONSTANDARD_TY:
+			return ruleError(ErrNonStandard, "transaction %s output %d has a non-standard script", txHash, i)
+		case txscript.NULL_DATA_TY:
+			if len(out.PkScript) > MAX_OP_RETURN_RELAY {
+				return ruleError(ErrNonStandard, "transaction %s output %d carries too much data", txHash, i)
+			}
+			dataOutputs++
+			continue
+		case txscript.MULTISIG_TY:
+			if _, n, _ := txscript.ParseMultisig(out.PkScript); n > MAX_STANDARD_MULTISIG_KEYS {
+				return ruleError(ErrNonStandard, "transaction %s output %d is a multisig with %d keys", txHash, i, n)
+			}
+		}
+
+		if threshold := DustThreshold(out); out.Value < threshold {
+			return ruleError(ErrNonStandard, "transaction %s output %d is dust: %d is less than %d", txHash, i, out.Value, threshold)
+		}
+	}
+	if dataOutputs > 1 {
+		return ruleError(ErrNonStandard, "transaction %s has %d OP_RETURN outputs", txHash, dataOutputs)
+	}
+
+	return nil
+}
+
+// checkInputsStandard checks the outputs a transaction spends are of kinds we know how to limit
+// the cost of checking, and that the inputs stay within those limits.
+func checkInputsStandard(tx *proto.Tx, txHash proto.Hash, prevOuts []proto.TxOut) error {
+	for i, in := range tx.TxIn {
+		pkScript := prevOuts[i].PkScript
+		class := txscript.GetScriptClass(pkScript)
+		switch class {
+		case txscript.NONSTANDARD_TY, txscript.WITNESS_UNKNOWN_TY:
+			return ruleError(ErrNonStandard, "transaction %s input %d spends a %s output", txHash, i, class)
+		case txscript.SCRIPT_HASH_TY:
+			if sigOps := txscript.CountP2SHSigOps(in.SignatureScript, pkScript); sigOps > MAX_P2SH_SIGOPS {
+				return ruleError(ErrNonStandard, "transaction %s input %d redeem script has %d signature checks", txHash, i, sigOps)
+			}
+		}
+
+		if err := checkWitnessStandard(in, pkScript); err != nil {
+			return ruleError(ErrNonStandard, "transaction %s input %d: %v", txHash, i, err)
+		}
+	}
+	return nil
+}
+
+// checkWitnessStandard checks an input's witness data is of a size we're happy to relay.
+func checkWitnessStandard(in proto.TxIn, pkScript []byte) error {
+	if len(in.Witness) == 0 {
+		return nil
+	}
+
+	// The witness program is either the output script, or the redeem script of a P2SH output
+	program := pkScript
+	if txscript.IsPayToScriptHash(pkScript) {
+		if len(in.SignatureScript) == 0 || int(in.SignatureScript[0])+1 != len(in.SignatureScript) {
+			return fmt.Errorf("witness for a P2SH output that isn't a witness program")
+		}
+		program = in.SignatureScript[1:]
+	}
+
+	switch txscript.GetScriptClass(program) {
+	case txscript.WITNESS_V0_SCRIPTHASH_TY:
+		script := in.Witness[len(in.Witness)-1]
+		if len(script) > MAX_STANDARD_P2WSH_SCRIPT_SIZE {
+			return fmt.Errorf("witness script is %d bytes", len(script))
+		}
+		if items := len(in.Witness) - 1; items > MAX_STANDARD_P2WSH_STACK_ITEMS {
+			return fmt.Errorf("witness script is given %d items", items)
+		}
+		for _, item := range in.Witness[:len(in.Witness)-1] {
+			if len(item) > MAX_STANDARD_P2WSH_STACK_ITEM_SIZE {
+				return fmt.Errorf("witness item is %d bytes", len(item))
+			}
+		}
+
+	case txscript.WITNESS_V1_TAPROOT_TY:
+		stack := in.Witness
+		if len(stack) >= 2 && len(stack[len(stack)-1]) > 0 && stack[len(stack)-1][0] == txscript.ANNEX_TAG {
+			return fmt.Errorf("witness has an annex")
+		}
+		if len(stack) >= 2 {
+			// A script path spend, whose last two items are the script and control block
+			control := stack[len(stack)-1]
+			if len(control) > 0 && control[0]&txscript.TAPROOT_LEAF_MASK == txscript.TAPROOT_LEAF_TAPSCRIPT {
+				for _, item := range stack[:len(stack)-2] {
+					if len(item) > MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE {
+						return fmt.Errorf("tapscript item is %d bytes", len(item))
+					}
+				}
+			}
+		}
+
+	case txscript.WITNESS_V0_KEYHASH_TY:
+		// Just a signature and a key, whose sizes the script checks
+
+	default:
+		return fmt.Errorf("witness for an output that isn't a witness program")
+	}
+	return nil
+}
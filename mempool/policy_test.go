@@ -0,0 +1,27 @@
+package mempool_test
+
+import (
+	"testing"
+
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDustThreshold(t *testing.T) {
+	p2pkh := append(append([]byte{txscript.OP_DUP, txscript.OP_HASH160, 0x14}, make([]byte, 20)...), txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG)
+	p2wpkh := append([]byte{txscript.OP_0, 0x14}, make([]byte, 20)...)
+
+	assert.Equal(t, int64(546), mempool.DustThreshold(proto.TxOut{PkScript: p2pkh}))
+	assert.Equal(t, int64(294), mempool.DustThreshold(proto.TxOut{PkScript: p2wpkh}))
+	assert.Zero(t, mempool.DustThreshold(proto.TxOut{PkScript: []byte{txscript.OP_RETURN}}))
+}
+
+func TestFeeRate(t *testing.T) {
+	rate := mempool.NewFeeRate(1000, 141)
+	assert.Equal(t, mempool.FeeRate(7092), rate)
+	assert.Equal(t, "7.092 sat/vB", rate.String())
+	assert.Equal(t, int64(1000), rate.Fee(141))
+	assert.Equal(t, int64(1), mempool.FeeRate(1).Fee(1))
+}
@@ -0,0 +1,120 @@
+package mempool
+
+import (
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// Inputs with a sequence number no higher than this signal, as per BIP125, that the
+	// transaction spending them may be replaced.
+	MAX_BIP125_RBF_SEQUENCE = 0xfffffffd
+
+	// The most transactions a replacement may evict, counting descendants, as per Bitcoin Core.
+	MAX_REPLACEMENT_CANDIDATES = 100
+)
+
+// SignalsReplacement reports whether a transaction opts in to being replaced, as per BIP125.
+func SignalsReplacement(tx *proto.Tx) bool {
+	for _, in := range tx.TxIn {
+		if in.Sequence <= MAX_BIP125_RBF_SEQUENCE {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceable reports whether a transaction in the pool may be replaced under BIP125: it signals,
+// or inherits the signal from one of its ancestors in the pool.
+func (mp *TxPool) replaceable(desc *TxDesc) bool {
+	if SignalsReplacement(desc.Tx) {
+		return true
+	}
+	for ancestor := range mp.ancestorsOf(desc.parents) {
+		if SignalsReplacement(ancestor.Tx) {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictsOf returns the transactions in the pool that spend the same outputs as a transaction.
+// Unless the policy allows replacing any transaction, they must all be replaceable.
+func (mp *TxPool) conflictsOf(tx *proto.Tx, txHash proto.Hash) (map[*TxDesc]struct{}, error) {
+	conflicts := make(map[*TxDesc]struct{})
+	for i, in := range tx.TxIn {
+		spender, ok := mp.spent[in.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		if !mp.policy.FullRBF && !mp.replaceable(spender) {
+			return nil, ruleError(ErrConflict, "transaction %s input %d spends %s, which %s in the pool already spends and doesn't signal it can be replaced", txHash, i, in.PreviousOutPoint, spender.Hash)
+		}
+		conflicts[spender] = struct{}{}
+	}
+	return conflicts, nil
+}
+
+// checkReplacement checks a transaction is allowed to replace those it conflicts with, given the
+// transactions in the pool it spends and their ancestors, and returns everything it would evict:
+// the conflicts and all their descendants. Like Bitcoin Core, it follows BIP125's rules, and also
+// has to pay a higher fee rate than each of the conflicts. Their descendants only have to be paid
+// for in total, so a conflict with a high fee rate child can still be replaced.
+func (mp *TxPool) checkReplacement(txHash proto.Hash, fee int64, vsize int, conflicts, parents, ancestors map[*TxDesc]struct{}) (map[*TxDesc]struct{}, error) {
+	evicted := make(map[*TxDesc]struct{})
+	queue := make([]*TxDesc, 0, len(conflicts))
+	for conflict := range conflicts {
+		evicted[conflict] = struct{}{}
+		queue = append(queue, conflict)
+	}
+	for len(queue) > 0 {
+		desc := queue[0]
+		queue = queue[1:]
+		for child := range desc.children {
+			if _, ok := evicted[child]; !ok {
+				evicted[child] = struct{}{}
+				queue = append(queue, child)
+			}
+		}
+	}
+	if len(evicted) > MAX_REPLACEMENT_CANDIDATES {
+		return nil, ruleError(ErrReplacement, "transaction %s would replace %d transactions, more than the limit of %d", txHash, len(evicted), MAX_REPLACEMENT_CANDIDATES)
+	}
+
+	// It can't depend on what it replaces, or bring in new unconfirmed transactions, which might
+	// pay too little for the replacement to be worth mining
+	for ancestor := range ancestors {
+		if _, ok := evicted[ancestor]; ok {
+			return nil, ruleError(ErrReplacement, "transaction %s spends an output of %s, which it would replace", txHash, ancestor.Hash)
+		}
+	}
+	conflictParents := make(map[*TxDesc]struct{})
+	for conflict := range conflicts {
+		for parent := range conflict.parents {
+			conflictParents[parent] = struct{}{}
+		}
+	}
+	for parent := range parents {
+		if _, ok := conflictParents[parent]; !ok {
+			return nil, ruleError(ErrReplacement, "transaction %s spends unconfirmed transaction %s, which the transactions it replaces don't", txHash, parent.Hash)
+		}
+	}
+
+	rate := NewFeeRate(fee, vsize)
+	for conflict := range conflicts {
+		if rate <= conflict.FeeRate() {
+			return nil, ruleError(ErrInsufficientFee, "transaction %s pays %s, no more than the %s of %s, which it would replace", txHash, rate, conflict.FeeRate(), conflict.Hash)
+		}
+	}
+	var evictedFees int64
+	for desc := range evicted {
+		evictedFees += desc.Fee
+	}
+	if fee < evictedFees {
+		return nil, ruleError(ErrInsufficientFee, "transaction %s pays a fee of %d, less than the %d paid by the transactions it would replace", txHash, fee, evictedFees)
+	}
+	if extra, needed := fee-evictedFees, INCREMENTAL_RELAY_FEE.Fee(vsize); extra < needed {
+		return nil, ruleError(ErrInsufficientFee, "transaction %s pays %d more than the transactions it would replace, less than the %d needed to relay it", txHash, extra, needed)
+	}
+
+	return evicted, nil
+}
@@ -0,0 +1,160 @@
+package mempool_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signalling marks a transaction as replaceable.
+func signalling(tx *proto.Tx) *proto.Tx {
+	tx.TxIn[0].Sequence = mempool.MAX_BIP125_RBF_SEQUENCE
+	return tx
+}
+
+func TestSignalsReplacement(t *testing.T) {
+	tx := spendTx(1000, proto.OutPoint{}, proto.OutPoint{Index: 1})
+	assert.False(t, mempool.SignalsReplacement(tx))
+	tx.TxIn[1].Sequence = proto.MAX_TX_IN_SEQUENCE - 1
+	assert.False(t, mempool.SignalsReplacement(tx))
+	tx.TxIn[1].Sequence = mempool.MAX_BIP125_RBF_SEQUENCE
+	assert.True(t, mempool.SignalsReplacement(tx))
+}
+
+func TestTxPool_ReplacesTransactions(t *testing.T) {
+	// Each test fills the pool, then returns a replacement and what it should evict
+	tests := []struct {
+		name    string
+		fullRBF bool
+		setup   func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx)
+		code    mempool.ErrorCode // Ignored if the replacement should be accepted
+	}{
+		{"signalling transaction", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			original := mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			return spendTx(98_000, funding), []*proto.Tx{original}
+		}, 0},
+		{"non-signalling transaction", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			mustAccept(t, pool, spendTx(99_000, funding))
+			return spendTx(98_000, funding), nil
+		}, mempool.ErrConflict},
+		{"non-signalling transaction with full-RBF", true, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			original := mustAccept(t, pool, spendTx(99_000, funding))
+			return spendTx(98_000, funding), []*proto.Tx{original}
+		}, 0},
+		{"child of signalling transaction", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			parent := mustAccept(t, pool, signalling(spendTx(99_000, c.fund(100_000))))
+			child := mustAccept(t, pool, spendTx(98_000, outPoint(parent, 0)))
+			return spendTx(97_000, outPoint(parent, 0)), []*proto.Tx{child}
+		}, 0},
+		{"transaction and its descendants", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			original := mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			child := mustAccept(t, pool, spendTx(98_000, outPoint(original, 0)))
+			return spendTx(97_000, funding), []*proto.Tx{original, child}
+		}, 0},
+		{"several transactions", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			first, second := c.fund(100_000), c.fund(100_000)
+			originals := []*proto.Tx{
+				mustAccept(t, pool, signalling(spendTx(99_000, first))),
+				mustAccept(t, pool, signalling(spendTx(99_000, second))),
+			}
+			return spendTx(197_000, first, second), originals
+		}, 0},
+		{"paying less in total than the descendants", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			original := mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			mustAccept(t, pool, spendTx(90_000, outPoint(original, 0)))
+			return spendTx(95_000, funding), nil
+		}, mempool.ErrInsufficientFee},
+		{"paying too little extra to relay", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			return spendTx(98_990, funding), nil
+		}, mempool.ErrInsufficientFee},
+		{"paying a lower fee rate than a conflict", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			return withData(spendTx(98_700, funding)), nil
+		}, mempool.ErrInsufficientFee},
+		{"paying a lower fee rate than a conflict's descendant", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			original := mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			child := mustAccept(t, pool, spendTx(79_000, outPoint(original, 0)))
+
+			// More in total, and a higher fee rate than the original, which is all that's needed
+			return withData(spendTx(77_000, funding)), []*proto.Tx{original, child}
+		}, 0},
+		{"spending a new unconfirmed output", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			unrelated := mustAccept(t, pool, spendTx(99_000, c.fund(100_000)))
+			return spendTx(190_000, funding, outPoint(unrelated, 0)), nil
+		}, mempool.ErrReplacement},
+		{"spending an output it replaces", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			funding := c.fund(100_000)
+			original := mustAccept(t, pool, signalling(spendTx(99_000, funding)))
+			child := mustAccept(t, pool, spendTx(98_000, outPoint(original, 0)))
+			return spendTx(190_000, funding, outPoint(child, 0)), nil
+		}, mempool.ErrReplacement},
+		{"too many transactions", false, func(t *testing.T, c *fakeChain, pool *mempool.TxPool) (*proto.Tx, []*proto.Tx) {
+			// Five chains of 21, one more than the limit
+			var fundings []proto.OutPoint
+			for i := 0; i < 5; i++ {
+				funding := c.fund(1_000_000)
+				fundings = append(fundings, funding)
+				tx := mustAccept(t, pool, signalling(spendTx(999_000, funding)))
+				for j := 0; j < 20; j++ {
+					tx = mustAccept(t, pool, spendTx(tx.TxOut[0].Value-1000, outPoint(tx, 0)))
+				}
+			}
+			return spendTx(4_000_000, fundings...), nil
+		}, mempool.ErrReplacement},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newFakeChain()
+			policy := mempool.DefaultPolicy()
+			policy.FullRBF = tt.fullRBF
+			pool := mempool.New(chain, policy)
+
+			replacement, evicted := tt.setup(t, chain, pool)
+			count := pool.Count()
+			_, err := pool.AcceptTransaction(replacement)
+			if len(evicted) == 0 {
+				requireRuleError(t, err, tt.code)
+				assert.Equal(t, count, pool.Count())
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, count-len(evicted)+1, pool.Count())
+			assert.True(t, pool.HaveTransaction(replacement.TxHash()))
+			for _, tx := range evicted {
+				assert.False(t, pool.HaveTransaction(tx.TxHash()))
+			}
+		})
+	}
+}
+
+// withData makes a transaction bigger, with an OP_RETURN output.
+func withData(tx *proto.Tx) *proto.Tx {
+	data := append([]byte{txscript.OP_RETURN, 0x4c, 80}, bytes.Repeat([]byte{0x01}, 80)...)
+	tx.TxOut = append(tx.TxOut, proto.TxOut{PkScript: data})
+	return tx
+}
+
+func mustAccept(t *testing.T, pool *mempool.TxPool, tx *proto.Tx) *proto.Tx {
+	t.Helper()
+	_, err := pool.AcceptTransaction(tx)
+	require.NoError(t, err)
+	return tx
+}
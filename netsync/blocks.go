@@ -0,0 +1,393 @@
+package netsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// The most blocks we'll have requested from one peer at a time.
+	MAX_BLOCKS_IN_FLIGHT_PER_PEER = 16
+
+	// How far past the last processed block we'll download. Blocks can arrive out of order, but
+	// they can't be processed until the ones before them have arrived, so this bounds how much a
+	// single slow peer can hold everything up.
+	BLOCK_DOWNLOAD_WINDOW = 1024
+
+	// How long a peer has to send a block we asked for.
+	BLOCK_DOWNLOAD_TIMEOUT = time.Minute
+)
+
+// BlockProcessor is handed each downloaded block of the best header chain, in chain order, for
+// validation. After a reorg of the header chain, blocks on the new branch follow on from where the
+// branches fork, so the processor must be ready to switch branches itself.
+type BlockProcessor interface {
+	// Tip is the last block that was connected. Downloading carries on from the one after it.
+	Tip() *headerchain.HeaderNode
+
+	// ProcessBlock validates a block whose parent has already been processed, returning an error
+	// if it's invalid. An invalid block should be marked as such in the header chain, so that it
+	// drops out of the best chain.
+	ProcessBlock(node *headerchain.HeaderNode, block *proto.Block) error
+}
+
+// blockRequest is a block we've asked a peer for.
+type blockRequest struct {
+	peer        *peer.Peer
+	node        *headerchain.HeaderNode
+	requestedAt time.Time
+}
+
+// canDownloadBlocks reports whether a peer claims to be able to send us any block we ask for.
+func canDownloadBlocks(p *peer.Peer) bool {
+	return p.TheirVersion().Services&proto.NODE_NETWORK != 0
+}
+
+// blockInvType is how we ask the peer for blocks: with their witness data, if they have it.
+func blockInvType(p *peer.Peer) proto.InvType {
+	if p.TheirVersion().Services&proto.NODE_WITNESS != 0 {
+		return proto.INV_TYPE_WITNESS_BLOCK
+	}
+	return proto.INV_TYPE_BLOCK
+}
+
+// scheduleBlocks works out which blocks to ask each peer for. Blocks within the download window
+// of the best header chain that we don't have and haven't asked for are shared out in height
+// order among peers that have them and room in their in-flight window. The caller must hold the
+// lock, and should send the requests once it's released it.
+func (sm *SyncManager) scheduleBlocks() map[*peer.Peer][]*headerchain.HeaderNode {
+	// The last processed block may have been reorganised out of the best chain, in which case we
+	// need the blocks from where the chains forked
+	anchor := sm.processed
+	for !sm.chain.InBestChain(anchor) {
+		anchor = anchor.Parent
+	}
+
+	var candidates []*headerchain.HeaderNode
+	maxHeight := min(anchor.Height+BLOCK_DOWNLOAD_WINDOW, sm.chain.Height())
+	for height := anchor.Height + 1; height <= maxHeight; height++ {
+		node := sm.chain.NodeAtHeight(height)
+		if node == nil {
+			break
+		}
+		if _, ok := sm.blocksInFlight[node.Hash]; ok || sm.chain.HaveBlock(node.Hash) {
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	requests := make(map[*peer.Peer][]*headerchain.HeaderNode)
+	now := sm.now()
+	for p, state := range sm.peers {
+		if !canDownloadBlocks(p) {
+			continue
+		}
+
+		remaining := candidates[:0]
+		for _, node := range candidates {
+			if state.blocksInFlight >= MAX_BLOCKS_IN_FLIGHT_PER_PEER || node.Height > state.bestHeight || state.notFound[node.Hash] {
+				remaining = append(remaining, node)
+				continue
+			}
+			requests[p] = append(requests[p], node)
+			sm.blocksInFlight[node.Hash] = &blockRequest{peer: p, node: node, requestedAt: now}
+			state.blocksInFlight++
+		}
+		candidates = remaining
+		if len(candidates) == 0 {
+			break
+		}
+	}
+	return requests
+}
+
+// requestBlocks sends each peer a 'getdata' for the blocks scheduled for it.
+func (sm *SyncManager) requestBlocks(requests map[*peer.Peer][]*headerchain.HeaderNode) {
+	for p, nodes := range requests {
+		invType := blockInvType(p)
+		invList := make([]proto.InvVect, len(nodes))
+		for i, node := range nodes {
+			invList[i] = proto.InvVect{Type: invType, Hash: node.Hash}
+		}
+
+		if err := p.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: invList}); err != nil {
+			log.Printf("error requesting blocks from %s: %v", p.Addr(), err)
+			p.Close()
+		}
+	}
+}
+
+// cancelBlockRequests forgets the blocks we asked the peer for, so they can be asked for from
+// someone else. The caller must hold the lock.
+func (sm *SyncManager) cancelBlockRequests(p *peer.Peer) {
+	for hash, request := range sm.blocksInFlight {
+		if request.peer == p {
+			delete(sm.blocksInFlight, hash)
+		}
+	}
+	if state, ok := sm.peers[p]; ok {
+		state.blocksInFlight = 0
+	}
+}
+
+// completeBlockRequest notes that a block we asked for has arrived, or isn't coming. The caller must hold the lock.
+func (sm *SyncManager) completeBlockRequest(hash proto.Hash) {
+	request, ok := sm.blocksInFlight[hash]
+	if !ok {
+		return
+	}
+	delete(sm.blocksInFlight, hash)
+	if state, ok := sm.peers[request.peer]; ok {
+		state.blocksInFlight--
+	}
+}
+
+// OnInv handles announcements of new blocks and transactions. If we don't have a block's header we
+// ask for the headers leading up to it, as they'll tell us whether it's worth having; otherwise we
+// note that the peer has it, so it can be downloaded from them. Transactions we don't have are
+// asked for straight away.
+func (sm *SyncManager) OnInv(p *peer.Peer, msg *proto.Inv) {
+	var unknownHeader bool
+
+	sm.mu.Lock()
+	state, ok := sm.peers[p]
+	if !ok {
+		sm.mu.Unlock()
+		return
+	}
+	for _, iv := range msg.InvList {
+		if !iv.Type.IsBlock() {
+			continue
+		}
+
+		node := sm.chain.LookupNode(iv.Hash)
+		if node == nil {
+			unknownHeader = true
+			continue
+		}
+		if sm.chain.InBestChain(node) {
+			state.bestHeight = max(state.bestHeight, node.Height)
+		}
+	}
+	requests := sm.scheduleBlocks()
+	txs := sm.scheduleTxs(p, state, msg.InvList)
+	sm.mu.Unlock()
+
+	if unknownHeader {
+		sm.requestHeaders(p)
+	}
+	sm.requestBlocks(requests)
+	sm.requestTxs(p, txs)
+}
+
+// OnBlock checks a block a peer sent us and saves it, then hands on any blocks that are now ready
+// to be processed. Peers that send invalid blocks are disconnected.
+func (sm *SyncManager) OnBlock(p *peer.Peer, msg *proto.Block) {
+	hash := msg.BlockHash()
+	err := sm.chain.AcceptBlock(msg)
+
+	sm.mu.Lock()
+	sm.completeBlockRequest(hash)
+	sm.mu.Unlock()
+
+	var ruleErr headerchain.RuleError
+	switch {
+	case errors.As(err, &ruleErr):
+		log.Printf("disconnecting %s: invalid block: %v", p.Addr(), err)
+		p.Close()
+	case err != nil:
+		log.Printf("error processing block from %s: %v", p.Addr(), err)
+	}
+
+	sm.processBlocks()
+
+	sm.mu.Lock()
+	requests := sm.scheduleBlocks()
+	sm.mu.Unlock()
+	sm.requestBlocks(requests)
+}
+
+// processBlocks hands on blocks to the processor for as long as the next block on the best chain
+// has been downloaded. If the best chain has moved to another branch, that's from where it forks
+// with the blocks already processed.
+func (sm *SyncManager) processBlocks() {
+	sm.processMu.Lock()
+	defer sm.processMu.Unlock()
+
+	for {
+		anchor := sm.processed
+		for !sm.chain.InBestChain(anchor) {
+			anchor = anchor.Parent
+		}
+
+		next := sm.chain.NodeAtHeight(anchor.Height + 1)
+		if next == nil || next.Parent != anchor || !sm.chain.HaveBlock(next.Hash) {
+			return
+		}
+
+		if sm.processor != nil {
+			block, err := sm.loadBlock(next.Hash)
+			if err != nil {
+				log.Printf("error loading block %s: %v", next.Hash, err)
+				return
+			}
+			if err := sm.processor.ProcessBlock(next, block); err != nil {
+				log.Printf("error processing block %s: %v", next.Hash, err)
+				if !sm.chain.InBestChain(next) {
+					// It was invalid, so carry on with whatever the best chain is now
+					continue
+				}
+				return
+			}
+		}
+
+		sm.mu.Lock()
+		sm.processed = next
+		sm.mu.Unlock()
+
+		if next.Height%1000 == 0 || next.Height == sm.chain.Height() {
+			log.Printf("processed block %s at height %d", next.Hash, next.Height)
+		}
+	}
+}
+
+// loadBlock reads a downloaded block back from disk. Blocks aren't kept in memory while they wait
+// to be processed, as a whole download window of them could take up a lot of it.
+func (sm *SyncManager) loadBlock(hash proto.Hash) (*proto.Block, error) {
+	raw, err := sm.chain.ReadBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	block := &proto.Block{}
+	if err := block.UnmarshalFromReader(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("unable to decode stored block: %w", err)
+	}
+	return block, nil
+}
+
+// servesBlock reports whether a block is on the chain we've validated, so it's fit to send to
+// other peers. Without a processor nothing is validated beyond the headers, so that's the best
+// header chain, which invalid blocks drop out of.
+func (sm *SyncManager) servesBlock(hash proto.Hash) bool {
+	node := sm.chain.LookupNode(hash)
+	if node == nil {
+		return false
+	}
+	if sm.processor == nil {
+		return sm.chain.InBestChain(node)
+	}
+	return sm.chain.Ancestor(sm.processor.Tip(), node.Height) == node
+}
+
+// OnGetData sends a peer the blocks and transactions it asked for. Those we don't have, or won't
+// send it yet, go in a 'notfound'. That includes blocks we haven't validated, or found to be
+// invalid, which we keep in the store but don't pass on.
+func (sm *SyncManager) OnGetData(p *peer.Peer, msg *proto.GetData) {
+	var notFound []proto.InvVect
+	for _, iv := range msg.InvList {
+		if iv.Type.IsTx() {
+			tx := sm.findTx(p, iv)
+			if tx == nil {
+				notFound = append(notFound, iv)
+				continue
+			}
+			if err := p.WriteMessage(proto.MSG_TX, tx); err != nil {
+				log.Printf("error sending transaction to %s: %v", p.Addr(), err)
+				return
+			}
+			continue
+		}
+		if iv.Type&^proto.INV_WITNESS_FLAG != proto.INV_TYPE_BLOCK {
+			notFound = append(notFound, iv)
+			continue
+		}
+
+		if !sm.servesBlock(iv.Hash) {
+			notFound = append(notFound, iv)
+			continue
+		}
+		raw, err := sm.chain.ReadBlock(iv.Hash)
+		if err != nil {
+			notFound = append(notFound, iv)
+			continue
+		}
+
+		var payload proto.Marshallable = rawPayload(raw)
+		if iv.Type&proto.INV_WITNESS_FLAG == 0 {
+			// They want it without witness data, so it has to be decoded and re-encoded
+			var block proto.Block
+			if err := block.UnmarshalFromReader(bytes.NewReader(raw)); err != nil {
+				log.Printf("error decoding stored block %s: %v", iv.Hash, err)
+				notFound = append(notFound, iv)
+				continue
+			}
+			payload = strippedBlock{&block}
+		}
+
+		if err := p.WriteMessage(proto.MSG_BLOCK, payload); err != nil {
+			log.Printf("error sending block to %s: %v", p.Addr(), err)
+			return
+		}
+	}
+
+	if len(notFound) > 0 {
+		if err := p.WriteMessage(proto.MSG_NOTFOUND, proto.NotFound{InvList: notFound}); err != nil {
+			log.Printf("error sending notfound to %s: %v", p.Addr(), err)
+		}
+	}
+}
+
+// OnNotFound handles a peer not having blocks or transactions we asked for. We stop expecting them
+// from that peer, and ask someone else for the blocks instead.
+func (sm *SyncManager) OnNotFound(p *peer.Peer, msg *proto.NotFound) {
+	sm.mu.Lock()
+	state, ok := sm.peers[p]
+	if !ok {
+		sm.mu.Unlock()
+		return
+	}
+	for _, iv := range msg.InvList {
+		if request, ok := sm.txsInFlight[iv.Hash]; iv.Type.IsTx() && ok && request.peer == p {
+			sm.completeTxRequest(iv.Hash)
+			continue
+		}
+		if request, ok := sm.blocksInFlight[iv.Hash]; !iv.Type.IsBlock() || !ok || request.peer != p {
+			continue
+		}
+		log.Printf("%s doesn't have block %s", p.Addr(), iv.Hash)
+		sm.completeBlockRequest(iv.Hash)
+		state.notFound[iv.Hash] = true
+	}
+	requests := sm.scheduleBlocks()
+	sm.mu.Unlock()
+
+	sm.requestBlocks(requests)
+}
+
+// rawPayload is a message payload that's already been serialized.
+type rawPayload []byte
+
+func (r rawPayload) MarshalToWriter(w io.Writer) error {
+	_, err := w.Write(r)
+	return err
+}
+
+// strippedBlock is a block serialized without witness data.
+type strippedBlock struct {
+	*proto.Block
+}
+
+func (b strippedBlock) MarshalToWriter(w io.Writer) error {
+	return b.MarshalNoWitness(w)
+}
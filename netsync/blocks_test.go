@@ -0,0 +1,305 @@
+package netsync_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/netsync"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildBlocks returns a chain of n valid regtest blocks on top of genesis.
+func buildBlocks(n int) []proto.Block {
+	return buildBranch(config.RegTestParams.GenesisHeader, 0, n)
+}
+
+// buildBranch returns a chain of n valid regtest blocks on top of prev. Their coinbases are
+// numbered from first, so branches numbered differently don't share blocks.
+func buildBranch(prev proto.BlockHeader, first, n int) []proto.Block {
+	params := &config.RegTestParams
+	blocks := make([]proto.Block, 0, n)
+	for i := first; i < first+n; i++ {
+		coinbase := proto.Tx{
+			Version: 2,
+			TxIn: []proto.TxIn{{
+				PreviousOutPoint: proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX},
+				SignatureScript:  []byte{0x02, byte(i), byte(i >> 8)},
+				Sequence:         proto.MAX_TX_IN_SEQUENCE,
+			}},
+			TxOut: []proto.TxOut{{Value: 50 * 100_000_000, PkScript: []byte{0x51}}},
+		}
+		block := proto.Block{
+			Header: proto.BlockHeader{
+				Version:   4,
+				PrevBlock: prev.BlockHash(),
+				Timestamp: prev.Timestamp + 600,
+				Bits:      params.PowLimitBits,
+			},
+			Transactions: []proto.Tx{coinbase},
+		}
+		block.Header.MerkleRoot, _ = block.MerkleRoot()
+		for headerchain.CheckProofOfWork(block.Header, params.PowLimit) != nil {
+			block.Header.Nonce++
+		}
+		blocks = append(blocks, block)
+		prev = block.Header
+	}
+	return blocks
+}
+
+func headersOf(blocks []proto.Block) []proto.BlockHeader {
+	headers := make([]proto.BlockHeader, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header
+	}
+	return headers
+}
+
+// recordingProcessor checks blocks are handed to it in order, following any reorgs, and
+// remembers them.
+type recordingProcessor struct {
+	t      *testing.T
+	mu     sync.Mutex
+	tip    *headerchain.HeaderNode
+	hashes []proto.Hash
+}
+
+func (r *recordingProcessor) Tip() *headerchain.HeaderNode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tip
+}
+
+func (r *recordingProcessor) ProcessBlock(node *headerchain.HeaderNode, block *proto.Block) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Blocks follow on from the tip, or from where a new best chain forks from it
+	fork := r.tip
+	for fork.Height >= node.Height {
+		fork = fork.Parent
+	}
+	assert.Equal(r.t, fork, node.Parent, "block processed out of order")
+	assert.Equal(r.t, node.Hash, block.BlockHash())
+	r.tip = node
+	r.hashes = append(r.hashes, node.Hash)
+	return nil
+}
+
+func (r *recordingProcessor) processed() []proto.Hash {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]proto.Hash(nil), r.hashes...)
+}
+
+// syncingNode returns a sync manager whose chain has the headers for the blocks, but none of the
+// blocks themselves, and the processor it hands blocks to.
+func syncingNode(t *testing.T, blocks []proto.Block) (*netsync.SyncManager, *recordingProcessor) {
+	t.Helper()
+	chain := storedChain(t)
+	_, err := chain.ProcessHeaders(headersOf(blocks))
+	require.NoError(t, err)
+
+	processor := &recordingProcessor{t: t, tip: chain.NodeAtHeight(0)}
+	return netsync.New(chain, processor), processor
+}
+
+// serveBlocks answers 'getdata' on the remote end of a connection from the blocks, sending each
+// batch in reverse order so they arrive out of order. It returns how many requests were answered.
+func serveBlocks(p *peer.Peer, blocks []proto.Block) *counter {
+	byHash := make(map[proto.Hash]proto.Block, len(blocks))
+	for _, block := range blocks {
+		byHash[block.BlockHash()] = block
+	}
+
+	var served counter
+	go p.Run(&peer.Listeners{
+		OnGetData: func(p *peer.Peer, msg *proto.GetData) {
+			for i := len(msg.InvList) - 1; i >= 0; i-- {
+				if block, ok := byHash[msg.InvList[i].Hash]; ok {
+					served.add(1)
+					p.WriteMessage(proto.MSG_BLOCK, block)
+				}
+			}
+		},
+	})
+	return &served
+}
+
+type counter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *counter) add(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += n
+}
+
+func (c *counter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func allHashes(blocks []proto.Block) []proto.Hash {
+	hashes := make([]proto.Hash, len(blocks))
+	for i, block := range blocks {
+		hashes[i] = block.BlockHash()
+	}
+	return hashes
+}
+
+func TestSyncManager_DownloadsBlocksInParallel(t *testing.T) {
+	blocks := buildBlocks(100)
+	local, processor := syncingNode(t, blocks)
+
+	// Connect them all before any starts syncing, so the first can't fetch everything before the
+	// last has finished its handshake
+	var counters []*counter
+	var outbounds []*peer.Peer
+	for i := 0; i < 3; i++ {
+		outbound, inbound := connectedPeers(t, int32(len(blocks)))
+		counters = append(counters, serveBlocks(inbound, blocks))
+		outbounds = append(outbounds, outbound)
+	}
+	for _, outbound := range outbounds {
+		run(local, outbound)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(processor.processed()) == len(blocks)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, allHashes(blocks), processor.processed())
+
+	// Each block was asked for once, and shared between the peers
+	total := 0
+	for _, counter := range counters {
+		assert.NotZero(t, counter.get())
+		total += counter.get()
+	}
+	assert.Equal(t, len(blocks), total)
+}
+
+func TestSyncManager_ReassignsStalledBlocks(t *testing.T) {
+	blocks := buildBlocks(40)
+	local, processor := syncingNode(t, blocks)
+	local.BlockTimeout = 200 * time.Millisecond
+	local.StallCheckInterval = 50 * time.Millisecond
+	local.Start()
+	defer local.Stop()
+
+	// One peer that never sends what it's asked for...
+	stalling, stallingRemote := connectedPeers(t, int32(len(blocks)))
+	go stallingRemote.Run(&peer.Listeners{})
+	stallingDone := run(local, stalling)
+
+	// ...and one that does
+	outbound, inbound := connectedPeers(t, int32(len(blocks)))
+	serveBlocks(inbound, blocks)
+	run(local, outbound)
+
+	select {
+	case <-stallingDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalling peer was not disconnected")
+	}
+
+	require.Eventually(t, func() bool {
+		return len(processor.processed()) == len(blocks)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, allHashes(blocks), processor.processed())
+}
+
+func TestSyncManager_ReassignsStalledBlocksToOtherPeers(t *testing.T) {
+	blocks := buildBlocks(3 * netsync.MAX_BLOCKS_IN_FLIGHT_PER_PEER)
+	local, processor := syncingNode(t, blocks)
+	local.BlockTimeout = time.Second
+	local.StallCheckInterval = 50 * time.Millisecond
+	local.Start()
+	defer local.Stop()
+
+	// Peers that are asked for every block but never send them. They aren't handed to DonePeer
+	// when they're disconnected, so any blocks asked of them again would be stuck until they
+	// stalled a second time.
+	disconnected := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		stalling, stallingRemote := connectedPeers(t, int32(len(blocks)))
+		go func() {
+			stallingRemote.Run(&peer.Listeners{})
+			disconnected <- struct{}{}
+		}()
+		local.NewPeer(stalling)
+	}
+
+	outbound, inbound := connectedPeers(t, int32(len(blocks)))
+	serveBlocks(inbound, blocks)
+	run(local, outbound)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-disconnected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stalling peer was not disconnected")
+		}
+	}
+
+	// Everything comes from the peer that's left, well before another stall could be noticed
+	require.Eventually(t, func() bool {
+		return len(processor.processed()) == len(blocks)
+	}, local.BlockTimeout/2, 10*time.Millisecond)
+	assert.Equal(t, allHashes(blocks), processor.processed())
+}
+
+func TestSyncManager_ProcessesStoredBlocksOnStart(t *testing.T) {
+	blocks := buildBlocks(5)
+	chain := storedChain(t)
+	_, err := chain.ProcessHeaders(headersOf(blocks))
+	require.NoError(t, err)
+
+	// Downloaded last time, but not processed
+	for i := range blocks[:3] {
+		require.NoError(t, chain.AcceptBlock(&blocks[i]))
+	}
+
+	processor := &recordingProcessor{t: t, tip: chain.NodeAtHeight(0)}
+	local := netsync.New(chain, processor)
+	local.Start()
+	defer local.Stop()
+
+	assert.Equal(t, allHashes(blocks[:3]), processor.processed())
+}
+
+func TestSyncManager_FollowsReorg(t *testing.T) {
+	blocks := buildBlocks(5)
+	chain := storedChain(t)
+	_, err := chain.ProcessHeaders(headersOf(blocks))
+	require.NoError(t, err)
+	for i := range blocks {
+		require.NoError(t, chain.AcceptBlock(&blocks[i]))
+	}
+
+	processor := &recordingProcessor{t: t, tip: chain.NodeAtHeight(0)}
+	local := netsync.New(chain, processor)
+	local.Start()
+	defer local.Stop()
+	require.Equal(t, allHashes(blocks), processor.processed())
+
+	// A branch from height 3 with more work, whose blocks arrive after its headers
+	branch := buildBranch(blocks[2].Header, 1000, 4)
+	_, err = chain.ProcessHeaders(headersOf(branch))
+	require.NoError(t, err)
+	for i := range branch[:3] {
+		require.NoError(t, chain.AcceptBlock(&branch[i]))
+	}
+	local.OnBlock(nil, &branch[3])
+
+	assert.Equal(t, append(allHashes(blocks), allHashes(branch)...), processor.processed())
+	assert.Equal(t, branch[3].BlockHash(), processor.Tip().Hash)
+}
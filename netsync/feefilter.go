@@ -0,0 +1,114 @@
+package netsync
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// The protocol version from which nodes understand 'feefilter' (BIP133).
+	FEEFILTER_VERSION int32 = 70013
+
+	// On average how often we send each peer our fee filter, and how soon we send it once it's
+	// changed a lot, as per Bitcoin Core.
+	AVG_FEEFILTER_BROADCAST_INTERVAL = 10 * time.Minute
+	MAX_FEEFILTER_CHANGE_DELAY       = 5 * time.Minute
+
+	// How often we check whether peers are due our fee filter.
+	FEEFILTER_CHECK_INTERVAL = 10 * time.Second
+)
+
+// feeFilterHandler periodically sends peers our fee filter.
+func (sm *SyncManager) feeFilterHandler() {
+	defer sm.wg.Done()
+
+	ticker := time.NewTicker(sm.FeeFilterCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.quit:
+			return
+		case <-ticker.C:
+			sm.sendFeeFilters()
+		}
+	}
+}
+
+// sendFeeFilters sends our fee filter to the peers that are due it, so they don't announce
+// transactions the pool wouldn't accept.
+func (sm *SyncManager) sendFeeFilters() {
+	if sm.TxPool == nil {
+		return
+	}
+	minFee, minRelayFee := sm.TxPool.MinFee(), sm.TxPool.MinRelayFee()
+
+	filters := make(map[*peer.Peer]mempool.FeeRate)
+	sm.mu.Lock()
+	for p, state := range sm.peers {
+		if filter, ok := sm.nextFeeFilter(p, state, minFee, minRelayFee); ok {
+			filters[p] = filter
+		}
+	}
+	sm.mu.Unlock()
+
+	for p, filter := range filters {
+		if err := p.WriteMessage(proto.MSG_FEEFILTER, proto.FeeFilter{MinFee: int64(filter)}); err != nil {
+			log.Printf("error sending fee filter to %s: %v", p.Addr(), err)
+		}
+	}
+}
+
+// nextFeeFilter returns the fee filter to send a peer, if it's time to send one and it's changed,
+// and otherwise brings the next one forward if the pool's minimum fee has changed a lot. While
+// we're catching up with the chain the filter is as high as it goes, as we don't want any
+// transactions yet. As per Bitcoin Core, it's rounded so as not to give away exactly what's in
+// the pool, and sent at random intervals. The caller must hold the lock.
+func (sm *SyncManager) nextFeeFilter(p *peer.Peer, state *peerState, minFee, minRelayFee mempool.FeeRate) (mempool.FeeRate, bool) {
+	if p.ProtocolVersion() < FEEFILTER_VERSION {
+		return 0, false
+	}
+
+	now := sm.now()
+	if sm.catchingUp() {
+		minFee = headerchain.MAX_MONEY
+	} else if state.feeFilterSent == sm.maxFeeFilter {
+		// We've just caught up, so let them know straight away
+		state.nextFeeFilter = time.Time{}
+	}
+
+	if now.After(state.nextFeeFilter) {
+		state.nextFeeFilter = now.Add(poissonDelay(AVG_FEEFILTER_BROADCAST_INTERVAL))
+		filter := max(sm.feeRounder.Round(minFee), minRelayFee)
+		if filter == state.feeFilterSent {
+			return 0, false
+		}
+		state.feeFilterSent = filter
+		return filter, true
+	}
+
+	sent := state.feeFilterSent
+	if now.Add(MAX_FEEFILTER_CHANGE_DELAY).Before(state.nextFeeFilter) && (minFee < 3*sent/4 || minFee > 4*sent/3) {
+		state.nextFeeFilter = now.Add(time.Duration(rand.Int63n(int64(MAX_FEEFILTER_CHANGE_DELAY))))
+	}
+	return 0, false
+}
+
+// OnFeeFilter records the lowest fee rate of the transactions a peer wants to hear about.
+func (sm *SyncManager) OnFeeFilter(p *peer.Peer, msg *proto.FeeFilter) {
+	if msg.MinFee < 0 || msg.MinFee > headerchain.MAX_MONEY {
+		return
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if state, ok := sm.peers[p]; ok {
+		state.feeFilter = mempool.FeeRate(msg.MinFee)
+	}
+}
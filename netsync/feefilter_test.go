@@ -0,0 +1,87 @@
+package netsync_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/netsync"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteFeeFilters returns a channel of the fee filters the remote end of a connection receives.
+func remoteFeeFilters(p *peer.Peer) <-chan *proto.FeeFilter {
+	received := make(chan *proto.FeeFilter, 10)
+	go p.Run(&peer.Listeners{
+		OnFeeFilter: func(p *peer.Peer, msg *proto.FeeFilter) { received <- msg },
+	})
+	return received
+}
+
+func nextFeeFilter(t *testing.T, received <-chan *proto.FeeFilter) int64 {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg.MinFee
+	case <-time.After(5 * time.Second):
+		t.Fatal("no fee filter received")
+		return 0
+	}
+}
+
+func TestSyncManager_SendsFeeFilters(t *testing.T) {
+	// Once caught up, it's the pool's minimum fee rate, rounded to within a step either way
+	local := caughtUpNode(t, &fakeTxPool{have: map[proto.Hash]bool{}, minFee: 50_000})
+	outbound, inbound := connectedPeers(t, 0)
+	run(local, outbound)
+	filter := nextFeeFilter(t, remoteFeeFilters(inbound))
+	assert.InDelta(t, 50_000, float64(filter), 50_000*(mempool.FEEFILTER_SPACING-1))
+
+	// Until then, it's as high as it goes
+	local = netsync.New(storedChain(t), nil)
+	local.TxPool = &fakeTxPool{have: map[proto.Hash]bool{}}
+	outbound, inbound = connectedPeers(t, 0)
+	run(local, outbound)
+	maxFilter := mempool.NewFeeFilterRounder(mempool.INCREMENTAL_RELAY_FEE).Round(headerchain.MAX_MONEY)
+	assert.Equal(t, int64(maxFilter), nextFeeFilter(t, remoteFeeFilters(inbound)))
+}
+
+func TestSyncManager_HonoursFeeFilters(t *testing.T) {
+	cheap, dear := testTx(1), testTx(2)
+	pool := &fakeTxPool{
+		have: map[proto.Hash]bool{},
+		fees: map[proto.Hash]int64{cheap.TxHash(): 5_000, dear.TxHash(): 20_000},
+	}
+	local := caughtUpNode(t, pool)
+	local.OutboundTrickleInterval = 10 * time.Millisecond
+
+	source, sourceRemote := connectedPeers(t, 0)
+	run(local, source)
+	dest, destRemote := connectedPeers(t, 0)
+	run(local, dest)
+	destReceived := remoteMessages(destRemote)
+
+	// Wait for the filter to be dealt with by asking for something that isn't there
+	require.NoError(t, destRemote.WriteMessage(proto.MSG_FEEFILTER, proto.FeeFilter{MinFee: 10_000}))
+	require.NoError(t, destRemote.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: []proto.InvVect{
+		{Type: proto.INV_TYPE_WTX, Hash: cheap.WitnessHash()},
+	}}))
+	_, ok := nextMessage(t, destReceived).(*proto.NotFound)
+	require.True(t, ok)
+
+	// Only the transaction paying enough is announced
+	require.NoError(t, sourceRemote.WriteMessage(proto.MSG_TX, cheap))
+	require.NoError(t, sourceRemote.WriteMessage(proto.MSG_TX, dear))
+	inv, ok := nextMessage(t, destReceived).(*proto.Inv)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{{Type: proto.INV_TYPE_WTX, Hash: dear.WitnessHash()}}, inv.InvList)
+	select {
+	case msg := <-destReceived:
+		t.Fatalf("unexpected %T", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
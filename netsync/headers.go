@@ -0,0 +1,147 @@
+package netsync
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+// chooseSyncPeer picks the peer that claims the longest chain to sync from, if we don't have a
+// sync peer and any of them are ahead of us. It returns the newly chosen peer, or nil. The caller
+// must hold the lock.
+func (sm *SyncManager) chooseSyncPeer() *peer.Peer {
+	if sm.syncPeer != nil {
+		return nil
+	}
+
+	var best *peer.Peer
+	bestHeight := sm.chain.Height()
+	for p, state := range sm.peers {
+		if state.bestHeight > bestHeight {
+			best, bestHeight = p, state.bestHeight
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	sm.syncPeer = best
+	sm.requestedAt = sm.now()
+	log.Printf("syncing headers from %s, which has height %d", best.Addr(), bestHeight)
+	return best
+}
+
+// requestHeaders asks the peer for the headers following our best chain.
+func (sm *SyncManager) requestHeaders(p *peer.Peer) {
+	msg := proto.GetHeaders{
+		Version:            uint32(p.ProtocolVersion()),
+		BlockLocatorHashes: sm.chain.BlockLocator(),
+	}
+	if err := p.WriteMessage(proto.MSG_GETHEADERS, msg); err != nil {
+		log.Printf("error requesting headers from %s: %v", p.Addr(), err)
+		p.Close()
+	}
+}
+
+// OnHeaders adds the headers a peer sent to our chain, and asks for more if there are likely to
+// be some. Peers that send invalid headers are disconnected.
+func (sm *SyncManager) OnHeaders(p *peer.Peer, msg *proto.Headers) {
+	headers := msg.Headers
+	_, err := sm.chain.ProcessHeaders(headers)
+
+	sm.mu.Lock()
+	state, ok := sm.peers[p]
+	if !ok {
+		sm.mu.Unlock()
+		return
+	}
+	if p == sm.syncPeer {
+		sm.requestedAt = time.Time{}
+	}
+
+	var ruleErr headerchain.RuleError
+	switch {
+	case errors.As(err, &ruleErr) && ruleErr.Code == headerchain.ErrOrphanHeader:
+		// They're on a chain we don't know the start of, perhaps because they announced a new
+		// block. Ask for the headers in between, unless they keep doing it.
+		state.unconnecting++
+		tooMany := state.unconnecting > MAX_UNCONNECTING_HEADERS
+		sm.mu.Unlock()
+		if tooMany {
+			log.Printf("disconnecting %s: too many headers that don't connect", p.Addr())
+			p.Close()
+			return
+		}
+		sm.requestHeaders(p)
+		return
+
+	case errors.As(err, &ruleErr) && ruleErr.Code == headerchain.ErrDuplicateHeader:
+		// Most likely an invalid header we've already rejected; either way there's nothing more
+		// to do with these.
+		sm.mu.Unlock()
+		return
+
+	case errors.As(err, &ruleErr):
+		sm.mu.Unlock()
+		log.Printf("disconnecting %s: invalid headers: %v", p.Addr(), err)
+		p.Close()
+		return
+
+	case err != nil:
+		// Our problem rather than theirs, most likely a full disk
+		sm.mu.Unlock()
+		log.Printf("error processing headers from %s: %v", p.Addr(), err)
+		return
+	}
+
+	state.unconnecting = 0
+	if len(headers) > 0 {
+		if node := sm.chain.LookupNode(headers[len(headers)-1].BlockHash()); node != nil {
+			state.bestHeight = max(state.bestHeight, node.Height)
+		}
+	}
+
+	// A full batch means there are probably more where those came from
+	more := len(headers) == proto.MAX_HEADERS_RESULTS
+	if more && p == sm.syncPeer {
+		sm.requestedAt = sm.now()
+	}
+	if !more && p == sm.syncPeer {
+		// They've nothing more to give us; if another peer claims to be further ahead, move on
+		// to them
+		if sm.chain.Height() < sm.progress().PeerHeight {
+			state.bestHeight = sm.chain.Height()
+		}
+		sm.syncPeer = nil
+	}
+	progress := sm.progress()
+	var next *peer.Peer
+	if !more {
+		next = sm.chooseSyncPeer()
+	}
+	requests := sm.scheduleBlocks()
+	sm.mu.Unlock()
+
+	if len(headers) > 0 {
+		log.Printf("synced headers to height %d of %d (%.2f%%)", progress.Height, progress.PeerHeight, 100*progress.Fraction())
+	}
+	if more {
+		sm.requestHeaders(p)
+	}
+	if next != nil {
+		sm.requestHeaders(next)
+	}
+	sm.requestBlocks(requests)
+}
+
+// OnGetHeaders answers a peer's request for headers from our best chain.
+func (sm *SyncManager) OnGetHeaders(p *peer.Peer, msg *proto.GetHeaders) {
+	headers := sm.chain.LocateHeaders(msg.BlockLocatorHashes, msg.HashStop, proto.MAX_HEADERS_RESULTS)
+	if err := p.WriteMessage(proto.MSG_HEADERS, proto.Headers{Headers: headers}); err != nil {
+		log.Printf("error sending headers to %s: %v", p.Addr(), err)
+	}
+}
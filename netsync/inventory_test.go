@@ -0,0 +1,199 @@
+package netsync_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/blockstore"
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/netsync"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlock returns a valid regtest block on top of genesis.
+func testBlock() proto.Block {
+	params := &config.RegTestParams
+	coinbase := proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX},
+			SignatureScript:  []byte{0x01, 0x01},
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{{Value: 50 * 100_000_000, PkScript: []byte{0x51}}},
+	}
+	block := proto.Block{
+		Header: proto.BlockHeader{
+			Version:   4,
+			PrevBlock: params.GenesisHash,
+			Timestamp: params.GenesisHeader.Timestamp + 600,
+			Bits:      params.PowLimitBits,
+		},
+		Transactions: []proto.Tx{coinbase},
+	}
+	block.Header.MerkleRoot, _ = block.MerkleRoot()
+	for headerchain.CheckProofOfWork(block.Header, params.PowLimit) != nil {
+		block.Header.Nonce++
+	}
+	return block
+}
+
+// storedChain returns a regtest chain backed by a block store in a temporary directory.
+func storedChain(t *testing.T) *headerchain.HeaderChain {
+	t.Helper()
+	store, err := blockstore.Open(t.TempDir(), config.MAGIC_REGTEST)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	chain, err := headerchain.Load(&config.RegTestParams, store)
+	require.NoError(t, err)
+	return chain
+}
+
+// remoteMessages runs the remote end of the connection, passing on what it receives.
+func remoteMessages(p *peer.Peer) <-chan proto.Payload {
+	received := make(chan proto.Payload, 10)
+	go p.Run(&peer.Listeners{
+		OnGetHeaders: func(p *peer.Peer, msg *proto.GetHeaders) { received <- msg },
+		OnGetData:    func(p *peer.Peer, msg *proto.GetData) { received <- msg },
+		OnNotFound:   func(p *peer.Peer, msg *proto.NotFound) { received <- msg },
+		OnBlock:      func(p *peer.Peer, msg *proto.Block) { received <- msg },
+		OnInv:        func(p *peer.Peer, msg *proto.Inv) { received <- msg },
+		OnTx:         func(p *peer.Peer, msg *proto.Tx) { received <- msg },
+	})
+	return received
+}
+
+func nextMessage(t *testing.T, received <-chan proto.Payload) proto.Payload {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestSyncManager_OnInv(t *testing.T) {
+	chain := storedChain(t)
+	local := netsync.New(chain, nil)
+
+	outbound, inbound := connectedPeers(t, 0)
+	run(local, outbound)
+	received := remoteMessages(inbound)
+
+	// For a block we've not heard of, we ask for the headers leading up to it
+	block := testBlock()
+	blockInv := proto.InvVect{Type: proto.INV_TYPE_BLOCK, Hash: block.BlockHash()}
+	require.NoError(t, inbound.WriteMessage(proto.MSG_INV, proto.Inv{InvList: []proto.InvVect{blockInv}}))
+	getHeaders, ok := nextMessage(t, received).(*proto.GetHeaders)
+	require.True(t, ok)
+	assert.Equal(t, []proto.Hash{config.RegTestParams.GenesisHash}, getHeaders.BlockLocatorHashes)
+
+	// Once we have the header, we ask for the block itself
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{block.Header})
+	require.NoError(t, err)
+	require.NoError(t, inbound.WriteMessage(proto.MSG_INV, proto.Inv{InvList: []proto.InvVect{blockInv}}))
+	getData, ok := nextMessage(t, received).(*proto.GetData)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{{Type: proto.INV_TYPE_WITNESS_BLOCK, Hash: block.BlockHash()}}, getData.InvList)
+
+	// Which gets stored when it arrives
+	require.NoError(t, inbound.WriteMessage(proto.MSG_BLOCK, block))
+	require.Eventually(t, func() bool {
+		_, err := chain.ReadBlock(block.BlockHash())
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSyncManager_OnGetData(t *testing.T) {
+	chain := storedChain(t)
+	block := testBlock()
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{block.Header})
+	require.NoError(t, err)
+	require.NoError(t, chain.AcceptBlock(&block))
+	local := netsync.New(chain, nil)
+
+	outbound, inbound := connectedPeers(t, 0)
+	run(local, outbound)
+	received := remoteMessages(inbound)
+
+	tx := proto.InvVect{Type: proto.INV_TYPE_WITNESS_TX, Hash: block.Transactions[0].TxHash()}
+	missing := proto.InvVect{Type: proto.INV_TYPE_BLOCK, Hash: config.RegTestParams.GenesisHash}
+	getData := proto.GetData{InvList: []proto.InvVect{
+		{Type: proto.INV_TYPE_WITNESS_BLOCK, Hash: block.BlockHash()},
+		{Type: proto.INV_TYPE_BLOCK, Hash: block.BlockHash()},
+		tx,
+		missing,
+	}}
+	require.NoError(t, inbound.WriteMessage(proto.MSG_GETDATA, getData))
+
+	for i := 0; i < 2; i++ {
+		gotBlock, ok := nextMessage(t, received).(*proto.Block)
+		require.True(t, ok)
+		assert.Equal(t, block, *gotBlock)
+	}
+
+	notFound, ok := nextMessage(t, received).(*proto.NotFound)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{tx, missing}, notFound.InvList)
+}
+
+func TestSyncManager_OnGetDataOnlyServesValidatedBlocks(t *testing.T) {
+	chain := storedChain(t)
+	block := testBlock()
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{block.Header})
+	require.NoError(t, err)
+	require.NoError(t, chain.AcceptBlock(&block))
+	blockInv := proto.InvVect{Type: proto.INV_TYPE_WITNESS_BLOCK, Hash: block.BlockHash()}
+
+	// A block the processor hasn't got to yet
+	processor := &recordingProcessor{t: t, tip: chain.NodeAtHeight(0)}
+	local := netsync.New(chain, processor)
+	outbound, inbound := connectedPeers(t, 0)
+	run(local, outbound)
+	received := remoteMessages(inbound)
+	require.NoError(t, inbound.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: []proto.InvVect{blockInv}}))
+	notFound, ok := nextMessage(t, received).(*proto.NotFound)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{blockInv}, notFound.InvList)
+
+	// A block that's been found to be invalid
+	require.NoError(t, chain.InvalidateBlock(chain.LookupNode(block.BlockHash())))
+	local = netsync.New(chain, nil)
+	outbound, inbound = connectedPeers(t, 0)
+	run(local, outbound)
+	received = remoteMessages(inbound)
+	require.NoError(t, inbound.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: []proto.InvVect{blockInv}}))
+	notFound, ok = nextMessage(t, received).(*proto.NotFound)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{blockInv}, notFound.InvList)
+}
+
+func TestSyncManager_DisconnectsInvalidBlock(t *testing.T) {
+	chain := storedChain(t)
+	block := testBlock()
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{block.Header})
+	require.NoError(t, err)
+	local := netsync.New(chain, nil)
+
+	outbound, inbound := connectedPeers(t, 0)
+	done := run(local, outbound)
+
+	// Transactions that don't match the header's merkle root
+	block.Transactions[0].TxOut[0].Value++
+	require.NoError(t, inbound.WriteMessage(proto.MSG_BLOCK, block))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer was not disconnected")
+	}
+	_, err = chain.ReadBlock(block.BlockHash())
+	assert.Error(t, err)
+}
@@ -0,0 +1,292 @@
+package netsync
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// How long the sync peer has to answer a 'getheaders' before we give up on it and try another.
+	HEADERS_RESPONSE_TIMEOUT = 2 * time.Minute
+
+	// How often to check whether any peer has stalled.
+	STALL_CHECK_INTERVAL = 15 * time.Second
+
+	// How many headers that don't connect to our chain we'll put up with from a peer before
+	// disconnecting it.
+	MAX_UNCONNECTING_HEADERS = 10
+)
+
+// peerState is what the sync manager tracks about each peer.
+type peerState struct {
+	// The height of the peer's best chain, as far as we know. It starts off as the height the
+	// peer advertised in its version message.
+	bestHeight int32
+
+	// How many 'headers' messages in a row didn't connect to our chain.
+	unconnecting int
+
+	// How many blocks we've asked the peer for that haven't arrived yet.
+	blocksInFlight int
+
+	// Blocks the peer told us it doesn't have, so we don't ask again.
+	notFound map[proto.Hash]bool
+
+	// How many transactions we've asked the peer for that haven't arrived yet.
+	txsInFlight int
+
+	// Transactions waiting to be announced to the peer, and whether the next batch has been
+	// scheduled.
+	txsToAnnounce    []*mempool.TxDesc
+	trickleScheduled bool
+
+	// The lowest fee rate of the transactions the peer wants to hear about, the fee filter we
+	// last sent it, and when we're next due to send it ours.
+	feeFilter     mempool.FeeRate
+	feeFilterSent mempool.FeeRate
+	nextFeeFilter time.Time
+}
+
+// Progress describes how far through syncing headers we are.
+type Progress struct {
+	// The height of our best header chain.
+	Height int32
+
+	// The best height our peers have told us about.
+	PeerHeight int32
+}
+
+// Fraction returns how far we are through syncing, between 0 and 1.
+func (p Progress) Fraction() float64 {
+	if p.PeerHeight <= 0 || p.Height >= p.PeerHeight {
+		return 1
+	}
+	return float64(p.Height) / float64(p.PeerHeight)
+}
+
+// SyncManager downloads the chain from our peers. It picks the peer that claims the longest
+// chain and asks it for headers, a batch at a time, until it has caught up; if that peer stalls or
+// sends an invalid header it's disconnected and another is chosen. Meanwhile, the blocks for
+// those headers are fetched from all our peers at once and handed on in order to be processed.
+// It also follows announcements of new blocks and transactions, announces the transactions it
+// accepts to other nodes, and answers their requests for headers, blocks and transactions. Peers
+// are sent fee filters so they only announce transactions the pool would accept.
+type SyncManager struct {
+	// How long a peer has to send a block we asked for before we give up on it, and how often
+	// that's checked. They can be changed before Start is called.
+	BlockTimeout       time.Duration
+	StallCheckInterval time.Duration
+
+	// On average how often transactions are announced to inbound and outbound peers. They can be
+	// changed before Start is called.
+	InboundTrickleInterval  time.Duration
+	OutboundTrickleInterval time.Duration
+
+	// How often to check whether peers are due our fee filter. It can be changed before Start is
+	// called.
+	FeeFilterCheckInterval time.Duration
+
+	// Where transactions announced by peers go, once we've caught up with the chain, to be
+	// announced to the others if they're accepted. If it's nil they're ignored. It can be set
+	// before Start is called.
+	TxPool TxPool
+
+	chain     *headerchain.HeaderChain
+	processor BlockProcessor
+	now       func() time.Time
+
+	mu       sync.Mutex
+	peers    map[*peer.Peer]*peerState
+	syncPeer *peer.Peer
+
+	// When we sent the sync peer the 'getheaders' it hasn't answered yet; zero if there isn't one.
+	requestedAt time.Time
+
+	// The blocks we've asked for and not yet received.
+	blocksInFlight map[proto.Hash]*blockRequest
+
+	// processMu is held while handing blocks to the processor, to keep them in order.
+	processMu sync.Mutex
+	processed *headerchain.HeaderNode // The last block handed on
+
+	// The transactions we've asked for and not yet received, and those we've rejected since the
+	// tip was last rejectsTip.
+	txsInFlight   map[proto.Hash]*txRequest
+	recentRejects map[proto.Hash]bool
+	rejectsTip    proto.Hash
+
+	// When the inbound peers are next sent the transactions waiting to be announced to them
+	nextInboundTrickle time.Time
+
+	// Rounds the fee filters we send, and the filter we send while catching up
+	feeRounder   *mempool.FeeFilterRounder
+	maxFeeFilter mempool.FeeRate
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a sync manager that adds the headers it downloads to the chain, and hands blocks to
+// the processor in order. The processor may be nil, in which case blocks are just stored.
+func New(chain *headerchain.HeaderChain, processor BlockProcessor) *SyncManager {
+	processed := chain.NodeAtHeight(0)
+	if processor != nil {
+		processed = processor.Tip()
+	}
+
+	feeRounder := mempool.NewFeeFilterRounder(mempool.INCREMENTAL_RELAY_FEE)
+
+	return &SyncManager{
+		BlockTimeout:       BLOCK_DOWNLOAD_TIMEOUT,
+		StallCheckInterval: STALL_CHECK_INTERVAL,
+
+		InboundTrickleInterval:  INBOUND_INVENTORY_BROADCAST_INTERVAL,
+		OutboundTrickleInterval: OUTBOUND_INVENTORY_BROADCAST_INTERVAL,
+		FeeFilterCheckInterval:  FEEFILTER_CHECK_INTERVAL,
+
+		chain:          chain,
+		processor:      processor,
+		now:            time.Now,
+		peers:          make(map[*peer.Peer]*peerState),
+		blocksInFlight: make(map[proto.Hash]*blockRequest),
+		processed:      processed,
+		txsInFlight:    make(map[proto.Hash]*txRequest),
+		recentRejects:  make(map[proto.Hash]bool),
+		feeRounder:     feeRounder,
+		maxFeeFilter:   feeRounder.Round(headerchain.MAX_MONEY),
+		quit:           make(chan struct{}),
+	}
+}
+
+// Start hands on any blocks that were already downloaded, and begins watching for stalled peers
+// and sending fee filters.
+func (sm *SyncManager) Start() {
+	sm.processBlocks()
+
+	sm.wg.Add(2)
+	go sm.stallHandler()
+	go sm.feeFilterHandler()
+}
+
+// Stop halts the stall watcher and fee filter sender, and waits for them to finish.
+func (sm *SyncManager) Stop() {
+	close(sm.quit)
+	sm.wg.Wait()
+}
+
+// Progress reports our height relative to the best height our peers have told us about.
+func (sm *SyncManager) Progress() Progress {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.progress()
+}
+
+func (sm *SyncManager) progress() Progress {
+	progress := Progress{Height: sm.chain.Height()}
+	for _, state := range sm.peers {
+		progress.PeerHeight = max(progress.PeerHeight, state.bestHeight)
+	}
+	return progress
+}
+
+// SyncPeer returns the peer we're downloading headers from, or nil if there isn't one.
+func (sm *SyncManager) SyncPeer() *peer.Peer {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.syncPeer
+}
+
+// NewPeer should be called once the handshake with a peer has completed, before its messages are
+// dispatched.
+func (sm *SyncManager) NewPeer(p *peer.Peer) {
+	sm.mu.Lock()
+	sm.peers[p] = &peerState{
+		bestHeight: p.TheirVersion().StartHeight,
+		notFound:   make(map[proto.Hash]bool),
+	}
+	next := sm.chooseSyncPeer()
+	requests := sm.scheduleBlocks()
+	sm.mu.Unlock()
+
+	if next != nil {
+		sm.requestHeaders(next)
+	}
+	sm.requestBlocks(requests)
+	sm.sendFeeFilters()
+}
+
+// DonePeer should be called once a peer has disconnected. Any blocks it was sending us are asked
+// for from other peers, as are transactions once someone else announces them.
+func (sm *SyncManager) DonePeer(p *peer.Peer) {
+	sm.mu.Lock()
+	delete(sm.peers, p)
+	if sm.syncPeer == p {
+		sm.syncPeer = nil
+		sm.requestedAt = time.Time{}
+	}
+	sm.cancelBlockRequests(p)
+	sm.cancelTxRequests(p)
+	next := sm.chooseSyncPeer()
+	requests := sm.scheduleBlocks()
+	sm.mu.Unlock()
+
+	if next != nil {
+		sm.requestHeaders(next)
+	}
+	sm.requestBlocks(requests)
+}
+
+// stallHandler periodically checks that our peers are answering our requests.
+func (sm *SyncManager) stallHandler() {
+	defer sm.wg.Done()
+
+	ticker := time.NewTicker(sm.StallCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.quit:
+			return
+		case <-ticker.C:
+			sm.checkStall()
+		}
+	}
+}
+
+// checkStall disconnects peers that have taken too long to answer, whether that's the sync peer
+// with headers or any peer with blocks. They're forgotten straight away, so that their blocks are
+// asked for from other peers, and another sync peer is chosen once the old one has gone.
+func (sm *SyncManager) checkStall() {
+	now := sm.now()
+	stalled := make(map[*peer.Peer]bool)
+
+	sm.mu.Lock()
+	if sm.syncPeer != nil && !sm.requestedAt.IsZero() && now.Sub(sm.requestedAt) >= HEADERS_RESPONSE_TIMEOUT {
+		log.Printf("disconnecting %s: sync peer stalled", sm.syncPeer.Addr())
+		stalled[sm.syncPeer] = true
+	}
+	for hash, request := range sm.blocksInFlight {
+		if now.Sub(request.requestedAt) >= sm.BlockTimeout && !stalled[request.peer] {
+			log.Printf("disconnecting %s: stalled sending block %s", request.peer.Addr(), hash)
+			stalled[request.peer] = true
+		}
+	}
+	for p := range stalled {
+		sm.cancelBlockRequests(p)
+		delete(sm.peers, p)
+	}
+	sm.expireTxRequests(now)
+	requests := sm.scheduleBlocks()
+	sm.mu.Unlock()
+
+	for p := range stalled {
+		p.Close()
+	}
+	sm.requestBlocks(requests)
+}
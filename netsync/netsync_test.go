@@ -0,0 +1,176 @@
+package netsync_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/netsync"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildChain returns a regtest header chain with n headers on top of genesis.
+func buildChain(t *testing.T, n int) *headerchain.HeaderChain {
+	t.Helper()
+	params := &config.RegTestParams
+	chain := headerchain.New(params)
+
+	prev := params.GenesisHeader
+	headers := make([]proto.BlockHeader, 0, n)
+	for i := 0; i < n; i++ {
+		header := proto.BlockHeader{
+			Version:    4,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: proto.DoubleSHA256([]byte{byte(i), byte(i >> 8)}),
+			Timestamp:  prev.Timestamp + 600,
+			Bits:       params.PowLimitBits,
+		}
+		for headerchain.CheckProofOfWork(header, params.PowLimit) != nil {
+			header.Nonce++
+		}
+		headers = append(headers, header)
+		prev = header
+	}
+
+	_, err := chain.ProcessHeaders(headers)
+	require.NoError(t, err)
+	return chain
+}
+
+// connectedPeers returns an outbound peer from a node at height 0 and an inbound peer to a node at
+// the given height, connected to each other over loopback TCP and handshaken.
+func connectedPeers(t *testing.T, remoteHeight int32) (*peer.Peer, *peer.Peer) {
+	t.Helper()
+	remoteCfg := config.Default()
+	remoteCfg.SetNetwork("regtest")
+	remoteCfg.StartHeight = remoteHeight
+	remoteCfg.Services = proto.NODE_NETWORK | proto.NODE_WITNESS
+	return connectedPeersWith(t, remoteCfg)
+}
+
+// connectedPeersWith is connectedPeers for a remote node with the given config.
+func connectedPeersWith(t *testing.T, remoteCfg *config.Config) (*peer.Peer, *peer.Peer) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	require.NotNil(t, server)
+
+	localCfg := config.Default()
+	localCfg.SetNetwork("regtest")
+
+	outbound := peer.NewOutbound(localCfg, peer.NewNonceSet(), client)
+	inbound := peer.NewInbound(remoteCfg, peer.NewNonceSet(), server)
+	t.Cleanup(func() {
+		outbound.Close()
+		inbound.Close()
+	})
+
+	errs := make(chan error, 2)
+	go func() { errs <- outbound.Handshake() }()
+	go func() { errs <- inbound.Handshake() }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	return outbound, inbound
+}
+
+// run dispatches the peer's messages to the sync manager until it disconnects. The returned
+// channel is closed when it does.
+func run(sm *netsync.SyncManager, p *peer.Peer) <-chan struct{} {
+	done := make(chan struct{})
+	sm.NewPeer(p)
+	go func() {
+		defer close(done)
+		defer sm.DonePeer(p)
+		p.Run(&peer.Listeners{
+			OnHeaders:    sm.OnHeaders,
+			OnGetHeaders: sm.OnGetHeaders,
+			OnInv:        sm.OnInv,
+			OnGetData:    sm.OnGetData,
+			OnNotFound:   sm.OnNotFound,
+			OnBlock:      sm.OnBlock,
+			OnTx:         sm.OnTx,
+			OnFeeFilter:  sm.OnFeeFilter,
+		})
+	}()
+	return done
+}
+
+func TestSyncManager_SyncsHeaders(t *testing.T) {
+	// More than one batch's worth, so we have to ask more than once
+	const height = proto.MAX_HEADERS_RESULTS + 500
+
+	remoteChain := buildChain(t, height)
+	localChain := headerchain.New(&config.RegTestParams)
+	local := netsync.New(localChain, nil)
+	remote := netsync.New(remoteChain, nil)
+
+	outbound, inbound := connectedPeers(t, height)
+	run(remote, inbound)
+	run(local, outbound)
+
+	require.Eventually(t, func() bool {
+		return localChain.Height() == height
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, remoteChain.Tip().Hash, localChain.Tip().Hash)
+	assert.Equal(t, netsync.Progress{Height: height, PeerHeight: height}, local.Progress())
+	assert.Equal(t, 1.0, local.Progress().Fraction())
+
+	// Having caught up, we're no longer syncing from anyone
+	require.Eventually(t, func() bool {
+		return local.SyncPeer() == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSyncManager_DisconnectsInvalidHeaders(t *testing.T) {
+	localChain := headerchain.New(&config.RegTestParams)
+	local := netsync.New(localChain, nil)
+
+	outbound, inbound := connectedPeers(t, 1)
+	done := run(local, outbound)
+	assert.Equal(t, outbound, local.SyncPeer())
+	assert.Equal(t, netsync.Progress{Height: 0, PeerHeight: 1}, local.Progress())
+	assert.Equal(t, 0.0, local.Progress().Fraction())
+
+	// A header that doesn't meet its own target
+	params := &config.RegTestParams
+	header := proto.BlockHeader{
+		Version:   4,
+		PrevBlock: params.GenesisHash,
+		Timestamp: params.GenesisHeader.Timestamp + 600,
+		Bits:      params.PowLimitBits,
+	}
+	for headerchain.CheckProofOfWork(header, params.PowLimit) == nil {
+		header.Nonce++
+	}
+	require.NoError(t, inbound.WriteMessage(proto.MSG_HEADERS, proto.Headers{Headers: []proto.BlockHeader{header}}))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer was not disconnected")
+	}
+	assert.Nil(t, local.SyncPeer())
+	assert.Equal(t, int32(0), localChain.Height())
+}
+
+func TestProgress_Fraction(t *testing.T) {
+	assert.Equal(t, 0.5, netsync.Progress{Height: 50, PeerHeight: 100}.Fraction())
+	assert.Equal(t, 1.0, netsync.Progress{Height: 150, PeerHeight: 100}.Fraction())
+	assert.Equal(t, 1.0, netsync.Progress{Height: 0, PeerHeight: 0}.Fraction())
+}
@@ -0,0 +1,143 @@
+package netsync
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// On average how often we announce transactions to inbound and outbound peers, as per Bitcoin
+	// Core. Announcements are batched up and sent at random intervals so that peers can't work
+	// out who first sent a transaction from when they hear about it. Inbound peers, which anyone
+	// can make lots of, all get theirs at the same moments and less often.
+	INBOUND_INVENTORY_BROADCAST_INTERVAL  = 5 * time.Second
+	OUTBOUND_INVENTORY_BROADCAST_INTERVAL = 2 * time.Second
+
+	// The most transactions we announce to a peer at once. Any more wait for the next batch.
+	INVENTORY_BROADCAST_MAX = 1000
+
+	// How long a transaction has to have been in the pool before we'll send it to a peer we
+	// haven't announced it to, as per Bitcoin Core. Until then, peers can't use requests to find
+	// out what we've heard about ahead of the announcements.
+	UNCONDITIONAL_RELAY_DELAY = 2 * time.Minute
+)
+
+// poissonDelay is how long until the next event of a Poisson process with the given average
+// interval between events.
+func poissonDelay(average time.Duration) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(average))
+}
+
+// txInv is how we announce a transaction to a peer: by wtxid if they asked for that.
+func txInv(p *peer.Peer, desc *mempool.TxDesc) proto.InvVect {
+	if p.WantsWtxidRelay() {
+		return proto.InvVect{Type: proto.INV_TYPE_WTX, Hash: desc.WitnessHash}
+	}
+	return proto.InvVect{Type: proto.INV_TYPE_TX, Hash: desc.Hash}
+}
+
+// announceTx queues a transaction that's been accepted into the pool to be announced to the
+// peers that want to hear about transactions, with the next batch for each.
+func (sm *SyncManager) announceTx(desc *mempool.TxDesc) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for p, state := range sm.peers {
+		if !p.RelaysTransactions() || p.HasKnownInventory(txInv(p, desc)) {
+			continue
+		}
+		state.txsToAnnounce = append(state.txsToAnnounce, desc)
+		if !state.trickleScheduled {
+			sm.scheduleTrickle(p, state)
+		}
+	}
+}
+
+// scheduleTrickle arranges for the peer's next batch of announcements to be sent after a random
+// delay, or at the same time as the other inbound peers' next batch. The caller must hold the lock.
+func (sm *SyncManager) scheduleTrickle(p *peer.Peer, state *peerState) {
+	now := sm.now()
+	at := now.Add(poissonDelay(sm.OutboundTrickleInterval))
+	if p.Inbound() {
+		if !sm.nextInboundTrickle.After(now) {
+			sm.nextInboundTrickle = now.Add(poissonDelay(sm.InboundTrickleInterval))
+		}
+		at = sm.nextInboundTrickle
+	}
+
+	state.trickleScheduled = true
+	time.AfterFunc(at.Sub(now), func() { sm.trickle(p) })
+}
+
+// trickle sends the peer a batch of the transactions waiting to be announced to it, leaving out
+// any that have since left the pool or pay less than its fee filter.
+func (sm *SyncManager) trickle(p *peer.Peer) {
+	sm.mu.Lock()
+	state, ok := sm.peers[p]
+	if !ok {
+		sm.mu.Unlock()
+		return
+	}
+	state.trickleScheduled = false
+	feeFilter := state.feeFilter
+	batch := state.txsToAnnounce[:min(len(state.txsToAnnounce), INVENTORY_BROADCAST_MAX)]
+	state.txsToAnnounce = state.txsToAnnounce[len(batch):]
+	if len(state.txsToAnnounce) > 0 {
+		sm.scheduleTrickle(p, state)
+	} else {
+		state.txsToAnnounce = nil
+	}
+	sm.mu.Unlock()
+
+	// They were queued in the order they were accepted, so parents come before their children
+	var invList []proto.InvVect
+	for _, desc := range batch {
+		if desc.Fee >= feeFilter.Fee(desc.VSize) && sm.TxPool.HaveTransaction(desc.Hash) {
+			invList = append(invList, txInv(p, desc))
+		}
+	}
+	if err := p.PushInventory(invList); err != nil {
+		log.Printf("error announcing transactions to %s: %v", p.Addr(), err)
+	}
+}
+
+// findTx returns the transaction a peer asked for, ready to send, or nil if we don't have it or
+// aren't willing to send it to them yet. That it announced the transaction to us doesn't count,
+// or it could find out what we have by announcing it first.
+func (sm *SyncManager) findTx(p *peer.Peer, iv proto.InvVect) proto.Marshallable {
+	if sm.TxPool == nil {
+		return nil
+	}
+
+	desc := sm.TxPool.Lookup(iv.Hash)
+	switch {
+	case desc == nil:
+		return nil
+	case iv.Type == proto.INV_TYPE_WTX && desc.WitnessHash != iv.Hash:
+		return nil
+	case iv.Type != proto.INV_TYPE_WTX && desc.Hash != iv.Hash:
+		return nil
+	case !p.RecentlyAnnounced(iv) && sm.now().Sub(desc.Added) < UNCONDITIONAL_RELAY_DELAY:
+		return nil
+	}
+
+	if iv.Type == proto.INV_TYPE_TX {
+		return strippedTx{desc.Tx}
+	}
+	return desc.Tx
+}
+
+// strippedTx is a transaction serialized without witness data.
+type strippedTx struct {
+	*proto.Tx
+}
+
+func (tx strippedTx) MarshalToWriter(w io.Writer) error {
+	return tx.MarshalNoWitness(w)
+}
@@ -0,0 +1,184 @@
+package netsync
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// The most transactions we'll have requested from one peer at a time, as per Bitcoin Core.
+	MAX_PEER_TX_REQUEST_IN_FLIGHT = 100
+
+	// How long a peer has to send a transaction we asked for before we'll ask someone else.
+	TX_REQUEST_TIMEOUT = time.Minute
+
+	// How old our tip can be while we still count as caught up with the chain, as per Bitcoin
+	// Core. Until then we don't fetch transactions, as we couldn't check their inputs.
+	MAX_TIP_AGE = 24 * time.Hour
+
+	// How many rejected transactions we remember, so as not to fetch them again.
+	MAX_RECENT_REJECTS = 50_000
+)
+
+// TxPool is where the transactions our peers send us go.
+type TxPool interface {
+	// HaveTransaction reports whether the pool has a transaction, by txid or wtxid.
+	HaveTransaction(hash proto.Hash) bool
+
+	// Lookup returns a transaction in the pool by txid or wtxid, or nil if it isn't there.
+	Lookup(hash proto.Hash) *mempool.TxDesc
+
+	// AcceptTransaction validates a transaction and adds it to the pool, returning a
+	// mempool.RuleError if it's rejected.
+	AcceptTransaction(tx *proto.Tx) (*mempool.TxDesc, error)
+
+	// MinFee is the lowest fee rate the pool currently accepts, and MinRelayFee the lowest it
+	// ever does.
+	MinFee() mempool.FeeRate
+	MinRelayFee() mempool.FeeRate
+}
+
+// txRequest is a transaction we've asked a peer for.
+type txRequest struct {
+	peer        *peer.Peer
+	requestedAt time.Time
+}
+
+// txInvType is how we ask the peer for an announced transaction: by whichever hash it was
+// announced with, and with its witness data if they have it.
+func txInvType(p *peer.Peer, announced proto.InvType) proto.InvType {
+	if announced == proto.INV_TYPE_WTX {
+		return proto.INV_TYPE_WTX
+	}
+	if p.TheirVersion().Services&proto.NODE_WITNESS != 0 {
+		return proto.INV_TYPE_WITNESS_TX
+	}
+	return proto.INV_TYPE_TX
+}
+
+// catchingUp reports whether our tip is too old for us to be interested in transactions. The
+// caller must hold the lock.
+func (sm *SyncManager) catchingUp() bool {
+	return sm.now().Sub(sm.processed.Header.Time()) > MAX_TIP_AGE
+}
+
+// scheduleTxs picks out the announced transactions we don't have and haven't already asked
+// for, up to the peer's in-flight limit, and returns the 'getdata' entries for them. The caller
+// must hold the lock, and should send the request once it's released it.
+func (sm *SyncManager) scheduleTxs(p *peer.Peer, state *peerState, invList []proto.InvVect) []proto.InvVect {
+	if sm.TxPool == nil || sm.catchingUp() {
+		return nil
+	}
+	sm.refreshRecentRejects()
+
+	var wanted []proto.InvVect
+	for _, iv := range invList {
+		if !iv.Type.IsTx() || state.txsInFlight >= MAX_PEER_TX_REQUEST_IN_FLIGHT {
+			continue
+		}
+		if _, ok := sm.txsInFlight[iv.Hash]; ok || sm.recentRejects[iv.Hash] || sm.TxPool.HaveTransaction(iv.Hash) {
+			continue
+		}
+
+		sm.txsInFlight[iv.Hash] = &txRequest{peer: p, requestedAt: sm.now()}
+		state.txsInFlight++
+		wanted = append(wanted, proto.InvVect{Type: txInvType(p, iv.Type), Hash: iv.Hash})
+	}
+	return wanted
+}
+
+// requestTxs sends the peer a 'getdata' for the transactions scheduleTxs picked out.
+func (sm *SyncManager) requestTxs(p *peer.Peer, invList []proto.InvVect) {
+	if len(invList) == 0 {
+		return
+	}
+	if err := p.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: invList}); err != nil {
+		log.Printf("error requesting transactions from %s: %v", p.Addr(), err)
+	}
+}
+
+// completeTxRequest forgets that we asked for a transaction. The caller must hold the lock.
+func (sm *SyncManager) completeTxRequest(hash proto.Hash) {
+	request, ok := sm.txsInFlight[hash]
+	if !ok {
+		return
+	}
+	delete(sm.txsInFlight, hash)
+	if state, ok := sm.peers[request.peer]; ok {
+		state.txsInFlight--
+	}
+}
+
+// cancelTxRequests forgets the transactions we asked a peer for, so they can be fetched from
+// whoever announces them next. The caller must hold the lock.
+func (sm *SyncManager) cancelTxRequests(p *peer.Peer) {
+	for hash, request := range sm.txsInFlight {
+		if request.peer == p {
+			sm.completeTxRequest(hash)
+		}
+	}
+}
+
+// expireTxRequests forgets transactions that have taken too long to arrive. Unlike blocks, a
+// peer not sending a transaction isn't worth disconnecting it over. The caller must hold the lock.
+func (sm *SyncManager) expireTxRequests(now time.Time) {
+	for hash, request := range sm.txsInFlight {
+		if now.Sub(request.requestedAt) >= TX_REQUEST_TIMEOUT {
+			sm.completeTxRequest(hash)
+		}
+	}
+}
+
+// refreshRecentRejects forgets the rejected transactions once the tip has changed, as they may
+// be valid now, or once there are too many of them. The caller must hold the lock.
+func (sm *SyncManager) refreshRecentRejects() {
+	if sm.processed.Hash != sm.rejectsTip || len(sm.recentRejects) >= MAX_RECENT_REJECTS {
+		clear(sm.recentRejects)
+		sm.rejectsTip = sm.processed.Hash
+	}
+}
+
+// OnTx hands a transaction a peer sent us to the pool, and announces it to our other peers if
+// it's accepted. Rejected transactions are logged, and remembered so we don't fetch them again,
+// unless they were only missing inputs: their parents may yet turn up.
+func (sm *SyncManager) OnTx(p *peer.Peer, msg *proto.Tx) {
+	if sm.TxPool == nil {
+		return
+	}
+	txHash, witnessHash := msg.TxHash(), msg.WitnessHash()
+
+	sm.mu.Lock()
+	sm.completeTxRequest(txHash)
+	sm.completeTxRequest(witnessHash)
+	sm.mu.Unlock()
+
+	desc, err := sm.TxPool.AcceptTransaction(msg)
+	if err == nil {
+		sm.announceTx(desc)
+		return
+	}
+
+	var ruleErr mempool.RuleError
+	if !errors.As(err, &ruleErr) {
+		log.Printf("error processing transaction %s from %s: %v", txHash, p.Addr(), err)
+		return
+	}
+	log.Printf("rejected transaction %s from %s: %v", txHash, p.Addr(), err)
+	if ruleErr.Code == mempool.ErrMissingInputs {
+		return
+	}
+
+	sm.mu.Lock()
+	sm.refreshRecentRejects()
+	sm.recentRejects[witnessHash] = true
+	if !msg.HasWitness() {
+		// Otherwise a different witness could make the same transaction valid
+		sm.recentRejects[txHash] = true
+	}
+	sm.mu.Unlock()
+}
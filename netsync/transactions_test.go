@@ -0,0 +1,236 @@
+package netsync_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/mempool"
+	"github.com/pscott31/mynode/netsync"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTxPool remembers the transactions it's given, rejecting those it's told to. Transactions
+// are 1000 vbytes, paying the fee they're given, if any.
+type fakeTxPool struct {
+	mu       sync.Mutex
+	have     map[proto.Hash]bool
+	reject   map[proto.Hash]mempool.ErrorCode
+	fees     map[proto.Hash]int64
+	minFee   mempool.FeeRate
+	accepted []proto.Hash
+	descs    map[proto.Hash]*mempool.TxDesc // By txid and wtxid
+}
+
+func (f *fakeTxPool) MinFee() mempool.FeeRate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return max(f.minFee, mempool.DEFAULT_MIN_RELAY_TX_FEE)
+}
+
+func (f *fakeTxPool) MinRelayFee() mempool.FeeRate {
+	return mempool.DEFAULT_MIN_RELAY_TX_FEE
+}
+
+func (f *fakeTxPool) Lookup(hash proto.Hash) *mempool.TxDesc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.descs[hash]
+}
+
+func (f *fakeTxPool) HaveTransaction(hash proto.Hash) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.have[hash]
+}
+
+func (f *fakeTxPool) AcceptTransaction(tx *proto.Tx) (*mempool.TxDesc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hash := tx.TxHash()
+	if code, ok := f.reject[hash]; ok {
+		return nil, mempool.RuleError{Code: code, Description: "rejected"}
+	}
+	desc := &mempool.TxDesc{Tx: tx, Hash: hash, WitnessHash: tx.WitnessHash(), Fee: f.fees[hash], VSize: 1000, Added: time.Now()}
+	if f.descs == nil {
+		f.descs = make(map[proto.Hash]*mempool.TxDesc)
+	}
+	f.have[hash] = true
+	f.accepted = append(f.accepted, hash)
+	f.descs[hash] = desc
+	f.descs[desc.WitnessHash] = desc
+	return desc, nil
+}
+
+func (f *fakeTxPool) acceptedTxs() []proto.Hash {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]proto.Hash(nil), f.accepted...)
+}
+
+func testTx(n byte) *proto.Tx {
+	return &proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Hash: proto.DoubleSHA256([]byte{n})},
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{{Value: 1000, PkScript: []byte{0x51}}},
+	}
+}
+
+// caughtUpNode returns a sync manager whose tip is a block mined just now, handing transactions
+// to the pool.
+func caughtUpNode(t *testing.T, pool *fakeTxPool) *netsync.SyncManager {
+	t.Helper()
+	params := &config.RegTestParams
+	header := proto.BlockHeader{
+		Version:   4,
+		PrevBlock: params.GenesisHash,
+		Timestamp: uint32(time.Now().Unix()),
+		Bits:      params.PowLimitBits,
+	}
+	for headerchain.CheckProofOfWork(header, params.PowLimit) != nil {
+		header.Nonce++
+	}
+
+	chain := storedChain(t)
+	_, err := chain.ProcessHeaders([]proto.BlockHeader{header})
+	require.NoError(t, err)
+
+	sm := netsync.New(chain, &recordingProcessor{t: t, tip: chain.NodeAtHeight(1)})
+	sm.TxPool = pool
+	return sm
+}
+
+func TestSyncManager_FetchesAnnouncedTransactions(t *testing.T) {
+	wanted, known, rejected, byWitnessHash := testTx(1), testTx(2), testTx(3), testTx(4)
+	pool := &fakeTxPool{
+		have:   map[proto.Hash]bool{known.TxHash(): true},
+		reject: map[proto.Hash]mempool.ErrorCode{rejected.TxHash(): mempool.ErrNonStandard},
+	}
+	local := caughtUpNode(t, pool)
+
+	outbound, inbound := connectedPeers(t, 0)
+	run(local, outbound)
+	received := remoteMessages(inbound)
+
+	// We ask for what we don't have, the same way it was announced
+	require.NoError(t, inbound.WriteMessage(proto.MSG_INV, proto.Inv{InvList: []proto.InvVect{
+		{Type: proto.INV_TYPE_TX, Hash: wanted.TxHash()},
+		{Type: proto.INV_TYPE_TX, Hash: known.TxHash()},
+		{Type: proto.INV_TYPE_TX, Hash: rejected.TxHash()},
+		{Type: proto.INV_TYPE_WTX, Hash: byWitnessHash.WitnessHash()},
+	}}))
+	getData, ok := nextMessage(t, received).(*proto.GetData)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{
+		{Type: proto.INV_TYPE_WITNESS_TX, Hash: wanted.TxHash()},
+		{Type: proto.INV_TYPE_WITNESS_TX, Hash: rejected.TxHash()},
+		{Type: proto.INV_TYPE_WTX, Hash: byWitnessHash.WitnessHash()},
+	}, getData.InvList)
+
+	for _, tx := range []*proto.Tx{wanted, rejected, byWitnessHash} {
+		require.NoError(t, inbound.WriteMessage(proto.MSG_TX, tx))
+	}
+	require.Eventually(t, func() bool {
+		return len(pool.acceptedTxs()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []proto.Hash{wanted.TxHash(), byWitnessHash.TxHash()}, pool.acceptedTxs())
+
+	// A rejected transaction isn't fetched again
+	another := testTx(5)
+	require.NoError(t, inbound.WriteMessage(proto.MSG_INV, proto.Inv{InvList: []proto.InvVect{
+		{Type: proto.INV_TYPE_TX, Hash: rejected.TxHash()},
+		{Type: proto.INV_TYPE_TX, Hash: another.TxHash()},
+	}}))
+	getData, ok = nextMessage(t, received).(*proto.GetData)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{{Type: proto.INV_TYPE_WITNESS_TX, Hash: another.TxHash()}}, getData.InvList)
+}
+
+func TestSyncManager_IgnoresTransactionsWhileCatchingUp(t *testing.T) {
+	// The tip is the regtest genesis block, from 2011
+	local := netsync.New(storedChain(t), nil)
+	local.TxPool = &fakeTxPool{have: map[proto.Hash]bool{}}
+
+	outbound, inbound := connectedPeers(t, 0)
+	run(local, outbound)
+	received := remoteMessages(inbound)
+
+	block := testBlock()
+	require.NoError(t, inbound.WriteMessage(proto.MSG_INV, proto.Inv{InvList: []proto.InvVect{
+		{Type: proto.INV_TYPE_TX, Hash: testTx(1).TxHash()},
+		{Type: proto.INV_TYPE_BLOCK, Hash: block.BlockHash()},
+	}}))
+
+	// Only the block gets followed up
+	_, ok := nextMessage(t, received).(*proto.GetHeaders)
+	require.True(t, ok)
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected %T", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSyncManager_RelaysTransactions(t *testing.T) {
+	pool := &fakeTxPool{have: map[proto.Hash]bool{}}
+	local := caughtUpNode(t, pool)
+	local.OutboundTrickleInterval = 10 * time.Millisecond
+
+	source, sourceRemote := connectedPeers(t, 0)
+	run(local, source)
+	dest, destRemote := connectedPeers(t, 0)
+	run(local, dest)
+	destReceived := remoteMessages(destRemote)
+
+	blocksOnlyCfg := config.Default()
+	blocksOnlyCfg.SetNetwork("regtest")
+	blocksOnlyCfg.BlocksOnly = true
+	quiet, quietRemote := connectedPeersWith(t, blocksOnlyCfg)
+	run(local, quiet)
+	quietReceived := remoteMessages(quietRemote)
+
+	// A transaction that's accepted is announced by wtxid to peers that want it, after a while
+	tx := testTx(1)
+	tx.TxIn[0].Witness = [][]byte{{0x01}}
+	require.NoError(t, sourceRemote.WriteMessage(proto.MSG_TX, tx))
+	inv, ok := nextMessage(t, destReceived).(*proto.Inv)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{{Type: proto.INV_TYPE_WTX, Hash: tx.WitnessHash()}}, inv.InvList)
+
+	// It can then be asked for, but not transactions we haven't told them about yet
+	unannounced := testTx(2)
+	_, err := pool.AcceptTransaction(unannounced)
+	require.NoError(t, err)
+	require.NoError(t, destRemote.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: []proto.InvVect{
+		{Type: proto.INV_TYPE_WTX, Hash: tx.WitnessHash()},
+		{Type: proto.INV_TYPE_WITNESS_TX, Hash: unannounced.TxHash()},
+	}}))
+	gotTx, ok := nextMessage(t, destReceived).(*proto.Tx)
+	require.True(t, ok)
+	assert.Equal(t, tx.WitnessHash(), gotTx.WitnessHash())
+	notFound, ok := nextMessage(t, destReceived).(*proto.NotFound)
+	require.True(t, ok)
+	assert.Equal(t, []proto.InvVect{{Type: proto.INV_TYPE_WITNESS_TX, Hash: unannounced.TxHash()}}, notFound.InvList)
+
+	// Announcing it to us first doesn't get round that
+	probe := []proto.InvVect{{Type: proto.INV_TYPE_WITNESS_TX, Hash: unannounced.TxHash()}}
+	require.NoError(t, destRemote.WriteMessage(proto.MSG_INV, proto.Inv{InvList: probe}))
+	require.NoError(t, destRemote.WriteMessage(proto.MSG_GETDATA, proto.GetData{InvList: probe}))
+	notFound, ok = nextMessage(t, destReceived).(*proto.NotFound)
+	require.True(t, ok)
+	assert.Equal(t, probe, notFound.InvList)
+
+	// A peer that asked not to hear about transactions doesn't
+	select {
+	case msg := <-quietReceived:
+		t.Fatalf("unexpected %T", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,27 @@
+package peer
+
+import "github.com/pscott31/mynode/proto"
+
+// PushAddresses sends addresses of other nodes to the remote node. If they asked for 'addrv2' during
+// the handshake they get everything in one; otherwise they get an 'addr' message containing only
+// the IPv4 and IPv6 addresses, since that's all it can express.
+func (p *Peer) PushAddresses(addrs []proto.NetAddressV2) error {
+	if len(addrs) > proto.MAX_ADDR_ENTRIES {
+		addrs = addrs[:proto.MAX_ADDR_ENTRIES]
+	}
+
+	if p.wantsAddrV2 {
+		return p.WriteMessage(proto.MSG_ADDRV2, proto.AddrV2{AddrList: addrs})
+	}
+
+	addrMsg := proto.Addr{}
+	for _, addr := range addrs {
+		if legacyAddr, ok := addr.ToNetAddress(); ok {
+			addrMsg.AddrList = append(addrMsg.AddrList, legacyAddr)
+		}
+	}
+	if len(addrMsg.AddrList) == 0 {
+		return nil
+	}
+	return p.WriteMessage(proto.MSG_ADDR, addrMsg)
+}
@@ -0,0 +1,61 @@
+package peer_test
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAddrs = []proto.NetAddressV2{
+	proto.NewNetAddressV2(1, 1, netip.MustParseAddrPort("192.0.2.1:8333")),
+	{Time: 2, Services: 1, NetworkID: proto.NET_TORV3, Addr: make([]byte, 32), Port: 8333},
+}
+
+func TestPeer_PushAddressesV2(t *testing.T) {
+	outbound, inbound := handshakenPair(t, config.Default(), config.Default())
+	require.True(t, outbound.WantsAddrV2())
+	require.True(t, inbound.WantsAddrV2())
+
+	received := make(chan *proto.AddrV2, 1)
+	go inbound.Run(&peer.Listeners{
+		OnAddrV2: func(p *peer.Peer, msg *proto.AddrV2) { received <- msg },
+	})
+
+	require.NoError(t, outbound.PushAddresses(testAddrs))
+	select {
+	case msg := <-received:
+		assert.Equal(t, testAddrs, msg.AddrList)
+	case <-time.After(time.Second):
+		t.Fatal("addrv2 message not received")
+	}
+}
+
+func TestPeer_PushAddressesLegacy(t *testing.T) {
+	// Nodes older than 70016 don't know about addrv2
+	oldCfg := config.Default()
+	oldCfg.Version = 70015
+	outbound, inbound := handshakenPair(t, config.Default(), oldCfg)
+	require.False(t, outbound.WantsAddrV2())
+
+	received := make(chan *proto.Addr, 1)
+	go inbound.Run(&peer.Listeners{
+		OnAddr: func(p *peer.Peer, msg *proto.Addr) { received <- msg },
+	})
+
+	// Only the IPv4 address can be sent in an 'addr' message
+	require.NoError(t, outbound.PushAddresses(testAddrs))
+	select {
+	case msg := <-received:
+		assert.Equal(t, []proto.TimestampedNetAddress{
+			{Time: 1, Services: 1, IP: netip.MustParseAddrPort("192.0.2.1:8333")},
+		}, msg.AddrList)
+	case <-time.After(time.Second):
+		t.Fatal("addr message not received")
+	}
+}
@@ -0,0 +1,41 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+var (
+	// ErrSelfConnection is returned when the remote node's version nonce matches one we sent, which
+	// means we've ended up connecting to ourselves.
+	ErrSelfConnection = errors.New("connected to self (version nonce matches our own)")
+
+	// ErrHandshakeTimeout is returned when the version/verack exchange doesn't complete in time.
+	ErrHandshakeTimeout = errors.New("timed out waiting for handshake to complete")
+
+	// ErrPingTimeout is returned when the remote node doesn't answer our ping within the ping timeout.
+	ErrPingTimeout = errors.New("timed out waiting for pong")
+)
+
+// MagicMismatchError is returned when a message arrives with the magic of a different network.
+type MagicMismatchError struct {
+	Expected uint32
+	Got      uint32
+}
+
+func (e *MagicMismatchError) Error() string {
+	return fmt.Sprintf("mismatched node networks - expected magic %x, got %x", e.Expected, e.Got)
+}
+
+// UnexpectedCommandError is returned when the remote node sends a message we weren't expecting at
+// this point in the conversation.
+type UnexpectedCommandError struct {
+	Expected proto.MessageType
+	Got      proto.MessageType
+}
+
+func (e *UnexpectedCommandError) Error() string {
+	return fmt.Sprintf("expected '%s' message, got '%s'", e.Expected, e.Got)
+}
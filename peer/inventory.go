@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"sync"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// How many transactions and blocks we remember each peer knowing about. Once full, the oldest
+	// are forgotten, at the cost of perhaps announcing them again.
+	MAX_KNOWN_INVENTORY = 5000
+
+	// How many transactions and blocks we remember announcing to each peer, as per Bitcoin Core.
+	MAX_RECENTLY_ANNOUNCED = 3500
+)
+
+// inventoryKey identifies an object regardless of which form it was announced or asked for in.
+// Transactions announced by wtxid are keyed by that, so a segwit transaction may appear twice.
+type inventoryKey struct {
+	block bool
+	hash  proto.Hash
+}
+
+func keyFor(iv proto.InvVect) inventoryKey {
+	return inventoryKey{block: iv.Type.IsBlock(), hash: iv.Hash}
+}
+
+// knownInventory is a fixed size set of inventory, which forgets the oldest entries first.
+type knownInventory struct {
+	mu    sync.Mutex
+	set   map[inventoryKey]struct{}
+	order []inventoryKey // Ring buffer of what's in the set, in the order it was added
+	next  int
+}
+
+func newKnownInventory(capacity int) *knownInventory {
+	return &knownInventory{
+		set:   make(map[inventoryKey]struct{}, capacity),
+		order: make([]inventoryKey, 0, capacity),
+	}
+}
+
+func (k *knownInventory) add(iv proto.InvVect) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.addLocked(keyFor(iv))
+}
+
+func (k *knownInventory) addLocked(key inventoryKey) {
+	if _, ok := k.set[key]; ok {
+		return
+	}
+
+	if len(k.order) < cap(k.order) {
+		k.order = append(k.order, key)
+	} else {
+		delete(k.set, k.order[k.next])
+		k.order[k.next] = key
+		k.next = (k.next + 1) % len(k.order)
+	}
+	k.set[key] = struct{}{}
+}
+
+func (k *knownInventory) has(iv proto.InvVect) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, ok := k.set[keyFor(iv)]
+	return ok
+}
+
+// filterUnknown returns the inventory not already known, and marks it as known.
+func (k *knownInventory) filterUnknown(invList []proto.InvVect) []proto.InvVect {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var unknown []proto.InvVect
+	for _, iv := range invList {
+		key := keyFor(iv)
+		if _, ok := k.set[key]; ok {
+			continue
+		}
+		k.addLocked(key)
+		unknown = append(unknown, iv)
+	}
+	return unknown
+}
+
+// AddKnownInventory records that the remote node has the transaction or block, so we don't
+// announce it to them.
+func (p *Peer) AddKnownInventory(iv proto.InvVect) {
+	p.knownInventory.add(iv)
+}
+
+// HasKnownInventory reports whether we know the remote node has the transaction or block.
+func (p *Peer) HasKnownInventory(iv proto.InvVect) bool {
+	return p.knownInventory.has(iv)
+}
+
+// RecentlyAnnounced reports whether we've announced the transaction or block to the remote node
+// lately. Unlike HasKnownInventory, it doesn't count what they've told us about themselves.
+func (p *Peer) RecentlyAnnounced(iv proto.InvVect) bool {
+	return p.announced.has(iv)
+}
+
+// PushInventory announces transactions or blocks to the remote node, leaving out any we know
+// they already have.
+func (p *Peer) PushInventory(invList []proto.InvVect) error {
+	invList = p.knownInventory.filterUnknown(invList)
+	for _, iv := range invList {
+		p.announced.add(iv)
+	}
+	for len(invList) > 0 {
+		batch := invList[:min(len(invList), proto.MAX_INV_ENTRIES)]
+		invList = invList[len(batch):]
+		if err := p.WriteMessage(proto.MSG_INV, proto.Inv{InvList: batch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noteInventory records what the remote node has told us about or sent us, before it's dispatched.
+func (p *Peer) noteInventory(payload proto.Payload) {
+	switch msg := payload.(type) {
+	case *proto.Inv:
+		for _, iv := range msg.InvList {
+			p.knownInventory.add(iv)
+		}
+	case *proto.Block:
+		p.knownInventory.add(proto.InvVect{Type: proto.INV_TYPE_BLOCK, Hash: msg.BlockHash()})
+	case *proto.Tx:
+		p.knownInventory.add(proto.InvVect{Type: proto.INV_TYPE_TX, Hash: msg.TxHash()})
+		if msg.HasWitness() {
+			p.knownInventory.add(proto.InvVect{Type: proto.INV_TYPE_WTX, Hash: msg.WitnessHash()})
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package peer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func txInv(tag string) proto.InvVect {
+	return proto.InvVect{Type: proto.INV_TYPE_TX, Hash: proto.DoubleSHA256([]byte(tag))}
+}
+
+func TestPeer_PushInventory(t *testing.T) {
+	outbound, inbound := handshakenPair(t, config.Default(), config.Default())
+
+	received := make(chan *proto.Inv, 2)
+	go inbound.Run(&peer.Listeners{
+		OnInv: func(p *peer.Peer, msg *proto.Inv) { received <- msg },
+	})
+
+	// Anything they're known to have is left out, and what we send becomes known
+	outbound.AddKnownInventory(txInv("known"))
+	require.NoError(t, outbound.PushInventory([]proto.InvVect{txInv("known"), txInv("new")}))
+	require.NoError(t, outbound.PushInventory([]proto.InvVect{txInv("new"), txInv("newer")}))
+
+	for _, expected := range [][]proto.InvVect{{txInv("new")}, {txInv("newer")}} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, expected, msg.InvList)
+		case <-time.After(time.Second):
+			t.Fatal("inv message not received")
+		}
+	}
+
+	// The receiving side remembers what was announced to it, and the sending side what it announced
+	assert.True(t, inbound.HasKnownInventory(txInv("new")))
+	assert.True(t, inbound.HasKnownInventory(txInv("newer")))
+	assert.False(t, inbound.HasKnownInventory(txInv("known")))
+	assert.True(t, outbound.RecentlyAnnounced(txInv("new")))
+	assert.False(t, outbound.RecentlyAnnounced(txInv("known")))
+	assert.False(t, inbound.RecentlyAnnounced(txInv("new")))
+
+	// Nothing new, so nothing is sent
+	require.NoError(t, outbound.PushInventory([]proto.InvVect{txInv("new")}))
+}
+
+func TestPeer_KnownInventoryFromMessages(t *testing.T) {
+	outbound, inbound := handshakenPair(t, config.Default(), config.Default())
+
+	blocks := make(chan *proto.Block, 1)
+	go inbound.Run(&peer.Listeners{
+		OnBlock: func(p *peer.Peer, msg *proto.Block) { blocks <- msg },
+	})
+
+	block := proto.Block{Header: proto.BlockHeader{Version: 4, Timestamp: 1}}
+	require.NoError(t, outbound.WriteMessage(proto.MSG_BLOCK, block))
+	select {
+	case <-blocks:
+	case <-time.After(time.Second):
+		t.Fatal("block not received")
+	}
+
+	// Known whichever form of block it's looked up as
+	for _, invType := range []proto.InvType{proto.INV_TYPE_BLOCK, proto.INV_TYPE_WITNESS_BLOCK, proto.INV_TYPE_CMPCT_BLOCK} {
+		assert.True(t, inbound.HasKnownInventory(proto.InvVect{Type: invType, Hash: block.BlockHash()}), invType.String())
+	}
+	assert.False(t, inbound.HasKnownInventory(proto.InvVect{Type: proto.INV_TYPE_TX, Hash: block.BlockHash()}))
+}
+
+func TestPeer_KnownInventoryForgetsOldest(t *testing.T) {
+	p := peer.NewOutbound(config.Default(), peer.NewNonceSet(), nil)
+
+	first := proto.InvVect{Type: proto.INV_TYPE_TX, Hash: proto.Hash{0xff}}
+	p.AddKnownInventory(first)
+	for i := 0; i < peer.MAX_KNOWN_INVENTORY-1; i++ {
+		p.AddKnownInventory(proto.InvVect{Type: proto.INV_TYPE_TX, Hash: proto.Hash{0x01, byte(i), byte(i >> 8)}})
+	}
+	assert.True(t, p.HasKnownInventory(first))
+
+	// Re-adding something already known doesn't push anything out
+	p.AddKnownInventory(first)
+	assert.True(t, p.HasKnownInventory(first))
+
+	p.AddKnownInventory(proto.InvVect{Type: proto.INV_TYPE_BLOCK, Hash: proto.Hash{0xff}})
+	assert.False(t, p.HasKnownInventory(first))
+	assert.True(t, p.HasKnownInventory(proto.InvVect{Type: proto.INV_TYPE_TX, Hash: proto.Hash{0x01}}))
+}
@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+// Listeners holds the callbacks the read loop invokes for each type of message. Callbacks are run
+// on the peer's read goroutine, so long-running work should be handed off elsewhere. Any left nil
+// are simply skipped.
+type Listeners struct {
+	OnVersion func(p *Peer, msg *proto.Version)
+	OnVerAck  func(p *Peer, msg *proto.VerAck)
+	OnPing    func(p *Peer, msg *proto.Ping)
+	OnPong    func(p *Peer, msg *proto.Pong)
+	OnAddr    func(p *Peer, msg *proto.Addr)
+	OnAddrV2  func(p *Peer, msg *proto.AddrV2)
+	OnGetAddr func(p *Peer, msg *proto.GetAddr)
+
+	OnGetHeaders func(p *Peer, msg *proto.GetHeaders)
+	OnHeaders    func(p *Peer, msg *proto.Headers)
+
+	OnInv      func(p *Peer, msg *proto.Inv)
+	OnGetData  func(p *Peer, msg *proto.GetData)
+	OnNotFound func(p *Peer, msg *proto.NotFound)
+	OnBlock    func(p *Peer, msg *proto.Block)
+	OnTx       func(p *Peer, msg *proto.Tx)
+
+	OnFeeFilter func(p *Peer, msg *proto.FeeFilter)
+
+	// OnUnknown is called for messages whose command isn't in the proto registry.
+	OnUnknown func(p *Peer, msg proto.Message)
+}
+
+// dispatch hands a decoded payload to the matching listener.
+func (l *Listeners) dispatch(p *Peer, payload proto.Payload) {
+	switch msg := payload.(type) {
+	case *proto.Version:
+		if l.OnVersion != nil {
+			l.OnVersion(p, msg)
+		}
+	case *proto.VerAck:
+		if l.OnVerAck != nil {
+			l.OnVerAck(p, msg)
+		}
+	case *proto.Ping:
+		if l.OnPing != nil {
+			l.OnPing(p, msg)
+		}
+	case *proto.Pong:
+		if l.OnPong != nil {
+			l.OnPong(p, msg)
+		}
+	case *proto.Addr:
+		if l.OnAddr != nil {
+			l.OnAddr(p, msg)
+		}
+	case *proto.AddrV2:
+		if l.OnAddrV2 != nil {
+			l.OnAddrV2(p, msg)
+		}
+	case *proto.GetAddr:
+		if l.OnGetAddr != nil {
+			l.OnGetAddr(p, msg)
+		}
+	case *proto.GetHeaders:
+		if l.OnGetHeaders != nil {
+			l.OnGetHeaders(p, msg)
+		}
+	case *proto.Headers:
+		if l.OnHeaders != nil {
+			l.OnHeaders(p, msg)
+		}
+	case *proto.Inv:
+		if l.OnInv != nil {
+			l.OnInv(p, msg)
+		}
+	case *proto.GetData:
+		if l.OnGetData != nil {
+			l.OnGetData(p, msg)
+		}
+	case *proto.NotFound:
+		if l.OnNotFound != nil {
+			l.OnNotFound(p, msg)
+		}
+	case *proto.Block:
+		if l.OnBlock != nil {
+			l.OnBlock(p, msg)
+		}
+	case *proto.Tx:
+		if l.OnTx != nil {
+			l.OnTx(p, msg)
+		}
+	case *proto.FeeFilter:
+		if l.OnFeeFilter != nil {
+			l.OnFeeFilter(p, msg)
+		}
+	}
+}
+
+// Run reads messages from the remote node, decodes them and dispatches them to the listeners until
+// the connection fails or a message can't be decoded. It should only be called after Handshake.
+// While it runs, pings are answered automatically and the remote node is pinged periodically, and
+// inventory the remote node announces or sends is remembered as known to them.
+func (p *Peer) Run(listeners *Listeners) error {
+	done := make(chan struct{})
+	defer close(done)
+	go p.pingLoop(done)
+
+	for {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			if p.pingTimedOut.Load() {
+				return ErrPingTimeout
+			}
+			return fmt.Errorf("error reading message: %w", err)
+		}
+
+		payload, err := msg.DecodePayload()
+		if err != nil {
+			return err
+		}
+
+		if payload == nil {
+			if listeners.OnUnknown != nil {
+				listeners.OnUnknown(p, msg)
+			}
+			continue
+		}
+
+		if err := p.handleKeepAlive(payload); err != nil {
+			return err
+		}
+		p.noteInventory(payload)
+
+		listeners.dispatch(p, payload)
+	}
+}
+
+// handleKeepAlive answers pings and records the round trip time of pongs before they're dispatched.
+func (p *Peer) handleKeepAlive(payload proto.Payload) error {
+	switch msg := payload.(type) {
+	case *proto.Ping:
+		return p.WriteMessage(proto.MSG_PONG, proto.Pong{Nonce: msg.Nonce})
+	case *proto.Pong:
+		p.handlePong(msg)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package peer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshakenPair returns two peers connected to each other that have completed their handshake.
+func handshakenPair(t *testing.T, outboundCfg, inboundCfg *config.Config) (*peer.Peer, *peer.Peer) {
+	t.Helper()
+	client, server := connPair(t)
+
+	outbound := peer.NewOutbound(outboundCfg, peer.NewNonceSet(), client)
+	inbound := peer.NewInbound(inboundCfg, peer.NewNonceSet(), server)
+
+	errs := make(chan error, 2)
+	go func() { errs <- outbound.Handshake() }()
+	go func() { errs <- inbound.Handshake() }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	return outbound, inbound
+}
+
+func TestPeer_RunDispatches(t *testing.T) {
+	outbound, inbound := handshakenPair(t, config.Default(), config.Default())
+
+	verAcks := make(chan *proto.VerAck, 1)
+	unknown := make(chan proto.Message, 1)
+	listeners := &peer.Listeners{
+		OnVerAck:  func(p *peer.Peer, msg *proto.VerAck) { verAcks <- msg },
+		OnUnknown: func(p *peer.Peer, msg proto.Message) { unknown <- msg },
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- inbound.Run(listeners) }()
+
+	require.NoError(t, outbound.WriteMessage(proto.MSG_VERACK, proto.VerAck{}))
+	require.NoError(t, outbound.WriteMessage(proto.MessageType("example"), proto.VarString("payload")))
+
+	select {
+	case msg := <-verAcks:
+		assert.Equal(t, &proto.VerAck{}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("verack listener was not called")
+	}
+
+	select {
+	case msg := <-unknown:
+		assert.Equal(t, proto.MessageType("example"), msg.Command)
+	case <-time.After(time.Second):
+		t.Fatal("unknown message listener was not called")
+	}
+
+	// Run should return once the connection goes away
+	outbound.Close()
+	select {
+	case err := <-runErr:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("run loop did not exit when connection closed")
+	}
+}
+
+func TestPeer_RunUndecodablePayload(t *testing.T) {
+	outbound, inbound := handshakenPair(t, config.Default(), config.Default())
+
+	go outbound.WriteMessage(proto.MSG_VERSION, proto.VarString("not a version"))
+
+	err := inbound.Run(&peer.Listeners{})
+	assert.ErrorContains(t, err, "version")
+}
@@ -0,0 +1,35 @@
+package peer
+
+import "sync"
+
+// NonceSet is the nonces a node has put in the version messages of its outbound connections that
+// are still handshaking. If one turns up in the version of a connection it receives, it has
+// connected to itself. A node's peers should all share the same set.
+type NonceSet struct {
+	mu     sync.Mutex
+	nonces map[uint64]struct{}
+}
+
+// NewNonceSet creates an empty set, for a node's peers to share.
+func NewNonceSet() *NonceSet {
+	return &NonceSet{nonces: make(map[uint64]struct{})}
+}
+
+func (s *NonceSet) add(nonce uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonces[nonce] = struct{}{}
+}
+
+func (s *NonceSet) remove(nonce uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.nonces, nonce)
+}
+
+func (s *NonceSet) has(nonce uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.nonces[nonce]
+	return ok
+}
@@ -0,0 +1,285 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/proto"
+)
+
+// The protocol versions from which nodes understand 'sendaddrv2' (BIP155) and 'wtxidrelay'
+// (BIP339).
+const (
+	ADDRV2_VERSION      int32 = 70016
+	WTXID_RELAY_VERSION int32 = 70016
+)
+
+// Peer wraps a connection to a remote node and takes care of the framing of messages sent over it.
+type Peer struct {
+	cfg     *config.Config
+	nonces  *NonceSet
+	conn    net.Conn
+	inbound bool
+
+	writeMu sync.Mutex
+
+	pingMu       sync.Mutex
+	ping         pingState
+	pingTimedOut atomic.Bool
+
+	ourVersion      proto.Version
+	theirVersion    proto.Version
+	protocolVersion int32
+
+	// Set if the remote node sent 'sendaddrv2' or 'wtxidrelay' during the handshake
+	wantsAddrV2     bool
+	wantsWtxidRelay bool
+
+	// What we know the remote node has, so we don't announce it to them, and what we've announced
+	knownInventory *knownInventory
+	announced      *knownInventory
+}
+
+// Dial connects to the remote node at addr. The handshake is not performed until Handshake is called.
+func Dial(cfg *config.Config, nonces *NonceSet, addr string) (*Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, cfg.HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %w", addr, err)
+	}
+	return NewOutbound(cfg, nonces, conn), nil
+}
+
+// NewOutbound wraps a connection that we initiated. The nonces are shared by all the node's peers,
+// to spot it connecting to itself.
+func NewOutbound(cfg *config.Config, nonces *NonceSet, conn net.Conn) *Peer {
+	return newPeer(cfg, nonces, conn, false)
+}
+
+// NewInbound wraps a connection that the remote node initiated. The nonces are shared by all the
+// node's peers, to spot it connecting to itself.
+func NewInbound(cfg *config.Config, nonces *NonceSet, conn net.Conn) *Peer {
+	return newPeer(cfg, nonces, conn, true)
+}
+
+func newPeer(cfg *config.Config, nonces *NonceSet, conn net.Conn, inbound bool) *Peer {
+	return &Peer{
+		cfg:            cfg,
+		nonces:         nonces,
+		conn:           conn,
+		inbound:        inbound,
+		knownInventory: newKnownInventory(MAX_KNOWN_INVENTORY),
+		announced:      newKnownInventory(MAX_RECENTLY_ANNOUNCED),
+	}
+}
+
+// Inbound reports whether the remote node initiated the connection.
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+// Addr is the address of the remote node.
+func (p *Peer) Addr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
+// NetAddress is the address of the remote node, along with the services it advertised in its version.
+func (p *Peer) NetAddress() proto.NetAddressV2 {
+	return proto.NewNetAddressV2(uint32(time.Now().Unix()), p.theirVersion.Services, p.remoteAddrPort())
+}
+
+// TheirVersion is the version message the remote node sent us during the handshake.
+func (p *Peer) TheirVersion() proto.Version {
+	return p.theirVersion
+}
+
+// ProtocolVersion is the protocol version negotiated during the handshake; the lower of ours and theirs.
+func (p *Peer) ProtocolVersion() int32 {
+	return p.protocolVersion
+}
+
+// WantsAddrV2 reports whether the remote node asked for 'addrv2' messages during the handshake.
+func (p *Peer) WantsAddrV2() bool {
+	return p.wantsAddrV2
+}
+
+// WantsWtxidRelay reports whether the remote node asked during the handshake for transactions to
+// be announced by wtxid.
+func (p *Peer) WantsWtxidRelay() bool {
+	return p.wantsWtxidRelay
+}
+
+// RelaysTransactions reports whether the remote node wants to hear about transactions, as it said
+// in its version message.
+func (p *Peer) RelaysTransactions() bool {
+	return p.theirVersion.Relay
+}
+
+// Close closes the underlying connection.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+// WriteMessage wraps the payload up in a message header and sends it to the remote node.
+func (p *Peer) WriteMessage(command proto.MessageType, payload proto.Marshallable) error {
+	msgBytes, err := proto.MarshalToBytes(proto.NewMessage(p.cfg.Magic, command, payload))
+	if err != nil {
+		return fmt.Errorf("error marshalling '%s' message: %w", command, err)
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if _, err := p.conn.Write(msgBytes); err != nil {
+		return fmt.Errorf("error writing '%s' message: %w", command, err)
+	}
+	return nil
+}
+
+// ReadMessage reads the next message from the remote node, checking that it is for our network.
+func (p *Peer) ReadMessage() (proto.Message, error) {
+	var msg proto.Message
+	if err := msg.UnmarshalFromReader(p.conn); err != nil {
+		return proto.Message{}, err
+	}
+
+	if msg.Magic != p.cfg.Magic {
+		return proto.Message{}, &MagicMismatchError{Expected: p.cfg.Magic, Got: msg.Magic}
+	}
+
+	return msg, nil
+}
+
+// remoteAddrPort returns the address of the remote node, or the zero value if the connection isn't
+// over IP (e.g. a net.Pipe in tests).
+func (p *Peer) remoteAddrPort() netip.AddrPort {
+	if tcpAddr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// Handshake performs the version/verack exchange. For outbound connections we send our version
+// first; for inbound connections we wait for theirs.
+func (p *Peer) Handshake() error {
+	if p.cfg.HandshakeTimeout > 0 {
+		if err := p.conn.SetDeadline(time.Now().Add(p.cfg.HandshakeTimeout)); err != nil {
+			return fmt.Errorf("unable to set handshake deadline: %w", err)
+		}
+		defer p.conn.SetDeadline(time.Time{})
+	}
+
+	if err := p.handshake(); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("%w: %w", ErrHandshakeTimeout, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *Peer) handshake() error {
+	ourVersion, err := proto.NewVersion(p.cfg.Version, p.cfg.Services, time.Now().Unix(), p.remoteAddrPort())
+	if err != nil {
+		return fmt.Errorf("error creating version message payload: %w", err)
+	}
+	ourVersion.StartHeight = p.cfg.StartHeight
+	if p.cfg.UserAgent != "" {
+		ourVersion.UserAgent = proto.VarString(p.cfg.UserAgent)
+	}
+	ourVersion.Relay = !p.cfg.BlocksOnly // Whether we want to hear about transactions
+	p.ourVersion = ourVersion
+
+	if !p.inbound {
+		p.nonces.add(ourVersion.Nonce)
+		defer p.nonces.remove(ourVersion.Nonce)
+		if err := p.WriteMessage(proto.MSG_VERSION, p.ourVersion); err != nil {
+			return err
+		}
+	}
+
+	if err := p.readVersion(); err != nil {
+		return err
+	}
+
+	if p.inbound {
+		if err := p.WriteMessage(proto.MSG_VERSION, p.ourVersion); err != nil {
+			return err
+		}
+	}
+
+	// Feature negotiation has to happen before we send our verack
+	if p.protocolVersion >= WTXID_RELAY_VERSION {
+		if err := p.WriteMessage(proto.MSG_WTXIDRELAY, proto.WtxidRelay{}); err != nil {
+			return err
+		}
+	}
+	if p.protocolVersion >= ADDRV2_VERSION {
+		if err := p.WriteMessage(proto.MSG_SENDADDRV2, proto.SendAddrV2{}); err != nil {
+			return err
+		}
+	}
+
+	if err := p.WriteMessage(proto.MSG_VERACK, proto.VerAck{}); err != nil {
+		return err
+	}
+
+	return p.readVerAck()
+}
+
+// readVersion waits for the remote node's version message, which must be the first thing they send.
+func (p *Peer) readVersion() error {
+	msg, err := p.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("error reading version message: %w", err)
+	}
+
+	if msg.Command != proto.MSG_VERSION {
+		return &UnexpectedCommandError{Expected: proto.MSG_VERSION, Got: msg.Command}
+	}
+
+	var theirVersion proto.Version
+	if err := theirVersion.UnmarshalFromReader(bytes.NewBuffer(msg.Payload)); err != nil {
+		return fmt.Errorf("error unmarshalling version payload: %w", err)
+	}
+
+	// Our outbound connections' nonces stay in the set until their handshakes finish, which for a
+	// connection to ourselves can't happen before this end has read the version
+	if p.nonces.has(theirVersion.Nonce) {
+		return ErrSelfConnection
+	}
+
+	p.theirVersion = theirVersion
+	p.protocolVersion = min(p.ourVersion.Version, theirVersion.Version)
+	return nil
+}
+
+// readVerAck waits for the remote node to acknowledge our version. Nodes may send feature
+// negotiation messages (e.g. 'sendaddrv2') before their verack; anything else is skipped.
+// 'wtxidrelay' only counts from nodes recent enough to know what it means.
+func (p *Peer) readVerAck() error {
+	for {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("error reading verack message: %w", err)
+		}
+
+		switch msg.Command {
+		case proto.MSG_VERACK:
+			return nil
+		case proto.MSG_VERSION:
+			return &UnexpectedCommandError{Expected: proto.MSG_VERACK, Got: msg.Command}
+		case proto.MSG_SENDADDRV2:
+			p.wantsAddrV2 = true
+		case proto.MSG_WTXIDRELAY:
+			p.wantsWtxidRelay = p.protocolVersion >= WTXID_RELAY_VERSION
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package peer_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connPair returns both ends of a loopback TCP connection. A real socket is used rather than
+// net.Pipe because both sides of the handshake write their verack without waiting to be read.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	require.NotNil(t, server)
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func writeMessage(t *testing.T, conn net.Conn, magic uint32, command proto.MessageType, payload proto.Marshallable) {
+	t.Helper()
+	msgBytes, err := proto.MarshalToBytes(proto.NewMessage(magic, command, payload))
+	require.NoError(t, err)
+	_, err = conn.Write(msgBytes)
+	require.NoError(t, err)
+}
+
+func readVersion(t *testing.T, conn net.Conn) proto.Version {
+	t.Helper()
+	var msg proto.Message
+	require.NoError(t, msg.UnmarshalFromReader(conn))
+	require.Equal(t, proto.MSG_VERSION, msg.Command)
+
+	var version proto.Version
+	require.NoError(t, version.UnmarshalFromReader(bytes.NewBuffer(msg.Payload)))
+	return version
+}
+
+func TestPeer_Handshake(t *testing.T) {
+	client, server := connPair(t)
+
+	ourCfg := config.Default()
+	theirCfg := config.Default()
+	theirCfg.Version = 70015
+	theirCfg.StartHeight = 42
+
+	outbound := peer.NewOutbound(ourCfg, peer.NewNonceSet(), client)
+	inbound := peer.NewInbound(theirCfg, peer.NewNonceSet(), server)
+
+	errs := make(chan error, 2)
+	go func() { errs <- outbound.Handshake() }()
+	go func() { errs <- inbound.Handshake() }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	assert.False(t, outbound.Inbound())
+	assert.True(t, inbound.Inbound())
+
+	// Both sides should settle on the lower of the two versions
+	assert.Equal(t, int32(70015), outbound.ProtocolVersion())
+	assert.Equal(t, int32(70015), inbound.ProtocolVersion())
+
+	assert.Equal(t, int32(42), outbound.TheirVersion().StartHeight)
+	assert.Equal(t, proto.VarString(proto.USER_AGENT), inbound.TheirVersion().UserAgent)
+
+	// Too old for wtxid relay
+	assert.False(t, outbound.WantsWtxidRelay())
+	assert.False(t, inbound.WantsWtxidRelay())
+}
+
+func TestPeer_HandshakeNegotiatesTransactionRelay(t *testing.T) {
+	client, server := connPair(t)
+
+	ourCfg := config.Default()
+	theirCfg := config.Default()
+	theirCfg.BlocksOnly = true
+
+	outbound := peer.NewOutbound(ourCfg, peer.NewNonceSet(), client)
+	inbound := peer.NewInbound(theirCfg, peer.NewNonceSet(), server)
+
+	errs := make(chan error, 2)
+	go func() { errs <- outbound.Handshake() }()
+	go func() { errs <- inbound.Handshake() }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	assert.True(t, outbound.WantsWtxidRelay())
+	assert.True(t, inbound.WantsWtxidRelay())
+
+	// They don't want to hear about transactions, but we do
+	assert.False(t, outbound.RelaysTransactions())
+	assert.True(t, inbound.RelaysTransactions())
+}
+
+func TestPeer_HandshakeSelfConnection(t *testing.T) {
+	client, server := connPair(t)
+	cfg := config.Default()
+
+	go func() {
+		// Echo their version straight back at them, as if they'd connected to themselves
+		version := readVersion(t, server)
+		writeMessage(t, server, cfg.Magic, proto.MSG_VERSION, version)
+	}()
+
+	err := peer.NewOutbound(cfg, peer.NewNonceSet(), client).Handshake()
+	assert.ErrorIs(t, err, peer.ErrSelfConnection)
+}
+
+func TestPeer_HandshakeMagicMismatch(t *testing.T) {
+	client, server := connPair(t)
+	cfg := config.Default()
+
+	go func() {
+		readVersion(t, server)
+		writeMessage(t, server, 0x0709110B, proto.MSG_VERSION, proto.Version{Version: 70016})
+	}()
+
+	err := peer.NewOutbound(cfg, peer.NewNonceSet(), client).Handshake()
+	var magicErr *peer.MagicMismatchError
+	require.True(t, errors.As(err, &magicErr))
+	assert.Equal(t, cfg.Magic, magicErr.Expected)
+	assert.Equal(t, uint32(0x0709110B), magicErr.Got)
+}
+
+func TestPeer_HandshakeUnexpectedCommand(t *testing.T) {
+	client, server := connPair(t)
+	cfg := config.Default()
+
+	go func() {
+		readVersion(t, server)
+		writeMessage(t, server, cfg.Magic, proto.MSG_VERACK, proto.VerAck{})
+	}()
+
+	err := peer.NewOutbound(cfg, peer.NewNonceSet(), client).Handshake()
+	var cmdErr *peer.UnexpectedCommandError
+	require.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, proto.MSG_VERSION, cmdErr.Expected)
+	assert.Equal(t, proto.MSG_VERACK, cmdErr.Got)
+}
+
+func TestPeer_HandshakeTimeout(t *testing.T) {
+	client, _ := connPair(t)
+	cfg := config.Default()
+	cfg.HandshakeTimeout = 50 * time.Millisecond
+
+	// The other end never says anything
+	err := peer.NewInbound(cfg, peer.NewNonceSet(), client).Handshake()
+	assert.ErrorIs(t, err, peer.ErrHandshakeTimeout)
+}
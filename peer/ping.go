@@ -0,0 +1,104 @@
+package peer
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+// pingState tracks our outstanding ping, if any, and the round trip time of the last one answered.
+type pingState struct {
+	nonce   uint64
+	sent    time.Time
+	lastRTT time.Duration
+}
+
+// LastPingRTT is the round trip time of the most recently answered ping, or zero if none has been
+// answered yet.
+func (p *Peer) LastPingRTT() time.Duration {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	return p.ping.lastRTT
+}
+
+// sendPing sends a new ping, unless we're still waiting for the answer to the last one.
+func (p *Peer) sendPing() error {
+	p.pingMu.Lock()
+	if p.ping.nonce != 0 {
+		p.pingMu.Unlock()
+		return nil
+	}
+
+	// Zero means 'no outstanding ping', so make sure we don't pick it
+	nonce := rand.Uint64()
+	for nonce == 0 {
+		nonce = rand.Uint64()
+	}
+	p.ping.nonce = nonce
+	p.ping.sent = time.Now()
+	p.pingMu.Unlock()
+
+	return p.WriteMessage(proto.MSG_PING, proto.Ping{Nonce: nonce})
+}
+
+// pingOverdue reports whether we've been waiting longer than the ping timeout for a pong.
+func (p *Peer) pingOverdue(now time.Time) bool {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	return p.ping.nonce != 0 && now.Sub(p.ping.sent) > p.cfg.PingTimeout
+}
+
+// handlePong records the round trip time if the pong answers our outstanding ping.
+func (p *Peer) handlePong(pong *proto.Pong) {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+
+	if pong.Nonce == 0 || pong.Nonce != p.ping.nonce {
+		// Either unsolicited or a reply to a ping we've given up on
+		return
+	}
+	p.ping.lastRTT = time.Since(p.ping.sent)
+	p.ping.nonce = 0
+}
+
+// pingLoop periodically pings the remote node, and disconnects it if it stops answering. It runs
+// until done is closed.
+func (p *Peer) pingLoop(done <-chan struct{}) {
+	if p.cfg.PingInterval <= 0 {
+		return
+	}
+
+	// Check for overdue pongs at least as often as we ping, so the timeout is reasonably prompt
+	checkInterval := p.cfg.PingInterval
+	if p.cfg.PingTimeout > 0 && p.cfg.PingTimeout < checkInterval {
+		checkInterval = p.cfg.PingTimeout
+	}
+	check := time.NewTicker(checkInterval)
+	defer check.Stop()
+
+	lastPing := time.Time{}
+	for {
+		now := time.Now()
+		if p.cfg.PingTimeout > 0 && p.pingOverdue(now) {
+			p.pingTimedOut.Store(true)
+			p.Close()
+			return
+		}
+
+		if now.Sub(lastPing) >= p.cfg.PingInterval {
+			if err := p.sendPing(); err != nil {
+				log.Printf("error pinging %s: %v", p.Addr(), err)
+				return
+			}
+			lastPing = now
+		}
+
+		select {
+		case <-done:
+			return
+		case <-check.C:
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package peer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeer_AnswersPing(t *testing.T) {
+	outbound, inbound := handshakenPair(t, config.Default(), config.Default())
+
+	pings := make(chan *proto.Ping, 1)
+	go inbound.Run(&peer.Listeners{
+		OnPing: func(p *peer.Peer, msg *proto.Ping) { pings <- msg },
+	})
+
+	require.NoError(t, outbound.WriteMessage(proto.MSG_PING, proto.Ping{Nonce: 1234}))
+
+	// The first thing we hear back is the inbound peer's own ping, since it pings as soon as it starts
+	for {
+		msg, err := outbound.ReadMessage()
+		require.NoError(t, err)
+		if msg.Command != proto.MSG_PONG {
+			continue
+		}
+
+		payload, err := msg.DecodePayload()
+		require.NoError(t, err)
+		assert.Equal(t, &proto.Pong{Nonce: 1234}, payload)
+		break
+	}
+
+	// Listeners still get to see the ping
+	assert.Equal(t, &proto.Ping{Nonce: 1234}, <-pings)
+}
+
+func TestPeer_MeasuresPingRTT(t *testing.T) {
+	cfg := config.Default()
+	cfg.PingInterval = 10 * time.Millisecond
+	outbound, inbound := handshakenPair(t, cfg, cfg)
+
+	assert.Zero(t, outbound.LastPingRTT())
+
+	go outbound.Run(&peer.Listeners{})
+	go inbound.Run(&peer.Listeners{})
+
+	assert.Eventually(t, func() bool {
+		return outbound.LastPingRTT() > 0 && inbound.LastPingRTT() > 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPeer_PingTimeout(t *testing.T) {
+	cfg := config.Default()
+	cfg.PingInterval = 10 * time.Millisecond
+	cfg.PingTimeout = 50 * time.Millisecond
+
+	// The outbound peer never runs its read loop, so never answers our pings
+	_, inbound := handshakenPair(t, config.Default(), cfg)
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- inbound.Run(&peer.Listeners{}) }()
+
+	select {
+	case err := <-runErr:
+		assert.ErrorIs(t, err, peer.ErrPingTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("peer was not disconnected after ping timeout")
+	}
+}
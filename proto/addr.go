@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The maximum number of addresses allowed in a single 'addr' or 'addrv2' message.
+const MAX_ADDR_ENTRIES = 1000
+
+// TimestampedNetAddress is the variant of NetAddress used in 'addr' messages, which is prefixed
+// with the time the node was last seen. The version message omits the timestamp.
+type TimestampedNetAddress NetAddress
+
+func (ta TimestampedNetAddress) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, ta.Time); err != nil {
+		return fmt.Errorf("unable to write time: %w", err)
+	}
+	return NetAddress(ta).MarshalToWriter(w)
+}
+
+func (ta *TimestampedNetAddress) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &ta.Time); err != nil {
+		return fmt.Errorf("unable to read time: %w", err)
+	}
+	return (*NetAddress)(ta).UnmarshalFromReader(r)
+}
+
+// Addr is the payload of an 'addr' message, used to gossip the addresses of other nodes.
+type Addr struct {
+	AddrList []TimestampedNetAddress
+}
+
+func (a Addr) MarshalToWriter(w io.Writer) error {
+	if len(a.AddrList) > MAX_ADDR_ENTRIES {
+		return fmt.Errorf("too many addresses (%d when protocol max is %d)", len(a.AddrList), MAX_ADDR_ENTRIES)
+	}
+
+	if err := VarInt(len(a.AddrList)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write address count: %w", err)
+	}
+
+	for i, addr := range a.AddrList {
+		if err := addr.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write address %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (a *Addr) UnmarshalFromReader(r io.Reader) error {
+	var count VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read address count: %w", err)
+	}
+
+	if count > MAX_ADDR_ENTRIES {
+		return fmt.Errorf("too many addresses (%d when protocol max is %d)", count, MAX_ADDR_ENTRIES)
+	}
+
+	a.AddrList = make([]TimestampedNetAddress, count)
+	for i := range a.AddrList {
+		if err := a.AddrList[i].UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read address %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// GetAddr asks the remote node to send us some addresses of other nodes. Contains no payload.
+type GetAddr struct{}
+
+func (ga GetAddr) MarshalToWriter(w io.Writer) error {
+	return nil
+}
+
+func (ga *GetAddr) UnmarshalFromReader(r io.Reader) error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package proto_test
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampedNetAddress_Marshal(t *testing.T) {
+	addr := proto.TimestampedNetAddress{
+		Time:     0x66743f26,
+		Services: 1,
+		IP:       netip.MustParseAddrPort("127.0.0.1:8333"),
+	}
+
+	expected := []byte{
+		0x26, 0x3f, 0x74, 0x66, // Time, little endian
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Services
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x7f, 0x00, 0x00, 0x01, // IPv4-mapped IP
+		0x20, 0x8d, // Port, big endian
+	}
+
+	addrBytes, err := proto.MarshalToBytes(addr)
+	require.NoError(t, err)
+	assert.Equal(t, expected, addrBytes)
+
+	var gotAddr proto.TimestampedNetAddress
+	require.NoError(t, gotAddr.UnmarshalFromReader(bytes.NewBuffer(addrBytes)))
+	assert.Equal(t, addr, gotAddr)
+}
+
+func TestAddr_MarshalUnmarshal(t *testing.T) {
+	addr := proto.Addr{AddrList: []proto.TimestampedNetAddress{
+		{Time: 1, Services: 1, IP: netip.MustParseAddrPort("192.0.2.1:8333")},
+		{Time: 2, Services: 1033, IP: netip.MustParseAddrPort("[2001:db8::1]:18333")},
+	}}
+
+	addrBytes, err := proto.MarshalToBytes(addr)
+	require.NoError(t, err)
+
+	var gotAddr proto.Addr
+	require.NoError(t, gotAddr.UnmarshalFromReader(bytes.NewBuffer(addrBytes)))
+	assert.Equal(t, addr, gotAddr)
+}
+
+func TestAddr_TooManyAddresses(t *testing.T) {
+	addr := proto.Addr{AddrList: make([]proto.TimestampedNetAddress, proto.MAX_ADDR_ENTRIES+1)}
+
+	_, err := proto.MarshalToBytes(addr)
+	assert.ErrorContains(t, err, "too many addresses")
+
+	// Just the count is enough for the reader to give up
+	countBytes, err := proto.MarshalToBytes(proto.VarInt(proto.MAX_ADDR_ENTRIES + 1))
+	require.NoError(t, err)
+	var gotAddr proto.Addr
+	assert.ErrorContains(t, gotAddr.UnmarshalFromReader(bytes.NewBuffer(countBytes)), "too many addresses")
+}
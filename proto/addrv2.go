@@ -0,0 +1,288 @@
+package proto
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/pscott31/mynode/sha3"
+)
+
+// NetworkID identifies the type of network an address in an 'addrv2' message belongs to (BIP155).
+type NetworkID uint8
+
+const (
+	NET_IPV4  NetworkID = 0x01
+	NET_IPV6  NetworkID = 0x02
+	NET_TORV2 NetworkID = 0x03 // Deprecated, but still has a reserved ID
+	NET_TORV3 NetworkID = 0x04
+	NET_I2P   NetworkID = 0x05
+	NET_CJDNS NetworkID = 0x06
+
+	// The maximum length of an address of any network, known or not.
+	MAX_ADDRV2_LENGTH = 512
+)
+
+// The length of addresses of each of the networks we know about.
+var addrV2Lengths = map[NetworkID]int{
+	NET_IPV4:  4,
+	NET_IPV6:  16,
+	NET_TORV2: 10,
+	NET_TORV3: 32,
+	NET_I2P:   32,
+	NET_CJDNS: 16,
+}
+
+func (n NetworkID) String() string {
+	switch n {
+	case NET_IPV4:
+		return "IPv4"
+	case NET_IPV6:
+		return "IPv6"
+	case NET_TORV2:
+		return "TorV2"
+	case NET_TORV3:
+		return "TorV3"
+	case NET_I2P:
+		return "I2P"
+	case NET_CJDNS:
+		return "CJDNS"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(n))
+	}
+}
+
+// Known reports whether this is a network we know the address format of.
+func (n NetworkID) Known() bool {
+	_, ok := addrV2Lengths[n]
+	return ok
+}
+
+// NetAddressV2 is the address of a node as it appears in an 'addrv2' message. Unlike NetAddress,
+// the address is variable length so it can hold addresses from non-IP networks.
+type NetAddressV2 struct {
+	Time      uint32
+	Services  uint64
+	NetworkID NetworkID
+	Addr      []byte
+	Port      uint16
+}
+
+// NewNetAddressV2 makes an 'addrv2' address for an IP address & port. IPv4-mapped IPv6 addresses are
+// stored as IPv4.
+func NewNetAddressV2(time uint32, services uint64, addrPort netip.AddrPort) NetAddressV2 {
+	addr := addrPort.Addr().Unmap()
+	na := NetAddressV2{
+		Time:     time,
+		Services: services,
+		Port:     addrPort.Port(),
+	}
+	if addr.Is4() {
+		ip := addr.As4()
+		na.NetworkID, na.Addr = NET_IPV4, ip[:]
+	} else {
+		ip := addr.As16()
+		na.NetworkID, na.Addr = NET_IPV6, ip[:]
+	}
+	return na
+}
+
+// AddrPort returns the IP address and port, or false if this isn't an IPv4 or IPv6 address.
+func (na NetAddressV2) AddrPort() (netip.AddrPort, bool) {
+	if na.NetworkID != NET_IPV4 && na.NetworkID != NET_IPV6 {
+		return netip.AddrPort{}, false
+	}
+	addr, ok := netip.AddrFromSlice(na.Addr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addr, na.Port), true
+}
+
+// ToNetAddress converts to the address format used by 'addr' messages, which is only possible for
+// IPv4 and IPv6 addresses.
+func (na NetAddressV2) ToNetAddress() (TimestampedNetAddress, bool) {
+	addrPort, ok := na.AddrPort()
+	if !ok {
+		return TimestampedNetAddress{}, false
+	}
+	return TimestampedNetAddress{Time: na.Time, Services: na.Services, IP: addrPort}, true
+}
+
+// String formats the address in the way it is conventionally written for its network.
+func (na NetAddressV2) String() string {
+	if addrPort, ok := na.AddrPort(); ok {
+		return addrPort.String()
+	}
+
+	host := hex.EncodeToString(na.Addr)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	switch na.NetworkID {
+	case NET_TORV2:
+		host = strings.ToLower(encoding.EncodeToString(na.Addr)) + ".onion"
+	case NET_TORV3:
+		host = strings.ToLower(encoding.EncodeToString(torV3Address(na.Addr))) + ".onion"
+	case NET_I2P:
+		host = strings.ToLower(encoding.EncodeToString(na.Addr)) + ".b32.i2p"
+	case NET_CJDNS:
+		if addr, ok := netip.AddrFromSlice(na.Addr); ok {
+			host = addr.String()
+		}
+	}
+	return na.NetworkID.String() + ":" + host + ":" + strconv.Itoa(int(na.Port))
+}
+
+// torV3Address is what a v3 onion address encodes: the service's public key, followed by a
+// checksum and the version, as per Tor's rend-spec-v3.
+func torV3Address(pubKey []byte) []byte {
+	const version = 0x03
+	checksum := sha3.Sum256(append(append([]byte(".onion checksum"), pubKey...), version))
+	return append(append(append([]byte(nil), pubKey...), checksum[:2]...), version)
+}
+
+// Validate checks the address is the right length for its network, or if we don't know the
+// network, that it's no longer than an address can be.
+func (na NetAddressV2) Validate() error {
+	return checkAddrLength(na.NetworkID, uint64(len(na.Addr)))
+}
+
+func checkAddrLength(id NetworkID, length uint64) error {
+	if length > MAX_ADDRV2_LENGTH {
+		return fmt.Errorf("address length %d exceeds maximum %d", length, MAX_ADDRV2_LENGTH)
+	}
+	if expected, ok := addrV2Lengths[id]; ok && length != uint64(expected) {
+		return fmt.Errorf("invalid %s address length %d (expected %d)", id, length, expected)
+	}
+	return nil
+}
+
+func (na NetAddressV2) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, na.Time); err != nil {
+		return fmt.Errorf("unable to write time: %w", err)
+	}
+
+	// Unlike NetAddress, services are written as a var_int
+	if err := VarInt(na.Services).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write services: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, na.NetworkID); err != nil {
+		return fmt.Errorf("unable to write network id: %w", err)
+	}
+
+	if err := na.Validate(); err != nil {
+		return err
+	}
+
+	if err := VarInt(len(na.Addr)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write address length: %w", err)
+	}
+
+	if _, err := w.Write(na.Addr); err != nil {
+		return fmt.Errorf("unable to write address: %w", err)
+	}
+
+	if err := binary.Write(w, binary.BigEndian, na.Port); err != nil {
+		return fmt.Errorf("unable to write port: %w", err)
+	}
+
+	return nil
+}
+
+// UnmarshalFromReader reads an address of any network. Addresses of networks we don't know about
+// are read successfully so they can be skipped, but it is an error for a known network to have an
+// address of the wrong length.
+func (na *NetAddressV2) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &na.Time); err != nil {
+		return fmt.Errorf("unable to read time: %w", err)
+	}
+
+	var services VarInt
+	if err := services.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read services: %w", err)
+	}
+	na.Services = uint64(services)
+
+	if err := binary.Read(r, binary.LittleEndian, &na.NetworkID); err != nil {
+		return fmt.Errorf("unable to read network id: %w", err)
+	}
+
+	var length VarInt
+	if err := length.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read address length: %w", err)
+	}
+
+	if err := checkAddrLength(na.NetworkID, uint64(length)); err != nil {
+		return err
+	}
+
+	na.Addr = make([]byte, length)
+	if _, err := io.ReadFull(r, na.Addr); err != nil {
+		return fmt.Errorf("unable to read address: %w", err)
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &na.Port); err != nil {
+		return fmt.Errorf("unable to read port: %w", err)
+	}
+
+	return nil
+}
+
+// AddrV2 is the payload of an 'addrv2' message (BIP155), which replaces 'addr' for nodes that have
+// signalled support with 'sendaddrv2'.
+type AddrV2 struct {
+	AddrList []NetAddressV2
+}
+
+func (a AddrV2) MarshalToWriter(w io.Writer) error {
+	if len(a.AddrList) > MAX_ADDR_ENTRIES {
+		return fmt.Errorf("too many addresses (%d when protocol max is %d)", len(a.AddrList), MAX_ADDR_ENTRIES)
+	}
+
+	if err := VarInt(len(a.AddrList)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write address count: %w", err)
+	}
+
+	for i, addr := range a.AddrList {
+		if err := addr.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write address %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (a *AddrV2) UnmarshalFromReader(r io.Reader) error {
+	var count VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read address count: %w", err)
+	}
+
+	if count > MAX_ADDR_ENTRIES {
+		return fmt.Errorf("too many addresses (%d when protocol max is %d)", count, MAX_ADDR_ENTRIES)
+	}
+
+	a.AddrList = make([]NetAddressV2, count)
+	for i := range a.AddrList {
+		if err := a.AddrList[i].UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read address %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SendAddrV2 signals that we'd like to receive 'addrv2' messages rather than 'addr'. It must be
+// sent between 'version' and 'verack'. Contains no payload.
+type SendAddrV2 struct{}
+
+func (s SendAddrV2) MarshalToWriter(w io.Writer) error {
+	return nil
+}
+
+func (s *SendAddrV2) UnmarshalFromReader(r io.Reader) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package proto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The public key of a well known v3 onion service.
+var torV3PubKey, _ = hex.DecodeString("1d04a1d04a338c6e6ae970bfabee49049d6702250984ca950c01673f4ec034ad")
+
+func TestNetAddressV2_MarshalUnmarshal(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   proto.NetAddressV2
+		String string
+	}{
+		{
+			name:   "IPv4 address",
+			addr:   proto.NewNetAddressV2(1, 1, netip.MustParseAddrPort("192.0.2.1:8333")),
+			String: "192.0.2.1:8333",
+		},
+		{
+			name:   "IPv6 address",
+			addr:   proto.NewNetAddressV2(1, 1, netip.MustParseAddrPort("[2001:db8::1]:8333")),
+			String: "[2001:db8::1]:8333",
+		},
+		{
+			name:   "TorV3 address",
+			addr:   proto.NetAddressV2{NetworkID: proto.NET_TORV3, Addr: torV3PubKey, Port: 8333},
+			String: "TorV3:duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion:8333",
+		},
+		{
+			name:   "I2P address",
+			addr:   proto.NetAddressV2{NetworkID: proto.NET_I2P, Addr: make([]byte, 32), Port: 0},
+			String: "I2P:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.b32.i2p:0",
+		},
+		{
+			name:   "CJDNS address",
+			addr:   proto.NetAddressV2{NetworkID: proto.NET_CJDNS, Addr: netip.MustParseAddr("fc00::1").AsSlice(), Port: 8333},
+			String: "CJDNS:fc00::1:8333",
+		},
+		{
+			name:   "Unknown network",
+			addr:   proto.NetAddressV2{NetworkID: 0x42, Addr: []byte{0x01, 0x02, 0x03}, Port: 1},
+			String: "unknown(66):010203:1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrBytes, err := proto.MarshalToBytes(tt.addr)
+			require.NoError(t, err)
+
+			var gotAddr proto.NetAddressV2
+			require.NoError(t, gotAddr.UnmarshalFromReader(bytes.NewBuffer(addrBytes)))
+			assert.Equal(t, tt.addr, gotAddr)
+			assert.Equal(t, tt.String, gotAddr.String())
+		})
+	}
+}
+
+func TestNetAddressV2_Marshal(t *testing.T) {
+	addr := proto.NewNetAddressV2(0x66743f26, 1033, netip.MustParseAddrPort("127.0.0.1:8333"))
+
+	expected := []byte{
+		0x26, 0x3f, 0x74, 0x66, // Time, little endian
+		0xfd, 0x09, 0x04, // Services, var_int
+		0x01,                   // Network ID (IPv4)
+		0x04,                   // Address length
+		0x7f, 0x00, 0x00, 0x01, // Address
+		0x20, 0x8d, // Port, big endian
+	}
+
+	addrBytes, err := proto.MarshalToBytes(addr)
+	require.NoError(t, err)
+	assert.Equal(t, expected, addrBytes)
+}
+
+func TestNetAddressV2_InvalidLength(t *testing.T) {
+	addr := proto.NetAddressV2{NetworkID: proto.NET_IPV4, Addr: make([]byte, 16)}
+	_, err := proto.MarshalToBytes(addr)
+	assert.ErrorContains(t, err, "invalid IPv4 address length")
+
+	addrBytes := []byte{
+		0x00, 0x00, 0x00, 0x00, // Time
+		0x01,       // Services
+		0x04,       // Network ID (TorV3)
+		0x02,       // Address length, which should be 32
+		0x01, 0x02, // Address
+		0x20, 0x8d, // Port
+	}
+	var gotAddr proto.NetAddressV2
+	assert.ErrorContains(t, gotAddr.UnmarshalFromReader(bytes.NewBuffer(addrBytes)), "invalid TorV3 address length")
+}
+
+func TestNetAddressV2_ToNetAddress(t *testing.T) {
+	addr := proto.NewNetAddressV2(1, 1, netip.MustParseAddrPort("[::ffff:192.0.2.1]:8333"))
+	assert.Equal(t, proto.NET_IPV4, addr.NetworkID)
+
+	legacyAddr, ok := addr.ToNetAddress()
+	require.True(t, ok)
+	assert.Equal(t, proto.TimestampedNetAddress{Time: 1, Services: 1, IP: netip.MustParseAddrPort("192.0.2.1:8333")}, legacyAddr)
+
+	_, ok = proto.NetAddressV2{NetworkID: proto.NET_TORV3, Addr: make([]byte, 32)}.ToNetAddress()
+	assert.False(t, ok)
+}
+
+func TestAddrV2_MarshalUnmarshal(t *testing.T) {
+	addr := proto.AddrV2{AddrList: []proto.NetAddressV2{
+		proto.NewNetAddressV2(1, 1, netip.MustParseAddrPort("192.0.2.1:8333")),
+		{Time: 2, Services: 1, NetworkID: proto.NET_TORV3, Addr: make([]byte, 32), Port: 8333},
+	}}
+
+	addrBytes, err := proto.MarshalToBytes(addr)
+	require.NoError(t, err)
+
+	var gotAddr proto.AddrV2
+	require.NoError(t, gotAddr.UnmarshalFromReader(bytes.NewBuffer(addrBytes)))
+	assert.Equal(t, addr, gotAddr)
+}
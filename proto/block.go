@@ -0,0 +1,117 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+)
+
+// Block is a block header and the transactions it commits to, as carried in a 'block' message.
+type Block struct {
+	Header       BlockHeader
+	Transactions []Tx
+}
+
+// BlockHash is the hash of the block's header, which identifies the block.
+func (b Block) BlockHash() Hash {
+	return b.Header.BlockHash()
+}
+
+// MerkleRoot computes the root of the merkle tree of the block's txids, which should match the
+// one in the header. See CalcMerkleRoot for what mutated means.
+func (b Block) MerkleRoot() (root Hash, mutated bool) {
+	hashes := make([]Hash, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		hashes[i] = tx.TxHash()
+	}
+	return CalcMerkleRoot(hashes)
+}
+
+// WitnessMerkleRoot computes the root of the merkle tree of the block's wtxids, which the
+// coinbase commits to. The coinbase's own wtxid is taken to be zero, as it can't commit to itself.
+func (b Block) WitnessMerkleRoot() Hash {
+	hashes := make([]Hash, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		if i > 0 {
+			hashes[i] = tx.WitnessHash()
+		}
+	}
+	root, _ := CalcMerkleRoot(hashes)
+	return root
+}
+
+// SerializeSize is the size of the block's full serialization, including witness data.
+func (b Block) SerializeSize() int {
+	var counter countingWriter
+	_ = b.MarshalToWriter(&counter)
+	return int(counter)
+}
+
+// StrippedSize is the size of the block's serialization without witness data.
+func (b Block) StrippedSize() int {
+	size := BLOCK_HEADER_SIZE
+	var counter countingWriter
+	_ = VarInt(len(b.Transactions)).MarshalToWriter(&counter)
+	size += int(counter)
+	for _, tx := range b.Transactions {
+		size += tx.StrippedSize()
+	}
+	return size
+}
+
+// Weight is the BIP141 weight of the block.
+func (b Block) Weight() int {
+	return b.StrippedSize()*(WITNESS_SCALE_FACTOR-1) + b.SerializeSize()
+}
+
+func (b Block) MarshalToWriter(w io.Writer) error {
+	return b.marshal(w, true)
+}
+
+// MarshalNoWitness writes the block with its transactions' original serialization, for nodes that
+// don't understand witness data.
+func (b Block) MarshalNoWitness(w io.Writer) error {
+	return b.marshal(w, false)
+}
+
+func (b Block) marshal(w io.Writer, withWitness bool) error {
+	if err := b.Header.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write block header: %w", err)
+	}
+
+	if err := VarInt(len(b.Transactions)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write transaction count: %w", err)
+	}
+
+	for i, tx := range b.Transactions {
+		if err := tx.marshal(w, withWitness && tx.HasWitness()); err != nil {
+			return fmt.Errorf("unable to write transaction %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *Block) UnmarshalFromReader(r io.Reader) error {
+	if err := b.Header.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read block header: %w", err)
+	}
+
+	var count VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read transaction count: %w", err)
+	}
+	if err := checkCount(count); err != nil {
+		return fmt.Errorf("bad transaction count: %w", err)
+	}
+
+	b.Transactions = nil
+	for i := 0; i < int(count); i++ {
+		var tx Tx
+		if err := tx.UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read transaction %d: %w", i, err)
+		}
+		b.Transactions = append(b.Transactions, tx)
+	}
+
+	return nil
+}
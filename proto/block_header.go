@@ -0,0 +1,92 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The size of a block header on the wire.
+const BLOCK_HEADER_SIZE = 80
+
+// BlockHeader is the 80 byte header that every block starts with. It's what gets hashed for proof
+// of work, and commits to the transactions in the block via the merkle root.
+type BlockHeader struct {
+	Version    int32
+	PrevBlock  Hash
+	MerkleRoot Hash
+	Timestamp  uint32
+	Bits       uint32 // Compact encoding of the proof of work target
+	Nonce      uint32
+}
+
+// BlockHash is the double-SHA256 hash of the header, which identifies the block.
+func (h BlockHeader) BlockHash() Hash {
+	buf := bytes.NewBuffer(make([]byte, 0, BLOCK_HEADER_SIZE))
+	// Writing to a bytes.Buffer can't fail
+	_ = h.MarshalToWriter(buf)
+	return DoubleSHA256(buf.Bytes())
+}
+
+// Time is the header's timestamp as a time.Time.
+func (h BlockHeader) Time() time.Time {
+	return time.Unix(int64(h.Timestamp), 0)
+}
+
+func (h BlockHeader) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, h.Version); err != nil {
+		return fmt.Errorf("unable to write block version: %w", err)
+	}
+
+	if err := h.PrevBlock.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write previous block hash: %w", err)
+	}
+
+	if err := h.MerkleRoot.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write merkle root: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, h.Timestamp); err != nil {
+		return fmt.Errorf("unable to write timestamp: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, h.Bits); err != nil {
+		return fmt.Errorf("unable to write bits: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, h.Nonce); err != nil {
+		return fmt.Errorf("unable to write nonce: %w", err)
+	}
+
+	return nil
+}
+
+func (h *BlockHeader) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &h.Version); err != nil {
+		return fmt.Errorf("unable to read block version: %w", err)
+	}
+
+	if err := h.PrevBlock.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read previous block hash: %w", err)
+	}
+
+	if err := h.MerkleRoot.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read merkle root: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &h.Timestamp); err != nil {
+		return fmt.Errorf("unable to read timestamp: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &h.Bits); err != nil {
+		return fmt.Errorf("unable to read bits: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &h.Nonce); err != nil {
+		return fmt.Errorf("unable to read nonce: %w", err)
+	}
+
+	return nil
+}
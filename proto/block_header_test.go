@@ -0,0 +1,63 @@
+package proto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The mainnet genesis block header
+var GENESIS_HEADER = proto.BlockHeader{
+	Version:    1,
+	PrevBlock:  proto.Hash{},
+	MerkleRoot: proto.MustHashFromStr("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"),
+	Timestamp:  1231006505,
+	Bits:       0x1d00ffff,
+	Nonce:      2083236893,
+}
+
+const GENESIS_HEADER_HEX = "01000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a" +
+	"29ab5f49" +
+	"ffff001d" +
+	"1dac2b7c"
+
+func TestBlockHeader_Marshal(t *testing.T) {
+	headerBytes, err := proto.MarshalToBytes(GENESIS_HEADER)
+	require.NoError(t, err)
+	assert.Len(t, headerBytes, proto.BLOCK_HEADER_SIZE)
+	assert.Equal(t, GENESIS_HEADER_HEX, hex.EncodeToString(headerBytes))
+
+	var gotHeader proto.BlockHeader
+	require.NoError(t, gotHeader.UnmarshalFromReader(bytes.NewBuffer(headerBytes)))
+	assert.Equal(t, GENESIS_HEADER, gotHeader)
+}
+
+func TestBlockHeader_BlockHash(t *testing.T) {
+	assert.Equal(t, "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f", GENESIS_HEADER.BlockHash().String())
+
+	// Block 1 builds on the genesis block
+	block1 := proto.BlockHeader{
+		Version:    1,
+		PrevBlock:  GENESIS_HEADER.BlockHash(),
+		MerkleRoot: proto.MustHashFromStr("0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098"),
+		Timestamp:  1231469665,
+		Bits:       0x1d00ffff,
+		Nonce:      2573394689,
+	}
+	assert.Equal(t, "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048", block1.BlockHash().String())
+}
+
+func TestBlockHeader_UnmarshalShort(t *testing.T) {
+	headerBytes, err := proto.MarshalToBytes(GENESIS_HEADER)
+	require.NoError(t, err)
+
+	var gotHeader proto.BlockHeader
+	assert.ErrorContains(t, gotHeader.UnmarshalFromReader(bytes.NewBuffer(headerBytes[:79])), "nonce")
+	assert.ErrorContains(t, gotHeader.UnmarshalFromReader(bytes.NewBuffer(headerBytes[:20])), "previous block hash")
+}
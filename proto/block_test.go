@@ -0,0 +1,78 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func genesisBlock(t *testing.T) proto.Block {
+	t.Helper()
+	var coinbase proto.Tx
+	require.NoError(t, coinbase.UnmarshalFromReader(bytes.NewReader(mustDecodeHex(t, GENESIS_COINBASE_HEX))))
+	return proto.Block{Header: GENESIS_HEADER, Transactions: []proto.Tx{coinbase}}
+}
+
+func TestBlock_MarshalUnmarshal(t *testing.T) {
+	blockBytes := mustDecodeHex(t, GENESIS_HEADER_HEX+"01"+GENESIS_COINBASE_HEX)
+
+	var block proto.Block
+	require.NoError(t, block.UnmarshalFromReader(bytes.NewReader(blockBytes)))
+	assert.Equal(t, genesisBlock(t), block)
+	assert.Equal(t, GENESIS_HEADER.BlockHash(), block.BlockHash())
+
+	gotBytes, err := proto.MarshalToBytes(block)
+	require.NoError(t, err)
+	assert.Equal(t, blockBytes, gotBytes)
+
+	assert.Equal(t, len(blockBytes), block.SerializeSize())
+	assert.Equal(t, len(blockBytes), block.StrippedSize())
+	assert.Equal(t, 4*len(blockBytes), block.Weight())
+}
+
+func TestBlock_DecodeFromMessage(t *testing.T) {
+	block := genesisBlock(t)
+	msg := proto.NewMessage(42, proto.MSG_BLOCK, block)
+
+	payload, err := msg.DecodePayload()
+	require.NoError(t, err)
+	assert.Equal(t, &block, payload)
+}
+
+func TestBlock_MerkleRoot(t *testing.T) {
+	block := genesisBlock(t)
+	root, mutated := block.MerkleRoot()
+	assert.Equal(t, GENESIS_HEADER.MerkleRoot, root)
+	assert.False(t, mutated)
+
+	// With a witness transaction added, the witness root differs from the txid one
+	block.Transactions = append(block.Transactions, witnessTx())
+	root, _ = block.MerkleRoot()
+	witnessRoot := block.WitnessMerkleRoot()
+	assert.NotEqual(t, root, witnessRoot)
+
+	// The coinbase counts as zero in the witness tree
+	wtxid := witnessTx().WitnessHash()
+	assert.Equal(t, proto.DoubleSHA256(append(make([]byte, proto.HASH_SIZE), wtxid[:]...)), witnessRoot)
+
+	// Witness data counts once towards the weight, everything else four times
+	assert.Greater(t, block.SerializeSize(), block.StrippedSize())
+	assert.Equal(t, 3*block.StrippedSize()+block.SerializeSize(), block.Weight())
+}
+
+func TestBlock_MarshalNoWitness(t *testing.T) {
+	block := genesisBlock(t)
+	block.Transactions = append(block.Transactions, witnessTx())
+
+	var stripped bytes.Buffer
+	require.NoError(t, block.MarshalNoWitness(&stripped))
+	assert.Equal(t, block.StrippedSize(), stripped.Len())
+
+	var gotBlock proto.Block
+	require.NoError(t, gotBlock.UnmarshalFromReader(&stripped))
+	assert.False(t, gotBlock.Transactions[1].HasWitness())
+	assert.Equal(t, block.Transactions[1].TxHash(), gotBlock.Transactions[1].TxHash())
+}
@@ -0,0 +1,27 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FeeFilter asks the remote node not to announce transactions paying a fee rate below MinFee,
+// in satoshis per 1000 virtual bytes (BIP133).
+type FeeFilter struct {
+	MinFee int64
+}
+
+func (f FeeFilter) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, f.MinFee); err != nil {
+		return fmt.Errorf("unable to write fee filter: %w", err)
+	}
+	return nil
+}
+
+func (f *FeeFilter) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &f.MinFee); err != nil {
+		return fmt.Errorf("unable to read fee filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeFilter_MarshalUnmarshal(t *testing.T) {
+	filter := proto.FeeFilter{MinFee: 48_508}
+
+	filterBytes, err := proto.MarshalToBytes(filter)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x7c, 0xbd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, filterBytes)
+
+	var gotFilter proto.FeeFilter
+	assert.NoError(t, gotFilter.UnmarshalFromReader(bytes.NewBuffer(filterBytes)))
+	assert.Equal(t, filter, gotFilter)
+
+	// Too short
+	assert.ErrorContains(t, gotFilter.UnmarshalFromReader(bytes.NewBuffer(filterBytes[:4])), "fee filter")
+}
@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const HASH_SIZE = 32
+
+// Hash is a double-SHA256 hash, as used for block and transaction ids. It's stored in the byte
+// order it's hashed and sent over the wire in, but conventionally displayed byte-reversed.
+type Hash [HASH_SIZE]byte
+
+// DoubleSHA256 hashes the data twice with SHA256.
+func DoubleSHA256(b []byte) Hash {
+	hash := sha256.Sum256(b)
+	return Hash(sha256.Sum256(hash[:]))
+}
+
+// NewHashFromStr parses a hash from its (byte-reversed) display form.
+func NewHashFromStr(s string) (Hash, error) {
+	var h Hash
+	if len(s) != HASH_SIZE*2 {
+		return h, fmt.Errorf("hash string has length %d, expected %d", len(s), HASH_SIZE*2)
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, fmt.Errorf("unable to decode hash string: %w", err)
+	}
+
+	for i := range b {
+		h[i] = b[HASH_SIZE-1-i]
+	}
+	return h, nil
+}
+
+// MustHashFromStr is like NewHashFromStr but panics if the string isn't a valid hash. It's
+// intended for hard-coded constants.
+func MustHashFromStr(s string) Hash {
+	h, err := NewHashFromStr(s)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// String returns the hash in its conventional byte-reversed hex form.
+func (h Hash) String() string {
+	var reversed Hash
+	for i := range h {
+		reversed[i] = h[HASH_SIZE-1-i]
+	}
+	return hex.EncodeToString(reversed[:])
+}
+
+// IsZero reports whether every byte of the hash is zero.
+func (h Hash) IsZero() bool {
+	return h == Hash{}
+}
+
+func (h Hash) MarshalToWriter(w io.Writer) error {
+	if _, err := w.Write(h[:]); err != nil {
+		return fmt.Errorf("unable to write hash: %w", err)
+	}
+	return nil
+}
+
+func (h *Hash) UnmarshalFromReader(r io.Reader) error {
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return fmt.Errorf("unable to read hash: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash_String(t *testing.T) {
+	const genesis = "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+
+	hash, err := proto.NewHashFromStr(genesis)
+	require.NoError(t, err)
+
+	// Stored little endian, so the leading zeros of the display form come last
+	assert.Equal(t, byte(0x6f), hash[0])
+	assert.Equal(t, byte(0x00), hash[31])
+	assert.Equal(t, genesis, hash.String())
+}
+
+func TestHash_NewFromStrFails(t *testing.T) {
+	_, err := proto.NewHashFromStr("00")
+	assert.ErrorContains(t, err, "length")
+
+	_, err = proto.NewHashFromStr("zz0000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
+	assert.ErrorContains(t, err, "decode")
+}
+
+func TestHash_DoubleSHA256(t *testing.T) {
+	// The well known double-SHA256 of the empty string
+	assert.Equal(t, "56944c5d3f98413ef45cf54545538103cc9f298e0575820ad3591376e2e0f65d", proto.DoubleSHA256(nil).String())
+}
+
+func TestHash_MarshalUnmarshal(t *testing.T) {
+	hash := proto.DoubleSHA256([]byte("hello"))
+
+	hashBytes, err := proto.MarshalToBytes(hash)
+	require.NoError(t, err)
+	assert.Equal(t, hash[:], hashBytes)
+
+	var gotHash proto.Hash
+	require.NoError(t, gotHash.UnmarshalFromReader(bytes.NewBuffer(hashBytes)))
+	assert.Equal(t, hash, gotHash)
+	assert.False(t, gotHash.IsZero())
+}
@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// The most headers a node will send in reply to a single 'getheaders'.
+	MAX_HEADERS_RESULTS = 2000
+
+	// The most hashes we'll accept in a block locator.
+	MAX_LOCATOR_SIZE = 101
+)
+
+// GetHeaders asks the remote node for the headers following the first hash in the block locator
+// that's on its best chain, up to and including HashStop (or MAX_HEADERS_RESULTS of them, if
+// HashStop is zero).
+type GetHeaders struct {
+	Version            uint32
+	BlockLocatorHashes []Hash
+	HashStop           Hash
+}
+
+func (gh GetHeaders) MarshalToWriter(w io.Writer) error {
+	if len(gh.BlockLocatorHashes) > MAX_LOCATOR_SIZE {
+		return fmt.Errorf("too many block locator hashes (%d when max is %d)", len(gh.BlockLocatorHashes), MAX_LOCATOR_SIZE)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, gh.Version); err != nil {
+		return fmt.Errorf("unable to write version: %w", err)
+	}
+
+	if err := VarInt(len(gh.BlockLocatorHashes)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write block locator count: %w", err)
+	}
+
+	for i, hash := range gh.BlockLocatorHashes {
+		if err := hash.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write block locator hash %d: %w", i, err)
+		}
+	}
+
+	if err := gh.HashStop.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write stop hash: %w", err)
+	}
+
+	return nil
+}
+
+func (gh *GetHeaders) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &gh.Version); err != nil {
+		return fmt.Errorf("unable to read version: %w", err)
+	}
+
+	var count VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read block locator count: %w", err)
+	}
+
+	if count > MAX_LOCATOR_SIZE {
+		return fmt.Errorf("too many block locator hashes (%d when max is %d)", count, MAX_LOCATOR_SIZE)
+	}
+
+	gh.BlockLocatorHashes = make([]Hash, count)
+	for i := range gh.BlockLocatorHashes {
+		if err := gh.BlockLocatorHashes[i].UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read block locator hash %d: %w", i, err)
+		}
+	}
+
+	if err := gh.HashStop.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read stop hash: %w", err)
+	}
+
+	return nil
+}
+
+// Headers is the reply to 'getheaders'. On the wire each header is followed by a transaction count,
+// which is always zero.
+type Headers struct {
+	Headers []BlockHeader
+}
+
+func (h Headers) MarshalToWriter(w io.Writer) error {
+	if len(h.Headers) > MAX_HEADERS_RESULTS {
+		return fmt.Errorf("too many headers (%d when protocol max is %d)", len(h.Headers), MAX_HEADERS_RESULTS)
+	}
+
+	if err := VarInt(len(h.Headers)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write header count: %w", err)
+	}
+
+	for i, header := range h.Headers {
+		if err := header.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write header %d: %w", i, err)
+		}
+		if err := VarInt(0).MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write transaction count of header %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (h *Headers) UnmarshalFromReader(r io.Reader) error {
+	var count VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read header count: %w", err)
+	}
+
+	if count > MAX_HEADERS_RESULTS {
+		return fmt.Errorf("too many headers (%d when protocol max is %d)", count, MAX_HEADERS_RESULTS)
+	}
+
+	h.Headers = make([]BlockHeader, count)
+	for i := range h.Headers {
+		if err := h.Headers[i].UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read header %d: %w", i, err)
+		}
+
+		var txCount VarInt
+		if err := txCount.UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read transaction count of header %d: %w", i, err)
+		}
+		if txCount != 0 {
+			return fmt.Errorf("header %d has non-zero transaction count %d", i, txCount)
+		}
+	}
+
+	return nil
+}
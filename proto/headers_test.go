@@ -0,0 +1,80 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetHeaders_MarshalUnmarshal(t *testing.T) {
+	getHeaders := proto.GetHeaders{
+		Version:            70016,
+		BlockLocatorHashes: []proto.Hash{GENESIS_HEADER.BlockHash(), proto.DoubleSHA256([]byte("other"))},
+		HashStop:           proto.Hash{},
+	}
+
+	getHeadersBytes, err := proto.MarshalToBytes(getHeaders)
+	require.NoError(t, err)
+	assert.Len(t, getHeadersBytes, 4+1+32*2+32)
+
+	var gotGetHeaders proto.GetHeaders
+	require.NoError(t, gotGetHeaders.UnmarshalFromReader(bytes.NewBuffer(getHeadersBytes)))
+	assert.Equal(t, getHeaders, gotGetHeaders)
+}
+
+func TestGetHeaders_TooManyLocatorHashes(t *testing.T) {
+	getHeaders := proto.GetHeaders{BlockLocatorHashes: make([]proto.Hash, proto.MAX_LOCATOR_SIZE+1)}
+	_, err := proto.MarshalToBytes(getHeaders)
+	assert.ErrorContains(t, err, "too many block locator hashes")
+
+	getHeadersBytes := append([]byte{0x80, 0x11, 0x01, 0x00}, 0xfd, 0x66, 0x00)
+	var gotGetHeaders proto.GetHeaders
+	assert.ErrorContains(t, gotGetHeaders.UnmarshalFromReader(bytes.NewBuffer(getHeadersBytes)), "too many block locator hashes")
+}
+
+func TestHeaders_MarshalUnmarshal(t *testing.T) {
+	headers := proto.Headers{Headers: []proto.BlockHeader{GENESIS_HEADER, GENESIS_HEADER}}
+
+	headersBytes, err := proto.MarshalToBytes(headers)
+	require.NoError(t, err)
+
+	// Each header is followed by a zero transaction count
+	assert.Len(t, headersBytes, 1+2*(proto.BLOCK_HEADER_SIZE+1))
+	assert.Equal(t, byte(0), headersBytes[1+proto.BLOCK_HEADER_SIZE])
+
+	var gotHeaders proto.Headers
+	require.NoError(t, gotHeaders.UnmarshalFromReader(bytes.NewBuffer(headersBytes)))
+	assert.Equal(t, headers, gotHeaders)
+}
+
+func TestHeaders_TooManyHeaders(t *testing.T) {
+	headers := proto.Headers{Headers: make([]proto.BlockHeader, proto.MAX_HEADERS_RESULTS+1)}
+	_, err := proto.MarshalToBytes(headers)
+	assert.ErrorContains(t, err, "too many headers")
+
+	countBytes, err := proto.MarshalToBytes(proto.VarInt(proto.MAX_HEADERS_RESULTS + 1))
+	require.NoError(t, err)
+	var gotHeaders proto.Headers
+	assert.ErrorContains(t, gotHeaders.UnmarshalFromReader(bytes.NewBuffer(countBytes)), "too many headers")
+
+	// Exactly the maximum is fine
+	headers.Headers = headers.Headers[:proto.MAX_HEADERS_RESULTS]
+	headersBytes, err := proto.MarshalToBytes(headers)
+	require.NoError(t, err)
+	require.NoError(t, gotHeaders.UnmarshalFromReader(bytes.NewBuffer(headersBytes)))
+	assert.Len(t, gotHeaders.Headers, proto.MAX_HEADERS_RESULTS)
+}
+
+func TestHeaders_NonZeroTransactionCount(t *testing.T) {
+	headerBytes, err := proto.MarshalToBytes(GENESIS_HEADER)
+	require.NoError(t, err)
+
+	headersBytes := append([]byte{0x01}, headerBytes...)
+	headersBytes = append(headersBytes, 0x01)
+
+	var gotHeaders proto.Headers
+	assert.ErrorContains(t, gotHeaders.UnmarshalFromReader(bytes.NewBuffer(headersBytes)), "non-zero transaction count")
+}
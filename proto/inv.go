@@ -0,0 +1,174 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// InvType says what sort of object an inventory vector refers to.
+type InvType uint32
+
+const (
+	INV_TYPE_ERROR          InvType = 0
+	INV_TYPE_TX             InvType = 1
+	INV_TYPE_BLOCK          InvType = 2
+	INV_TYPE_FILTERED_BLOCK InvType = 3 // BIP37
+	INV_TYPE_CMPCT_BLOCK    InvType = 4 // BIP152
+	INV_TYPE_WTX            InvType = 5 // BIP339: the hash is a wtxid
+
+	// BIP144: set in 'getdata' to ask for the object with its witness data.
+	INV_WITNESS_FLAG InvType = 1 << 30
+
+	INV_TYPE_WITNESS_TX             = INV_TYPE_TX | INV_WITNESS_FLAG
+	INV_TYPE_WITNESS_BLOCK          = INV_TYPE_BLOCK | INV_WITNESS_FLAG
+	INV_TYPE_FILTERED_WITNESS_BLOCK = INV_TYPE_FILTERED_BLOCK | INV_WITNESS_FLAG
+)
+
+// The most inventory vectors a single 'inv', 'getdata' or 'notfound' may carry.
+const MAX_INV_ENTRIES = 50000
+
+var invTypeStrings = map[InvType]string{
+	INV_TYPE_ERROR:                  "ERROR",
+	INV_TYPE_TX:                     "TX",
+	INV_TYPE_BLOCK:                  "BLOCK",
+	INV_TYPE_FILTERED_BLOCK:         "FILTERED_BLOCK",
+	INV_TYPE_CMPCT_BLOCK:            "CMPCT_BLOCK",
+	INV_TYPE_WTX:                    "WTX",
+	INV_TYPE_WITNESS_TX:             "WITNESS_TX",
+	INV_TYPE_WITNESS_BLOCK:          "WITNESS_BLOCK",
+	INV_TYPE_FILTERED_WITNESS_BLOCK: "FILTERED_WITNESS_BLOCK",
+}
+
+func (t InvType) String() string {
+	if s, ok := invTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown InvType (%d)", uint32(t))
+}
+
+// IsTx reports whether the type refers to a transaction, by txid or wtxid.
+func (t InvType) IsTx() bool {
+	base := t &^ INV_WITNESS_FLAG
+	return base == INV_TYPE_TX || base == INV_TYPE_WTX
+}
+
+// IsBlock reports whether the type refers to a block, in any of its forms.
+func (t InvType) IsBlock() bool {
+	switch t &^ INV_WITNESS_FLAG {
+	case INV_TYPE_BLOCK, INV_TYPE_FILTERED_BLOCK, INV_TYPE_CMPCT_BLOCK:
+		return true
+	}
+	return false
+}
+
+// InvVect identifies a transaction or block that a node has, or wants.
+type InvVect struct {
+	Type InvType
+	Hash Hash
+}
+
+func (iv InvVect) String() string {
+	return fmt.Sprintf("%s %s", iv.Type, iv.Hash)
+}
+
+func (iv InvVect) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, iv.Type); err != nil {
+		return fmt.Errorf("unable to write inventory type: %w", err)
+	}
+
+	if err := iv.Hash.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write inventory hash: %w", err)
+	}
+
+	return nil
+}
+
+func (iv *InvVect) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &iv.Type); err != nil {
+		return fmt.Errorf("unable to read inventory type: %w", err)
+	}
+
+	if err := iv.Hash.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read inventory hash: %w", err)
+	}
+
+	return nil
+}
+
+// Inv announces transactions or blocks the sending node has.
+type Inv struct {
+	InvList []InvVect
+}
+
+func (inv Inv) MarshalToWriter(w io.Writer) error {
+	return marshalInvList(w, inv.InvList)
+}
+
+func (inv *Inv) UnmarshalFromReader(r io.Reader) error {
+	return unmarshalInvList(r, &inv.InvList)
+}
+
+// GetData asks for the transactions or blocks listed, usually in response to an 'inv'.
+type GetData struct {
+	InvList []InvVect
+}
+
+func (gd GetData) MarshalToWriter(w io.Writer) error {
+	return marshalInvList(w, gd.InvList)
+}
+
+func (gd *GetData) UnmarshalFromReader(r io.Reader) error {
+	return unmarshalInvList(r, &gd.InvList)
+}
+
+// NotFound lists the objects from a 'getdata' that the sending node doesn't have.
+type NotFound struct {
+	InvList []InvVect
+}
+
+func (nf NotFound) MarshalToWriter(w io.Writer) error {
+	return marshalInvList(w, nf.InvList)
+}
+
+func (nf *NotFound) UnmarshalFromReader(r io.Reader) error {
+	return unmarshalInvList(r, &nf.InvList)
+}
+
+func marshalInvList(w io.Writer, invList []InvVect) error {
+	if len(invList) > MAX_INV_ENTRIES {
+		return fmt.Errorf("too many inventory vectors (%d when max is %d)", len(invList), MAX_INV_ENTRIES)
+	}
+
+	if err := VarInt(len(invList)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write inventory count: %w", err)
+	}
+
+	for i, iv := range invList {
+		if err := iv.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write inventory vector %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func unmarshalInvList(r io.Reader, invList *[]InvVect) error {
+	var count VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read inventory count: %w", err)
+	}
+
+	if count > MAX_INV_ENTRIES {
+		return fmt.Errorf("too many inventory vectors (%d when max is %d)", count, MAX_INV_ENTRIES)
+	}
+
+	*invList = make([]InvVect, count)
+	for i := range *invList {
+		if err := (*invList)[i].UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read inventory vector %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
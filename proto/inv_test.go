@@ -0,0 +1,85 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvVect_MarshalUnmarshal(t *testing.T) {
+	iv := proto.InvVect{Type: proto.INV_TYPE_WITNESS_BLOCK, Hash: GENESIS_HEADER.BlockHash()}
+
+	ivBytes, err := proto.MarshalToBytes(iv)
+	require.NoError(t, err)
+	assert.Len(t, ivBytes, 36)
+	assert.Equal(t, []byte{0x02, 0x00, 0x00, 0x40}, ivBytes[:4])
+
+	var gotIV proto.InvVect
+	require.NoError(t, gotIV.UnmarshalFromReader(bytes.NewReader(ivBytes)))
+	assert.Equal(t, iv, gotIV)
+	assert.Equal(t, "WITNESS_BLOCK 000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f", gotIV.String())
+}
+
+func TestInvType(t *testing.T) {
+	tests := []struct {
+		invType proto.InvType
+		name    string
+		isTx    bool
+		isBlock bool
+	}{
+		{proto.INV_TYPE_ERROR, "ERROR", false, false},
+		{proto.INV_TYPE_TX, "TX", true, false},
+		{proto.INV_TYPE_BLOCK, "BLOCK", false, true},
+		{proto.INV_TYPE_FILTERED_BLOCK, "FILTERED_BLOCK", false, true},
+		{proto.INV_TYPE_CMPCT_BLOCK, "CMPCT_BLOCK", false, true},
+		{proto.INV_TYPE_WTX, "WTX", true, false},
+		{proto.INV_TYPE_WITNESS_TX, "WITNESS_TX", true, false},
+		{proto.INV_TYPE_WITNESS_BLOCK, "WITNESS_BLOCK", false, true},
+		{proto.INV_TYPE_FILTERED_WITNESS_BLOCK, "FILTERED_WITNESS_BLOCK", false, true},
+		{proto.InvType(99), "Unknown InvType (99)", false, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.name, tt.invType.String())
+		assert.Equal(t, tt.isTx, tt.invType.IsTx(), tt.name)
+		assert.Equal(t, tt.isBlock, tt.invType.IsBlock(), tt.name)
+	}
+}
+
+func TestInvMessages_MarshalUnmarshal(t *testing.T) {
+	invList := []proto.InvVect{
+		{Type: proto.INV_TYPE_TX, Hash: proto.DoubleSHA256([]byte("tx"))},
+		{Type: proto.INV_TYPE_BLOCK, Hash: GENESIS_HEADER.BlockHash()},
+	}
+
+	for _, tt := range []struct {
+		command proto.MessageType
+		payload proto.Payload
+	}{
+		{proto.MSG_INV, &proto.Inv{InvList: invList}},
+		{proto.MSG_GETDATA, &proto.GetData{InvList: invList}},
+		{proto.MSG_NOTFOUND, &proto.NotFound{InvList: invList}},
+	} {
+		payloadBytes, err := proto.MarshalToBytes(tt.payload)
+		require.NoError(t, err)
+		assert.Len(t, payloadBytes, 1+2*36)
+
+		gotPayload, err := proto.NewMessage(42, tt.command, tt.payload).DecodePayload()
+		require.NoError(t, err)
+		assert.Equal(t, tt.payload, gotPayload)
+	}
+}
+
+func TestInv_TooManyEntries(t *testing.T) {
+	inv := proto.Inv{InvList: make([]proto.InvVect, proto.MAX_INV_ENTRIES+1)}
+	_, err := proto.MarshalToBytes(inv)
+	assert.ErrorContains(t, err, "too many inventory vectors")
+
+	countBytes, err := proto.MarshalToBytes(proto.VarInt(proto.MAX_INV_ENTRIES + 1))
+	require.NoError(t, err)
+	var gotInv proto.Inv
+	assert.ErrorContains(t, gotInv.UnmarshalFromReader(bytes.NewReader(countBytes)), "too many inventory vectors")
+}
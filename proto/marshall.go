@@ -16,3 +16,13 @@ func MarshalToBytes[T Marshallable](t T) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+type Unmarshallable interface {
+	UnmarshalFromReader(r io.Reader) error
+}
+
+// Payload is implemented by the types carried in the payload of a Message.
+type Payload interface {
+	Marshallable
+	Unmarshallable
+}
@@ -0,0 +1,36 @@
+package proto
+
+// CalcMerkleRoot computes the root of the merkle tree over the hashes, as used for a block's
+// transactions. Where a level has an odd number of hashes, the last is paired with itself.
+//
+// That pairing means a list of transactions with a duplicated pair at the end gives the same root
+// as the list without (CVE-2012-2459), so mutated reports whether two identical hashes were paired
+// at any level. A block with a mutated tree can't be valid, but the header may still be fine.
+func CalcMerkleRoot(hashes []Hash) (root Hash, mutated bool) {
+	if len(hashes) == 0 {
+		return Hash{}, false
+	}
+
+	level := make([]Hash, len(hashes))
+	copy(level, hashes)
+
+	var pair [2 * HASH_SIZE]byte
+	for len(level) > 1 {
+		for i := 0; i+1 < len(level); i += 2 {
+			if level[i] == level[i+1] {
+				mutated = true
+			}
+		}
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+
+		for i := 0; i < len(level); i += 2 {
+			copy(pair[:HASH_SIZE], level[i][:])
+			copy(pair[HASH_SIZE:], level[i+1][:])
+			level[i/2] = DoubleSHA256(pair[:])
+		}
+		level = level[:len(level)/2]
+	}
+	return level[0], mutated
+}
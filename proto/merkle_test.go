@@ -0,0 +1,40 @@
+package proto_test
+
+import (
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalcMerkleRoot(t *testing.T) {
+	a, b, c := proto.DoubleSHA256([]byte("a")), proto.DoubleSHA256([]byte("b")), proto.DoubleSHA256([]byte("c"))
+	pair := func(l, r proto.Hash) proto.Hash { return proto.DoubleSHA256(append(l[:], r[:]...)) }
+
+	root, mutated := proto.CalcMerkleRoot(nil)
+	assert.Equal(t, proto.Hash{}, root)
+	assert.False(t, mutated)
+
+	// A single hash is its own root
+	root, mutated = proto.CalcMerkleRoot([]proto.Hash{a})
+	assert.Equal(t, a, root)
+	assert.False(t, mutated)
+
+	root, mutated = proto.CalcMerkleRoot([]proto.Hash{a, b})
+	assert.Equal(t, pair(a, b), root)
+	assert.False(t, mutated)
+
+	// An odd one out is paired with itself
+	root, mutated = proto.CalcMerkleRoot([]proto.Hash{a, b, c})
+	assert.Equal(t, pair(pair(a, b), pair(c, c)), root)
+	assert.False(t, mutated)
+
+	// Which means duplicating it gives the same root, but is detected
+	mutatedRoot, mutated := proto.CalcMerkleRoot([]proto.Hash{a, b, c, c})
+	assert.Equal(t, root, mutatedRoot)
+	assert.True(t, mutated)
+
+	// As is a duplicated pair further up the tree
+	_, mutated = proto.CalcMerkleRoot([]proto.Hash{a, b, a, b})
+	assert.True(t, mutated)
+}
@@ -13,6 +13,21 @@ const (
 	MAX_COMMAND_LENGTH int         = 12
 	MSG_VERSION        MessageType = "version"
 	MSG_VERACK         MessageType = "verack"
+	MSG_PING           MessageType = "ping"
+	MSG_PONG           MessageType = "pong"
+	MSG_ADDR           MessageType = "addr"
+	MSG_ADDRV2         MessageType = "addrv2"
+	MSG_SENDADDRV2     MessageType = "sendaddrv2"
+	MSG_GETADDR        MessageType = "getaddr"
+	MSG_GETHEADERS     MessageType = "getheaders"
+	MSG_HEADERS        MessageType = "headers"
+	MSG_TX             MessageType = "tx"
+	MSG_BLOCK          MessageType = "block"
+	MSG_INV            MessageType = "inv"
+	MSG_GETDATA        MessageType = "getdata"
+	MSG_NOTFOUND       MessageType = "notfound"
+	MSG_WTXIDRELAY     MessageType = "wtxidrelay"
+	MSG_FEEFILTER      MessageType = "feefilter"
 )
 
 func (mt MessageType) MarshalToWriter(w io.Writer) error {
@@ -13,6 +13,8 @@ var (
 	INVALID_IP_ADDR  = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 )
 
+// NetAddress is the address of a node as it appears in a version message. The Time field is only
+// marshalled when wrapped up as a TimestampedNetAddress, as in 'addr' messages.
 type NetAddress struct {
 	Time     uint32
 	Services uint64
@@ -22,11 +24,6 @@ type NetAddress struct {
 func (na NetAddress) MarshalToWriter(w io.Writer) error {
 	var err error
 
-	// Timestamp is not written in the version message, which is all we're using NetAddress for at the moment
-	// if err = binary.Write(w, binary.LittleEndian, na.Time); err != nil {
-	// 	return fmt.Errorf("unable to write time: %w", err)
-	// }
-
 	// Write the services bitmask
 	if err = binary.Write(w, binary.LittleEndian, na.Services); err != nil {
 		return fmt.Errorf("unable to write services: %w", err)
@@ -67,11 +64,6 @@ func (na NetAddress) MarshalToWriter(w io.Writer) error {
 }
 
 func (na *NetAddress) UnmarshalFromReader(r io.Reader) error {
-	// // Timestamp is not written in the version message, which is all we're using NetAddress for at the moment
-	// if err := binary.Read(r, binary.LittleEndian, &na.Time); err != nil {
-	// 	return fmt.Errorf("unable to read time: %w", err)
-	// }
-
 	if err := binary.Read(r, binary.LittleEndian, &na.Services); err != nil {
 		return fmt.Errorf("unable to read services: %w", err)
 	}
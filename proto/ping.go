@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Ping is sent periodically to check the connection is still alive. The remote node should reply
+// with a Pong carrying the same nonce (BIP31).
+type Ping struct {
+	Nonce uint64
+}
+
+func (p Ping) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, p.Nonce); err != nil {
+		return fmt.Errorf("unable to write ping nonce: %w", err)
+	}
+	return nil
+}
+
+func (p *Ping) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &p.Nonce); err != nil {
+		return fmt.Errorf("unable to read ping nonce: %w", err)
+	}
+	return nil
+}
+
+// Pong is the reply to a Ping, echoing back its nonce.
+type Pong struct {
+	Nonce uint64
+}
+
+func (p Pong) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, p.Nonce); err != nil {
+		return fmt.Errorf("unable to write pong nonce: %w", err)
+	}
+	return nil
+}
+
+func (p *Pong) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &p.Nonce); err != nil {
+		return fmt.Errorf("unable to read pong nonce: %w", err)
+	}
+	return nil
+}
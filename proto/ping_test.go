@@ -0,0 +1,36 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPing_MarshalUnmarshal(t *testing.T) {
+	ping := proto.Ping{Nonce: 0x0102030405060708}
+
+	pingBytes, err := proto.MarshalToBytes(ping)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, pingBytes)
+
+	var gotPing proto.Ping
+	assert.NoError(t, gotPing.UnmarshalFromReader(bytes.NewBuffer(pingBytes)))
+	assert.Equal(t, ping, gotPing)
+}
+
+func TestPong_MarshalUnmarshal(t *testing.T) {
+	pong := proto.Pong{Nonce: 0x0102030405060708}
+
+	pongBytes, err := proto.MarshalToBytes(pong)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, pongBytes)
+
+	var gotPong proto.Pong
+	assert.NoError(t, gotPong.UnmarshalFromReader(bytes.NewBuffer(pongBytes)))
+	assert.Equal(t, pong, gotPong)
+
+	// Too short
+	assert.ErrorContains(t, gotPong.UnmarshalFromReader(bytes.NewBuffer(pongBytes[:4])), "pong nonce")
+}
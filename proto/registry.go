@@ -0,0 +1,55 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// payloadTypes maps each message type we understand to a constructor for its (empty) payload.
+var payloadTypes = map[MessageType]func() Payload{
+	MSG_VERSION: func() Payload { return &Version{} },
+	MSG_VERACK:  func() Payload { return &VerAck{} },
+	MSG_PING:    func() Payload { return &Ping{} },
+	MSG_PONG:    func() Payload { return &Pong{} },
+
+	MSG_ADDR:       func() Payload { return &Addr{} },
+	MSG_ADDRV2:     func() Payload { return &AddrV2{} },
+	MSG_SENDADDRV2: func() Payload { return &SendAddrV2{} },
+	MSG_GETADDR:    func() Payload { return &GetAddr{} },
+
+	MSG_GETHEADERS: func() Payload { return &GetHeaders{} },
+	MSG_HEADERS:    func() Payload { return &Headers{} },
+
+	MSG_TX:         func() Payload { return &Tx{} },
+	MSG_BLOCK:      func() Payload { return &Block{} },
+	MSG_WTXIDRELAY: func() Payload { return &WtxidRelay{} },
+	MSG_FEEFILTER:  func() Payload { return &FeeFilter{} },
+
+	MSG_INV:      func() Payload { return &Inv{} },
+	MSG_GETDATA:  func() Payload { return &GetData{} },
+	MSG_NOTFOUND: func() Payload { return &NotFound{} },
+}
+
+// NewPayload returns an empty payload of the type carried by messages of the given type, or false
+// if we don't know about that type of message.
+func NewPayload(messageType MessageType) (Payload, bool) {
+	newPayload, ok := payloadTypes[messageType]
+	if !ok {
+		return nil, false
+	}
+	return newPayload(), true
+}
+
+// DecodePayload unmarshals the payload of a message into the appropriate type. It returns a nil
+// payload (and no error) if we don't know about that type of message.
+func (m Message) DecodePayload() (Payload, error) {
+	payload, ok := NewPayload(m.Command)
+	if !ok {
+		return nil, nil
+	}
+
+	if err := payload.UnmarshalFromReader(bytes.NewReader(m.Payload)); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal '%s' payload: %w", m.Command, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,33 @@
+package proto_test
+
+import (
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_DecodePayload(t *testing.T) {
+	version := proto.Version{Version: 70016, Services: 1, Nonce: 1234, UserAgent: "/test/"}
+	msg := proto.NewMessage(42, proto.MSG_VERSION, version)
+
+	payload, err := msg.DecodePayload()
+	require.NoError(t, err)
+	assert.Equal(t, &version, payload)
+}
+
+func TestMessage_DecodePayloadUnknown(t *testing.T) {
+	msg := proto.NewMessage(42, proto.MessageType("example"), proto.VarString("payload"))
+
+	payload, err := msg.DecodePayload()
+	assert.NoError(t, err)
+	assert.Nil(t, payload)
+}
+
+func TestMessage_DecodePayloadInvalid(t *testing.T) {
+	msg := proto.NewMessage(42, proto.MSG_VERSION, proto.VarString("not a version"))
+
+	_, err := msg.DecodePayload()
+	assert.ErrorContains(t, err, "version")
+}
@@ -0,0 +1,9 @@
+package proto
+
+// Service flags, advertised in the version message, saying what a node can do for its peers.
+const (
+	NODE_NETWORK         uint64 = 1 << 0  // Serves the full block chain
+	NODE_BLOOM           uint64 = 1 << 2  // BIP111: serves bloom filtered blocks and transactions
+	NODE_WITNESS         uint64 = 1 << 3  // BIP144: serves blocks and transactions with witness data
+	NODE_NETWORK_LIMITED uint64 = 1 << 10 // BIP159: serves only the last 288 blocks
+)
@@ -0,0 +1,294 @@
+package proto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"github.com/pscott31/mynode/secp256k1"
+)
+
+// SigHashType says which parts of a transaction a signature commits to. It's the last byte of an
+// ECDSA signature, and of a 65 byte Schnorr signature.
+type SigHashType uint32
+
+const (
+	SIGHASH_DEFAULT      SigHashType = 0x00 // Taproot only: the same as SIGHASH_ALL
+	SIGHASH_ALL          SigHashType = 0x01
+	SIGHASH_NONE         SigHashType = 0x02
+	SIGHASH_SINGLE       SigHashType = 0x03
+	SIGHASH_ANYONECANPAY SigHashType = 0x80
+
+	SIGHASH_OUTPUT_MASK = 0x03
+)
+
+// ErrSigHashType is returned for a taproot signature hash type that isn't defined, or
+// SIGHASH_SINGLE without a matching output.
+var ErrSigHashType = errors.New("invalid taproot signature hash type")
+
+// SigHashMidstate holds the hashes of a transaction's inputs and outputs that all its BIP143 and
+// BIP341 signature hashes share. Working them out once per transaction, rather than once per
+// signature, keeps the hashing linear in the size of the transaction.
+type SigHashMidstate struct {
+	// BIP143 double SHA256s
+	hashPrevOuts Hash
+	hashSequence Hash
+	hashOutputs  Hash
+
+	// BIP341 single SHA256s, which need the spent outputs
+	taproot          bool
+	shaPrevOuts      Hash
+	shaAmounts       Hash
+	shaScriptPubKeys Hash
+	shaSequences     Hash
+	shaOutputs       Hash
+}
+
+// NewSigHashMidstate works out the shared hashes for a transaction. prevOuts are the outputs spent
+// by each input, in order, which taproot signatures commit to; they can be nil if none of the
+// inputs are taproot spends.
+func NewSigHashMidstate(tx Tx, prevOuts []TxOut) *SigHashMidstate {
+	// Writing to a hash can't fail
+	prevOutsHash, sequencesHash, outputsHash := sha256.New(), sha256.New(), sha256.New()
+	for _, in := range tx.TxIn {
+		_ = in.PreviousOutPoint.MarshalToWriter(prevOutsHash)
+		_ = binary.Write(sequencesHash, binary.LittleEndian, in.Sequence)
+	}
+	for _, out := range tx.TxOut {
+		_ = out.MarshalToWriter(outputsHash)
+	}
+
+	m := &SigHashMidstate{
+		shaPrevOuts:  sumHash(prevOutsHash),
+		shaSequences: sumHash(sequencesHash),
+		shaOutputs:   sumHash(outputsHash),
+	}
+	// BIP143's hashes are just these hashed again
+	m.hashPrevOuts = sha256.Sum256(m.shaPrevOuts[:])
+	m.hashSequence = sha256.Sum256(m.shaSequences[:])
+	m.hashOutputs = sha256.Sum256(m.shaOutputs[:])
+
+	if prevOuts != nil && len(prevOuts) == len(tx.TxIn) {
+		amountsHash, scriptsHash := sha256.New(), sha256.New()
+		for _, out := range prevOuts {
+			_ = binary.Write(amountsHash, binary.LittleEndian, out.Value)
+			_ = writeVarBytes(scriptsHash, out.PkScript)
+		}
+		m.shaAmounts = sumHash(amountsHash)
+		m.shaScriptPubKeys = sumHash(scriptsHash)
+		m.taproot = true
+	}
+	return m
+}
+
+// SignatureHash is the original signature hash, which legacy and P2SH scripts sign. scriptCode is
+// the script being run, with any OP_CODESEPARATORs and the signature itself already removed.
+//
+// Signing an output that doesn't exist with SIGHASH_SINGLE signs the number one instead. It's a
+// bug, but one signatures rely on, so it has to be kept.
+func (tx Tx) SignatureHash(scriptCode []byte, hashType SigHashType, idx int) Hash {
+	outputs := hashType & 0x1f
+	if outputs == SIGHASH_SINGLE && idx >= len(tx.TxOut) {
+		return Hash{1}
+	}
+	anyoneCanPay := hashType&SIGHASH_ANYONECANPAY != 0
+
+	// Writing to a hash can't fail
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, tx.Version)
+
+	writeInput := func(i int) {
+		in := tx.TxIn[i]
+		_ = in.PreviousOutPoint.MarshalToWriter(h)
+		if i == idx {
+			_ = writeVarBytes(h, scriptCode)
+		} else {
+			_ = writeVarBytes(h, nil)
+		}
+		// Other inputs' sequences aren't signed if their outputs aren't either, so they can be
+		// updated
+		if i != idx && (outputs == SIGHASH_NONE || outputs == SIGHASH_SINGLE) {
+			_ = binary.Write(h, binary.LittleEndian, uint32(0))
+		} else {
+			_ = binary.Write(h, binary.LittleEndian, in.Sequence)
+		}
+	}
+	if anyoneCanPay {
+		_ = VarInt(1).MarshalToWriter(h)
+		writeInput(idx)
+	} else {
+		_ = VarInt(len(tx.TxIn)).MarshalToWriter(h)
+		for i := range tx.TxIn {
+			writeInput(i)
+		}
+	}
+
+	switch outputs {
+	case SIGHASH_NONE:
+		_ = VarInt(0).MarshalToWriter(h)
+	case SIGHASH_SINGLE:
+		// Outputs before ours are blanked out, and those after left off
+		_ = VarInt(idx + 1).MarshalToWriter(h)
+		for i := 0; i < idx; i++ {
+			_ = TxOut{Value: -1}.MarshalToWriter(h)
+		}
+		_ = tx.TxOut[idx].MarshalToWriter(h)
+	default:
+		_ = VarInt(len(tx.TxOut)).MarshalToWriter(h)
+		for _, out := range tx.TxOut {
+			_ = out.MarshalToWriter(h)
+		}
+	}
+
+	_ = binary.Write(h, binary.LittleEndian, tx.LockTime)
+	_ = binary.Write(h, binary.LittleEndian, uint32(hashType))
+	first := sumHash(h)
+	return sha256.Sum256(first[:])
+}
+
+// WitnessSignatureHash is the BIP143 signature hash, which segwit v0 scripts sign. Unlike the
+// original it commits to the amount being spent. midstate can be nil, in which case it's worked
+// out just for this signature.
+func (tx Tx) WitnessSignatureHash(scriptCode []byte, hashType SigHashType, idx int, amount int64, midstate *SigHashMidstate) Hash {
+	if midstate == nil {
+		midstate = NewSigHashMidstate(tx, nil)
+	}
+	anyoneCanPay := hashType&SIGHASH_ANYONECANPAY != 0
+	outputs := hashType & 0x1f
+
+	var hashPrevOuts, hashSequence, hashOutputs Hash
+	if !anyoneCanPay {
+		hashPrevOuts = midstate.hashPrevOuts
+	}
+	if !anyoneCanPay && outputs != SIGHASH_SINGLE && outputs != SIGHASH_NONE {
+		hashSequence = midstate.hashSequence
+	}
+	if outputs != SIGHASH_SINGLE && outputs != SIGHASH_NONE {
+		hashOutputs = midstate.hashOutputs
+	} else if outputs == SIGHASH_SINGLE && idx < len(tx.TxOut) {
+		var buf byteWriter
+		_ = tx.TxOut[idx].MarshalToWriter(&buf)
+		hashOutputs = DoubleSHA256(buf)
+	}
+
+	// Writing to a hash can't fail
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, tx.Version)
+	h.Write(hashPrevOuts[:])
+	h.Write(hashSequence[:])
+	_ = tx.TxIn[idx].PreviousOutPoint.MarshalToWriter(h)
+	_ = writeVarBytes(h, scriptCode)
+	_ = binary.Write(h, binary.LittleEndian, amount)
+	_ = binary.Write(h, binary.LittleEndian, tx.TxIn[idx].Sequence)
+	h.Write(hashOutputs[:])
+	_ = binary.Write(h, binary.LittleEndian, tx.LockTime)
+	_ = binary.Write(h, binary.LittleEndian, uint32(hashType))
+	first := sumHash(h)
+	return sha256.Sum256(first[:])
+}
+
+// TaprootSpend is what a BIP341 signature hash commits to about how an input is spent, beyond the
+// transaction itself.
+type TaprootSpend struct {
+	// The SHA256 of the length-prefixed annex, if the witness has one
+	AnnexPresent bool
+	AnnexHash    Hash
+
+	// BIP342: set for a script path spend, with the leaf being run and the position of the last
+	// OP_CODESEPARATOR executed in it, or 0xffffffff
+	ScriptPath  bool
+	TapLeafHash Hash
+	CodeSepPos  uint32
+}
+
+// TaprootSignatureHash is the BIP341 signature hash, which taproot key path spends sign, and with
+// the BIP342 extension, tapscripts. prevOuts are the outputs spent by each input, in order.
+// midstate can be nil, in which case it's worked out just for this signature.
+func (tx Tx) TaprootSignatureHash(hashType SigHashType, idx int, prevOuts []TxOut, spend TaprootSpend, midstate *SigHashMidstate) (Hash, error) {
+	if len(prevOuts) != len(tx.TxIn) || idx < 0 || idx >= len(tx.TxIn) {
+		return Hash{}, errors.New("previous outputs don't match the inputs")
+	}
+	if midstate == nil {
+		midstate = NewSigHashMidstate(tx, prevOuts)
+	}
+	if !midstate.taproot {
+		return Hash{}, errors.New("midstate was worked out without the previous outputs")
+	}
+
+	if !(hashType <= SIGHASH_SINGLE || (hashType >= SIGHASH_ALL|SIGHASH_ANYONECANPAY && hashType <= SIGHASH_SINGLE|SIGHASH_ANYONECANPAY)) {
+		return Hash{}, ErrSigHashType
+	}
+	outputs := hashType & SIGHASH_OUTPUT_MASK
+	if hashType == SIGHASH_DEFAULT {
+		outputs = SIGHASH_ALL
+	}
+	anyoneCanPay := hashType&SIGHASH_ANYONECANPAY != 0
+	if outputs == SIGHASH_SINGLE && idx >= len(tx.TxOut) {
+		return Hash{}, ErrSigHashType
+	}
+
+	// Writing to a byteWriter can't fail
+	var buf byteWriter
+	buf = append(buf, 0) // Epoch
+	buf = append(buf, byte(hashType))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(tx.Version))
+	buf = binary.LittleEndian.AppendUint32(buf, tx.LockTime)
+
+	if !anyoneCanPay {
+		buf = append(buf, midstate.shaPrevOuts[:]...)
+		buf = append(buf, midstate.shaAmounts[:]...)
+		buf = append(buf, midstate.shaScriptPubKeys[:]...)
+		buf = append(buf, midstate.shaSequences[:]...)
+	}
+	if outputs == SIGHASH_ALL {
+		buf = append(buf, midstate.shaOutputs[:]...)
+	}
+
+	var spendType byte
+	if spend.ScriptPath {
+		spendType |= 2
+	}
+	if spend.AnnexPresent {
+		spendType |= 1
+	}
+	buf = append(buf, spendType)
+
+	if anyoneCanPay {
+		_ = tx.TxIn[idx].PreviousOutPoint.MarshalToWriter(&buf)
+		_ = prevOuts[idx].MarshalToWriter(&buf)
+		buf = binary.LittleEndian.AppendUint32(buf, tx.TxIn[idx].Sequence)
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(idx))
+	}
+	if spend.AnnexPresent {
+		buf = append(buf, spend.AnnexHash[:]...)
+	}
+	if outputs == SIGHASH_SINGLE {
+		outputHash := sha256.New()
+		_ = tx.TxOut[idx].MarshalToWriter(outputHash)
+		sum := sumHash(outputHash)
+		buf = append(buf, sum[:]...)
+	}
+
+	if spend.ScriptPath {
+		buf = append(buf, spend.TapLeafHash[:]...)
+		buf = append(buf, 0) // Key version
+		buf = binary.LittleEndian.AppendUint32(buf, spend.CodeSepPos)
+	}
+
+	return Hash(secp256k1.TaggedHash("TapSighash", buf)), nil
+}
+
+// AnnexHash is the hash of a taproot annex that signatures commit to.
+func AnnexHash(annex []byte) Hash {
+	h := sha256.New()
+	_ = writeVarBytes(h, annex)
+	return sumHash(h)
+}
+
+func sumHash(h hash.Hash) Hash {
+	var sum Hash
+	h.Sum(sum[:0])
+	return sum
+}
@@ -0,0 +1,266 @@
+package proto_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/secp256k1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustDecodeTx(t *testing.T, s string) proto.Tx {
+	t.Helper()
+	var tx proto.Tx
+	require.NoError(t, tx.UnmarshalFromReader(bytes.NewReader(mustDecodeHex(t, s))))
+	return tx
+}
+
+func TestTx_SignatureHash(t *testing.T) {
+	// The first bitcoin ever spent, in block 170, which pays to a public key
+	tx := mustDecodeTx(t, "0100000001c997a5e56e104102fa209c6a852dd90660a20b2d9c352423edce25857fcd3704000000004847304402204e45e16932b8af514961a1d3a1a25fdf3f4f7732e9d624c6c61548ab5fb8cd410220181522ec8eca07de4860a4acdd12909d831cc56cbbac4622082221a8768d1d0901ffffffff0200ca9a3b00000000434104ae1a62fe09c5f51b13905f07f06b99a2f7159b2225f374cd378d71302fa28414e7aab37397f554a7df5f142c21c1b7303b8a0626f1baded5c72a704f7e6cd84cac00286bee0000000043410411db93e1dcdb8a016b49840f8c53bc1eb68a382e97b1482ecad7b148a6909a5cb2e0eaddfb84ccf9744464f82e160bfa9b8b64f9d4c03f999b8643f656b412a3ac00000000")
+	pubKey := mustDecodeHex(t, "0411db93e1dcdb8a016b49840f8c53bc1eb68a382e97b1482ecad7b148a6909a5cb2e0eaddfb84ccf9744464f82e160bfa9b8b64f9d4c03f999b8643f656b412a3")
+	pkScript := append(append([]byte{0x41}, pubKey...), 0xac)
+
+	// The signature script is a single push of the signature and its hash type
+	sigScript := tx.TxIn[0].SignatureScript
+	sig, hashType := sigScript[1:len(sigScript)-1], proto.SigHashType(sigScript[len(sigScript)-1])
+	require.Equal(t, proto.SIGHASH_ALL, hashType)
+
+	parsedSig, err := secp256k1.ParseDERSignature(sig)
+	require.NoError(t, err)
+	parsedKey, err := secp256k1.ParsePubKey(pubKey)
+	require.NoError(t, err)
+
+	hash := tx.SignatureHash(pkScript, hashType, 0)
+	assert.True(t, parsedSig.Verify(hash[:], parsedKey))
+
+	hash = tx.SignatureHash(pkScript, proto.SIGHASH_NONE, 0)
+	assert.False(t, parsedSig.Verify(hash[:], parsedKey))
+}
+
+func TestTx_SignatureHashSingleBug(t *testing.T) {
+	tx := sigHashTx()
+	tx.TxOut = tx.TxOut[:1]
+
+	// SIGHASH_SINGLE without a matching output signs the number one
+	assert.Equal(t, proto.Hash{1}, tx.SignatureHash([]byte{0x51}, proto.SIGHASH_SINGLE, 1))
+	assert.Equal(t, proto.Hash{1}, tx.SignatureHash([]byte{0x51}, proto.SIGHASH_SINGLE|proto.SIGHASH_ANYONECANPAY, 1))
+	assert.NotEqual(t, proto.Hash{1}, tx.SignatureHash([]byte{0x51}, proto.SIGHASH_SINGLE, 0))
+}
+
+func TestTx_WitnessSignatureHash(t *testing.T) {
+	// The examples from BIP143
+	tests := []struct {
+		name       string
+		tx         string
+		idx        int
+		scriptCode string
+		amount     int64
+		expected   string
+	}{
+		{
+			name:       "native P2WPKH",
+			tx:         "0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000",
+			idx:        1,
+			scriptCode: "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac",
+			amount:     600_000_000,
+			expected:   "c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670",
+		},
+		{
+			name:       "P2SH-P2WPKH",
+			tx:         "0100000001db6b1b20aa0fd7b23880be2ecbd4a98130974cf4748fb66092ac4d3ceb1a54770100000000feffffff02b8b4eb0b000000001976a914a457b684d7f0d539a46a45bbc043f35b59d0d96388ac0008af2f000000001976a914fd270b1ee6abcaea97fea7ad0402e8bd8ad6d77c88ac92040000",
+			idx:        0,
+			scriptCode: "76a91479091972186c449eb1ded22b78e40d009bdf008988ac",
+			amount:     1_000_000_000,
+			expected:   "64f3b0f4dd2bb3aa1ce8566d220cc74dda9df97d8490cc81d89d735c92e59fb6",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := mustDecodeTx(t, tt.tx)
+			scriptCode := mustDecodeHex(t, tt.scriptCode)
+
+			// BIP143 writes digests in the order they're hashed, not reversed like hashes usually are
+			hash := tx.WitnessSignatureHash(scriptCode, proto.SIGHASH_ALL, tt.idx, tt.amount, nil)
+			assert.Equal(t, tt.expected, hexString(hash))
+
+			midstate := proto.NewSigHashMidstate(tx, nil)
+			hash = tx.WitnessSignatureHash(scriptCode, proto.SIGHASH_ALL, tt.idx, tt.amount, midstate)
+			assert.Equal(t, tt.expected, hexString(hash))
+		})
+	}
+}
+
+func TestTx_WitnessSignatureHashCommitments(t *testing.T) {
+	tx := sigHashTx()
+	script := []byte{0x51}
+	midstate := proto.NewSigHashMidstate(tx, nil)
+
+	// Changing another input's sequence only matters if all the outputs are signed, and inputs
+	// aren't signed at all with ANYONECANPAY
+	changed := sigHashTx()
+	changed.TxIn[0].Sequence--
+	changedMidstate := proto.NewSigHashMidstate(changed, nil)
+
+	tests := []struct {
+		hashType proto.SigHashType
+		changes  bool
+	}{
+		{proto.SIGHASH_ALL, true},
+		{proto.SIGHASH_NONE, false},
+		{proto.SIGHASH_SINGLE, false},
+		{proto.SIGHASH_ALL | proto.SIGHASH_ANYONECANPAY, false},
+	}
+	for _, tt := range tests {
+		hash := tx.WitnessSignatureHash(script, tt.hashType, 1, 1000, midstate)
+		assert.Equal(t, hash, tx.WitnessSignatureHash(script, tt.hashType, 1, 1000, nil), "%#x", tt.hashType)
+		assert.NotEqual(t, hash, tx.WitnessSignatureHash(script, tt.hashType, 1, 1001, midstate), "%#x", tt.hashType)
+		changedHash := changed.WitnessSignatureHash(script, tt.hashType, 1, 1000, changedMidstate)
+		assert.Equal(t, tt.changes, hash != changedHash, "%#x", tt.hashType)
+	}
+}
+
+func TestTx_TaprootSignatureHash(t *testing.T) {
+	tx := sigHashTx()
+	prevOuts := []proto.TxOut{
+		{Value: 1000, PkScript: []byte{0x51}},
+		{Value: 2000, PkScript: append([]byte{0x51, 0x20}, bytes.Repeat([]byte{0x01}, 32)...)},
+	}
+	midstate := proto.NewSigHashMidstate(tx, prevOuts)
+
+	hash := func(hashType proto.SigHashType, prevOuts []proto.TxOut, spend proto.TaprootSpend) proto.Hash {
+		t.Helper()
+		h, err := tx.TaprootSignatureHash(hashType, 1, prevOuts, spend, proto.NewSigHashMidstate(tx, prevOuts))
+		require.NoError(t, err)
+		return h
+	}
+
+	t.Run("midstate", func(t *testing.T) {
+		for _, hashType := range []proto.SigHashType{proto.SIGHASH_DEFAULT, proto.SIGHASH_ALL, proto.SIGHASH_NONE, proto.SIGHASH_SINGLE, proto.SIGHASH_ALL | proto.SIGHASH_ANYONECANPAY} {
+			withMidstate, err := tx.TaprootSignatureHash(hashType, 1, prevOuts, proto.TaprootSpend{}, midstate)
+			require.NoError(t, err)
+			withoutMidstate, err := tx.TaprootSignatureHash(hashType, 1, prevOuts, proto.TaprootSpend{}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, withMidstate, withoutMidstate, "%#x", hashType)
+		}
+	})
+
+	t.Run("every amount is signed", func(t *testing.T) {
+		changed := []proto.TxOut{{Value: 1001, PkScript: prevOuts[0].PkScript}, prevOuts[1]}
+		assert.NotEqual(t, hash(proto.SIGHASH_DEFAULT, prevOuts, proto.TaprootSpend{}), hash(proto.SIGHASH_DEFAULT, changed, proto.TaprootSpend{}))
+		assert.NotEqual(t, hash(proto.SIGHASH_NONE, prevOuts, proto.TaprootSpend{}), hash(proto.SIGHASH_NONE, changed, proto.TaprootSpend{}))
+
+		// Except with ANYONECANPAY, which only signs its own
+		acp := proto.SIGHASH_ALL | proto.SIGHASH_ANYONECANPAY
+		assert.Equal(t, hash(acp, prevOuts, proto.TaprootSpend{}), hash(acp, changed, proto.TaprootSpend{}))
+		ownChanged := []proto.TxOut{prevOuts[0], {Value: 2001, PkScript: prevOuts[1].PkScript}}
+		assert.NotEqual(t, hash(acp, prevOuts, proto.TaprootSpend{}), hash(acp, ownChanged, proto.TaprootSpend{}))
+	})
+
+	t.Run("default is not all", func(t *testing.T) {
+		// They sign the same things, but the hash type itself is signed too
+		assert.NotEqual(t, hash(proto.SIGHASH_DEFAULT, prevOuts, proto.TaprootSpend{}), hash(proto.SIGHASH_ALL, prevOuts, proto.TaprootSpend{}))
+	})
+
+	t.Run("annex", func(t *testing.T) {
+		withoutAnnex := hash(proto.SIGHASH_DEFAULT, prevOuts, proto.TaprootSpend{})
+		annex := proto.TaprootSpend{AnnexPresent: true, AnnexHash: proto.AnnexHash([]byte{0x50, 1})}
+		withAnnex := hash(proto.SIGHASH_DEFAULT, prevOuts, annex)
+		assert.NotEqual(t, withoutAnnex, withAnnex)
+
+		otherAnnex := proto.TaprootSpend{AnnexPresent: true, AnnexHash: proto.AnnexHash([]byte{0x50, 2})}
+		assert.NotEqual(t, withAnnex, hash(proto.SIGHASH_DEFAULT, prevOuts, otherAnnex))
+	})
+
+	t.Run("script path", func(t *testing.T) {
+		keyPath := hash(proto.SIGHASH_DEFAULT, prevOuts, proto.TaprootSpend{})
+		leaf := proto.TaprootSpend{ScriptPath: true, TapLeafHash: proto.Hash{1}, CodeSepPos: 0xffffffff}
+		scriptPath := hash(proto.SIGHASH_DEFAULT, prevOuts, leaf)
+		assert.NotEqual(t, keyPath, scriptPath)
+
+		leaf.CodeSepPos = 3
+		assert.NotEqual(t, scriptPath, hash(proto.SIGHASH_DEFAULT, prevOuts, leaf))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, hashType := range []proto.SigHashType{0x04, 0x80, 0x84, 0x101} {
+			_, err := tx.TaprootSignatureHash(hashType, 1, prevOuts, proto.TaprootSpend{}, midstate)
+			assert.ErrorIs(t, err, proto.ErrSigHashType, "%#x", hashType)
+		}
+
+		// SIGHASH_SINGLE has no output to sign
+		short := sigHashTx()
+		short.TxOut = short.TxOut[:1]
+		_, err := short.TaprootSignatureHash(proto.SIGHASH_SINGLE, 1, prevOuts, proto.TaprootSpend{}, nil)
+		assert.ErrorIs(t, err, proto.ErrSigHashType)
+
+		_, err = tx.TaprootSignatureHash(proto.SIGHASH_DEFAULT, 1, prevOuts[:1], proto.TaprootSpend{}, nil)
+		assert.Error(t, err)
+		_, err = tx.TaprootSignatureHash(proto.SIGHASH_DEFAULT, 1, prevOuts, proto.TaprootSpend{}, proto.NewSigHashMidstate(tx, nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("BIP341", func(t *testing.T) {
+		// The key path spending examples from BIP341, which sign every input of one transaction
+		// with a different hash type
+		tx := mustDecodeTx(t, "02000000097de20cbff686da83a54981d2b9bab3586f4ca7e48f57f5b55963115f3b334e9c010000000000000000d7b7cab57b1393ace2d064f4d4a2cb8af6def61273e127517d44759b6dafdd990000000000fffffffff8e1f583384333689228c5d28eac13366be082dc57441760d957275419a418420000000000fffffffff0689180aa63b30cb162a73c6d2a38b7eeda2a83ece74310fda0843ad604853b0100000000feffffffaa5202bdf6d8ccd2ee0f0202afbbb7461d9264a25e5bfd3c5a52ee1239e0ba6c0000000000feffffff956149bdc66faa968eb2be2d2faa29718acbfe3941215893a2a3446d32acd050000000000000000000e664b9773b88c09c32cb70a2a3e4da0ced63b7ba3b22f848531bbb1d5d5f4c94010000000000000000e9aa6b8e6c9de67619e6a3924ae25696bb7b694bb677a632a74ef7eadfd4eabf0000000000ffffffffa778eb6a263dc090464cd125c466b5a99667720b1c110468831d058aa1b82af10100000000ffffffff0200ca9a3b000000001976a91406afd46bcdfd22ef94ac122aa11f241244a37ecc88ac807840cb0000000020ac9a87f5594be208f8532db38cff670c450ed2fea8fcdefcc9a663f78bab962b0065cd1d")
+		prevOuts := []proto.TxOut{
+			{Value: 420_000_000, PkScript: mustDecodeHex(t, "512053a1f6e454df1aa2776a2814a721372d6258050de330b3c6d10ee8f4e0dda343")},
+			{Value: 462_000_000, PkScript: mustDecodeHex(t, "5120147c9c57132f6e7ecddba9800bb0c4449251c92a1e60371ee77557b6620f3ea3")},
+			{Value: 294_000_000, PkScript: mustDecodeHex(t, "76a914751e76e8199196d454941c45d1b3a323f1433bd688ac")},
+			{Value: 504_000_000, PkScript: mustDecodeHex(t, "5120e4d810fd50586274face62b8a807eb9719cef49c04177cc6b76a9a4251d5450e")},
+			{Value: 630_000_000, PkScript: mustDecodeHex(t, "512091b64d5324723a985170e4dc5a0f84c041804f2cd12660fa5dec09fc21783605")},
+			{Value: 378_000_000, PkScript: mustDecodeHex(t, "00147dd65592d0ab2fe0d0257d571abf032cd9db93dc")},
+			{Value: 672_000_000, PkScript: mustDecodeHex(t, "512075169f4001aa68f15bbed28b218df1d0a62cbbcf1188c6665110c293c907b831")},
+			{Value: 546_000_000, PkScript: mustDecodeHex(t, "5120712447206d7a5238acc7ff53fbe94a3b64539ad291c7cdbc490b7577e4b17df5")},
+			{Value: 588_000_000, PkScript: mustDecodeHex(t, "512077e30a5522dd9f894c3f8b8bd4c4b2cf82ca7da8a3ea6a239655c39c050ab220")},
+		}
+		tests := []struct {
+			idx      int
+			hashType proto.SigHashType
+			expected string
+		}{
+			{0, proto.SIGHASH_SINGLE, "2514a6272f85cfa0f45eb907fcb0d121b808ed37c6ea160a5a9046ed5526d555"},
+			{1, proto.SIGHASH_SINGLE | proto.SIGHASH_ANYONECANPAY, "325a644af47e8a5a2591cda0ab0723978537318f10e6a63d4eed783b96a71a4d"},
+			{3, proto.SIGHASH_ALL, "bf013ea93474aa67815b1b6cc441d23b64fa310911d991e713cd34c7f5d46669"},
+			{4, proto.SIGHASH_DEFAULT, "4f900a0bae3f1446fd48490c2958b5a023228f01661cda3496a11da502a7f7ef"},
+			{6, proto.SIGHASH_NONE, "15f25c298eb5cdc7eb1d638dd2d45c97c4c59dcaec6679cfc16ad84f30876b85"},
+			{7, proto.SIGHASH_NONE | proto.SIGHASH_ANYONECANPAY, "cd292de50313804dabe4685e83f923d2969577191a3e1d2882220dca88cbeb10"},
+			{8, proto.SIGHASH_ALL | proto.SIGHASH_ANYONECANPAY, "cccb739eca6c13a8a89e6e5cd317ffe55669bbda23f2fd37b0f18755e008edd2"},
+		}
+		midstate := proto.NewSigHashMidstate(tx, prevOuts)
+		for _, tt := range tests {
+			hash, err := tx.TaprootSignatureHash(tt.hashType, tt.idx, prevOuts, proto.TaprootSpend{}, midstate)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, hexString(hash), "input %d", tt.idx)
+
+			hash, err = tx.TaprootSignatureHash(tt.hashType, tt.idx, prevOuts, proto.TaprootSpend{}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, hexString(hash), "input %d", tt.idx)
+		}
+	})
+}
+
+// sigHashTx is a transaction with two inputs and two outputs.
+func sigHashTx() proto.Tx {
+	return proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{
+			{PreviousOutPoint: proto.OutPoint{Hash: proto.DoubleSHA256([]byte("first")), Index: 0}, Sequence: 0xfffffffd},
+			{PreviousOutPoint: proto.OutPoint{Hash: proto.DoubleSHA256([]byte("second")), Index: 3}, Sequence: 0xfffffffe},
+		},
+		TxOut: []proto.TxOut{
+			{Value: 1500, PkScript: []byte{0x51}},
+			{Value: 1400, PkScript: []byte{0x52}},
+		},
+		LockTime: 100,
+	}
+}
+
+func hexString(h proto.Hash) string {
+	return fmt.Sprintf("%x", h[:])
+}
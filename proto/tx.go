@@ -0,0 +1,413 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// BIP144: a transaction with witness data has these in place of its input count.
+	WITNESS_MARKER = 0x00
+	WITNESS_FLAG   = 0x01
+
+	// BIP141: non-witness bytes count this many times as much as witness bytes towards the weight.
+	WITNESS_SCALE_FACTOR = 4
+
+	// The sequence number of an input that opts out of relative locktime and RBF.
+	MAX_TX_IN_SEQUENCE = 0xffffffff
+
+	// The output index of a coinbase's null outpoint.
+	NULL_OUTPOINT_INDEX = 0xffffffff
+
+	// BIP68: an input's sequence number is a relative lock time unless this bit is set. If the
+	// type flag is set, it's in units of 512 seconds rather than blocks, and the mask gives the
+	// value.
+	SEQUENCE_LOCKTIME_DISABLE_FLAG = 1 << 31
+	SEQUENCE_LOCKTIME_TYPE_FLAG    = 1 << 22
+	SEQUENCE_LOCKTIME_MASK         = 0x0000ffff
+	SEQUENCE_LOCKTIME_GRANULARITY  = 9 // log2(512)
+
+	// Lock times below this are block heights, and from it on, unix timestamps.
+	LOCKTIME_THRESHOLD = 500_000_000
+)
+
+// OutPoint refers to an output of a previous transaction.
+type OutPoint struct {
+	Hash  Hash
+	Index uint32
+}
+
+// IsNull reports whether the outpoint refers to no output at all, as a coinbase's input does.
+func (op OutPoint) IsNull() bool {
+	return op.Index == NULL_OUTPOINT_INDEX && op.Hash.IsZero()
+}
+
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%s:%d", op.Hash, op.Index)
+}
+
+func (op OutPoint) MarshalToWriter(w io.Writer) error {
+	if err := op.Hash.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write outpoint hash: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, op.Index); err != nil {
+		return fmt.Errorf("unable to write outpoint index: %w", err)
+	}
+
+	return nil
+}
+
+func (op *OutPoint) UnmarshalFromReader(r io.Reader) error {
+	if err := op.Hash.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read outpoint hash: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &op.Index); err != nil {
+		return fmt.Errorf("unable to read outpoint index: %w", err)
+	}
+
+	return nil
+}
+
+// TxWitness is the stack of items an input provides to satisfy a segwit output.
+type TxWitness [][]byte
+
+// TxIn spends an output of a previous transaction.
+type TxIn struct {
+	PreviousOutPoint OutPoint
+	SignatureScript  []byte
+	Witness          TxWitness // Serialized separately, after all the outputs
+	Sequence         uint32
+}
+
+func (ti TxIn) MarshalToWriter(w io.Writer) error {
+	if err := ti.PreviousOutPoint.MarshalToWriter(w); err != nil {
+		return err
+	}
+
+	if err := writeVarBytes(w, ti.SignatureScript); err != nil {
+		return fmt.Errorf("unable to write signature script: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, ti.Sequence); err != nil {
+		return fmt.Errorf("unable to write sequence: %w", err)
+	}
+
+	return nil
+}
+
+func (ti *TxIn) UnmarshalFromReader(r io.Reader) error {
+	if err := ti.PreviousOutPoint.UnmarshalFromReader(r); err != nil {
+		return err
+	}
+
+	script, err := readVarBytes(r)
+	if err != nil {
+		return fmt.Errorf("unable to read signature script: %w", err)
+	}
+	ti.SignatureScript = script
+
+	if err := binary.Read(r, binary.LittleEndian, &ti.Sequence); err != nil {
+		return fmt.Errorf("unable to read sequence: %w", err)
+	}
+
+	return nil
+}
+
+// TxOut is an amount, in satoshis, and the script that must be satisfied to spend it.
+type TxOut struct {
+	Value    int64
+	PkScript []byte
+}
+
+func (to TxOut) MarshalToWriter(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, to.Value); err != nil {
+		return fmt.Errorf("unable to write value: %w", err)
+	}
+
+	if err := writeVarBytes(w, to.PkScript); err != nil {
+		return fmt.Errorf("unable to write public key script: %w", err)
+	}
+
+	return nil
+}
+
+func (to *TxOut) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &to.Value); err != nil {
+		return fmt.Errorf("unable to read value: %w", err)
+	}
+
+	script, err := readVarBytes(r)
+	if err != nil {
+		return fmt.Errorf("unable to read public key script: %w", err)
+	}
+	to.PkScript = script
+
+	return nil
+}
+
+// Tx is a transaction. It's marshalled with the BIP144 witness serialization if any of its inputs
+// have witness data, and the original serialization otherwise.
+type Tx struct {
+	Version  int32
+	TxIn     []TxIn
+	TxOut    []TxOut
+	LockTime uint32
+}
+
+// HasWitness reports whether any of the inputs have witness data.
+func (tx Tx) HasWitness() bool {
+	for _, in := range tx.TxIn {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCoinBase reports whether this is a block's coinbase transaction, which has a single input
+// spending the null outpoint.
+func (tx Tx) IsCoinBase() bool {
+	return len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutPoint.IsNull()
+}
+
+// TxHash is the transaction's id, the hash of its serialization without witness data.
+func (tx Tx) TxHash() Hash {
+	return tx.hash(false)
+}
+
+// WitnessHash is the BIP141 wtxid, the hash of the serialization including witness data. It's the
+// same as the txid for a transaction without any.
+func (tx Tx) WitnessHash() Hash {
+	return tx.hash(true)
+}
+
+func (tx Tx) hash(withWitness bool) Hash {
+	buf := make(byteWriter, 0, tx.SerializeSize())
+	// Writing to a byteWriter can't fail
+	_ = tx.marshal(&buf, withWitness && tx.HasWitness())
+	return DoubleSHA256(buf)
+}
+
+// SerializeSize is the size of the transaction's full serialization, including witness data.
+func (tx Tx) SerializeSize() int {
+	var counter countingWriter
+	_ = tx.marshal(&counter, tx.HasWitness())
+	return int(counter)
+}
+
+// StrippedSize is the size of the transaction's serialization without witness data.
+func (tx Tx) StrippedSize() int {
+	var counter countingWriter
+	_ = tx.marshal(&counter, false)
+	return int(counter)
+}
+
+// Weight is the BIP141 weight: the stripped size counts four times, witness data once.
+func (tx Tx) Weight() int {
+	return tx.StrippedSize()*(WITNESS_SCALE_FACTOR-1) + tx.SerializeSize()
+}
+
+// VSize is the virtual size, the weight divided by four and rounded up.
+func (tx Tx) VSize() int {
+	return (tx.Weight() + WITNESS_SCALE_FACTOR - 1) / WITNESS_SCALE_FACTOR
+}
+
+func (tx Tx) MarshalToWriter(w io.Writer) error {
+	return tx.marshal(w, tx.HasWitness())
+}
+
+// MarshalNoWitness writes the transaction's original serialization, without any witness data.
+func (tx Tx) MarshalNoWitness(w io.Writer) error {
+	return tx.marshal(w, false)
+}
+
+func (tx Tx) marshal(w io.Writer, withWitness bool) error {
+	if err := binary.Write(w, binary.LittleEndian, tx.Version); err != nil {
+		return fmt.Errorf("unable to write tx version: %w", err)
+	}
+
+	if withWitness {
+		if _, err := w.Write([]byte{WITNESS_MARKER, WITNESS_FLAG}); err != nil {
+			return fmt.Errorf("unable to write witness marker: %w", err)
+		}
+	}
+
+	if err := VarInt(len(tx.TxIn)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write input count: %w", err)
+	}
+	for i, in := range tx.TxIn {
+		if err := in.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write input %d: %w", i, err)
+		}
+	}
+
+	if err := VarInt(len(tx.TxOut)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write output count: %w", err)
+	}
+	for i, out := range tx.TxOut {
+		if err := out.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write output %d: %w", i, err)
+		}
+	}
+
+	if withWitness {
+		for i, in := range tx.TxIn {
+			if err := VarInt(len(in.Witness)).MarshalToWriter(w); err != nil {
+				return fmt.Errorf("unable to write witness count for input %d: %w", i, err)
+			}
+			for _, item := range in.Witness {
+				if err := writeVarBytes(w, item); err != nil {
+					return fmt.Errorf("unable to write witness for input %d: %w", i, err)
+				}
+			}
+		}
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, tx.LockTime); err != nil {
+		return fmt.Errorf("unable to write lock time: %w", err)
+	}
+
+	return nil
+}
+
+func (tx *Tx) UnmarshalFromReader(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &tx.Version); err != nil {
+		return fmt.Errorf("unable to read tx version: %w", err)
+	}
+
+	// A zero input count is really the witness marker, followed by the flag
+	var inCount VarInt
+	if err := inCount.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read input count: %w", err)
+	}
+
+	withWitness := false
+	if inCount == WITNESS_MARKER {
+		var flag [1]byte
+		if _, err := io.ReadFull(r, flag[:]); err != nil {
+			return fmt.Errorf("unable to read witness flag: %w", err)
+		}
+		if flag[0] != WITNESS_FLAG {
+			return fmt.Errorf("unknown witness flag %#02x", flag[0])
+		}
+		withWitness = true
+
+		if err := inCount.UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read input count: %w", err)
+		}
+	}
+
+	// Counts aren't trusted for preallocation, so a bogus one can't make us allocate lots of memory
+	if err := checkCount(inCount); err != nil {
+		return fmt.Errorf("bad input count: %w", err)
+	}
+	tx.TxIn = nil
+	for i := 0; i < int(inCount); i++ {
+		var in TxIn
+		if err := in.UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read input %d: %w", i, err)
+		}
+		tx.TxIn = append(tx.TxIn, in)
+	}
+
+	var outCount VarInt
+	if err := outCount.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read output count: %w", err)
+	}
+	if err := checkCount(outCount); err != nil {
+		return fmt.Errorf("bad output count: %w", err)
+	}
+	tx.TxOut = nil
+	for i := 0; i < int(outCount); i++ {
+		var out TxOut
+		if err := out.UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read output %d: %w", i, err)
+		}
+		tx.TxOut = append(tx.TxOut, out)
+	}
+
+	if withWitness {
+		for i := range tx.TxIn {
+			var itemCount VarInt
+			if err := itemCount.UnmarshalFromReader(r); err != nil {
+				return fmt.Errorf("unable to read witness count for input %d: %w", i, err)
+			}
+			if err := checkCount(itemCount); err != nil {
+				return fmt.Errorf("bad witness count for input %d: %w", i, err)
+			}
+			for j := 0; j < int(itemCount); j++ {
+				item, err := readVarBytes(r)
+				if err != nil {
+					return fmt.Errorf("unable to read witness for input %d: %w", i, err)
+				}
+				tx.TxIn[i].Witness = append(tx.TxIn[i].Witness, item)
+			}
+		}
+
+		// The marker and flag mustn't be used without any witness data, or the same transaction
+		// could be serialized two ways
+		if !tx.HasWitness() {
+			return errors.New("witness flag set but there's no witness data")
+		}
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &tx.LockTime); err != nil {
+		return fmt.Errorf("unable to read lock time: %w", err)
+	}
+
+	return nil
+}
+
+// checkCount rejects counts that couldn't possibly fit in a message.
+func checkCount(count VarInt) error {
+	if count > MAX_PROTOCOL_MESSAGE_LENGTH {
+		return fmt.Errorf("%d is more than fits in a message", count)
+	}
+	return nil
+}
+
+// writeVarBytes writes a byte slice preceded by its length.
+func writeVarBytes(w io.Writer, b []byte) error {
+	if err := VarInt(len(b)).MarshalToWriter(w); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readVarBytes reads a byte slice preceded by its length.
+func readVarBytes(r io.Reader) ([]byte, error) {
+	var length VarInt
+	if err := length.UnmarshalFromReader(r); err != nil {
+		return nil, err
+	}
+	if err := checkCount(length); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// countingWriter counts the bytes written to it, for working out serialized sizes.
+type countingWriter int
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	*c += countingWriter(len(b))
+	return len(b), nil
+}
+
+// byteWriter appends everything written to it to a byte slice, without bytes.Buffer's overhead.
+type byteWriter []byte
+
+func (b *byteWriter) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
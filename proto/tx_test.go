@@ -0,0 +1,159 @@
+package proto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The coinbase transaction of the genesis block.
+const GENESIS_COINBASE_HEX = "01000000" +
+	"01" +
+	"0000000000000000000000000000000000000000000000000000000000000000ffffffff" +
+	"4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73" +
+	"ffffffff" +
+	"01" +
+	"00f2052a01000000" +
+	"434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac" +
+	"00000000"
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+// witnessTx is a transaction spending a P2WPKH output to another, with a signature and public
+// key-sized witness.
+func witnessTx() proto.Tx {
+	return proto.Tx{
+		Version: 2,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Hash: proto.DoubleSHA256([]byte("previous")), Index: 1},
+			SignatureScript:  []byte{},
+			Witness:          proto.TxWitness{bytes.Repeat([]byte{0x30}, 71), bytes.Repeat([]byte{0x02}, 33)},
+			Sequence:         0xfffffffd,
+		}},
+		TxOut: []proto.TxOut{{
+			Value:    50_000,
+			PkScript: append([]byte{0x00, 0x14}, bytes.Repeat([]byte{0xab}, 20)...),
+		}},
+		LockTime: 800_000,
+	}
+}
+
+func TestTx_Legacy(t *testing.T) {
+	txBytes := mustDecodeHex(t, GENESIS_COINBASE_HEX)
+
+	var tx proto.Tx
+	require.NoError(t, tx.UnmarshalFromReader(bytes.NewReader(txBytes)))
+	assert.Equal(t, int32(1), tx.Version)
+	require.Len(t, tx.TxIn, 1)
+	require.Len(t, tx.TxOut, 1)
+	assert.Equal(t, int64(50*100_000_000), tx.TxOut[0].Value)
+	assert.True(t, tx.IsCoinBase())
+	assert.False(t, tx.HasWitness())
+
+	// The genesis block has only this transaction, so its merkle root is the txid
+	assert.Equal(t, GENESIS_HEADER.MerkleRoot, tx.TxHash())
+	assert.Equal(t, tx.TxHash(), tx.WitnessHash())
+
+	gotBytes, err := proto.MarshalToBytes(tx)
+	require.NoError(t, err)
+	assert.Equal(t, txBytes, gotBytes)
+
+	assert.Equal(t, len(txBytes), tx.SerializeSize())
+	assert.Equal(t, len(txBytes), tx.StrippedSize())
+	assert.Equal(t, 4*len(txBytes), tx.Weight())
+	assert.Equal(t, len(txBytes), tx.VSize())
+}
+
+func TestTx_Witness(t *testing.T) {
+	tx := witnessTx()
+	assert.True(t, tx.HasWitness())
+	assert.False(t, tx.IsCoinBase())
+
+	txBytes, err := proto.MarshalToBytes(tx)
+	require.NoError(t, err)
+
+	// The input count is replaced by the marker and flag
+	assert.Equal(t, []byte{0x00, 0x01, 0x01}, txBytes[4:7])
+
+	var gotTx proto.Tx
+	require.NoError(t, gotTx.UnmarshalFromReader(bytes.NewReader(txBytes)))
+	assert.Equal(t, tx, gotTx)
+
+	var stripped bytes.Buffer
+	require.NoError(t, tx.MarshalNoWitness(&stripped))
+	assert.Equal(t, proto.DoubleSHA256(stripped.Bytes()), tx.TxHash())
+	assert.Equal(t, proto.DoubleSHA256(txBytes), tx.WitnessHash())
+	assert.NotEqual(t, tx.TxHash(), tx.WitnessHash())
+
+	// The stripped serialization still decodes, just without the witness
+	var strippedTx proto.Tx
+	require.NoError(t, strippedTx.UnmarshalFromReader(bytes.NewReader(stripped.Bytes())))
+	assert.False(t, strippedTx.HasWitness())
+	assert.Equal(t, tx.TxHash(), strippedTx.TxHash())
+
+	// 4 version + 1 count + 41 input + 1 count + 31 output + 4 locktime
+	assert.Equal(t, 82, tx.StrippedSize())
+	// + 2 marker and flag + 1 count + 72 signature + 34 public key
+	assert.Equal(t, 191, tx.SerializeSize())
+	assert.Equal(t, len(txBytes), tx.SerializeSize())
+	assert.Equal(t, 82*3+191, tx.Weight())
+	assert.Equal(t, 110, tx.VSize())
+}
+
+func TestTx_UnmarshalInvalid(t *testing.T) {
+	tx := witnessTx()
+	tx.TxIn[0].Witness = nil
+	legacyBytes, err := proto.MarshalToBytes(tx)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		txBytes []byte
+		err     string
+	}{
+		{
+			"unknown flag",
+			append([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}, legacyBytes[4:]...),
+			"unknown witness flag",
+		},
+		{
+			"witness flag without witness data",
+			append(append([]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}, legacyBytes[4:len(legacyBytes)-4]...), 0x00, 0x00, 0x00, 0x00, 0x00),
+			"no witness data",
+		},
+		{
+			"impossible input count",
+			[]byte{0x02, 0x00, 0x00, 0x00, 0xfe, 0xff, 0xff, 0xff, 0xff},
+			"bad input count",
+		},
+		{
+			"truncated",
+			legacyBytes[:len(legacyBytes)-2],
+			"lock time",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tx proto.Tx
+			assert.ErrorContains(t, tx.UnmarshalFromReader(bytes.NewReader(tt.txBytes)), tt.err)
+		})
+	}
+}
+
+func TestOutPoint(t *testing.T) {
+	assert.True(t, proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX}.IsNull())
+	assert.False(t, proto.OutPoint{Index: 0}.IsNull())
+
+	op := proto.OutPoint{Hash: GENESIS_HEADER.MerkleRoot, Index: 3}
+	assert.Equal(t, "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b:3", op.String())
+}
@@ -0,0 +1,15 @@
+package proto
+
+import "io"
+
+// WtxidRelay signals that we'd like transactions announced by wtxid rather than txid (BIP339). It
+// must be sent between 'version' and 'verack'. Contains no payload.
+type WtxidRelay struct{}
+
+func (wr WtxidRelay) MarshalToWriter(w io.Writer) error {
+	return nil
+}
+
+func (wr *WtxidRelay) UnmarshalFromReader(r io.Reader) error {
+	return nil
+}
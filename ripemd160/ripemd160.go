@@ -0,0 +1,184 @@
+// Package ripemd160 implements the RIPEMD-160 hash, which bitcoin uses (after SHA-256) to shorten
+// public keys and scripts into addresses.
+package ripemd160
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	// The size of a RIPEMD-160 checksum in bytes.
+	SIZE = 20
+
+	// The block size of the hash in bytes.
+	BLOCK_SIZE = 64
+)
+
+// The message word used by each step of the left and right lines.
+var (
+	wordLeft = [80]uint8{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		7, 4, 13, 1, 10, 6, 15, 3, 12, 0, 9, 5, 2, 14, 11, 8,
+		3, 10, 14, 4, 9, 15, 8, 1, 2, 7, 0, 6, 13, 11, 5, 12,
+		1, 9, 11, 10, 0, 8, 12, 4, 13, 3, 7, 15, 14, 5, 6, 2,
+		4, 0, 5, 9, 7, 12, 2, 10, 14, 1, 3, 8, 11, 6, 15, 13,
+	}
+	wordRight = [80]uint8{
+		5, 14, 7, 0, 9, 2, 11, 4, 13, 6, 15, 8, 1, 10, 3, 12,
+		6, 11, 3, 7, 0, 13, 5, 10, 14, 15, 8, 12, 4, 9, 1, 2,
+		15, 5, 1, 3, 7, 14, 6, 9, 11, 8, 12, 2, 10, 0, 4, 13,
+		8, 6, 4, 1, 3, 11, 15, 0, 5, 12, 2, 13, 9, 7, 10, 14,
+		12, 15, 10, 4, 1, 5, 8, 7, 6, 2, 13, 14, 0, 3, 9, 11,
+	}
+)
+
+// How far each step of the left and right lines rotates by.
+var (
+	shiftLeft = [80]uint8{
+		11, 14, 15, 12, 5, 8, 7, 9, 11, 13, 14, 15, 6, 7, 9, 8,
+		7, 6, 8, 13, 11, 9, 7, 15, 7, 12, 15, 9, 11, 7, 13, 12,
+		11, 13, 6, 7, 14, 9, 13, 15, 14, 8, 13, 6, 5, 12, 7, 5,
+		11, 12, 14, 15, 14, 15, 9, 8, 9, 14, 5, 6, 8, 6, 5, 12,
+		9, 15, 5, 11, 6, 8, 13, 12, 5, 12, 13, 14, 11, 8, 5, 6,
+	}
+	shiftRight = [80]uint8{
+		8, 9, 9, 11, 13, 15, 15, 5, 7, 7, 8, 11, 14, 14, 12, 6,
+		9, 13, 15, 7, 12, 8, 9, 11, 7, 7, 12, 7, 6, 15, 13, 11,
+		9, 7, 15, 11, 8, 6, 6, 14, 12, 13, 5, 14, 13, 13, 7, 5,
+		15, 5, 8, 11, 14, 14, 6, 14, 6, 9, 12, 9, 12, 5, 15, 8,
+		8, 5, 12, 9, 12, 5, 14, 6, 8, 13, 6, 5, 15, 13, 11, 11,
+	}
+)
+
+// The constant added in each round of the left and right lines.
+var (
+	constLeft  = [5]uint32{0x00000000, 0x5a827999, 0x6ed9eba1, 0x8f1bbcdc, 0xa953fd4e}
+	constRight = [5]uint32{0x50a28be6, 0x5c4dd124, 0x6d703ef3, 0x7a6d76e9, 0x00000000}
+)
+
+// f is the boolean function used in a round. The right line uses them in the opposite order.
+func f(round int, x, y, z uint32) uint32 {
+	switch round {
+	case 0:
+		return x ^ y ^ z
+	case 1:
+		return (x & y) | (^x & z)
+	case 2:
+		return (x | ^y) ^ z
+	case 3:
+		return (x & z) | (y & ^z)
+	default:
+		return x ^ (y | ^z)
+	}
+}
+
+type digest struct {
+	h   [5]uint32
+	buf [BLOCK_SIZE]byte
+	n   int    // How much of buf is filled
+	len uint64 // How many bytes have been written in total
+}
+
+// New returns a new hash.Hash computing the RIPEMD-160 checksum.
+func New() hash.Hash {
+	d := new(digest)
+	d.Reset()
+	return d
+}
+
+// Sum returns the RIPEMD-160 checksum of the data.
+func Sum(data []byte) [SIZE]byte {
+	d := New()
+	d.Write(data)
+
+	var sum [SIZE]byte
+	d.Sum(sum[:0])
+	return sum
+}
+
+func (d *digest) Reset() {
+	d.h = [5]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0}
+	d.n = 0
+	d.len = 0
+}
+
+func (d *digest) Size() int {
+	return SIZE
+}
+
+func (d *digest) BlockSize() int {
+	return BLOCK_SIZE
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	written := len(p)
+	d.len += uint64(len(p))
+
+	if d.n > 0 {
+		n := copy(d.buf[d.n:], p)
+		d.n += n
+		p = p[n:]
+		if d.n < BLOCK_SIZE {
+			return written, nil
+		}
+		d.block(d.buf[:])
+		d.n = 0
+	}
+
+	for len(p) >= BLOCK_SIZE {
+		d.block(p[:BLOCK_SIZE])
+		p = p[BLOCK_SIZE:]
+	}
+	d.n = copy(d.buf[:], p)
+	return written, nil
+}
+
+// Sum appends the checksum to b, without changing the state of the hash.
+func (d *digest) Sum(b []byte) []byte {
+	// Pad a copy, so more can still be written to the original
+	c := *d
+	length := c.len
+
+	var padding [BLOCK_SIZE + 8]byte
+	padding[0] = 0x80
+	padLen := 56 - int(length%BLOCK_SIZE)
+	if padLen <= 0 {
+		padLen += BLOCK_SIZE
+	}
+	binary.LittleEndian.PutUint64(padding[padLen:], length<<3)
+	c.Write(padding[:padLen+8])
+
+	for _, h := range c.h {
+		b = binary.LittleEndian.AppendUint32(b, h)
+	}
+	return b
+}
+
+// block runs the compression function over one block.
+func (d *digest) block(p []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(p[i*4:])
+	}
+
+	al, bl, cl, dl, el := d.h[0], d.h[1], d.h[2], d.h[3], d.h[4]
+	ar, br, cr, dr, er := al, bl, cl, dl, el
+	for j := 0; j < 80; j++ {
+		round := j / 16
+
+		t := bits.RotateLeft32(al+f(round, bl, cl, dl)+x[wordLeft[j]]+constLeft[round], int(shiftLeft[j])) + el
+		al, el, dl, cl, bl = el, dl, bits.RotateLeft32(cl, 10), bl, t
+
+		t = bits.RotateLeft32(ar+f(4-round, br, cr, dr)+x[wordRight[j]]+constRight[round], int(shiftRight[j])) + er
+		ar, er, dr, cr, br = er, dr, bits.RotateLeft32(cr, 10), br, t
+	}
+
+	t := d.h[1] + cl + dr
+	d.h[1] = d.h[2] + dl + er
+	d.h[2] = d.h[3] + el + ar
+	d.h[3] = d.h[4] + al + br
+	d.h[4] = d.h[0] + bl + cr
+	d.h[0] = t
+}
@@ -0,0 +1,45 @@
+package ripemd160_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/pscott31/mynode/ripemd160"
+	"github.com/stretchr/testify/assert"
+)
+
+// The test vectors from the RIPEMD-160 homepage.
+func TestSum(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "9c1185a5c5e9fc54612808977ee8f548b2258d31"},
+		{"a", "0bdc9d2d256b3ee9daae347be6f4dc835a467ffe"},
+		{"abc", "8eb208f7e05d987a9b044a8e98c6b087f15a0bfc"},
+		{"message digest", "5d0689ef49d2fae572b881b123a85ffa21595f36"},
+		{"abcdefghijklmnopqrstuvwxyz", "f71c27109c692c1b56bbdceb5b9d2865b3708dbc"},
+		{"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq", "12a053384a9c0c88e405a06c27dcf49ada62eb2b"},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", "b0e20b6e3116640286ed3a87a5713079b21f5189"},
+		{strings.Repeat("1234567890", 8), "9b752e45573d4b39f4dbd3323cab82bf63326bfb"},
+	}
+
+	for _, tt := range tests {
+		sum := ripemd160.Sum([]byte(tt.in))
+		assert.Equal(t, tt.want, hex.EncodeToString(sum[:]), tt.in)
+	}
+}
+
+func TestWriteInPieces(t *testing.T) {
+	in := []byte(strings.Repeat("a", 1000))
+	want := ripemd160.Sum(in)
+
+	for _, size := range []int{1, 7, 63, 64, 65} {
+		h := ripemd160.New()
+		for i := 0; i < len(in); i += size {
+			h.Write(in[i:min(i+size, len(in))])
+		}
+		assert.Equal(t, want[:], h.Sum(nil), size)
+	}
+}
@@ -0,0 +1,214 @@
+// Package secp256k1 implements the elliptic curve bitcoin uses for its signatures: parsing and
+// serializing keys, and creating and verifying ECDSA and BIP340 Schnorr signatures.
+//
+// It favours being simple and obviously correct over being fast or constant time, so it's fine
+// for verifying signatures but shouldn't be used to sign with keys that matter.
+package secp256k1
+
+import "math/big"
+
+func mustParseHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex constant " + s)
+	}
+	return n
+}
+
+var (
+	// The field prime
+	fieldP = mustParseHex("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f")
+
+	// The order of the group
+	curveN = mustParseHex("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141")
+	halfN  = new(big.Int).Rsh(curveN, 1)
+
+	// The generator
+	generator = affinePoint{
+		x: mustParseHex("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"),
+		y: mustParseHex("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"),
+	}
+
+	// The curve is y² = x³ + 7
+	curveB = big.NewInt(7)
+
+	// p ≡ 3 (mod 4), so square roots are a single exponentiation
+	sqrtExp = new(big.Int).Rsh(new(big.Int).Add(fieldP, big.NewInt(1)), 2)
+)
+
+// affinePoint is a point on the curve in the usual x and y coordinates. A nil x is the point at
+// infinity.
+type affinePoint struct {
+	x, y *big.Int
+}
+
+func (p affinePoint) isInfinity() bool {
+	return p.x == nil
+}
+
+// jacobianPoint is a point in Jacobian coordinates, (X/Z², Y/Z³), which lets points be added
+// without a modular inverse each time. A zero Z is the point at infinity.
+type jacobianPoint struct {
+	x, y, z *big.Int
+}
+
+func infinity() jacobianPoint {
+	return jacobianPoint{x: new(big.Int), y: new(big.Int), z: new(big.Int)}
+}
+
+func (p affinePoint) toJacobian() jacobianPoint {
+	if p.isInfinity() {
+		return infinity()
+	}
+	return jacobianPoint{x: new(big.Int).Set(p.x), y: new(big.Int).Set(p.y), z: big.NewInt(1)}
+}
+
+func (p jacobianPoint) isInfinity() bool {
+	return p.z.Sign() == 0
+}
+
+func (p jacobianPoint) toAffine() affinePoint {
+	if p.isInfinity() {
+		return affinePoint{}
+	}
+
+	zInv := new(big.Int).ModInverse(p.z, fieldP)
+	zInv2 := fmul(zInv, zInv)
+	return affinePoint{
+		x: fmul(p.x, zInv2),
+		y: fmul(p.y, fmul(zInv2, zInv)),
+	}
+}
+
+func fmul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, fieldP)
+}
+
+func fadd(a, b *big.Int) *big.Int {
+	r := new(big.Int).Add(a, b)
+	return r.Mod(r, fieldP)
+}
+
+func fsub(a, b *big.Int) *big.Int {
+	r := new(big.Int).Sub(a, b)
+	return r.Mod(r, fieldP)
+}
+
+// double returns 2p.
+func (p jacobianPoint) double() jacobianPoint {
+	if p.isInfinity() || p.y.Sign() == 0 {
+		return infinity()
+	}
+
+	a := fmul(p.x, p.x)
+	b := fmul(p.y, p.y)
+	c := fmul(b, b)
+	xb := fadd(p.x, b)
+	d := fsub(fsub(fmul(xb, xb), a), c)
+	d = fadd(d, d)
+	e := fadd(fadd(a, a), a)
+	f := fmul(e, e)
+
+	x := fsub(f, fadd(d, d))
+	c8 := new(big.Int).Lsh(c, 3)
+	y := fsub(fmul(e, fsub(d, x)), c8)
+	z := fmul(p.y, p.z)
+	return jacobianPoint{x: x, y: y, z: fadd(z, z)}
+}
+
+// add returns p + q.
+func (p jacobianPoint) add(q jacobianPoint) jacobianPoint {
+	if p.isInfinity() {
+		return q
+	}
+	if q.isInfinity() {
+		return p
+	}
+
+	z1z1 := fmul(p.z, p.z)
+	z2z2 := fmul(q.z, q.z)
+	u1 := fmul(p.x, z2z2)
+	u2 := fmul(q.x, z1z1)
+	s1 := fmul(p.y, fmul(q.z, z2z2))
+	s2 := fmul(q.y, fmul(p.z, z1z1))
+
+	h := fsub(u2, u1)
+	r := fsub(s2, s1)
+	if h.Sign() == 0 {
+		if r.Sign() == 0 {
+			return p.double()
+		}
+		return infinity()
+	}
+
+	h2 := fmul(h, h)
+	h3 := fmul(h2, h)
+	u1h2 := fmul(u1, h2)
+
+	x := fsub(fsub(fmul(r, r), h3), fadd(u1h2, u1h2))
+	y := fsub(fmul(r, fsub(u1h2, x)), fmul(s1, h3))
+	z := fmul(fmul(p.z, q.z), h)
+	return jacobianPoint{x: x, y: y, z: z}
+}
+
+// scalarMult returns k·p.
+func scalarMult(k *big.Int, p affinePoint) affinePoint {
+	return doubleScalarMult(k, p, new(big.Int), generator)
+}
+
+// scalarBaseMult returns k·G.
+func scalarBaseMult(k *big.Int) affinePoint {
+	return scalarMult(k, generator)
+}
+
+// doubleScalarMult returns a·p + b·q, doubling just once for both (Shamir's trick).
+func doubleScalarMult(a *big.Int, p affinePoint, b *big.Int, q affinePoint) affinePoint {
+	pj, qj := p.toJacobian(), q.toJacobian()
+	sum := pj.add(qj)
+
+	result := infinity()
+	for i := max(a.BitLen(), b.BitLen()) - 1; i >= 0; i-- {
+		result = result.double()
+		switch {
+		case a.Bit(i) == 1 && b.Bit(i) == 1:
+			result = result.add(sum)
+		case a.Bit(i) == 1:
+			result = result.add(pj)
+		case b.Bit(i) == 1:
+			result = result.add(qj)
+		}
+	}
+	return result.toAffine()
+}
+
+// isOnCurve reports whether the point satisfies the curve equation.
+func (p affinePoint) isOnCurve() bool {
+	if p.x.Cmp(fieldP) >= 0 || p.y.Cmp(fieldP) >= 0 || p.x.Sign() < 0 || p.y.Sign() < 0 {
+		return false
+	}
+	return fmul(p.y, p.y).Cmp(curveRHS(p.x)) == 0
+}
+
+// curveRHS is x³ + 7.
+func curveRHS(x *big.Int) *big.Int {
+	return fadd(fmul(fmul(x, x), x), curveB)
+}
+
+// liftX finds the point with the given x coordinate, choosing the even y if oddY is false. It
+// returns false if there isn't one.
+func liftX(x *big.Int, oddY bool) (affinePoint, bool) {
+	if x.Sign() < 0 || x.Cmp(fieldP) >= 0 {
+		return affinePoint{}, false
+	}
+
+	c := curveRHS(x)
+	y := new(big.Int).Exp(c, sqrtExp, fieldP)
+	if fmul(y, y).Cmp(c) != 0 {
+		return affinePoint{}, false
+	}
+	if (y.Bit(0) == 1) != oddY {
+		y.Sub(fieldP, y)
+	}
+	return affinePoint{x: new(big.Int).Set(x), y: y}, true
+}
@@ -0,0 +1,231 @@
+package secp256k1
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// Signature is an ECDSA signature.
+type Signature struct {
+	r, s *big.Int
+}
+
+// ParseDERSignature parses a DER encoded signature as leniently as bitcoind does: lengths may use
+// more bytes than they need and integers may have extra leading zeros, and anything after the
+// signature is ignored. Signatures from before BIP66 made strict DER a consensus rule depend on
+// that. A signature with R or S too big to be valid parses, but never verifies.
+func ParseDERSignature(b []byte) (*Signature, error) {
+	pos := 0
+
+	// Sequence tag, and a length that's otherwise ignored
+	if pos == len(b) || b[pos] != 0x30 {
+		return nil, errors.New("signature doesn't start with a sequence")
+	}
+	pos++
+	if pos == len(b) {
+		return nil, errors.New("signature is truncated")
+	}
+	lenByte := int(b[pos])
+	pos++
+	if lenByte&0x80 != 0 {
+		lenByte -= 0x80
+		if lenByte > len(b)-pos {
+			return nil, errors.New("signature length is truncated")
+		}
+		pos += lenByte
+	}
+
+	r, pos, err := parseDERInteger(b, pos)
+	if err != nil {
+		return nil, err
+	}
+	s, _, err := parseDERInteger(b, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip leading zeros; anything still longer than 32 bytes overflows
+	sig := &Signature{r: new(big.Int), s: new(big.Int)}
+	for len(r) > 0 && r[0] == 0 {
+		r = r[1:]
+	}
+	for len(s) > 0 && s[0] == 0 {
+		s = s[1:]
+	}
+	if len(r) > 32 || len(s) > 32 {
+		return sig, nil
+	}
+	sig.r.SetBytes(r)
+	sig.s.SetBytes(s)
+	if sig.r.Cmp(curveN) >= 0 || sig.s.Cmp(curveN) >= 0 {
+		return &Signature{r: new(big.Int), s: new(big.Int)}, nil
+	}
+	return sig, nil
+}
+
+// parseDERInteger reads an integer's tag, length and value, returning the value and where it
+// ends.
+func parseDERInteger(b []byte, pos int) ([]byte, int, error) {
+	if pos == len(b) || b[pos] != 0x02 {
+		return nil, 0, errors.New("expected an integer in signature")
+	}
+	pos++
+	if pos == len(b) {
+		return nil, 0, errors.New("signature is truncated")
+	}
+
+	length := int(b[pos])
+	pos++
+	if length&0x80 != 0 {
+		lenBytes := length - 0x80
+		if lenBytes > len(b)-pos {
+			return nil, 0, errors.New("signature integer length is truncated")
+		}
+		for lenBytes > 0 && b[pos] == 0 {
+			pos++
+			lenBytes--
+		}
+		if lenBytes >= 4 {
+			return nil, 0, errors.New("signature integer length is too long")
+		}
+		length = 0
+		for ; lenBytes > 0; lenBytes-- {
+			length = length<<8 | int(b[pos])
+			pos++
+		}
+	}
+
+	if length > len(b)-pos {
+		return nil, 0, errors.New("signature integer is truncated")
+	}
+	return b[pos : pos+length], pos + length, nil
+}
+
+// Serialize returns the strict DER encoding of the signature.
+func (sig *Signature) Serialize() []byte {
+	r, s := derInteger(sig.r), derInteger(sig.s)
+
+	b := make([]byte, 0, 6+len(r)+len(s))
+	b = append(b, 0x30, byte(4+len(r)+len(s)))
+	b = append(b, 0x02, byte(len(r)))
+	b = append(b, r...)
+	b = append(b, 0x02, byte(len(s)))
+	return append(b, s...)
+}
+
+// derInteger is the minimal big endian encoding of a positive integer, with a leading zero if the
+// top bit would otherwise be set.
+func derInteger(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// Verify reports whether the signature is valid for the hash and public key. Signatures with a
+// high S are accepted, as they are by consensus; only policy requires a low S.
+func (sig *Signature) Verify(hash []byte, pub *PublicKey) bool {
+	if sig.r.Sign() <= 0 || sig.s.Sign() <= 0 || sig.r.Cmp(curveN) >= 0 || sig.s.Cmp(curveN) >= 0 {
+		return false
+	}
+
+	e := hashToInt(hash)
+	w := new(big.Int).ModInverse(sig.s, curveN)
+	u1 := new(big.Int).Mul(e, w)
+	u1.Mod(u1, curveN)
+	u2 := new(big.Int).Mul(sig.r, w)
+	u2.Mod(u2, curveN)
+
+	point := doubleScalarMult(u1, generator, u2, pub.point)
+	if point.isInfinity() {
+		return false
+	}
+	x := new(big.Int).Mod(point.x, curveN)
+	return x.Cmp(sig.r) == 0
+}
+
+// HasLowS reports whether S is in the lower half of the range, as policy requires so that
+// signatures can't be malleated by negating it.
+func (sig *Signature) HasLowS() bool {
+	return sig.s.Cmp(halfN) <= 0
+}
+
+// hashToInt converts a 32 byte hash to an integer mod the group order.
+func hashToInt(hash []byte) *big.Int {
+	e := new(big.Int).SetBytes(hash)
+	return e.Mod(e, curveN)
+}
+
+// SignECDSA signs a 32 byte hash, with the nonce derived from the key and hash as RFC6979
+// describes. S is always low.
+func (k *PrivateKey) SignECDSA(hash []byte) *Signature {
+	e := hashToInt(hash)
+	nonces := newRFC6979(k.Serialize(), hash)
+	for {
+		nonce := nonces.next()
+		if nonce.Sign() == 0 || nonce.Cmp(curveN) >= 0 {
+			continue
+		}
+
+		point := scalarBaseMult(nonce)
+		r := new(big.Int).Mod(point.x, curveN)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		s := new(big.Int).Mul(r, k.d)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(nonce, curveN))
+		s.Mod(s, curveN)
+		if s.Sign() == 0 {
+			continue
+		}
+		if s.Cmp(halfN) > 0 {
+			s.Sub(curveN, s)
+		}
+		return &Signature{r: r, s: s}
+	}
+}
+
+// rfc6979 generates the deterministic nonces of RFC6979 section 3.2, using HMAC-SHA256.
+type rfc6979 struct {
+	k, v  []byte
+	first bool
+}
+
+func newRFC6979(key, hash []byte) *rfc6979 {
+	h1 := make([]byte, 32)
+	hashToInt(hash).FillBytes(h1)
+
+	g := &rfc6979{k: make([]byte, 32), v: make([]byte, 32), first: true}
+	for i := range g.v {
+		g.v[i] = 0x01
+	}
+	g.k = g.mac(g.v, []byte{0x00}, key, h1)
+	g.v = g.mac(g.v)
+	g.k = g.mac(g.v, []byte{0x01}, key, h1)
+	g.v = g.mac(g.v)
+	return g
+}
+
+func (g *rfc6979) mac(data ...[]byte) []byte {
+	h := hmac.New(sha256.New, g.k)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func (g *rfc6979) next() *big.Int {
+	if !g.first {
+		g.k = g.mac(g.v, []byte{0x00})
+		g.v = g.mac(g.v)
+	}
+	g.first = false
+
+	g.v = g.mac(g.v)
+	return new(big.Int).SetBytes(g.v)
+}
@@ -0,0 +1,158 @@
+package secp256k1
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	PUBKEY_COMPRESSED_LEN   = 33
+	PUBKEY_UNCOMPRESSED_LEN = 65
+	PUBKEY_XONLY_LEN        = 32 // BIP340
+	PRIVKEY_LEN             = 32
+
+	// The first byte of a serialized public key says what follows. Hybrid keys give both
+	// coordinates like uncompressed ones but also the parity of y like compressed ones; they're
+	// obscure, but valid in scripts.
+	PUBKEY_FORMAT_EVEN         = 0x02
+	PUBKEY_FORMAT_ODD          = 0x03
+	PUBKEY_FORMAT_UNCOMPRESSED = 0x04
+	PUBKEY_FORMAT_HYBRID_EVEN  = 0x06
+	PUBKEY_FORMAT_HYBRID_ODD   = 0x07
+)
+
+// PublicKey is a point on the curve, other than the point at infinity.
+type PublicKey struct {
+	point affinePoint
+}
+
+// ParsePubKey parses a public key in any of the formats bitcoin accepts: compressed,
+// uncompressed or hybrid.
+func ParsePubKey(b []byte) (*PublicKey, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty public key")
+	}
+
+	switch b[0] {
+	case PUBKEY_FORMAT_EVEN, PUBKEY_FORMAT_ODD:
+		if len(b) != PUBKEY_COMPRESSED_LEN {
+			return nil, fmt.Errorf("compressed public key has length %d", len(b))
+		}
+		point, ok := liftX(new(big.Int).SetBytes(b[1:]), b[0] == PUBKEY_FORMAT_ODD)
+		if !ok {
+			return nil, errors.New("public key isn't on the curve")
+		}
+		return &PublicKey{point: point}, nil
+
+	case PUBKEY_FORMAT_UNCOMPRESSED, PUBKEY_FORMAT_HYBRID_EVEN, PUBKEY_FORMAT_HYBRID_ODD:
+		if len(b) != PUBKEY_UNCOMPRESSED_LEN {
+			return nil, fmt.Errorf("uncompressed public key has length %d", len(b))
+		}
+		point := affinePoint{x: new(big.Int).SetBytes(b[1:33]), y: new(big.Int).SetBytes(b[33:])}
+		if !point.isOnCurve() {
+			return nil, errors.New("public key isn't on the curve")
+		}
+		if b[0] != PUBKEY_FORMAT_UNCOMPRESSED && (point.y.Bit(0) == 1) != (b[0] == PUBKEY_FORMAT_HYBRID_ODD) {
+			return nil, errors.New("hybrid public key has the wrong parity")
+		}
+		return &PublicKey{point: point}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown public key format %#02x", b[0])
+	}
+}
+
+// ParseXOnlyPubKey parses a BIP340 public key, which is just the x coordinate; y is taken to be
+// even.
+func ParseXOnlyPubKey(b []byte) (*PublicKey, error) {
+	if len(b) != PUBKEY_XONLY_LEN {
+		return nil, fmt.Errorf("x-only public key has length %d", len(b))
+	}
+	point, ok := liftX(new(big.Int).SetBytes(b), false)
+	if !ok {
+		return nil, errors.New("public key isn't on the curve")
+	}
+	return &PublicKey{point: point}, nil
+}
+
+// SerializeCompressed returns the 33 byte compressed form of the key.
+func (k *PublicKey) SerializeCompressed() []byte {
+	b := make([]byte, PUBKEY_COMPRESSED_LEN)
+	b[0] = PUBKEY_FORMAT_EVEN
+	if k.HasOddY() {
+		b[0] = PUBKEY_FORMAT_ODD
+	}
+	k.point.x.FillBytes(b[1:])
+	return b
+}
+
+// SerializeUncompressed returns the 65 byte uncompressed form of the key.
+func (k *PublicKey) SerializeUncompressed() []byte {
+	b := make([]byte, PUBKEY_UNCOMPRESSED_LEN)
+	b[0] = PUBKEY_FORMAT_UNCOMPRESSED
+	k.point.x.FillBytes(b[1:33])
+	k.point.y.FillBytes(b[33:])
+	return b
+}
+
+// SerializeXOnly returns the 32 byte BIP340 form of the key, which drops the parity of y.
+func (k *PublicKey) SerializeXOnly() []byte {
+	b := make([]byte, PUBKEY_XONLY_LEN)
+	k.point.x.FillBytes(b)
+	return b
+}
+
+// HasOddY reports whether the key's y coordinate is odd.
+func (k *PublicKey) HasOddY() bool {
+	return k.point.y.Bit(0) == 1
+}
+
+// IsEqual reports whether the keys are the same point.
+func (k *PublicKey) IsEqual(other *PublicKey) bool {
+	return k.point.x.Cmp(other.point.x) == 0 && k.point.y.Cmp(other.point.y) == 0
+}
+
+// AddTweak returns the key plus tweak·G, as used to commit to a taproot script tree. It fails if
+// the tweak isn't less than the group order, or if the result is the point at infinity.
+func (k *PublicKey) AddTweak(tweak []byte) (*PublicKey, error) {
+	t := new(big.Int).SetBytes(tweak)
+	if t.Cmp(curveN) >= 0 {
+		return nil, errors.New("tweak is out of range")
+	}
+
+	point := doubleScalarMult(big.NewInt(1), k.point, t, generator)
+	if point.isInfinity() {
+		return nil, errors.New("tweaked key is the point at infinity")
+	}
+	return &PublicKey{point: point}, nil
+}
+
+// PrivateKey is a scalar between 1 and the group order.
+type PrivateKey struct {
+	d *big.Int
+}
+
+// NewPrivateKey makes a private key from its 32 byte big endian form.
+func NewPrivateKey(b []byte) (*PrivateKey, error) {
+	if len(b) != PRIVKEY_LEN {
+		return nil, fmt.Errorf("private key has length %d", len(b))
+	}
+	d := new(big.Int).SetBytes(b)
+	if d.Sign() == 0 || d.Cmp(curveN) >= 0 {
+		return nil, errors.New("private key is out of range")
+	}
+	return &PrivateKey{d: d}, nil
+}
+
+// Serialize returns the 32 byte big endian form of the key.
+func (k *PrivateKey) Serialize() []byte {
+	b := make([]byte, PRIVKEY_LEN)
+	k.d.FillBytes(b)
+	return b
+}
+
+// PubKey returns the public key for the private key.
+func (k *PrivateKey) PubKey() *PublicKey {
+	return &PublicKey{point: scalarBaseMult(k.d)}
+}
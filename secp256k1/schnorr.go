@@ -0,0 +1,111 @@
+package secp256k1
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+const SCHNORR_SIGNATURE_LEN = 64
+
+// TaggedHash is the BIP340 tagged hash, SHA256(SHA256(tag) || SHA256(tag) || msgs...), which keeps
+// hashes used for different purposes from colliding.
+func TaggedHash(tag string, msgs ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// VerifySchnorr reports whether sig is a valid BIP340 signature of msg by the key, which is taken
+// to have an even y as x-only keys do.
+func VerifySchnorr(pub *PublicKey, msg []byte, sig []byte) bool {
+	if len(sig) != SCHNORR_SIGNATURE_LEN {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(fieldP) >= 0 || s.Cmp(curveN) >= 0 {
+		return false
+	}
+
+	// An x-only key always stands for the point with even y
+	p := pub.point
+	if p.y.Bit(0) == 1 {
+		p = affinePoint{x: p.x, y: new(big.Int).Sub(fieldP, p.y)}
+	}
+
+	e := challenge(sig[:32], p, msg)
+
+	// R = s·G - e·P
+	negE := new(big.Int).Sub(curveN, e)
+	point := doubleScalarMult(s, generator, negE, p)
+	if point.isInfinity() || point.y.Bit(0) == 1 {
+		return false
+	}
+	return point.x.Cmp(r) == 0
+}
+
+// challenge is the BIP340 challenge e = hash(R || P || m) mod n.
+func challenge(r []byte, p affinePoint, msg []byte) *big.Int {
+	var px [32]byte
+	p.x.FillBytes(px[:])
+
+	hash := TaggedHash("BIP0340/challenge", r, px[:], msg)
+	return hashToInt(hash[:])
+}
+
+// SignSchnorr makes a BIP340 signature of msg, mixing auxRand (32 bytes, ideally random) into the
+// nonce.
+func (k *PrivateKey) SignSchnorr(msg, auxRand []byte) ([]byte, error) {
+	if len(auxRand) != 32 {
+		return nil, errors.New("auxiliary randomness must be 32 bytes")
+	}
+
+	// Use whichever of d and -d gives a public key with even y
+	p := scalarBaseMult(k.d)
+	d := new(big.Int).Set(k.d)
+	if p.y.Bit(0) == 1 {
+		d.Sub(curveN, d)
+	}
+
+	var db, px [32]byte
+	d.FillBytes(db[:])
+	p.x.FillBytes(px[:])
+
+	auxHash := TaggedHash("BIP0340/aux", auxRand)
+	var t [32]byte
+	for i := range t {
+		t[i] = db[i] ^ auxHash[i]
+	}
+
+	rand := TaggedHash("BIP0340/nonce", t[:], px[:], msg)
+	nonce := hashToInt(rand[:])
+	if nonce.Sign() == 0 {
+		return nil, errors.New("nonce is zero")
+	}
+
+	r := scalarBaseMult(nonce)
+	if r.y.Bit(0) == 1 {
+		nonce.Sub(curveN, nonce)
+	}
+
+	sig := make([]byte, SCHNORR_SIGNATURE_LEN)
+	r.x.FillBytes(sig[:32])
+
+	e := challenge(sig[:32], p, msg)
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, nonce)
+	s.Mod(s, curveN)
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
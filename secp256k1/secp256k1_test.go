@@ -0,0 +1,217 @@
+package secp256k1_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/pscott31/mynode/secp256k1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func privateKey(t *testing.T, hexKey string) *secp256k1.PrivateKey {
+	t.Helper()
+	key, err := secp256k1.NewPrivateKey(mustDecodeHex(hexKey))
+	require.NoError(t, err)
+	return key
+}
+
+func TestPublicKey(t *testing.T) {
+	tests := []struct {
+		privKey      string
+		compressed   string
+		uncompressed string
+	}{
+		{
+			// The generator
+			privKey:      "0000000000000000000000000000000000000000000000000000000000000001",
+			compressed:   "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+			uncompressed: "0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8",
+		},
+		{
+			privKey:      "0000000000000000000000000000000000000000000000000000000000000002",
+			compressed:   "02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5",
+			uncompressed: "04c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee51ae168fea63dc339a3c58419466ceaeef7f632653266d0e1236431a950cfe52a",
+		},
+		{
+			privKey:      "0000000000000000000000000000000000000000000000000000000000000003",
+			compressed:   "02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+			uncompressed: "04f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9388f7b0f632de8140fe337e62a37f3566500a99934c2231b6cb9fd7584b8e672",
+		},
+	}
+
+	for _, tt := range tests {
+		pub := privateKey(t, tt.privKey).PubKey()
+		assert.Equal(t, tt.compressed, hex.EncodeToString(pub.SerializeCompressed()))
+		assert.Equal(t, tt.uncompressed, hex.EncodeToString(pub.SerializeUncompressed()))
+
+		for _, serialized := range []string{tt.compressed, tt.uncompressed} {
+			parsed, err := secp256k1.ParsePubKey(mustDecodeHex(serialized))
+			require.NoError(t, err)
+			assert.True(t, pub.IsEqual(parsed))
+		}
+
+		// Hybrid keys give both coordinates and the parity
+		hybrid := pub.SerializeUncompressed()
+		hybrid[0] = secp256k1.PUBKEY_FORMAT_HYBRID_EVEN
+		if pub.HasOddY() {
+			hybrid[0] = secp256k1.PUBKEY_FORMAT_HYBRID_ODD
+		}
+		parsed, err := secp256k1.ParsePubKey(hybrid)
+		require.NoError(t, err)
+		assert.True(t, pub.IsEqual(parsed))
+
+		hybrid[0] ^= 1
+		_, err = secp256k1.ParsePubKey(hybrid)
+		assert.Error(t, err)
+	}
+}
+
+func TestParsePubKey_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"empty", ""},
+		{"unknown format", "05" + strings.Repeat("11", 32)},
+		{"compressed too short", "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817"},
+		{"uncompressed too short", "0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"not on the curve", "0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b9"},
+		{"x not on the curve", "020000000000000000000000000000000000000000000000000000000000000005"},
+		{"x out of range", "02fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"[:66]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := secp256k1.ParsePubKey(mustDecodeHex(tt.key))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestECDSA(t *testing.T) {
+	// The widely used RFC6979 test vector for secp256k1
+	key := privateKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	hash := sha256.Sum256([]byte("Satoshi Nakamoto"))
+
+	sig := key.SignECDSA(hash[:])
+	assert.Equal(t, "3045022100934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d802202442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5", hex.EncodeToString(sig.Serialize()))
+	assert.True(t, sig.HasLowS())
+	assert.True(t, sig.Verify(hash[:], key.PubKey()))
+
+	// Wrong hash, wrong key
+	other := sha256.Sum256([]byte("Hal Finney"))
+	assert.False(t, sig.Verify(other[:], key.PubKey()))
+	assert.False(t, sig.Verify(hash[:], privateKey(t, "0000000000000000000000000000000000000000000000000000000000000002").PubKey()))
+}
+
+func TestParseDERSignature(t *testing.T) {
+	key := privateKey(t, "0000000000000000000000000000000000000000000000000000000000000001")
+	hash := sha256.Sum256([]byte("Satoshi Nakamoto"))
+	pub := key.PubKey()
+
+	// r is 0x934b..., so needs a leading zero; s doesn't
+	r := "00934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d8"
+	s := "2442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5"
+	n, _ := new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	highS := hex.EncodeToString(new(big.Int).Sub(n, new(big.Int).SetBytes(mustDecodeHex(s))).Bytes())
+
+	tests := []struct {
+		name   string
+		sig    string
+		valid  bool
+		verify bool
+	}{
+		{"strict", "3045022100" + r[2:] + "0220" + s, true, true},
+		{"extra leading zeros", "3047022200" + "00" + r[2:] + "022200" + "00" + s, true, true},
+		{"long form lengths", "30814602812100" + r[2:] + "028120" + s, true, true},
+		{"trailing garbage", "3045022100" + r[2:] + "0220" + s + "0102", true, true},
+		{"high S", "3045022100" + r[2:] + "022100" + highS, true, true},
+		{"zero R", "3025020100" + "0220" + s, true, false},
+		{"R too big", "30460222" + "01" + r + "0220" + s, true, false},
+		{"not a sequence", "3145022100" + r[2:] + "0220" + s, false, false},
+		{"truncated", "3045022100" + r[2:], false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := secp256k1.ParseDERSignature(mustDecodeHex(tt.sig))
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.verify, sig.Verify(hash[:], pub))
+		})
+	}
+}
+
+// Test vectors from BIP340.
+func TestSchnorr(t *testing.T) {
+	tests := []struct {
+		privKey string
+		pubKey  string
+		auxRand string
+		msg     string
+		sig     string
+	}{
+		{
+			privKey: "0000000000000000000000000000000000000000000000000000000000000003",
+			pubKey:  "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+			auxRand: "0000000000000000000000000000000000000000000000000000000000000000",
+			msg:     "0000000000000000000000000000000000000000000000000000000000000000",
+			sig:     "e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0",
+		},
+		{
+			privKey: "b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef",
+			pubKey:  "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+			auxRand: "0000000000000000000000000000000000000000000000000000000000000001",
+			msg:     "243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			sig:     "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8dcf8c78de33418906d11ac976abccb20b091292bff4ea897efcb639ea871cfa95f6de339e4b0a",
+		},
+	}
+
+	for _, tt := range tests {
+		key := privateKey(t, tt.privKey)
+		assert.Equal(t, tt.pubKey, hex.EncodeToString(key.PubKey().SerializeXOnly()))
+
+		sig, err := key.SignSchnorr(mustDecodeHex(tt.msg), mustDecodeHex(tt.auxRand))
+		require.NoError(t, err)
+		assert.Equal(t, tt.sig, hex.EncodeToString(sig))
+
+		pub, err := secp256k1.ParseXOnlyPubKey(mustDecodeHex(tt.pubKey))
+		require.NoError(t, err)
+		assert.True(t, secp256k1.VerifySchnorr(pub, mustDecodeHex(tt.msg), sig))
+
+		// Any change breaks it
+		msg := mustDecodeHex(tt.msg)
+		msg[0] ^= 1
+		assert.False(t, secp256k1.VerifySchnorr(pub, msg, sig))
+		sig[63] ^= 1
+		assert.False(t, secp256k1.VerifySchnorr(pub, mustDecodeHex(tt.msg), sig))
+	}
+}
+
+func TestAddTweak(t *testing.T) {
+	// Adding a tweak t to the key for d gives the key for d + t
+	key := privateKey(t, "0000000000000000000000000000000000000000000000000000000000000003")
+	tweak := mustDecodeHex("0000000000000000000000000000000000000000000000000000000000000004")
+	tweaked, err := key.PubKey().AddTweak(tweak)
+	require.NoError(t, err)
+	assert.True(t, privateKey(t, "0000000000000000000000000000000000000000000000000000000000000007").PubKey().IsEqual(tweaked))
+
+	_, err = key.PubKey().AddTweak(mustDecodeHex("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+)
+
+// PeerHandler is run in its own goroutine for each inbound peer once the handshake has completed.
+// The peer's connection is closed when the handler returns.
+type PeerHandler func(p *peer.Peer)
+
+// Server accepts inbound connections from other nodes.
+type Server struct {
+	cfg      *config.Config
+	nonces   *peer.NonceSet
+	listener net.Listener
+	handler  PeerHandler
+
+	mu      sync.Mutex
+	inbound map[*peer.Peer]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// Listen binds to the configured listen address. Connections are not accepted until Serve is called.
+// The nonces are those shared by all the node's peers.
+func Listen(cfg *config.Config, nonces *peer.NonceSet, handler PeerHandler) (*Server, error) {
+	listener, err := net.Listen("tcp", cfg.ListenAddress())
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", cfg.ListenAddress(), err)
+	}
+
+	return &Server{
+		cfg:      cfg,
+		nonces:   nonces,
+		listener: listener,
+		handler:  handler,
+		inbound:  map[*peer.Peer]struct{}{},
+	}, nil
+}
+
+// Addr is the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// NumInbound is the number of inbound peers currently connected, including those mid-handshake.
+func (s *Server) NumInbound() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inbound)
+}
+
+// Serve accepts connections until the server is closed, running each peer in its own goroutine.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+
+		p := peer.NewInbound(s.cfg, s.nonces, conn)
+		if !s.addPeer(p) {
+			log.Printf("rejecting inbound connection from %s: already have %d inbound peers", conn.RemoteAddr(), s.cfg.MaxInbound)
+			conn.Close()
+			continue
+		}
+		go s.runPeer(p)
+	}
+}
+
+// Close stops accepting connections, disconnects all inbound peers and waits for their handlers to return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for p := range s.inbound {
+		p.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// addPeer registers a new inbound peer, returning false if we're already at our inbound limit or
+// have been closed. Otherwise Close waits for the peer to be run, so the caller must run it.
+func (s *Server) addPeer(p *peer.Peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || len(s.inbound) >= s.cfg.MaxInbound {
+		return false
+	}
+	s.inbound[p] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) removePeer(p *peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inbound, p)
+}
+
+func (s *Server) runPeer(p *peer.Peer) {
+	defer s.wg.Done()
+	defer s.removePeer(p)
+	defer p.Close()
+
+	if err := p.Handshake(); err != nil {
+		log.Printf("handshake with inbound peer %s failed: %v", p.Addr(), err)
+		return
+	}
+
+	log.Printf("accepted inbound peer %s (%s)", p.Addr(), p.TheirVersion().UserAgent)
+	if s.handler != nil {
+		s.handler(p)
+	}
+}
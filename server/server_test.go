@@ -0,0 +1,100 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pscott31/mynode/config"
+	"github.com/pscott31/mynode/peer"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.HandshakeTimeout = time.Second
+	return cfg
+}
+
+func TestServer_AcceptsInboundPeer(t *testing.T) {
+	cfg := testConfig()
+
+	connected := make(chan *peer.Peer)
+	srv, err := server.Listen(cfg, peer.NewNonceSet(), func(p *peer.Peer) {
+		connected <- p
+	})
+	require.NoError(t, err)
+	go srv.Serve()
+	defer srv.Close()
+
+	client, err := peer.Dial(config.Default(), peer.NewNonceSet(), srv.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Handshake())
+
+	select {
+	case p := <-connected:
+		assert.True(t, p.Inbound())
+		assert.Equal(t, proto.VarString(proto.USER_AGENT), p.TheirVersion().UserAgent)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called for inbound peer")
+	}
+}
+
+func TestServer_MaxInbound(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxInbound = 1
+
+	release := make(chan struct{})
+	srv, err := server.Listen(cfg, peer.NewNonceSet(), func(p *peer.Peer) {
+		<-release
+	})
+	require.NoError(t, err)
+	go srv.Serve()
+	defer srv.Close()
+	defer close(release)
+
+	first, err := peer.Dial(config.Default(), peer.NewNonceSet(), srv.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	require.NoError(t, first.Handshake())
+	assert.Equal(t, 1, srv.NumInbound())
+
+	// We're at our limit, so the second connection should be dropped without a handshake
+	second, err := peer.Dial(config.Default(), peer.NewNonceSet(), srv.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+
+	err = second.Handshake()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, peer.ErrHandshakeTimeout)
+	assert.Equal(t, 1, srv.NumInbound())
+}
+
+func TestServer_RejectsSelfConnection(t *testing.T) {
+	cfg := testConfig()
+	nonces := peer.NewNonceSet()
+
+	connected := make(chan *peer.Peer, 1)
+	srv, err := server.Listen(cfg, nonces, func(p *peer.Peer) {
+		connected <- p
+	})
+	require.NoError(t, err)
+	go srv.Serve()
+	defer srv.Close()
+
+	// Dialling it from the same node, the server recognises our nonce and hangs up
+	self, err := peer.Dial(cfg, nonces, srv.Addr().String())
+	require.NoError(t, err)
+	defer self.Close()
+	require.Error(t, self.Handshake())
+
+	select {
+	case <-connected:
+		t.Fatal("handler was called for a connection to ourselves")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
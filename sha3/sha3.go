@@ -0,0 +1,93 @@
+// Package sha3 implements the SHA3-256 hash, which Tor uses in the checksum of v3 onion addresses.
+package sha3
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	// The size of a SHA3-256 checksum in bytes.
+	SIZE = 32
+
+	// How many bytes of the state each block of input is absorbed into.
+	RATE = 200 - 2*SIZE
+)
+
+// The constants mixed into the state in each round of Keccak-f[1600].
+var roundConstants = [24]uint64{
+	0x0000000000000001, 0x0000000000008082, 0x800000000000808a, 0x8000000080008000,
+	0x000000000000808b, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+	0x000000000000008a, 0x0000000000000088, 0x0000000080008009, 0x000000008000000a,
+	0x000000008000808b, 0x800000000000008b, 0x8000000000008089, 0x8000000000008003,
+	0x8000000000008002, 0x8000000000000080, 0x000000000000800a, 0x800000008000000a,
+	0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+}
+
+// How far each lane of the state is rotated by, indexed by x+5y.
+var rotations = [25]int{
+	0, 1, 62, 28, 27,
+	36, 44, 6, 55, 20,
+	3, 10, 43, 25, 39,
+	41, 45, 15, 21, 8,
+	18, 2, 61, 56, 14,
+}
+
+// Sum256 returns the SHA3-256 checksum of the data.
+func Sum256(data []byte) [SIZE]byte {
+	// The domain separation bits and the first and last bits of the padding, which always adds
+	// at least one byte
+	padded := make([]byte, len(data)+RATE-len(data)%RATE)
+	copy(padded, data)
+	padded[len(data)] = 0x06
+	padded[len(padded)-1] |= 0x80
+
+	var state [25]uint64
+	for ; len(padded) > 0; padded = padded[RATE:] {
+		for i := 0; i < RATE/8; i++ {
+			state[i] ^= binary.LittleEndian.Uint64(padded[8*i:])
+		}
+		keccakF1600(&state)
+	}
+
+	var sum [SIZE]byte
+	for i := 0; i < SIZE/8; i++ {
+		binary.LittleEndian.PutUint64(sum[8*i:], state[i])
+	}
+	return sum
+}
+
+// keccakF1600 is the permutation applied to the state after each block is absorbed.
+func keccakF1600(a *[25]uint64) {
+	var c [5]uint64
+	var b [25]uint64
+	for round := 0; round < 24; round++ {
+		// θ: mix each column into its neighbours
+		for x := 0; x < 5; x++ {
+			c[x] = a[x] ^ a[x+5] ^ a[x+10] ^ a[x+15] ^ a[x+20]
+		}
+		for x := 0; x < 5; x++ {
+			d := c[(x+4)%5] ^ bits.RotateLeft64(c[(x+1)%5], 1)
+			for y := 0; y < 25; y += 5 {
+				a[x+y] ^= d
+			}
+		}
+
+		// ρ and π: rotate each lane and move it to its new position
+		for x := 0; x < 5; x++ {
+			for y := 0; y < 5; y++ {
+				b[y+5*((2*x+3*y)%5)] = bits.RotateLeft64(a[x+5*y], rotations[x+5*y])
+			}
+		}
+
+		// χ: the only non-linear step, along each row
+		for y := 0; y < 25; y += 5 {
+			for x := 0; x < 5; x++ {
+				a[x+y] = b[x+y] ^ (^b[(x+1)%5+y] & b[(x+2)%5+y])
+			}
+		}
+
+		// ι
+		a[0] ^= roundConstants[round]
+	}
+}
@@ -0,0 +1,28 @@
+package sha3_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/pscott31/mynode/sha3"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test vectors from NIST's examples, including messages of more than one block.
+func TestSum256(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a"},
+		{"abc", "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		{"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq", "41c0dba2a9d6240849100376a8235e2c82e1b9998a999e21db32dd97496d3376"},
+		{strings.Repeat("\xa3", 200), "79f38adec5c20307a98ef76e8324afbfd46cfd81b22e3973c65fa1bd9de31787"},
+	}
+
+	for _, tt := range tests {
+		sum := sha3.Sum256([]byte(tt.in))
+		assert.Equal(t, tt.want, hex.EncodeToString(sum[:]), tt.in)
+	}
+}
@@ -0,0 +1,92 @@
+package txscript
+
+import (
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/secp256k1"
+)
+
+// isValidSignatureEncoding reports whether sig, with its hash type on the end, is strict DER as
+// BIP66 requires.
+func isValidSignatureEncoding(sig []byte) bool {
+	// 0x30 [total-length] 0x02 [R-length] [R] 0x02 [S-length] [S] [sighash]
+	if len(sig) < 9 || len(sig) > 73 {
+		return false
+	}
+	if sig[0] != 0x30 || int(sig[1]) != len(sig)-3 {
+		return false
+	}
+
+	lenR := int(sig[3])
+	if 5+lenR >= len(sig) {
+		return false
+	}
+	lenS := int(sig[5+lenR])
+	if lenR+lenS+7 != len(sig) {
+		return false
+	}
+
+	// R and S must be positive and without needless leading zeros
+	if sig[2] != 0x02 || lenR == 0 || sig[4]&0x80 != 0 {
+		return false
+	}
+	if lenR > 1 && sig[4] == 0x00 && sig[5]&0x80 == 0 {
+		return false
+	}
+	if sig[lenR+4] != 0x02 || lenS == 0 || sig[lenR+6]&0x80 != 0 {
+		return false
+	}
+	if lenS > 1 && sig[lenR+6] == 0x00 && sig[lenR+7]&0x80 == 0 {
+		return false
+	}
+	return true
+}
+
+// checkSignatureEncoding fails if the flags rule out how an ECDSA signature is encoded. An empty
+// signature is always allowed, as a way to fail a check on purpose.
+func checkSignatureEncoding(sig []byte, flags ScriptFlags) error {
+	if len(sig) == 0 {
+		return nil
+	}
+	if flags&(SCRIPT_VERIFY_DERSIG|SCRIPT_VERIFY_LOW_S|SCRIPT_VERIFY_STRICTENC) != 0 && !isValidSignatureEncoding(sig) {
+		return scriptError(ErrSigDER, "signature isn't strict DER")
+	}
+	if flags&SCRIPT_VERIFY_LOW_S != 0 {
+		parsed, err := secp256k1.ParseDERSignature(sig[:len(sig)-1])
+		if err != nil {
+			return scriptError(ErrSigDER, "signature isn't strict DER")
+		}
+		if !parsed.HasLowS() {
+			return scriptError(ErrSigHighS, "signature has a high S")
+		}
+	}
+	if flags&SCRIPT_VERIFY_STRICTENC != 0 {
+		hashType := proto.SigHashType(sig[len(sig)-1]) &^ proto.SIGHASH_ANYONECANPAY
+		if hashType < proto.SIGHASH_ALL || hashType > proto.SIGHASH_SINGLE {
+			return scriptError(ErrSigHashType, "signature has undefined hash type %#x", sig[len(sig)-1])
+		}
+	}
+	return nil
+}
+
+// checkPubKeyEncoding fails if the flags rule out how a public key is encoded.
+func checkPubKeyEncoding(pubKey []byte, flags ScriptFlags, sigVersion sigVersion) error {
+	if flags&SCRIPT_VERIFY_STRICTENC != 0 && !isCompressedOrUncompressedPubKey(pubKey) {
+		return scriptError(ErrPubKeyType, "public key is neither compressed nor uncompressed")
+	}
+	if flags&SCRIPT_VERIFY_WITNESS_PUBKEYTYPE != 0 && sigVersion == sigVersionWitnessV0 && !isCompressedPubKey(pubKey) {
+		return scriptError(ErrWitnessPubKeyType, "public key in witness script isn't compressed")
+	}
+	return nil
+}
+
+func isCompressedOrUncompressedPubKey(pubKey []byte) bool {
+	if len(pubKey) == secp256k1.PUBKEY_UNCOMPRESSED_LEN {
+		return pubKey[0] == secp256k1.PUBKEY_FORMAT_UNCOMPRESSED
+	}
+	return isCompressedPubKey(pubKey)
+}
+
+func isCompressedPubKey(pubKey []byte) bool {
+	return len(pubKey) == secp256k1.PUBKEY_COMPRESSED_LEN &&
+		(pubKey[0] == secp256k1.PUBKEY_FORMAT_EVEN || pubKey[0] == secp256k1.PUBKEY_FORMAT_ODD)
+}
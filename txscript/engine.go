@@ -0,0 +1,788 @@
+package txscript
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/ripemd160"
+	"github.com/pscott31/mynode/secp256k1"
+)
+
+// stack is the script stack, with the top at the end. Items are never modified in place, so they
+// can share memory with the script that pushed them.
+type stack [][]byte
+
+func (s *stack) push(b []byte) {
+	*s = append(*s, b)
+}
+
+func (s *stack) pop() []byte {
+	b := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return b
+}
+
+// top returns the i'th item from the top, counting from 1.
+func (s stack) top(i int) []byte {
+	return s[len(s)-i]
+}
+
+// remove removes the i'th item from the top, counting from 1.
+func (s *stack) remove(i int) {
+	n := len(*s) - i
+	*s = append((*s)[:n], (*s)[n+1:]...)
+}
+
+func (s stack) swap(i, j int) {
+	s[len(s)-i], s[len(s)-j] = s[len(s)-j], s[len(s)-i]
+}
+
+func (s *stack) pushBool(b bool) {
+	if b {
+		s.push([]byte{1})
+	} else {
+		s.push([]byte{})
+	}
+}
+
+func (s *stack) pushNum(n scriptNum) {
+	s.push(n.Bytes())
+}
+
+// engine is the state of a script being evaluated.
+type engine struct {
+	stack      stack
+	altStack   stack
+	conditions []bool // Whether each enclosing branch is being executed
+
+	script    []byte
+	codeStart int // Where the script code that signatures commit to starts
+	opCount   int
+
+	flags      ScriptFlags
+	checker    *sigChecker
+	sigVersion sigVersion
+	exec       *execData
+}
+
+// evalScript runs the script on the stack, failing with the reason if it doesn't run to the end.
+// Whether the script succeeded is then down to what it left on the stack.
+func evalScript(stk *stack, script []byte, flags ScriptFlags, checker *sigChecker, sigVersion sigVersion, exec *execData) error {
+	legacyLimits := sigVersion == sigVersionBase || sigVersion == sigVersionWitnessV0
+	if legacyLimits && len(script) > MAX_SCRIPT_SIZE {
+		return scriptError(ErrScriptSize, "script of %d bytes is more than %d", len(script), MAX_SCRIPT_SIZE)
+	}
+
+	e := engine{
+		stack:      *stk,
+		script:     script,
+		flags:      flags,
+		checker:    checker,
+		sigVersion: sigVersion,
+		exec:       exec,
+	}
+	defer func() { *stk = e.stack }()
+	exec.codeSepPos = 0xffffffff
+
+	for pc, opPos := 0, uint32(0); pc < len(script); opPos++ {
+		op, data, next, ok := getOp(script, pc)
+		if !ok {
+			return scriptError(ErrBadOpcode, "push at %d runs off the end of the script", pc)
+		}
+		pc = next
+
+		if len(data) > MAX_SCRIPT_ELEMENT_SIZE {
+			return scriptError(ErrPushSize, "push of %d bytes is more than %d", len(data), MAX_SCRIPT_ELEMENT_SIZE)
+		}
+		if legacyLimits && op > OP_16 {
+			e.opCount++
+			if e.opCount > MAX_OPS_PER_SCRIPT {
+				return scriptError(ErrOpCount, "more than %d opcodes", MAX_OPS_PER_SCRIPT)
+			}
+		}
+		if isDisabled(op) {
+			return scriptError(ErrDisabledOpcode, "%s is disabled", OpcodeName(op))
+		}
+		if op == OP_CODESEPARATOR && sigVersion == sigVersionBase && flags&SCRIPT_VERIFY_CONST_SCRIPTCODE != 0 {
+			return scriptError(ErrOpCodeSeparator, "OP_CODESEPARATOR in legacy script")
+		}
+
+		executing := e.executing()
+		if executing && op <= OP_PUSHDATA4 {
+			if flags&SCRIPT_VERIFY_MINIMALDATA != 0 && !isMinimalPush(op, data) {
+				return scriptError(ErrMinimalData, "push of %x isn't minimal", data)
+			}
+			e.stack.push(data)
+		} else if executing || (op >= OP_IF && op <= OP_ENDIF) {
+			if err := e.step(op, pc, opPos); err != nil {
+				return err
+			}
+		}
+
+		if len(e.stack)+len(e.altStack) > MAX_STACK_SIZE {
+			return scriptError(ErrStackSize, "more than %d stack items", MAX_STACK_SIZE)
+		}
+	}
+
+	if len(e.conditions) != 0 {
+		return scriptError(ErrUnbalancedConditional, "OP_IF without OP_ENDIF")
+	}
+	return nil
+}
+
+// executing reports whether every enclosing branch is being executed.
+func (e *engine) executing() bool {
+	for _, c := range e.conditions {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// num reads the i'th stack item from the top as a number.
+func (e *engine) num(i int, maxSize int) (scriptNum, error) {
+	return makeScriptNum(e.stack.top(i), e.flags&SCRIPT_VERIFY_MINIMALDATA != 0, maxSize)
+}
+
+// need fails unless there are at least n items on the stack.
+func (e *engine) need(op byte, n int) error {
+	if len(e.stack) < n {
+		return scriptError(ErrInvalidStackOperation, "%s needs %d stack items, there are %d", OpcodeName(op), n, len(e.stack))
+	}
+	return nil
+}
+
+// step executes an opcode other than a data push. pc is the position after it, and opPos its
+// index in the script.
+func (e *engine) step(op byte, pc int, opPos uint32) error {
+	switch op {
+	case OP_1NEGATE, OP_1, OP_2, OP_3, OP_4, OP_5, OP_6, OP_7, OP_8, OP_9, OP_10, OP_11, OP_12, OP_13, OP_14, OP_15, OP_16:
+		e.stack.pushNum(scriptNum(int(op) - (OP_1 - 1)))
+
+	// Control
+	case OP_NOP:
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		if e.flags&SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY == 0 {
+			break
+		}
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		// The lock time may need all 32 bits, hence the extra byte
+		lockTime, err := e.num(1, LOCKTIME_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 {
+			return scriptError(ErrNegativeLockTime, "negative lock time %d", lockTime)
+		}
+		if !e.checker.checkLockTime(lockTime) {
+			return scriptError(ErrUnsatisfiedLockTime, "lock time %d isn't satisfied", lockTime)
+		}
+
+	case OP_CHECKSEQUENCEVERIFY:
+		if e.flags&SCRIPT_VERIFY_CHECKSEQUENCEVERIFY == 0 {
+			break
+		}
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		sequence, err := e.num(1, LOCKTIME_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		if sequence < 0 {
+			return scriptError(ErrNegativeLockTime, "negative sequence %d", sequence)
+		}
+		// With the disable flag set it's a NOP, left for future soft forks
+		if sequence&proto.SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+			break
+		}
+		if !e.checker.checkSequence(sequence) {
+			return scriptError(ErrUnsatisfiedLockTime, "sequence %d isn't satisfied", sequence)
+		}
+
+	case OP_NOP1, OP_NOP4, OP_NOP5, OP_NOP6, OP_NOP7, OP_NOP8, OP_NOP9, OP_NOP10:
+		if e.flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS != 0 {
+			return scriptError(ErrDiscourageUpgradableNops, "%s is reserved for soft forks", OpcodeName(op))
+		}
+
+	case OP_IF, OP_NOTIF:
+		value := false
+		if e.executing() {
+			if len(e.stack) < 1 {
+				return scriptError(ErrInvalidStackOperation, "%s with an empty stack", OpcodeName(op))
+			}
+			arg := e.stack.top(1)
+			minimal := len(arg) == 0 || (len(arg) == 1 && arg[0] == 1)
+			if e.sigVersion == sigVersionTapscript && !minimal {
+				return scriptError(ErrTapscriptMinimalIf, "%s argument %x isn't minimal", OpcodeName(op), arg)
+			}
+			if e.sigVersion == sigVersionWitnessV0 && e.flags&SCRIPT_VERIFY_MINIMALIF != 0 && !minimal {
+				return scriptError(ErrMinimalIf, "%s argument %x isn't minimal", OpcodeName(op), arg)
+			}
+			value = castToBool(arg)
+			if op == OP_NOTIF {
+				value = !value
+			}
+			e.stack.pop()
+		}
+		e.conditions = append(e.conditions, value)
+
+	case OP_ELSE:
+		if len(e.conditions) == 0 {
+			return scriptError(ErrUnbalancedConditional, "OP_ELSE without OP_IF")
+		}
+		e.conditions[len(e.conditions)-1] = !e.conditions[len(e.conditions)-1]
+
+	case OP_ENDIF:
+		if len(e.conditions) == 0 {
+			return scriptError(ErrUnbalancedConditional, "OP_ENDIF without OP_IF")
+		}
+		e.conditions = e.conditions[:len(e.conditions)-1]
+
+	case OP_VERIFY:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		if !castToBool(e.stack.top(1)) {
+			return scriptError(ErrVerify, "OP_VERIFY failed")
+		}
+		e.stack.pop()
+
+	case OP_RETURN:
+		return scriptError(ErrOpReturn, "OP_RETURN executed")
+
+	// Stack
+	case OP_TOALTSTACK:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		e.altStack.push(e.stack.pop())
+
+	case OP_FROMALTSTACK:
+		if len(e.altStack) < 1 {
+			return scriptError(ErrInvalidAltStackOperation, "OP_FROMALTSTACK with an empty alt stack")
+		}
+		e.stack.push(e.altStack.pop())
+
+	case OP_2DROP:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		e.stack.pop()
+		e.stack.pop()
+
+	case OP_2DUP:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		a, b := e.stack.top(2), e.stack.top(1)
+		e.stack.push(a)
+		e.stack.push(b)
+
+	case OP_3DUP:
+		if err := e.need(op, 3); err != nil {
+			return err
+		}
+		a, b, c := e.stack.top(3), e.stack.top(2), e.stack.top(1)
+		e.stack.push(a)
+		e.stack.push(b)
+		e.stack.push(c)
+
+	case OP_2OVER:
+		if err := e.need(op, 4); err != nil {
+			return err
+		}
+		a, b := e.stack.top(4), e.stack.top(3)
+		e.stack.push(a)
+		e.stack.push(b)
+
+	case OP_2ROT:
+		if err := e.need(op, 6); err != nil {
+			return err
+		}
+		a, b := e.stack.top(6), e.stack.top(5)
+		e.stack.remove(6)
+		e.stack.remove(5)
+		e.stack.push(a)
+		e.stack.push(b)
+
+	case OP_2SWAP:
+		if err := e.need(op, 4); err != nil {
+			return err
+		}
+		e.stack.swap(4, 2)
+		e.stack.swap(3, 1)
+
+	case OP_IFDUP:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		if castToBool(e.stack.top(1)) {
+			e.stack.push(e.stack.top(1))
+		}
+
+	case OP_DEPTH:
+		e.stack.pushNum(scriptNum(len(e.stack)))
+
+	case OP_DROP:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		e.stack.pop()
+
+	case OP_DUP:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		e.stack.push(e.stack.top(1))
+
+	case OP_NIP:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		e.stack.remove(2)
+
+	case OP_OVER:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		e.stack.push(e.stack.top(2))
+
+	case OP_PICK, OP_ROLL:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		n, err := e.num(1, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		e.stack.pop()
+		if n < 0 || int64(n) >= int64(len(e.stack)) {
+			return scriptError(ErrInvalidStackOperation, "%s of item %d with %d on the stack", OpcodeName(op), n, len(e.stack))
+		}
+		item := e.stack.top(int(n) + 1)
+		if op == OP_ROLL {
+			e.stack.remove(int(n) + 1)
+		}
+		e.stack.push(item)
+
+	case OP_ROT:
+		if err := e.need(op, 3); err != nil {
+			return err
+		}
+		e.stack.swap(3, 2)
+		e.stack.swap(2, 1)
+
+	case OP_SWAP:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		e.stack.swap(2, 1)
+
+	case OP_TUCK:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		top := e.stack.pop()
+		below := e.stack.pop()
+		e.stack.push(top)
+		e.stack.push(below)
+		e.stack.push(top)
+
+	case OP_SIZE:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		e.stack.pushNum(scriptNum(len(e.stack.top(1))))
+
+	// Bitwise logic
+	case OP_EQUAL, OP_EQUALVERIFY:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		equal := bytes.Equal(e.stack.pop(), e.stack.pop())
+		e.stack.pushBool(equal)
+		if op == OP_EQUALVERIFY {
+			if !equal {
+				return scriptError(ErrEqualVerify, "OP_EQUALVERIFY failed")
+			}
+			e.stack.pop()
+		}
+
+	// Arithmetic
+	case OP_1ADD, OP_1SUB, OP_NEGATE, OP_ABS, OP_NOT, OP_0NOTEQUAL:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		n, err := e.num(1, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case OP_1ADD:
+			n++
+		case OP_1SUB:
+			n--
+		case OP_NEGATE:
+			n = -n
+		case OP_ABS:
+			if n < 0 {
+				n = -n
+			}
+		case OP_NOT:
+			n = boolNum(n == 0)
+		case OP_0NOTEQUAL:
+			n = boolNum(n != 0)
+		}
+		e.stack.pop()
+		e.stack.pushNum(n)
+
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_NUMNOTEQUAL,
+		OP_LESSTHAN, OP_GREATERTHAN, OP_LESSTHANOREQUAL, OP_GREATERTHANOREQUAL, OP_MIN, OP_MAX:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		a, err := e.num(2, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		b, err := e.num(1, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+
+		var n scriptNum
+		switch op {
+		case OP_ADD:
+			n = a + b
+		case OP_SUB:
+			n = a - b
+		case OP_BOOLAND:
+			n = boolNum(a != 0 && b != 0)
+		case OP_BOOLOR:
+			n = boolNum(a != 0 || b != 0)
+		case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+			n = boolNum(a == b)
+		case OP_NUMNOTEQUAL:
+			n = boolNum(a != b)
+		case OP_LESSTHAN:
+			n = boolNum(a < b)
+		case OP_GREATERTHAN:
+			n = boolNum(a > b)
+		case OP_LESSTHANOREQUAL:
+			n = boolNum(a <= b)
+		case OP_GREATERTHANOREQUAL:
+			n = boolNum(a >= b)
+		case OP_MIN:
+			n = min(a, b)
+		case OP_MAX:
+			n = max(a, b)
+		}
+		e.stack.pop()
+		e.stack.pop()
+		e.stack.pushNum(n)
+
+		if op == OP_NUMEQUALVERIFY {
+			if n == 0 {
+				return scriptError(ErrNumEqualVerify, "OP_NUMEQUALVERIFY failed")
+			}
+			e.stack.pop()
+		}
+
+	case OP_WITHIN:
+		if err := e.need(op, 3); err != nil {
+			return err
+		}
+		x, err := e.num(3, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		lower, err := e.num(2, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		upper, err := e.num(1, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		e.stack.pop()
+		e.stack.pop()
+		e.stack.pop()
+		e.stack.pushBool(lower <= x && x < upper)
+
+	// Crypto
+	case OP_RIPEMD160, OP_SHA1, OP_SHA256, OP_HASH160, OP_HASH256:
+		if err := e.need(op, 1); err != nil {
+			return err
+		}
+		data := e.stack.pop()
+		var hash []byte
+		switch op {
+		case OP_RIPEMD160:
+			sum := ripemd160.Sum(data)
+			hash = sum[:]
+		case OP_SHA1:
+			sum := sha1.Sum(data)
+			hash = sum[:]
+		case OP_SHA256:
+			sum := sha256.Sum256(data)
+			hash = sum[:]
+		case OP_HASH160:
+			hash = hash160(data)
+		case OP_HASH256:
+			sum := sha256.Sum256(data)
+			sum = sha256.Sum256(sum[:])
+			hash = sum[:]
+		}
+		e.stack.push(hash)
+
+	case OP_CODESEPARATOR:
+		e.codeStart = pc
+		e.exec.codeSepPos = opPos
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		if err := e.need(op, 2); err != nil {
+			return err
+		}
+		ok, err := e.checkSig(e.stack.top(2), e.stack.top(1))
+		if err != nil {
+			return err
+		}
+		e.stack.pop()
+		e.stack.pop()
+		e.stack.pushBool(ok)
+		if op == OP_CHECKSIGVERIFY {
+			if !ok {
+				return scriptError(ErrCheckSigVerify, "OP_CHECKSIGVERIFY failed")
+			}
+			e.stack.pop()
+		}
+
+	case OP_CHECKSIGADD:
+		if e.sigVersion == sigVersionBase || e.sigVersion == sigVersionWitnessV0 {
+			return scriptError(ErrBadOpcode, "OP_CHECKSIGADD outside tapscript")
+		}
+		if err := e.need(op, 3); err != nil {
+			return err
+		}
+		n, err := e.num(2, DEFAULT_NUM_SIZE)
+		if err != nil {
+			return err
+		}
+		ok, err := e.checkSig(e.stack.top(3), e.stack.top(1))
+		if err != nil {
+			return err
+		}
+		e.stack.pop()
+		e.stack.pop()
+		e.stack.pop()
+		if ok {
+			n++
+		}
+		e.stack.pushNum(n)
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		if e.sigVersion == sigVersionTapscript {
+			return scriptError(ErrTapscriptCheckMultiSig, "%s in tapscript", OpcodeName(op))
+		}
+		ok, err := e.checkMultiSig(op)
+		if err != nil {
+			return err
+		}
+		e.stack.pushBool(ok)
+		if op == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return scriptError(ErrCheckMultiSigVerify, "OP_CHECKMULTISIGVERIFY failed")
+			}
+			e.stack.pop()
+		}
+
+	default:
+		return scriptError(ErrBadOpcode, "%s can't be executed", OpcodeName(op))
+	}
+	return nil
+}
+
+func boolNum(b bool) scriptNum {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// hash160 is RIPEMD160(SHA256(data)), which public keys and scripts are hashed with to make
+// addresses.
+func hash160(data []byte) []byte {
+	sha := sha256.Sum256(data)
+	sum := ripemd160.Sum(sha[:])
+	return sum[:]
+}
+
+// checkSig checks a signature for OP_CHECKSIG and friends. An invalid signature just makes it
+// return false, but a malformed one may fail the script depending on the flags.
+func (e *engine) checkSig(sig, pubKey []byte) (bool, error) {
+	if e.sigVersion == sigVersionTapscript {
+		return e.checkSigTapscript(sig, pubKey)
+	}
+
+	scriptCode := e.script[e.codeStart:]
+
+	// A legacy signature can't sign itself, so it's removed from the script code
+	if e.sigVersion == sigVersionBase {
+		var found int
+		scriptCode, found = findAndDelete(scriptCode, pushData(sig))
+		if found > 0 && e.flags&SCRIPT_VERIFY_CONST_SCRIPTCODE != 0 {
+			return false, scriptError(ErrSigFindAndDelete, "signature found in script code")
+		}
+	}
+
+	if err := checkSignatureEncoding(sig, e.flags); err != nil {
+		return false, err
+	}
+	if err := checkPubKeyEncoding(pubKey, e.flags, e.sigVersion); err != nil {
+		return false, err
+	}
+
+	ok := e.checker.checkECDSASignature(sig, pubKey, scriptCode, e.sigVersion)
+	if !ok && e.flags&SCRIPT_VERIFY_NULLFAIL != 0 && len(sig) != 0 {
+		return false, scriptError(ErrSigNullFail, "failed signature check with a non-empty signature")
+	}
+	return ok, nil
+}
+
+// checkSigTapscript checks a signature under BIP342's rules. An empty signature is a failed check;
+// any other invalid signature fails the script.
+func (e *engine) checkSigTapscript(sig, pubKey []byte) (bool, error) {
+	ok := len(sig) != 0
+	if ok {
+		// Each signature must be paid for with witness bytes, which bounds the work a spend can
+		// cause
+		e.exec.validationWeightLeft -= VALIDATION_WEIGHT_PER_SIGOP_PASSED
+		if e.exec.validationWeightLeft < 0 {
+			return false, scriptError(ErrTapscriptValidationWeight, "too many signature checks for the witness size")
+		}
+	}
+
+	switch len(pubKey) {
+	case 0:
+		return false, scriptError(ErrTapscriptEmptyPubKey, "empty public key")
+	case secp256k1.PUBKEY_XONLY_LEN:
+		if ok {
+			if err := e.checker.checkSchnorrSignature(sig, pubKey, e.sigVersion, e.exec); err != nil {
+				return false, err
+			}
+		}
+	default:
+		// Other key types are left for soft forks to define, and count as valid until then
+		if e.flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE != 0 {
+			return false, scriptError(ErrDiscourageUpgradablePubKeyType, "public key of unknown type")
+		}
+	}
+	return ok, nil
+}
+
+// checkMultiSig checks the signatures for OP_CHECKMULTISIG, removing its arguments from the
+// stack. The signatures must be in the same order as the keys they're made with.
+func (e *engine) checkMultiSig(op byte) (bool, error) {
+	i := 1
+	if err := e.need(op, i); err != nil {
+		return false, err
+	}
+	keyCount, err := e.num(i, DEFAULT_NUM_SIZE)
+	if err != nil {
+		return false, err
+	}
+	if keyCount < 0 || keyCount > MAX_PUBKEYS_PER_MULTISIG {
+		return false, scriptError(ErrPubKeyCount, "%d public keys is outside 0 to %d", keyCount, MAX_PUBKEYS_PER_MULTISIG)
+	}
+	e.opCount += int(keyCount)
+	if e.opCount > MAX_OPS_PER_SCRIPT {
+		return false, scriptError(ErrOpCount, "more than %d opcodes", MAX_OPS_PER_SCRIPT)
+	}
+	i++
+	keyIdx := i
+	// The last item that isn't a signature, to clean up to if the check fails under NULLFAIL
+	lastKeyIdx := int(keyCount) + 2
+	i += int(keyCount)
+	if err := e.need(op, i); err != nil {
+		return false, err
+	}
+
+	sigCount, err := e.num(i, DEFAULT_NUM_SIZE)
+	if err != nil {
+		return false, err
+	}
+	if sigCount < 0 || sigCount > keyCount {
+		return false, scriptError(ErrSigCount, "%d signatures is outside 0 to %d", sigCount, keyCount)
+	}
+	i++
+	sigIdx := i
+	i += int(sigCount)
+	if err := e.need(op, i); err != nil {
+		return false, err
+	}
+
+	scriptCode := e.script[e.codeStart:]
+	if e.sigVersion == sigVersionBase {
+		for k := 0; k < int(sigCount); k++ {
+			var found int
+			scriptCode, found = findAndDelete(scriptCode, pushData(e.stack.top(sigIdx+k)))
+			if found > 0 && e.flags&SCRIPT_VERIFY_CONST_SCRIPTCODE != 0 {
+				return false, scriptError(ErrSigFindAndDelete, "signature found in script code")
+			}
+		}
+	}
+
+	ok := true
+	keysLeft, sigsLeft := int(keyCount), int(sigCount)
+	for ok && sigsLeft > 0 {
+		sig, pubKey := e.stack.top(sigIdx), e.stack.top(keyIdx)
+
+		// Which keys get checked against which signatures can be seen from whether a malformed
+		// one fails the script, so this has to match bitcoind exactly
+		if err := checkSignatureEncoding(sig, e.flags); err != nil {
+			return false, err
+		}
+		if err := checkPubKeyEncoding(pubKey, e.flags, e.sigVersion); err != nil {
+			return false, err
+		}
+
+		if e.checker.checkECDSASignature(sig, pubKey, scriptCode, e.sigVersion) {
+			sigIdx++
+			sigsLeft--
+		}
+		keyIdx++
+		keysLeft--
+
+		// Give up once there are more signatures left than keys to match them
+		if sigsLeft > keysLeft {
+			ok = false
+		}
+	}
+
+	for ; i > 1; i-- {
+		if !ok && e.flags&SCRIPT_VERIFY_NULLFAIL != 0 && lastKeyIdx == 0 && len(e.stack.top(1)) != 0 {
+			return false, scriptError(ErrSigNullFail, "failed signature check with a non-empty signature")
+		}
+		if lastKeyIdx > 0 {
+			lastKeyIdx--
+		}
+		e.stack.pop()
+	}
+
+	// An off by one bug means an extra item is taken from the stack, and is otherwise ignored
+	if err := e.need(op, 1); err != nil {
+		return false, err
+	}
+	if e.flags&SCRIPT_VERIFY_NULLDUMMY != 0 && len(e.stack.top(1)) != 0 {
+		return false, scriptError(ErrSigNullDummy, "%s dummy argument isn't empty", OpcodeName(op))
+	}
+	e.stack.pop()
+	return ok, nil
+}
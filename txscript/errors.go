@@ -0,0 +1,161 @@
+package txscript
+
+import "fmt"
+
+// ErrorCode identifies why a script failed. They follow bitcoind's script errors.
+type ErrorCode int
+
+const (
+	ErrUnknown ErrorCode = iota
+	ErrEvalFalse
+	ErrOpReturn
+
+	// Limits
+	ErrScriptSize
+	ErrPushSize
+	ErrOpCount
+	ErrStackSize
+	ErrSigCount
+	ErrPubKeyCount
+
+	// Failed verify operations
+	ErrVerify
+	ErrEqualVerify
+	ErrCheckMultiSigVerify
+	ErrCheckSigVerify
+	ErrNumEqualVerify
+
+	// Logical and other errors
+	ErrBadOpcode
+	ErrDisabledOpcode
+	ErrInvalidStackOperation
+	ErrInvalidAltStackOperation
+	ErrUnbalancedConditional
+	ErrNumberOverflow
+	ErrMinimalNumber
+
+	// CHECKLOCKTIMEVERIFY and CHECKSEQUENCEVERIFY
+	ErrNegativeLockTime
+	ErrUnsatisfiedLockTime
+
+	// Malleability
+	ErrSigHashType
+	ErrSigDER
+	ErrMinimalData
+	ErrSigPushOnly
+	ErrSigHighS
+	ErrSigNullDummy
+	ErrPubKeyType
+	ErrCleanStack
+	ErrMinimalIf
+	ErrSigNullFail
+
+	// Soft fork safeness
+	ErrDiscourageUpgradableNops
+	ErrDiscourageUpgradableWitnessProgram
+	ErrDiscourageUpgradableTaprootVersion
+	ErrDiscourageOpSuccess
+	ErrDiscourageUpgradablePubKeyType
+
+	// Segregated witness
+	ErrWitnessProgramWrongLength
+	ErrWitnessProgramWitnessEmpty
+	ErrWitnessProgramMismatch
+	ErrWitnessMalleated
+	ErrWitnessMalleatedP2SH
+	ErrWitnessUnexpected
+	ErrWitnessPubKeyType
+
+	// Taproot
+	ErrSchnorrSigSize
+	ErrSchnorrSigHashType
+	ErrSchnorrSig
+	ErrTaprootWrongControlSize
+	ErrTapscriptValidationWeight
+	ErrTapscriptCheckMultiSig
+	ErrTapscriptMinimalIf
+	ErrTapscriptEmptyPubKey
+
+	// Constant scriptCode
+	ErrOpCodeSeparator
+	ErrSigFindAndDelete
+)
+
+var errorCodeStrings = map[ErrorCode]string{
+	ErrUnknown:                            "ErrUnknown",
+	ErrEvalFalse:                          "ErrEvalFalse",
+	ErrOpReturn:                           "ErrOpReturn",
+	ErrScriptSize:                         "ErrScriptSize",
+	ErrPushSize:                           "ErrPushSize",
+	ErrOpCount:                            "ErrOpCount",
+	ErrStackSize:                          "ErrStackSize",
+	ErrSigCount:                           "ErrSigCount",
+	ErrPubKeyCount:                        "ErrPubKeyCount",
+	ErrVerify:                             "ErrVerify",
+	ErrEqualVerify:                        "ErrEqualVerify",
+	ErrCheckMultiSigVerify:                "ErrCheckMultiSigVerify",
+	ErrCheckSigVerify:                     "ErrCheckSigVerify",
+	ErrNumEqualVerify:                     "ErrNumEqualVerify",
+	ErrBadOpcode:                          "ErrBadOpcode",
+	ErrDisabledOpcode:                     "ErrDisabledOpcode",
+	ErrInvalidStackOperation:              "ErrInvalidStackOperation",
+	ErrInvalidAltStackOperation:           "ErrInvalidAltStackOperation",
+	ErrUnbalancedConditional:              "ErrUnbalancedConditional",
+	ErrNumberOverflow:                     "ErrNumberOverflow",
+	ErrMinimalNumber:                      "ErrMinimalNumber",
+	ErrNegativeLockTime:                   "ErrNegativeLockTime",
+	ErrUnsatisfiedLockTime:                "ErrUnsatisfiedLockTime",
+	ErrSigHashType:                        "ErrSigHashType",
+	ErrSigDER:                             "ErrSigDER",
+	ErrMinimalData:                        "ErrMinimalData",
+	ErrSigPushOnly:                        "ErrSigPushOnly",
+	ErrSigHighS:                           "ErrSigHighS",
+	ErrSigNullDummy:                       "ErrSigNullDummy",
+	ErrPubKeyType:                         "ErrPubKeyType",
+	ErrCleanStack:                         "ErrCleanStack",
+	ErrMinimalIf:                          "ErrMinimalIf",
+	ErrSigNullFail:                        "ErrSigNullFail",
+	ErrDiscourageUpgradableNops:           "ErrDiscourageUpgradableNops",
+	ErrDiscourageUpgradableWitnessProgram: "ErrDiscourageUpgradableWitnessProgram",
+	ErrDiscourageUpgradableTaprootVersion: "ErrDiscourageUpgradableTaprootVersion",
+	ErrDiscourageOpSuccess:                "ErrDiscourageOpSuccess",
+	ErrDiscourageUpgradablePubKeyType:     "ErrDiscourageUpgradablePubKeyType",
+	ErrWitnessProgramWrongLength:          "ErrWitnessProgramWrongLength",
+	ErrWitnessProgramWitnessEmpty:         "ErrWitnessProgramWitnessEmpty",
+	ErrWitnessProgramMismatch:             "ErrWitnessProgramMismatch",
+	ErrWitnessMalleated:                   "ErrWitnessMalleated",
+	ErrWitnessMalleatedP2SH:               "ErrWitnessMalleatedP2SH",
+	ErrWitnessUnexpected:                  "ErrWitnessUnexpected",
+	ErrWitnessPubKeyType:                  "ErrWitnessPubKeyType",
+	ErrSchnorrSigSize:                     "ErrSchnorrSigSize",
+	ErrSchnorrSigHashType:                 "ErrSchnorrSigHashType",
+	ErrSchnorrSig:                         "ErrSchnorrSig",
+	ErrTaprootWrongControlSize:            "ErrTaprootWrongControlSize",
+	ErrTapscriptValidationWeight:          "ErrTapscriptValidationWeight",
+	ErrTapscriptCheckMultiSig:             "ErrTapscriptCheckMultiSig",
+	ErrTapscriptMinimalIf:                 "ErrTapscriptMinimalIf",
+	ErrTapscriptEmptyPubKey:               "ErrTapscriptEmptyPubKey",
+	ErrOpCodeSeparator:                    "ErrOpCodeSeparator",
+	ErrSigFindAndDelete:                   "ErrSigFindAndDelete",
+}
+
+func (e ErrorCode) String() string {
+	if s, ok := errorCodeStrings[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ErrorCode (%d)", int(e))
+}
+
+// ScriptError is returned when a script fails, saying why.
+type ScriptError struct {
+	Code        ErrorCode
+	Description string
+}
+
+func (e ScriptError) Error() string {
+	return e.Description
+}
+
+func scriptError(code ErrorCode, format string, args ...any) ScriptError {
+	return ScriptError{Code: code, Description: fmt.Sprintf(format, args...)}
+}
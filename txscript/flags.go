@@ -0,0 +1,76 @@
+package txscript
+
+// ScriptFlags select which rules scripts are checked against. Each soft fork added rules that
+// only apply from its activation on, and policy adds more that only apply to unconfirmed
+// transactions.
+type ScriptFlags uint32
+
+const (
+	// BIP16: evaluate P2SH redeem scripts.
+	SCRIPT_VERIFY_P2SH ScriptFlags = 1 << iota
+
+	// Public keys must be compressed or uncompressed, and signatures must have a defined hash
+	// type (policy).
+	SCRIPT_VERIFY_STRICTENC
+
+	// BIP66: signatures must be strict DER.
+	SCRIPT_VERIFY_DERSIG
+
+	// Signatures must have a low S (policy).
+	SCRIPT_VERIFY_LOW_S
+
+	// BIP147: CHECKMULTISIG's extra stack item must be empty.
+	SCRIPT_VERIFY_NULLDUMMY
+
+	// Signature scripts may only push data (policy).
+	SCRIPT_VERIFY_SIGPUSHONLY
+
+	// Pushes must use the smallest opcode, and numbers the smallest encoding (policy).
+	SCRIPT_VERIFY_MINIMALDATA
+
+	// Fail on the NOPs reserved for soft forks, so nodes that haven't upgraded don't relay
+	// transactions using them (policy).
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS
+
+	// Exactly one item must be left on the stack (policy; consensus for witness scripts).
+	SCRIPT_VERIFY_CLEANSTACK
+
+	// BIP65: OP_CHECKLOCKTIMEVERIFY.
+	SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY
+
+	// BIP112: OP_CHECKSEQUENCEVERIFY.
+	SCRIPT_VERIFY_CHECKSEQUENCEVERIFY
+
+	// BIP141: evaluate witness programs.
+	SCRIPT_VERIFY_WITNESS
+
+	// Fail on witness versions reserved for soft forks (policy).
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM
+
+	// OP_IF and OP_NOTIF arguments must be empty or 1 in witness v0 scripts (policy).
+	SCRIPT_VERIFY_MINIMALIF
+
+	// A failed signature check must have an empty signature (policy).
+	SCRIPT_VERIFY_NULLFAIL
+
+	// Public keys in witness v0 scripts must be compressed (policy).
+	SCRIPT_VERIFY_WITNESS_PUBKEYTYPE
+
+	// OP_CODESEPARATOR and signatures found in the script code make legacy scripts fail
+	// (policy).
+	SCRIPT_VERIFY_CONST_SCRIPTCODE
+
+	// BIP341 and BIP342: evaluate taproot outputs.
+	SCRIPT_VERIFY_TAPROOT
+
+	// Fail on unknown taproot leaf versions (policy).
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION
+
+	// Fail on OP_SUCCESSx in tapscripts (policy).
+	SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS
+
+	// Fail on tapscript public keys of unknown types (policy).
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE
+
+	SCRIPT_VERIFY_NONE ScriptFlags = 0
+)
@@ -0,0 +1,83 @@
+package txscript
+
+const (
+	// Arithmetic operands are at most this many bytes, though results may overflow it.
+	DEFAULT_NUM_SIZE = 4
+
+	// OP_CHECKLOCKTIMEVERIFY and OP_CHECKSEQUENCEVERIFY take 5 byte operands, so they can
+	// compare against the full range of a uint32.
+	LOCKTIME_NUM_SIZE = 5
+)
+
+// scriptNum is a number on the script stack. They're encoded little endian, in as few bytes as
+// possible, with the sign in the top bit of the last byte.
+type scriptNum int64
+
+// makeScriptNum decodes a number from the stack. It fails if the encoding is longer than maxSize
+// or, if requireMinimal is set, longer than it needs to be.
+func makeScriptNum(b []byte, requireMinimal bool, maxSize int) (scriptNum, error) {
+	if len(b) > maxSize {
+		return 0, scriptError(ErrNumberOverflow, "number of %d bytes is more than %d", len(b), maxSize)
+	}
+	if requireMinimal && len(b) > 0 {
+		// The last byte may only be zero, bar its sign bit, if the byte before needs its top bit
+		// for the value
+		if b[len(b)-1]&0x7f == 0 && (len(b) == 1 || b[len(b)-2]&0x80 == 0) {
+			return 0, scriptError(ErrMinimalNumber, "number %x isn't minimally encoded", b)
+		}
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, c := range b {
+		n |= int64(c) << (8 * i)
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		return -scriptNum(n &^ (0x80 << (8 * (len(b) - 1)))), nil
+	}
+	return scriptNum(n), nil
+}
+
+// Bytes returns the minimal encoding of the number.
+func (n scriptNum) Bytes() []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+
+	var b []byte
+	for abs > 0 {
+		b = append(b, byte(abs))
+		abs >>= 8
+	}
+
+	// Add a byte for the sign if the top bit is already taken
+	if b[len(b)-1]&0x80 != 0 {
+		if negative {
+			b = append(b, 0x80)
+		} else {
+			b = append(b, 0x00)
+		}
+	} else if negative {
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+// Int32 returns the number clamped to the range of an int32.
+func (n scriptNum) Int32() int32 {
+	switch {
+	case n > 1<<31-1:
+		return 1<<31 - 1
+	case n < -1<<31:
+		return -1 << 31
+	}
+	return int32(n)
+}
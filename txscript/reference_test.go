@@ -0,0 +1,467 @@
+package txscript_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pscott31/mynode/headerchain"
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/secp256k1"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file run the vectors in Bitcoin Core's src/test/data, so they can be compared
+// against its interpreter. The files in testdata are copied unmodified from Core at commit
+// 05e49b342faa, and every case in them is run.
+
+var flagNames = map[string]txscript.ScriptFlags{
+	"NONE":                                  txscript.SCRIPT_VERIFY_NONE,
+	"P2SH":                                  txscript.SCRIPT_VERIFY_P2SH,
+	"STRICTENC":                             txscript.SCRIPT_VERIFY_STRICTENC,
+	"DERSIG":                                txscript.SCRIPT_VERIFY_DERSIG,
+	"LOW_S":                                 txscript.SCRIPT_VERIFY_LOW_S,
+	"NULLDUMMY":                             txscript.SCRIPT_VERIFY_NULLDUMMY,
+	"SIGPUSHONLY":                           txscript.SCRIPT_VERIFY_SIGPUSHONLY,
+	"MINIMALDATA":                           txscript.SCRIPT_VERIFY_MINIMALDATA,
+	"DISCOURAGE_UPGRADABLE_NOPS":            txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS,
+	"CLEANSTACK":                            txscript.SCRIPT_VERIFY_CLEANSTACK,
+	"CHECKLOCKTIMEVERIFY":                   txscript.SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY,
+	"CHECKSEQUENCEVERIFY":                   txscript.SCRIPT_VERIFY_CHECKSEQUENCEVERIFY,
+	"WITNESS":                               txscript.SCRIPT_VERIFY_WITNESS,
+	"DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM": txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM,
+	"MINIMALIF":                             txscript.SCRIPT_VERIFY_MINIMALIF,
+	"NULLFAIL":                              txscript.SCRIPT_VERIFY_NULLFAIL,
+	"WITNESS_PUBKEYTYPE":                    txscript.SCRIPT_VERIFY_WITNESS_PUBKEYTYPE,
+	"CONST_SCRIPTCODE":                      txscript.SCRIPT_VERIFY_CONST_SCRIPTCODE,
+	"TAPROOT":                               txscript.SCRIPT_VERIFY_TAPROOT,
+	"DISCOURAGE_UPGRADABLE_TAPROOT_VERSION": txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION,
+	"DISCOURAGE_OP_SUCCESS":                 txscript.SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS,
+	"DISCOURAGE_UPGRADABLE_PUBKEYTYPE":      txscript.SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE,
+}
+
+// coreErrorNames are Core's names for each error. Core can't tell number encoding errors apart,
+// so they're all SCRIPTNUM.
+var coreErrorNames = map[txscript.ErrorCode]string{
+	txscript.ErrUnknown:                            "UNKNOWN_ERROR",
+	txscript.ErrNumberOverflow:                     "SCRIPTNUM",
+	txscript.ErrMinimalNumber:                      "SCRIPTNUM",
+	txscript.ErrEvalFalse:                          "EVAL_FALSE",
+	txscript.ErrOpReturn:                           "OP_RETURN",
+	txscript.ErrScriptSize:                         "SCRIPT_SIZE",
+	txscript.ErrPushSize:                           "PUSH_SIZE",
+	txscript.ErrOpCount:                            "OP_COUNT",
+	txscript.ErrStackSize:                          "STACK_SIZE",
+	txscript.ErrSigCount:                           "SIG_COUNT",
+	txscript.ErrPubKeyCount:                        "PUBKEY_COUNT",
+	txscript.ErrVerify:                             "VERIFY",
+	txscript.ErrEqualVerify:                        "EQUALVERIFY",
+	txscript.ErrCheckMultiSigVerify:                "CHECKMULTISIGVERIFY",
+	txscript.ErrCheckSigVerify:                     "CHECKSIGVERIFY",
+	txscript.ErrNumEqualVerify:                     "NUMEQUALVERIFY",
+	txscript.ErrBadOpcode:                          "BAD_OPCODE",
+	txscript.ErrDisabledOpcode:                     "DISABLED_OPCODE",
+	txscript.ErrInvalidStackOperation:              "INVALID_STACK_OPERATION",
+	txscript.ErrInvalidAltStackOperation:           "INVALID_ALTSTACK_OPERATION",
+	txscript.ErrUnbalancedConditional:              "UNBALANCED_CONDITIONAL",
+	txscript.ErrNegativeLockTime:                   "NEGATIVE_LOCKTIME",
+	txscript.ErrUnsatisfiedLockTime:                "UNSATISFIED_LOCKTIME",
+	txscript.ErrSigHashType:                        "SIG_HASHTYPE",
+	txscript.ErrSigDER:                             "SIG_DER",
+	txscript.ErrMinimalData:                        "MINIMALDATA",
+	txscript.ErrSigPushOnly:                        "SIG_PUSHONLY",
+	txscript.ErrSigHighS:                           "SIG_HIGH_S",
+	txscript.ErrSigNullDummy:                       "SIG_NULLDUMMY",
+	txscript.ErrPubKeyType:                         "PUBKEYTYPE",
+	txscript.ErrCleanStack:                         "CLEANSTACK",
+	txscript.ErrMinimalIf:                          "MINIMALIF",
+	txscript.ErrSigNullFail:                        "NULLFAIL",
+	txscript.ErrDiscourageUpgradableNops:           "DISCOURAGE_UPGRADABLE_NOPS",
+	txscript.ErrDiscourageUpgradableWitnessProgram: "DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM",
+	txscript.ErrDiscourageUpgradableTaprootVersion: "DISCOURAGE_UPGRADABLE_TAPROOT_VERSION",
+	txscript.ErrDiscourageOpSuccess:                "DISCOURAGE_OP_SUCCESS",
+	txscript.ErrDiscourageUpgradablePubKeyType:     "DISCOURAGE_UPGRADABLE_PUBKEYTYPE",
+	txscript.ErrWitnessProgramWrongLength:          "WITNESS_PROGRAM_WRONG_LENGTH",
+	txscript.ErrWitnessProgramWitnessEmpty:         "WITNESS_PROGRAM_WITNESS_EMPTY",
+	txscript.ErrWitnessProgramMismatch:             "WITNESS_PROGRAM_MISMATCH",
+	txscript.ErrWitnessMalleated:                   "WITNESS_MALLEATED",
+	txscript.ErrWitnessMalleatedP2SH:               "WITNESS_MALLEATED_P2SH",
+	txscript.ErrWitnessUnexpected:                  "WITNESS_UNEXPECTED",
+	txscript.ErrWitnessPubKeyType:                  "WITNESS_PUBKEYTYPE",
+	txscript.ErrSchnorrSigSize:                     "SCHNORR_SIG_SIZE",
+	txscript.ErrSchnorrSigHashType:                 "SCHNORR_SIG_HASHTYPE",
+	txscript.ErrSchnorrSig:                         "SCHNORR_SIG",
+	txscript.ErrTaprootWrongControlSize:            "TAPROOT_WRONG_CONTROL_SIZE",
+	txscript.ErrTapscriptValidationWeight:          "TAPSCRIPT_VALIDATION_WEIGHT",
+	txscript.ErrTapscriptCheckMultiSig:             "TAPSCRIPT_CHECKMULTISIG",
+	txscript.ErrTapscriptMinimalIf:                 "TAPSCRIPT_MINIMALIF",
+	txscript.ErrTapscriptEmptyPubKey:               "TAPSCRIPT_EMPTY_PUBKEY",
+	txscript.ErrOpCodeSeparator:                    "OP_CODESEPARATOR",
+	txscript.ErrSigFindAndDelete:                   "SIG_FINDANDDELETE",
+}
+
+var allFlags = func() txscript.ScriptFlags {
+	var flags txscript.ScriptFlags
+	for _, f := range flagNames {
+		flags |= f
+	}
+	return flags
+}()
+
+func parseFlags(t *testing.T, s string) txscript.ScriptFlags {
+	var flags txscript.ScriptFlags
+	for _, name := range strings.Split(s, ",") {
+		if name == "" {
+			continue
+		}
+		f, ok := flagNames[name]
+		require.True(t, ok, "unknown flag %s", name)
+		flags |= f
+	}
+	return flags
+}
+
+var opcodesByName = func() map[string]byte {
+	names := map[string]byte{}
+	for op := 0; op < 256; op++ {
+		name := txscript.OpcodeName(byte(op))
+		if name == "OP_UNKNOWN" || strings.HasPrefix(name, "OP_DATA_") {
+			continue
+		}
+		names[name] = byte(op)
+		names[strings.TrimPrefix(name, "OP_")] = byte(op)
+	}
+	names["NOP2"], names["OP_NOP2"] = txscript.OP_NOP2, txscript.OP_NOP2
+	names["NOP3"], names["OP_NOP3"] = txscript.OP_NOP3, txscript.OP_NOP3
+	return names
+}()
+
+// parseScript assembles a script written as Core's tests write them: decimal numbers are pushed,
+// 0x-prefixed hex is inserted as is, quoted strings are pushed and anything else is an opcode.
+func parseScript(t *testing.T, asm string) []byte {
+	var script []byte
+	for _, word := range strings.Fields(asm) {
+		if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+			switch {
+			case n == 0:
+				script = append(script, txscript.OP_0)
+			case n == -1 || (n >= 1 && n <= 16):
+				script = append(script, byte(txscript.OP_1+n-1))
+			default:
+				script = append(script, pushBytes(scriptNumBytes(n))...)
+			}
+			continue
+		}
+		if strings.HasPrefix(word, "0x") {
+			b, err := hex.DecodeString(word[2:])
+			require.NoError(t, err, "bad hex %s", word)
+			script = append(script, b...)
+			continue
+		}
+		if len(word) >= 2 && word[0] == '\'' && word[len(word)-1] == '\'' {
+			script = append(script, pushBytes([]byte(word[1:len(word)-1]))...)
+			continue
+		}
+		op, ok := opcodesByName[word]
+		require.True(t, ok, "unknown opcode %s", word)
+		script = append(script, op)
+	}
+	return script
+}
+
+func scriptNumBytes(n int64) []byte {
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append(b, byte(n))
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		b = append(b, 0)
+	}
+	if negative {
+		b[len(b)-1] |= 0x80
+	}
+	return b
+}
+
+func pushBytes(b []byte) []byte {
+	switch {
+	case len(b) < txscript.OP_PUSHDATA1:
+		return append([]byte{byte(len(b))}, b...)
+	case len(b) <= 0xff:
+		return append([]byte{txscript.OP_PUSHDATA1, byte(len(b))}, b...)
+	default:
+		return append([]byte{txscript.OP_PUSHDATA2, byte(len(b)), byte(len(b) >> 8)}, b...)
+	}
+}
+
+// checkError compares an error with the name Core gives it.
+func checkError(t *testing.T, expected string, err error, msgAndArgs ...any) {
+	if expected == "OK" {
+		assert.NoError(t, err, msgAndArgs...)
+		return
+	}
+	var scriptErr txscript.ScriptError
+	if !assert.True(t, errors.As(err, &scriptErr), "expected %s, got %v", expected, err) {
+		return
+	}
+	assert.Equal(t, expected, coreErrorNames[scriptErr.Code], "%s: %v", scriptErr.Code, err)
+}
+
+// loadVectors reads a file of Core test vectors, leaving out the single string comments.
+func loadVectors(t *testing.T, path string) [][]any {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entries [][]any
+	require.NoError(t, json.Unmarshal(data, &entries))
+
+	var vectors [][]any
+	for _, e := range entries {
+		if len(e) == 1 {
+			continue
+		}
+		vectors = append(vectors, e)
+	}
+	return vectors
+}
+
+// creditingTx and spendingTx are the transactions Core's script tests run in. The spending
+// transaction's only input spends the crediting transaction's only output.
+func creditingTx(pkScript []byte, amount int64) proto.Tx {
+	return proto.Tx{
+		Version: 1,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Index: math.MaxUint32},
+			SignatureScript:  []byte{txscript.OP_0, txscript.OP_0},
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{{Value: amount, PkScript: pkScript}},
+	}
+}
+
+func spendingTx(sigScript []byte, witness proto.TxWitness, credit proto.Tx) proto.Tx {
+	return proto.Tx{
+		Version: 1,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Hash: credit.TxHash(), Index: 0},
+			SignatureScript:  sigScript,
+			Witness:          witness,
+			Sequence:         proto.MAX_TX_IN_SEQUENCE,
+		}},
+		TxOut: []proto.TxOut{{Value: credit.TxOut[0].Value, PkScript: []byte{}}},
+	}
+}
+
+// taprootScriptSpend returns the output key of a script tree holding just the given tapscript,
+// and the control block to spend it, with the internal key Core's tests use.
+func taprootScriptSpend(t *testing.T, script []byte) ([]byte, []byte) {
+	key, err := secp256k1.NewPrivateKey(append(make([]byte, 31), 1))
+	require.NoError(t, err)
+	internalKey, err := secp256k1.ParseXOnlyPubKey(key.PubKey().SerializeXOnly())
+	require.NoError(t, err)
+
+	var leaf bytes.Buffer
+	leaf.WriteByte(txscript.TAPROOT_LEAF_TAPSCRIPT)
+	require.NoError(t, proto.VarInt(len(script)).MarshalToWriter(&leaf))
+	leaf.Write(script)
+	leafHash := secp256k1.TaggedHash("TapLeaf", leaf.Bytes())
+	tweak := secp256k1.TaggedHash("TapTweak", internalKey.SerializeXOnly(), leafHash[:])
+	outputKey, err := internalKey.AddTweak(tweak[:])
+	require.NoError(t, err)
+
+	control := append([]byte{txscript.TAPROOT_LEAF_TAPSCRIPT}, internalKey.SerializeXOnly()...)
+	if outputKey.HasOddY() {
+		control[0] |= 1
+	}
+	return outputKey.SerializeXOnly(), control
+}
+
+func TestScriptTests(t *testing.T) {
+	for i, v := range loadVectors(t, "testdata/script_tests.json") {
+		var witness proto.TxWitness
+		var amount int64
+		var taprootOutput []byte
+		if items, ok := v[0].([]any); ok {
+			for _, item := range items[:len(items)-1] {
+				switch item := item.(string); {
+				case strings.HasPrefix(item, "#SCRIPT#"):
+					witness = append(witness, parseScript(t, strings.TrimPrefix(item, "#SCRIPT#")))
+				case item == "#CONTROLBLOCK#":
+					var control []byte
+					taprootOutput, control = taprootScriptSpend(t, witness[len(witness)-1])
+					witness = append(witness, control)
+				default:
+					b, err := hex.DecodeString(item)
+					require.NoError(t, err)
+					witness = append(witness, b)
+				}
+			}
+			amount = int64(math.Round(items[len(items)-1].(float64) * 1e8))
+			v = v[1:]
+		}
+		name := fmt.Sprintf("%d", i)
+		if len(v) > 4 {
+			name = fmt.Sprintf("%d %s", i, v[4])
+		}
+
+		t.Run(name, func(t *testing.T) {
+			sigScript := parseScript(t, v[0].(string))
+			// Core's tests can ask for the output of the script tree in the witness
+			var pkScript []byte
+			if v[1] == "0x51 0x20 #TAPROOTOUTPUT#" {
+				pkScript = append([]byte{txscript.OP_1, 32}, taprootOutput...)
+			} else {
+				pkScript = parseScript(t, v[1].(string))
+			}
+			flags := parseFlags(t, v[2].(string))
+
+			credit := creditingTx(pkScript, amount)
+			tx := spendingTx(sigScript, witness, credit)
+			err := txscript.VerifyScript(&tx, 0, credit.TxOut, flags, nil)
+			checkError(t, v[3].(string), err, "%s | %s | %s", v[0], v[1], v[2])
+		})
+	}
+}
+
+// txVector is a transaction from tx_valid.json or tx_invalid.json, with the outputs it spends.
+type txVector struct {
+	tx       proto.Tx
+	prevOuts []proto.TxOut
+	flags    string
+}
+
+func parseTxVector(t *testing.T, v []any) txVector {
+	prevOuts := map[proto.OutPoint]proto.TxOut{}
+	for _, p := range v[0].([]any) {
+		p := p.([]any)
+		hash, err := proto.NewHashFromStr(p[0].(string))
+		require.NoError(t, err)
+		// Core writes an index of -1 for the null outpoint
+		outPoint := proto.OutPoint{Hash: hash, Index: uint32(int64(p[1].(float64)))}
+		out := proto.TxOut{PkScript: parseScript(t, p[2].(string))}
+		if len(p) > 3 {
+			out.Value = int64(p[3].(float64))
+		}
+		prevOuts[outPoint] = out
+	}
+
+	raw, err := hex.DecodeString(v[1].(string))
+	require.NoError(t, err)
+	vec := txVector{flags: v[2].(string)}
+	require.NoError(t, vec.tx.UnmarshalFromReader(bytes.NewReader(raw)))
+	for _, in := range vec.tx.TxIn {
+		out, ok := prevOuts[in.PreviousOutPoint]
+		require.True(t, ok, "no previous output for %s", in.PreviousOutPoint)
+		vec.prevOuts = append(vec.prevOuts, out)
+	}
+	return vec
+}
+
+// verify runs the scripts of each of the transaction's inputs, stopping at the first to fail.
+func (vec txVector) verify(flags txscript.ScriptFlags) error {
+	midstate := proto.NewSigHashMidstate(vec.tx, vec.prevOuts)
+	for idx := range vec.tx.TxIn {
+		if err := txscript.VerifyScript(&vec.tx, idx, vec.prevOuts, flags, midstate); err != nil {
+			return fmt.Errorf("input %d: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// trimFlags and fillFlags make a set of flags valid, as WITNESS needs P2SH and CLEANSTACK needs
+// WITNESS, by taking away or adding the flags they depend on.
+func trimFlags(flags txscript.ScriptFlags) txscript.ScriptFlags {
+	if flags&txscript.SCRIPT_VERIFY_P2SH == 0 {
+		flags &^= txscript.SCRIPT_VERIFY_WITNESS
+	}
+	if flags&txscript.SCRIPT_VERIFY_WITNESS == 0 {
+		flags &^= txscript.SCRIPT_VERIFY_CLEANSTACK
+	}
+	return flags
+}
+
+func fillFlags(flags txscript.ScriptFlags) txscript.ScriptFlags {
+	if flags&txscript.SCRIPT_VERIFY_CLEANSTACK != 0 {
+		flags |= txscript.SCRIPT_VERIFY_WITNESS
+	}
+	if flags&txscript.SCRIPT_VERIFY_WITNESS != 0 {
+		flags |= txscript.SCRIPT_VERIFY_P2SH
+	}
+	return flags
+}
+
+// excludeIndividualFlags returns each different valid set of flags made by taking one away.
+func excludeIndividualFlags(flags txscript.ScriptFlags) map[txscript.ScriptFlags]struct{} {
+	combos := map[txscript.ScriptFlags]struct{}{}
+	for _, f := range flagNames {
+		if excluding := trimFlags(flags &^ f); excluding != flags {
+			combos[excluding] = struct{}{}
+		}
+	}
+	return combos
+}
+
+// TestTxValid checks each transaction passes with every flag but the ones it lists, and with any
+// fewer. Like Core, it also checks the list is as short as it can be, so it fails with any of
+// them put back.
+func TestTxValid(t *testing.T) {
+	for i, v := range loadVectors(t, "testdata/tx_valid.json") {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			vec := parseTxVector(t, v)
+			require.NoError(t, headerchain.CheckTransactionSanity(&vec.tx))
+			excluded := parseFlags(t, vec.flags)
+			require.Equal(t, fillFlags(allFlags&^excluded), allFlags&^excluded, "bad flags %s", vec.flags)
+
+			assert.NoError(t, vec.verify(allFlags&^excluded))
+			for name, f := range flagNames {
+				assert.NoError(t, vec.verify(trimFlags(allFlags&^(excluded|f))), "without %s", name)
+			}
+			for flags := range excludeIndividualFlags(excluded) {
+				assert.Error(t, vec.verify(allFlags&^flags), "too many flags excluded: %s", vec.flags)
+			}
+		})
+	}
+}
+
+// TestTxInvalid checks each transaction fails with the flags it lists, and with any more, unless
+// it's BADTX, which is one that fails the sanity checks before its scripts are run. Like Core,
+// it also checks the list is as short as it can be, so it passes with any of them taken away.
+func TestTxInvalid(t *testing.T) {
+	for i, v := range loadVectors(t, "testdata/tx_invalid.json") {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			vec := parseTxVector(t, v)
+			if err := headerchain.CheckTransactionSanity(&vec.tx); err != nil {
+				assert.Equal(t, "BADTX", vec.flags, "%v", err)
+				return
+			}
+			flags := parseFlags(t, vec.flags)
+			require.Equal(t, fillFlags(flags), flags, "bad flags %s", vec.flags)
+
+			checkInvalid := func(err error, msgAndArgs ...any) {
+				var scriptErr txscript.ScriptError
+				if assert.Error(t, err, msgAndArgs...) {
+					assert.True(t, errors.As(err, &scriptErr), "%v", err)
+				}
+			}
+			checkInvalid(vec.verify(flags))
+			for name, f := range flagNames {
+				checkInvalid(vec.verify(fillFlags(flags|f)), "with %s", name)
+			}
+			for excluding := range excludeIndividualFlags(flags) {
+				assert.NoError(t, vec.verify(excluding), "too many flags: %s", vec.flags)
+			}
+		})
+	}
+}
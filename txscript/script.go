@@ -0,0 +1,203 @@
+// Package txscript evaluates bitcoin scripts, checking that a transaction's inputs satisfy the
+// conditions of the outputs they spend. It covers legacy scripts, P2SH, segwit v0 and taproot,
+// following bitcoind's interpreter rule for rule.
+package txscript
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// Consensus limits
+	MAX_SCRIPT_ELEMENT_SIZE  = 520 // bytes pushed to the stack
+	MAX_OPS_PER_SCRIPT       = 201 // non-push opcodes executed
+	MAX_PUBKEYS_PER_MULTISIG = 20
+	MAX_SCRIPT_SIZE          = 10_000
+	MAX_STACK_SIZE           = 1000 // stack and alt stack together
+
+	// BIP141 witness programs
+	WITNESS_V0_KEYHASH_SIZE    = 20
+	WITNESS_V0_SCRIPTHASH_SIZE = 32
+	WITNESS_V1_TAPROOT_SIZE    = 32
+
+	// BIP341: a control block is a leaf version and parity byte, the internal key, then the
+	// merkle path.
+	TAPROOT_LEAF_MASK              = 0xfe
+	TAPROOT_LEAF_TAPSCRIPT         = 0xc0
+	TAPROOT_CONTROL_BASE_SIZE      = 33
+	TAPROOT_CONTROL_NODE_SIZE      = 32
+	TAPROOT_CONTROL_MAX_NODE_COUNT = 128
+	TAPROOT_CONTROL_MAX_SIZE       = TAPROOT_CONTROL_BASE_SIZE + TAPROOT_CONTROL_NODE_SIZE*TAPROOT_CONTROL_MAX_NODE_COUNT
+
+	// BIP341: if the last witness item starts with this, it's an annex rather than part of the
+	// spend.
+	ANNEX_TAG = 0x50
+
+	// BIP342: each signature check uses up this much of the budget, which starts at the size of
+	// the witness plus the offset.
+	VALIDATION_WEIGHT_PER_SIGOP_PASSED = 50
+	VALIDATION_WEIGHT_OFFSET           = 50
+)
+
+// getOp reads the opcode at pc, and the data it pushes if it's a push. It returns the position of
+// the next opcode, and false if the push runs off the end of the script.
+func getOp(script []byte, pc int) (op byte, data []byte, next int, ok bool) {
+	op = script[pc]
+	pc++
+
+	var size int
+	switch {
+	case op < OP_PUSHDATA1:
+		size = int(op)
+	case op == OP_PUSHDATA1:
+		if len(script)-pc < 1 {
+			return op, nil, len(script), false
+		}
+		size = int(script[pc])
+		pc++
+	case op == OP_PUSHDATA2:
+		if len(script)-pc < 2 {
+			return op, nil, len(script), false
+		}
+		size = int(binary.LittleEndian.Uint16(script[pc:]))
+		pc += 2
+	case op == OP_PUSHDATA4:
+		if len(script)-pc < 4 {
+			return op, nil, len(script), false
+		}
+		size = int(binary.LittleEndian.Uint32(script[pc:]))
+		pc += 4
+	default:
+		return op, nil, pc, true
+	}
+
+	if size > len(script)-pc {
+		return op, nil, len(script), false
+	}
+	return op, script[pc : pc+size], pc + size, true
+}
+
+// IsPushOnly reports whether the script only pushes data. OP_RESERVED counts as a push here, as
+// it does in bitcoind, though executing it fails.
+func IsPushOnly(script []byte) bool {
+	for pc := 0; pc < len(script); {
+		op, _, next, ok := getOp(script, pc)
+		if !ok || op > OP_16 {
+			return false
+		}
+		pc = next
+	}
+	return true
+}
+
+// IsPayToScriptHash reports whether the script is the BIP16 template
+// OP_HASH160 <20 bytes> OP_EQUAL.
+func IsPayToScriptHash(script []byte) bool {
+	return len(script) == 23 && script[0] == OP_HASH160 && script[1] == 0x14 && script[22] == OP_EQUAL
+}
+
+// IsWitnessProgram reports whether the script is a BIP141 witness program, a version opcode
+// followed by a single push of 2 to 40 bytes, and returns the version and program.
+func IsWitnessProgram(script []byte) (version int, program []byte, ok bool) {
+	if len(script) < 4 || len(script) > 42 {
+		return 0, nil, false
+	}
+	if script[0] != OP_0 && (script[0] < OP_1 || script[0] > OP_16) {
+		return 0, nil, false
+	}
+	if int(script[1])+2 != len(script) {
+		return 0, nil, false
+	}
+	return decodeOpN(script[0]), script[2:], true
+}
+
+// decodeOpN returns the number an OP_0 or OP_1 to OP_16 pushes.
+func decodeOpN(op byte) int {
+	if op == OP_0 {
+		return 0
+	}
+	return int(op) - (OP_1 - 1)
+}
+
+// isMinimalPush reports whether data was pushed with the smallest possible opcode.
+func isMinimalPush(op byte, data []byte) bool {
+	switch {
+	case len(data) == 0:
+		return op == OP_0
+	case len(data) == 1 && data[0] >= 1 && data[0] <= 16:
+		return op == OP_1+data[0]-1
+	case len(data) == 1 && data[0] == 0x81:
+		return op == OP_1NEGATE
+	case len(data) <= 75:
+		return int(op) == len(data)
+	case len(data) <= 255:
+		return op == OP_PUSHDATA1
+	case len(data) <= 65535:
+		return op == OP_PUSHDATA2
+	}
+	return true
+}
+
+// pushData returns the script that pushes data, using the same encoding a signature would have in
+// a script, for finding and deleting it.
+func pushData(data []byte) []byte {
+	var b []byte
+	switch {
+	case len(data) < OP_PUSHDATA1:
+		b = append(b, byte(len(data)))
+	case len(data) <= 0xff:
+		b = append(b, OP_PUSHDATA1, byte(len(data)))
+	case len(data) <= 0xffff:
+		b = append(b, OP_PUSHDATA2)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+	default:
+		b = append(b, OP_PUSHDATA4)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	}
+	return append(b, data...)
+}
+
+// findAndDelete removes every occurrence of pattern that starts on an opcode boundary from the
+// script, as legacy signature checks do with the signature, and returns how many it removed.
+func findAndDelete(script, pattern []byte) ([]byte, int) {
+	if len(pattern) == 0 {
+		return script, 0
+	}
+
+	var result []byte
+	found := 0
+	start := 0
+	for pc := 0; pc < len(script); {
+		result = append(result, script[start:pc]...)
+		for len(script)-pc >= len(pattern) && bytes.Equal(script[pc:pc+len(pattern)], pattern) {
+			pc += len(pattern)
+			found++
+		}
+		start = pc
+		if pc == len(script) {
+			break
+		}
+		_, _, next, ok := getOp(script, pc)
+		if !ok {
+			pc = len(script)
+			break
+		}
+		pc = next
+	}
+	if found == 0 {
+		return script, 0
+	}
+	return append(result, script[start:]...), found
+}
+
+// castToBool reads a stack item as a boolean: false if it's all zeros, allowing for negative
+// zero.
+func castToBool(b []byte) bool {
+	for i, c := range b {
+		if c != 0 {
+			return !(i == len(b)-1 && c == 0x80)
+		}
+	}
+	return false
+}
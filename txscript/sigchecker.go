@@ -0,0 +1,124 @@
+package txscript
+
+import (
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/secp256k1"
+)
+
+// execData is what's known about a witness spend beyond the script being run, which taproot
+// signatures commit to.
+type execData struct {
+	annexPresent bool
+	annexHash    proto.Hash // SHA256 of the length-prefixed annex
+
+	tapLeafHash proto.Hash
+	codeSepPos  uint32 // Position of the last OP_CODESEPARATOR executed, or 0xffffffff
+
+	validationWeightLeft int64
+}
+
+// sigChecker checks signatures and lock times against the input being verified.
+type sigChecker struct {
+	tx       *proto.Tx
+	idx      int
+	prevOuts []proto.TxOut
+	midstate *proto.SigHashMidstate
+}
+
+// checkECDSASignature reports whether sig, with its hash type on the end, is a valid signature
+// by pubKey of the input under the given script code.
+func (c *sigChecker) checkECDSASignature(sig, pubKey, scriptCode []byte, sigVersion sigVersion) bool {
+	pub, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	if len(sig) == 0 {
+		return false
+	}
+	hashType := proto.SigHashType(sig[len(sig)-1])
+	parsed, err := secp256k1.ParseDERSignature(sig[:len(sig)-1])
+	if err != nil {
+		return false
+	}
+
+	var hash proto.Hash
+	if sigVersion == sigVersionWitnessV0 {
+		hash = c.tx.WitnessSignatureHash(scriptCode, hashType, c.idx, c.prevOuts[c.idx].Value, c.midstate)
+	} else {
+		hash = c.tx.SignatureHash(removeCodeSeparators(scriptCode), hashType, c.idx)
+	}
+	return parsed.Verify(hash[:], pub)
+}
+
+// checkSchnorrSignature checks a BIP340 signature by an x-only pubKey of the input, failing with
+// the reason if it isn't valid.
+func (c *sigChecker) checkSchnorrSignature(sig, pubKey []byte, sigVersion sigVersion, exec *execData) error {
+	if len(sig) != secp256k1.SCHNORR_SIGNATURE_LEN && len(sig) != secp256k1.SCHNORR_SIGNATURE_LEN+1 {
+		return scriptError(ErrSchnorrSigSize, "schnorr signature has length %d", len(sig))
+	}
+	hashType := proto.SIGHASH_DEFAULT
+	if len(sig) == secp256k1.SCHNORR_SIGNATURE_LEN+1 {
+		hashType = proto.SigHashType(sig[len(sig)-1])
+		sig = sig[:len(sig)-1]
+		if hashType == proto.SIGHASH_DEFAULT {
+			return scriptError(ErrSchnorrSigHashType, "schnorr signature has an explicit default hash type")
+		}
+	}
+
+	spend := proto.TaprootSpend{
+		AnnexPresent: exec.annexPresent,
+		AnnexHash:    exec.annexHash,
+		ScriptPath:   sigVersion == sigVersionTapscript,
+		TapLeafHash:  exec.tapLeafHash,
+		CodeSepPos:   exec.codeSepPos,
+	}
+	hash, err := c.tx.TaprootSignatureHash(hashType, c.idx, c.prevOuts, spend, c.midstate)
+	if err != nil {
+		return scriptError(ErrSchnorrSigHashType, "schnorr signature has hash type %#x", uint32(hashType))
+	}
+
+	pub, err := secp256k1.ParseXOnlyPubKey(pubKey)
+	if err != nil || !secp256k1.VerifySchnorr(pub, hash[:], sig) {
+		return scriptError(ErrSchnorrSig, "invalid schnorr signature")
+	}
+	return nil
+}
+
+// checkLockTime reports whether the transaction's lock time satisfies OP_CHECKLOCKTIMEVERIFY's
+// argument.
+func (c *sigChecker) checkLockTime(lockTime scriptNum) bool {
+	// Heights and times can't be compared
+	txLockTime := scriptNum(c.tx.LockTime)
+	if (txLockTime < proto.LOCKTIME_THRESHOLD) != (lockTime < proto.LOCKTIME_THRESHOLD) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+
+	// The lock time is ignored if the input is final, so it must not be
+	return c.tx.TxIn[c.idx].Sequence != proto.MAX_TX_IN_SEQUENCE
+}
+
+// checkSequence reports whether the input's relative lock time satisfies
+// OP_CHECKSEQUENCEVERIFY's argument.
+func (c *sigChecker) checkSequence(sequence scriptNum) bool {
+	// Relative lock times only apply from version 2 on, and not if they're disabled
+	txSequence := int64(c.tx.TxIn[c.idx].Sequence)
+	if uint32(c.tx.Version) < 2 {
+		return false
+	}
+	if txSequence&proto.SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return false
+	}
+
+	const mask = proto.SEQUENCE_LOCKTIME_TYPE_FLAG | proto.SEQUENCE_LOCKTIME_MASK
+	txMasked := txSequence & mask
+	masked := int64(sequence) & mask
+
+	// Blocks and times can't be compared
+	if (txMasked < proto.SEQUENCE_LOCKTIME_TYPE_FLAG) != (masked < proto.SEQUENCE_LOCKTIME_TYPE_FLAG) {
+		return false
+	}
+	return masked <= txMasked
+}
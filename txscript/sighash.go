@@ -0,0 +1,47 @@
+package txscript
+
+import (
+	"io"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+// sigVersion says which rules a script is evaluated under, which changes how signatures are
+// hashed and checked.
+type sigVersion int
+
+const (
+	sigVersionBase      sigVersion = iota // Legacy and P2SH scripts
+	sigVersionWitnessV0                   // BIP143
+	sigVersionTaproot                     // BIP341 key path
+	sigVersionTapscript                   // BIP342 script path
+)
+
+// removeCodeSeparators returns the script without any OP_CODESEPARATORs, which are never signed.
+func removeCodeSeparators(script []byte) []byte {
+	var result []byte
+	found := false
+	start := 0
+	for pc := 0; pc < len(script); {
+		op, _, next, ok := getOp(script, pc)
+		if !ok {
+			break
+		}
+		if op == OP_CODESEPARATOR {
+			result = append(result, script[start:pc]...)
+			start = next
+			found = true
+		}
+		pc = next
+	}
+	if !found {
+		return script
+	}
+	return append(result, script[start:]...)
+}
+
+// writeVarBytes writes a byte slice preceded by its length, as scripts are serialized.
+func writeVarBytes(w io.Writer, b []byte) {
+	proto.VarInt(len(b)).MarshalToWriter(w)
+	w.Write(b)
+}
@@ -0,0 +1,91 @@
+package txscript
+
+import "github.com/pscott31/mynode/proto"
+
+// CountSigOps counts the signature checks in a script, which blocks are limited in. Legacy
+// counting charges every CHECKMULTISIG the maximum of 20; accurate counting, used for P2SH redeem
+// scripts and witness scripts, charges the number of keys pushed just before it. Counting stops at
+// a push that runs off the end of the script.
+func CountSigOps(script []byte, accurate bool) int {
+	count := 0
+	var lastOp byte = OP_INVALIDOPCODE
+	for pc := 0; pc < len(script); {
+		op, _, next, ok := getOp(script, pc)
+		if !ok {
+			break
+		}
+		switch op {
+		case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+			count++
+		case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+			if accurate && lastOp >= OP_1 && lastOp <= OP_16 {
+				count += decodeOpN(lastOp)
+			} else {
+				count += MAX_PUBKEYS_PER_MULTISIG
+			}
+		}
+		lastOp = op
+		pc = next
+	}
+	return count
+}
+
+// lastPush returns the data last pushed by a script, and false if the script does anything besides
+// pushing data.
+func lastPush(script []byte) ([]byte, bool) {
+	var data []byte
+	for pc := 0; pc < len(script); {
+		op, push, next, ok := getOp(script, pc)
+		if !ok || op > OP_16 {
+			return nil, false
+		}
+		data = push
+		pc = next
+	}
+	return data, true
+}
+
+// CountP2SHSigOps counts the signature checks in the redeem script of a P2SH spend, accurately. It's
+// zero if pkScript isn't P2SH.
+func CountP2SHSigOps(sigScript, pkScript []byte) int {
+	if !IsPayToScriptHash(pkScript) {
+		return 0
+	}
+	redeemScript, ok := lastPush(sigScript)
+	if !ok {
+		return 0
+	}
+	return CountSigOps(redeemScript, true)
+}
+
+// CountWitnessSigOps counts the signature checks in a segwit v0 spend, either native or nested in
+// P2SH. Taproot spends aren't counted here, as BIP342 budgets them by witness size instead.
+func CountWitnessSigOps(sigScript, pkScript []byte, witness proto.TxWitness, flags ScriptFlags) int {
+	if flags&SCRIPT_VERIFY_WITNESS == 0 {
+		return 0
+	}
+
+	if version, program, ok := IsWitnessProgram(pkScript); ok {
+		return witnessSigOps(version, program, witness)
+	}
+	if IsPayToScriptHash(pkScript) && IsPushOnly(sigScript) {
+		redeemScript, _ := lastPush(sigScript)
+		if version, program, ok := IsWitnessProgram(redeemScript); ok {
+			return witnessSigOps(version, program, witness)
+		}
+	}
+	return 0
+}
+
+func witnessSigOps(version int, program []byte, witness proto.TxWitness) int {
+	if version != 0 {
+		return 0
+	}
+	switch {
+	case len(program) == WITNESS_V0_KEYHASH_SIZE:
+		return 1
+	case len(program) == WITNESS_V0_SCRIPTHASH_SIZE && len(witness) > 0:
+		return CountSigOps(witness[len(witness)-1], true)
+	}
+	return 0
+}
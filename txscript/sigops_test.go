@@ -0,0 +1,56 @@
+package txscript_test
+
+import (
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/txscript"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountSigOps(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   []byte
+		legacy   int
+		accurate int
+	}{
+		{"empty", nil, 0, 0},
+		{"checksig", []byte{txscript.OP_DUP, txscript.OP_CHECKSIG, txscript.OP_CHECKSIGVERIFY}, 2, 2},
+		{"multisig", []byte{txscript.OP_1, 0x01, 0x00, txscript.OP_3, txscript.OP_CHECKMULTISIG}, 20, 3},
+		{"multisig without a key count", []byte{0x01, 0x03, txscript.OP_CHECKMULTISIGVERIFY}, 20, 20},
+		{"pushed opcodes don't count", []byte{0x01, txscript.OP_CHECKSIG}, 0, 0},
+		{"stops at a bad push", []byte{txscript.OP_CHECKSIG, txscript.OP_PUSHDATA1}, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.legacy, txscript.CountSigOps(tt.script, false))
+			assert.Equal(t, tt.accurate, txscript.CountSigOps(tt.script, true))
+		})
+	}
+}
+
+func TestCountWitnessSigOps(t *testing.T) {
+	witnessScript := []byte{txscript.OP_2, txscript.OP_2, txscript.OP_CHECKMULTISIG}
+	scriptHash := make([]byte, 32)
+	p2wsh := append([]byte{txscript.OP_0, 0x20}, scriptHash...)
+	p2wpkh := append([]byte{txscript.OP_0, 0x14}, make([]byte, 20)...)
+	p2sh := append([]byte{txscript.OP_HASH160, 0x14}, make([]byte, 20)...)
+	p2sh = append(p2sh, txscript.OP_EQUAL)
+	taproot := append([]byte{txscript.OP_1, 0x20}, make([]byte, 32)...)
+	witness := proto.TxWitness{{}, witnessScript}
+	flags := txscript.SCRIPT_VERIFY_P2SH | txscript.SCRIPT_VERIFY_WITNESS
+
+	assert.Equal(t, 1, txscript.CountWitnessSigOps(nil, p2wpkh, witness, flags))
+	assert.Equal(t, 2, txscript.CountWitnessSigOps(nil, p2wsh, witness, flags))
+	assert.Equal(t, 0, txscript.CountWitnessSigOps(nil, p2wsh, nil, flags))
+	assert.Equal(t, 0, txscript.CountWitnessSigOps(nil, taproot, witness, flags))
+	assert.Equal(t, 0, txscript.CountWitnessSigOps(nil, p2wsh, witness, txscript.SCRIPT_VERIFY_P2SH))
+
+	// Nested in P2SH, the redeem script is the witness program
+	sigScript := append([]byte{byte(len(p2wpkh))}, p2wpkh...)
+	assert.Equal(t, 1, txscript.CountWitnessSigOps(sigScript, p2sh, witness, flags))
+	assert.Equal(t, 0, txscript.CountP2SHSigOps(sigScript, p2sh))
+	assert.Equal(t, 0, txscript.CountWitnessSigOps(append([]byte{txscript.OP_NOP}, sigScript...), p2sh, witness, flags))
+}
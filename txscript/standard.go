@@ -0,0 +1,120 @@
+package txscript
+
+import "fmt"
+
+// ScriptClass is the template an output script follows, if any. Nodes only relay transactions
+// whose outputs follow one of the templates they know, so anything unusual has to be mined
+// directly.
+type ScriptClass int
+
+const (
+	NONSTANDARD_TY           ScriptClass = iota
+	PUBKEY_TY                            // <pubkey> OP_CHECKSIG
+	PUBKEY_HASH_TY                       // OP_DUP OP_HASH160 <20 bytes> OP_EQUALVERIFY OP_CHECKSIG
+	SCRIPT_HASH_TY                       // BIP16: OP_HASH160 <20 bytes> OP_EQUAL
+	MULTISIG_TY                          // OP_m <pubkeys> OP_n OP_CHECKMULTISIG
+	NULL_DATA_TY                         // OP_RETURN followed by pushes
+	WITNESS_V0_KEYHASH_TY                // BIP141: OP_0 <20 bytes>
+	WITNESS_V0_SCRIPTHASH_TY             // BIP141: OP_0 <32 bytes>
+	WITNESS_V1_TAPROOT_TY                // BIP341: OP_1 <32 bytes>
+	WITNESS_UNKNOWN_TY                   // A witness program of a version reserved for soft forks
+)
+
+var scriptClassStrings = map[ScriptClass]string{
+	NONSTANDARD_TY:           "nonstandard",
+	PUBKEY_TY:                "pubkey",
+	PUBKEY_HASH_TY:           "pubkeyhash",
+	SCRIPT_HASH_TY:           "scripthash",
+	MULTISIG_TY:              "multisig",
+	NULL_DATA_TY:             "nulldata",
+	WITNESS_V0_KEYHASH_TY:    "witness_v0_keyhash",
+	WITNESS_V0_SCRIPTHASH_TY: "witness_v0_scripthash",
+	WITNESS_V1_TAPROOT_TY:    "witness_v1_taproot",
+	WITNESS_UNKNOWN_TY:       "witness_unknown",
+}
+
+func (c ScriptClass) String() string {
+	if s, ok := scriptClassStrings[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ScriptClass (%d)", int(c))
+}
+
+// GetScriptClass works out which template an output script follows, as bitcoind's Solver does.
+func GetScriptClass(script []byte) ScriptClass {
+	if version, program, ok := IsWitnessProgram(script); ok {
+		switch {
+		case version == 0 && len(program) == WITNESS_V0_KEYHASH_SIZE:
+			return WITNESS_V0_KEYHASH_TY
+		case version == 0 && len(program) == WITNESS_V0_SCRIPTHASH_SIZE:
+			return WITNESS_V0_SCRIPTHASH_TY
+		case version == 1 && len(program) == WITNESS_V1_TAPROOT_SIZE:
+			return WITNESS_V1_TAPROOT_TY
+		case version != 0:
+			return WITNESS_UNKNOWN_TY
+		}
+		return NONSTANDARD_TY
+	}
+
+	switch {
+	case IsPayToScriptHash(script):
+		return SCRIPT_HASH_TY
+	case isPayToPubKeyHash(script):
+		return PUBKEY_HASH_TY
+	case isPayToPubKey(script):
+		return PUBKEY_TY
+	case len(script) > 0 && script[0] == OP_RETURN && IsPushOnly(script[1:]):
+		return NULL_DATA_TY
+	}
+	if _, _, ok := ParseMultisig(script); ok {
+		return MULTISIG_TY
+	}
+	return NONSTANDARD_TY
+}
+
+func isPayToPubKeyHash(script []byte) bool {
+	return len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 0x14 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG
+}
+
+func isPayToPubKey(script []byte) bool {
+	if len(script) < 2 || script[len(script)-1] != OP_CHECKSIG {
+		return false
+	}
+	op, pubKey, next, ok := getOp(script, 0)
+	return ok && next == len(script)-1 && op == byte(len(pubKey)) && isCompressedOrUncompressedPubKey(pubKey)
+}
+
+// ParseMultisig returns how many signatures a bare multisig script needs, m, out of how many
+// public keys, n. ok is false if the script isn't OP_m <pubkeys> OP_n OP_CHECKMULTISIG with
+// validly sized keys.
+func ParseMultisig(script []byte) (m, n int, ok bool) {
+	if len(script) < 3 || script[len(script)-1] != OP_CHECKMULTISIG {
+		return 0, 0, false
+	}
+	if script[0] < OP_1 || script[0] > OP_16 {
+		return 0, 0, false
+	}
+	m = decodeOpN(script[0])
+
+	var keys int
+	pc := 1
+	for pc < len(script)-2 {
+		op, data, next, ok := getOp(script, pc)
+		if !ok || op != byte(len(data)) || !isCompressedOrUncompressedPubKey(data) {
+			return 0, 0, false
+		}
+		keys++
+		pc = next
+	}
+
+	nOp := script[len(script)-2]
+	if pc != len(script)-2 || nOp < OP_1 || nOp > OP_16 {
+		return 0, 0, false
+	}
+	n = decodeOpN(nOp)
+	if n != keys || m > n {
+		return 0, 0, false
+	}
+	return m, n, true
+}
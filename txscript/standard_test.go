@@ -0,0 +1,48 @@
+package txscript_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/txscript"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetScriptClass(t *testing.T) {
+	compressed := append([]byte{0x02}, bytes.Repeat([]byte{0x01}, 32)...)
+	uncompressed := append([]byte{0x04}, bytes.Repeat([]byte{0x01}, 64)...)
+	push := func(data []byte) []byte { return append([]byte{byte(len(data))}, data...) }
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	hash20, hash32 := make([]byte, 20), make([]byte, 32)
+
+	tests := []struct {
+		name   string
+		script []byte
+		want   txscript.ScriptClass
+	}{
+		{"empty", nil, txscript.NONSTANDARD_TY},
+		{"p2pk compressed", concat(push(compressed), []byte{txscript.OP_CHECKSIG}), txscript.PUBKEY_TY},
+		{"p2pk uncompressed", concat(push(uncompressed), []byte{txscript.OP_CHECKSIG}), txscript.PUBKEY_TY},
+		{"p2pk bad key", concat(push(hash32), []byte{txscript.OP_CHECKSIG}), txscript.NONSTANDARD_TY},
+		{"p2pkh", concat([]byte{txscript.OP_DUP, txscript.OP_HASH160}, push(hash20), []byte{txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG}), txscript.PUBKEY_HASH_TY},
+		{"p2sh", concat([]byte{txscript.OP_HASH160}, push(hash20), []byte{txscript.OP_EQUAL}), txscript.SCRIPT_HASH_TY},
+		{"1 of 2 multisig", concat([]byte{txscript.OP_1}, push(compressed), push(uncompressed), []byte{txscript.OP_2, txscript.OP_CHECKMULTISIG}), txscript.MULTISIG_TY},
+		{"multisig needing too many", concat([]byte{txscript.OP_2}, push(compressed), []byte{txscript.OP_1, txscript.OP_CHECKMULTISIG}), txscript.NONSTANDARD_TY},
+		{"multisig with wrong key count", concat([]byte{txscript.OP_1}, push(compressed), []byte{txscript.OP_2, txscript.OP_CHECKMULTISIG}), txscript.NONSTANDARD_TY},
+		{"null data", concat([]byte{txscript.OP_RETURN}, push([]byte("hello"))), txscript.NULL_DATA_TY},
+		{"bare op_return", []byte{txscript.OP_RETURN}, txscript.NULL_DATA_TY},
+		{"op_return then code", []byte{txscript.OP_RETURN, txscript.OP_CHECKSIG}, txscript.NONSTANDARD_TY},
+		{"p2wpkh", concat([]byte{txscript.OP_0}, push(hash20)), txscript.WITNESS_V0_KEYHASH_TY},
+		{"p2wsh", concat([]byte{txscript.OP_0}, push(hash32)), txscript.WITNESS_V0_SCRIPTHASH_TY},
+		{"v0 of another length", concat([]byte{txscript.OP_0}, push(make([]byte, 25))), txscript.NONSTANDARD_TY},
+		{"taproot", concat([]byte{txscript.OP_1}, push(hash32)), txscript.WITNESS_V1_TAPROOT_TY},
+		{"future witness version", concat([]byte{txscript.OP_2}, push(hash32)), txscript.WITNESS_UNKNOWN_TY},
+		{"anyone can spend", []byte{txscript.OP_TRUE}, txscript.NONSTANDARD_TY},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, txscript.GetScriptClass(tt.script), "got %s", txscript.GetScriptClass(tt.script))
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package txscript
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/secp256k1"
+)
+
+// VerifyScript checks that input idx of the transaction satisfies the output it spends, under the
+// rules the flags select. prevOuts are the outputs spent by every input, in order; taproot
+// signatures commit to all of them.
+//
+// midstate holds the signature hashing shared by the transaction's inputs. It can be nil, but
+// then it's worked out again for each input, which makes verifying every input of a large
+// transaction quadratic.
+func VerifyScript(tx *proto.Tx, idx int, prevOuts []proto.TxOut, flags ScriptFlags, midstate *proto.SigHashMidstate) error {
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return fmt.Errorf("input %d is out of range", idx)
+	}
+	if len(prevOuts) != len(tx.TxIn) {
+		return fmt.Errorf("have %d previous outputs for %d inputs", len(prevOuts), len(tx.TxIn))
+	}
+
+	sigScript := tx.TxIn[idx].SignatureScript
+	pkScript := prevOuts[idx].PkScript
+	witness := tx.TxIn[idx].Witness
+	if midstate == nil {
+		midstate = proto.NewSigHashMidstate(*tx, prevOuts)
+	}
+	checker := &sigChecker{tx: tx, idx: idx, prevOuts: prevOuts, midstate: midstate}
+
+	if flags&SCRIPT_VERIFY_SIGPUSHONLY != 0 && !IsPushOnly(sigScript) {
+		return scriptError(ErrSigPushOnly, "signature script isn't push only")
+	}
+
+	// The scripts are run one after the other on the same stack, rather than being joined,
+	// so the signature script can't mess with the flow of the public key script
+	var stk stack
+	if err := evalScript(&stk, sigScript, flags, checker, sigVersionBase, &execData{}); err != nil {
+		return err
+	}
+	var stackCopy stack
+	if flags&SCRIPT_VERIFY_P2SH != 0 {
+		stackCopy = append(stack(nil), stk...)
+	}
+	if err := evalScript(&stk, pkScript, flags, checker, sigVersionBase, &execData{}); err != nil {
+		return err
+	}
+	if len(stk) == 0 || !castToBool(stk.top(1)) {
+		return scriptError(ErrEvalFalse, "script evaluated to false")
+	}
+
+	hadWitness := false
+	if flags&SCRIPT_VERIFY_WITNESS != 0 {
+		if version, program, ok := IsWitnessProgram(pkScript); ok {
+			hadWitness = true
+			if len(sigScript) != 0 {
+				return scriptError(ErrWitnessMalleated, "signature script spending a witness program isn't empty")
+			}
+			if err := verifyWitnessProgram(witness, version, program, flags, checker, false); err != nil {
+				return err
+			}
+			// The stack obviously isn't clean, but that's not what CLEANSTACK is after
+			stk = stk[:1]
+		}
+	}
+
+	if flags&SCRIPT_VERIFY_P2SH != 0 && IsPayToScriptHash(pkScript) {
+		if !IsPushOnly(sigScript) {
+			return scriptError(ErrSigPushOnly, "P2SH signature script isn't push only")
+		}
+
+		// Run the redeem script on the stack as the signature script left it. The stack can't be
+		// empty, or the hash check would have failed.
+		stk = stackCopy
+		redeemScript := stk.pop()
+		if err := evalScript(&stk, redeemScript, flags, checker, sigVersionBase, &execData{}); err != nil {
+			return err
+		}
+		if len(stk) == 0 || !castToBool(stk.top(1)) {
+			return scriptError(ErrEvalFalse, "redeem script evaluated to false")
+		}
+
+		if flags&SCRIPT_VERIFY_WITNESS != 0 {
+			if version, program, ok := IsWitnessProgram(redeemScript); ok {
+				hadWitness = true
+				// Anything but exactly a push of the redeem script would be malleable
+				if !bytes.Equal(sigScript, pushData(redeemScript)) {
+					return scriptError(ErrWitnessMalleatedP2SH, "signature script isn't just the redeem script")
+				}
+				if err := verifyWitnessProgram(witness, version, program, flags, checker, true); err != nil {
+					return err
+				}
+				stk = stk[:1]
+			}
+		}
+	}
+
+	// Checked only after P2SH and witness evaluation, which don't leave a clean stack
+	if flags&SCRIPT_VERIFY_CLEANSTACK != 0 && len(stk) != 1 {
+		return scriptError(ErrCleanStack, "%d items left on the stack", len(stk))
+	}
+
+	if flags&SCRIPT_VERIFY_WITNESS != 0 && !hadWitness && len(witness) != 0 {
+		return scriptError(ErrWitnessUnexpected, "witness for an output that isn't a witness program")
+	}
+	return nil
+}
+
+// verifyWitnessProgram checks the witness satisfies a BIP141 witness program.
+func verifyWitnessProgram(witness proto.TxWitness, version int, program []byte, flags ScriptFlags, checker *sigChecker, isP2SH bool) error {
+	stk := append(stack(nil), witness...)
+	exec := &execData{}
+
+	switch {
+	case version == 0 && len(program) == WITNESS_V0_SCRIPTHASH_SIZE:
+		if len(stk) == 0 {
+			return scriptError(ErrWitnessProgramWitnessEmpty, "empty witness")
+		}
+		script := stk.pop()
+		if hash := sha256.Sum256(script); !bytes.Equal(hash[:], program) {
+			return scriptError(ErrWitnessProgramMismatch, "witness script doesn't match the program")
+		}
+		return executeWitnessScript(stk, script, flags, checker, sigVersionWitnessV0, exec)
+
+	case version == 0 && len(program) == WITNESS_V0_KEYHASH_SIZE:
+		if len(stk) != 2 {
+			return scriptError(ErrWitnessProgramMismatch, "P2WPKH witness has %d items", len(stk))
+		}
+		script := []byte{OP_DUP, OP_HASH160}
+		script = append(script, pushData(program)...)
+		script = append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+		return executeWitnessScript(stk, script, flags, checker, sigVersionWitnessV0, exec)
+
+	case version == 0:
+		return scriptError(ErrWitnessProgramWrongLength, "witness v0 program has length %d", len(program))
+
+	case version == 1 && len(program) == WITNESS_V1_TAPROOT_SIZE && !isP2SH:
+		if flags&SCRIPT_VERIFY_TAPROOT == 0 {
+			return nil
+		}
+		if len(stk) == 0 {
+			return scriptError(ErrWitnessProgramWitnessEmpty, "empty witness")
+		}
+		if len(stk) >= 2 && len(stk.top(1)) > 0 && stk.top(1)[0] == ANNEX_TAG {
+			exec.annexHash = proto.AnnexHash(stk.pop())
+			exec.annexPresent = true
+		}
+
+		if len(stk) == 1 {
+			// Key path: a signature by the output key itself
+			return checker.checkSchnorrSignature(stk[0], program, sigVersionTaproot, exec)
+		}
+
+		// Script path: a script, and the proof it's committed to by the output key
+		control := stk.pop()
+		script := stk.pop()
+		if len(control) < TAPROOT_CONTROL_BASE_SIZE || len(control) > TAPROOT_CONTROL_MAX_SIZE ||
+			(len(control)-TAPROOT_CONTROL_BASE_SIZE)%TAPROOT_CONTROL_NODE_SIZE != 0 {
+			return scriptError(ErrTaprootWrongControlSize, "control block has length %d", len(control))
+		}
+		leafVersion := control[0] & TAPROOT_LEAF_MASK
+		exec.tapLeafHash = tapLeafHash(leafVersion, script)
+		if !verifyTaprootCommitment(control, program, exec.tapLeafHash) {
+			return scriptError(ErrWitnessProgramMismatch, "script isn't committed to by the output key")
+		}
+
+		if leafVersion == TAPROOT_LEAF_TAPSCRIPT {
+			exec.validationWeightLeft = int64(witnessSize(witness)) + VALIDATION_WEIGHT_OFFSET
+			return executeWitnessScript(stk, script, flags, checker, sigVersionTapscript, exec)
+		}
+		if flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION != 0 {
+			return scriptError(ErrDiscourageUpgradableTaprootVersion, "unknown taproot leaf version %#x", leafVersion)
+		}
+		return nil
+
+	default:
+		// Left for future soft forks to define
+		if flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM != 0 {
+			return scriptError(ErrDiscourageUpgradableWitnessProgram, "unknown witness version %d", version)
+		}
+		return nil
+	}
+}
+
+// executeWitnessScript runs a witness script on the rest of the witness, which must leave just
+// true on the stack.
+func executeWitnessScript(stk stack, script []byte, flags ScriptFlags, checker *sigChecker, sigVersion sigVersion, exec *execData) error {
+	if sigVersion == sigVersionTapscript {
+		// An OP_SUCCESSx anywhere makes the script succeed, before any other rule applies
+		for pc := 0; pc < len(script); {
+			op, _, next, ok := getOp(script, pc)
+			if !ok {
+				return scriptError(ErrBadOpcode, "push at %d runs off the end of the script", pc)
+			}
+			if isOpSuccess(op) {
+				if flags&SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS != 0 {
+					return scriptError(ErrDiscourageOpSuccess, "OP_SUCCESS%d is reserved for soft forks", op)
+				}
+				return nil
+			}
+			pc = next
+		}
+
+		if len(stk) > MAX_STACK_SIZE {
+			return scriptError(ErrStackSize, "more than %d stack items", MAX_STACK_SIZE)
+		}
+	}
+
+	for _, item := range stk {
+		if len(item) > MAX_SCRIPT_ELEMENT_SIZE {
+			return scriptError(ErrPushSize, "witness item of %d bytes is more than %d", len(item), MAX_SCRIPT_ELEMENT_SIZE)
+		}
+	}
+
+	if err := evalScript(&stk, script, flags, checker, sigVersion, exec); err != nil {
+		return err
+	}
+
+	// Witness scripts must always leave a clean stack
+	if len(stk) != 1 {
+		return scriptError(ErrCleanStack, "%d items left on the stack", len(stk))
+	}
+	if !castToBool(stk.top(1)) {
+		return scriptError(ErrEvalFalse, "script evaluated to false")
+	}
+	return nil
+}
+
+// tapLeafHash is the BIP341 hash of a script tree leaf.
+func tapLeafHash(leafVersion byte, script []byte) proto.Hash {
+	var buf bytes.Buffer
+	buf.WriteByte(leafVersion)
+	writeVarBytes(&buf, script)
+	return proto.Hash(secp256k1.TaggedHash("TapLeaf", buf.Bytes()))
+}
+
+// tapBranchHash is the BIP341 hash of a script tree branch. The children are sorted, so proofs
+// don't need to say which side they're on.
+func tapBranchHash(a, b []byte) proto.Hash {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return proto.Hash(secp256k1.TaggedHash("TapBranch", a, b))
+}
+
+// verifyTaprootCommitment reports whether the control block proves the output key commits to the
+// script tree leaf.
+func verifyTaprootCommitment(control, program []byte, leafHash proto.Hash) bool {
+	internalKey, err := secp256k1.ParseXOnlyPubKey(control[1:TAPROOT_CONTROL_BASE_SIZE])
+	if err != nil {
+		return false
+	}
+
+	// Hash up the merkle path to the root
+	node := leafHash
+	for path := control[TAPROOT_CONTROL_BASE_SIZE:]; len(path) > 0; path = path[TAPROOT_CONTROL_NODE_SIZE:] {
+		node = tapBranchHash(node[:], path[:TAPROOT_CONTROL_NODE_SIZE])
+	}
+
+	tweak := secp256k1.TaggedHash("TapTweak", internalKey.SerializeXOnly(), node[:])
+	outputKey, err := internalKey.AddTweak(tweak[:])
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(outputKey.SerializeXOnly(), program) && outputKey.HasOddY() == (control[0]&1 == 1)
+}
+
+// witnessSize is the serialized size of the witness stack.
+func witnessSize(witness proto.TxWitness) int {
+	var buf bytes.Buffer
+	proto.VarInt(len(witness)).MarshalToWriter(&buf)
+	size := buf.Len()
+	for _, item := range witness {
+		buf.Reset()
+		writeVarBytes(&buf, item)
+		size += buf.Len()
+	}
+	return size
+}
@@ -0,0 +1,393 @@
+package utxo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// Roughly how much memory each cached output takes besides its script: the map slot, the
+	// entry and its bookkeeping.
+	CACHE_ENTRY_OVERHEAD = 160
+
+	// Undo data is kept for this many blocks below the one just connected, which is as deep as a
+	// reorg can go.
+	UNDO_DEPTH = 1000
+
+	// The default memory budget for the cache.
+	DEFAULT_CACHE_SIZE = 450 << 20
+)
+
+// ErrMissingOutput is returned when a block spends an output that isn't in the set.
+var ErrMissingOutput = errors.New("output is missing or already spent")
+
+// cacheEntry is an output the cache knows about.
+type cacheEntry struct {
+	entry *Entry // nil once it's been spent
+	dirty bool   // Changed since the last flush
+	fresh bool   // Not in the database, so if it's spent before a flush it can simply be forgotten
+}
+
+// journalEntry is how an output was in the cache before the block being connected or
+// disconnected touched it.
+type journalEntry struct {
+	entry  cacheEntry
+	cached bool
+}
+
+// Cache sits in front of the database, keeping outputs in memory as blocks are connected and
+// disconnected and writing them back only when it's flushed. It's flushed by itself between blocks
+// whenever it grows past its memory budget, so what's on disk is always the set as of some block.
+//
+// A Cache isn't safe for concurrent use.
+type Cache struct {
+	db        *DB
+	maxMemory int
+	memory    int
+
+	entries   map[proto.OutPoint]*cacheEntry
+	undo      map[int32]*BlockUndo // Added or removed since the last flush
+	bestBlock proto.Hash
+
+	// Set while a block is being connected or disconnected, so it can be rolled back if it fails
+	journal map[proto.OutPoint]journalEntry
+}
+
+// NewCache creates a cache in front of the database that uses roughly up to maxMemory bytes.
+func NewCache(db *DB, maxMemory int) *Cache {
+	return &Cache{
+		db:        db,
+		maxMemory: maxMemory,
+		entries:   make(map[proto.OutPoint]*cacheEntry),
+		undo:      make(map[int32]*BlockUndo),
+		bestBlock: db.BestBlock(),
+	}
+}
+
+// BestBlock is the hash of the block the set is as of, including what's not yet been flushed. It's
+// zero for an empty set that no block has been connected to.
+func (c *Cache) BestBlock() proto.Hash {
+	return c.bestBlock
+}
+
+// MemoryUsage is roughly how much memory the cache is using.
+func (c *Cache) MemoryUsage() int {
+	return c.memory
+}
+
+func entryMemory(entry *Entry) int {
+	if entry == nil {
+		return CACHE_ENTRY_OVERHEAD
+	}
+	return CACHE_ENTRY_OVERHEAD + len(entry.PkScript)
+}
+
+func undoMemory(undo *BlockUndo) int {
+	if undo == nil {
+		return 0
+	}
+	size := 0
+	for i := range undo.Spent {
+		size += entryMemory(&undo.Spent[i])
+	}
+	return size
+}
+
+// Entry returns an unspent output, or nil if it isn't in the set. The entry mustn't be modified.
+func (c *Cache) Entry(op proto.OutPoint) (*Entry, error) {
+	ce, err := c.fetch(op)
+	if err != nil || ce == nil {
+		return nil, err
+	}
+	return ce.entry, nil
+}
+
+// fetch finds an output in the cache, reading it in from the database if need be. It returns nil
+// if the database doesn't have it either.
+func (c *Cache) fetch(op proto.OutPoint) (*cacheEntry, error) {
+	if ce, ok := c.entries[op]; ok {
+		return ce, nil
+	}
+
+	entry, err := c.db.Entry(op)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	c.touch(op)
+	ce := &cacheEntry{entry: entry}
+	c.entries[op] = ce
+	c.memory += entryMemory(entry)
+	return ce, nil
+}
+
+// touch records how an output was before it's changed, if there's a block in progress.
+func (c *Cache) touch(op proto.OutPoint) {
+	if c.journal == nil {
+		return
+	}
+	if _, ok := c.journal[op]; ok {
+		return
+	}
+
+	ce, cached := c.entries[op]
+	var saved journalEntry
+	if cached {
+		saved = journalEntry{entry: *ce, cached: true}
+	}
+	c.journal[op] = saved
+}
+
+// addEntry adds an output to the set, replacing any that's there already.
+func (c *Cache) addEntry(op proto.OutPoint, entry *Entry) error {
+	if IsUnspendable(entry.PkScript) {
+		return nil
+	}
+
+	ce, ok := c.entries[op]
+	if !ok {
+		inDB, err := c.db.Has(op)
+		if err != nil {
+			return err
+		}
+		c.touch(op)
+		ce = &cacheEntry{fresh: !inDB}
+		c.entries[op] = ce
+		c.memory += entryMemory(nil)
+	} else {
+		c.touch(op)
+	}
+	if ce.entry != nil {
+		c.memory -= len(ce.entry.PkScript)
+	}
+
+	ce.entry = entry
+	ce.dirty = true
+	c.memory += len(entry.PkScript)
+	return nil
+}
+
+// spendEntry removes an output from the set, returning it.
+func (c *Cache) spendEntry(op proto.OutPoint) (*Entry, error) {
+	ce, err := c.fetch(op)
+	if err != nil {
+		return nil, err
+	}
+	if ce == nil || ce.entry == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMissingOutput, op)
+	}
+	c.touch(op)
+
+	entry := ce.entry
+	if ce.fresh {
+		delete(c.entries, op)
+		c.memory -= entryMemory(entry)
+	} else {
+		ce.entry = nil
+		ce.dirty = true
+		c.memory -= len(entry.PkScript)
+	}
+	return entry, nil
+}
+
+// ConnectBlock spends the outputs the block's transactions spend and adds the ones they create,
+// and keeps undo data so it can be disconnected again. The block must follow the best block,
+// unless the set is empty. It doesn't check anything besides that the outputs being spent exist;
+// if one doesn't, the set is left as it was and the error wraps ErrMissingOutput.
+func (c *Cache) ConnectBlock(block *proto.Block, height int32) error {
+	if !c.bestBlock.IsZero() && block.Header.PrevBlock != c.bestBlock {
+		return fmt.Errorf("block %s doesn't follow best block %s", block.BlockHash(), c.bestBlock)
+	}
+
+	undo := &BlockUndo{Block: block.BlockHash()}
+	err := c.update(func() error {
+		for i := range block.Transactions {
+			tx := &block.Transactions[i]
+			if !tx.IsCoinBase() {
+				for _, in := range tx.TxIn {
+					entry, err := c.spendEntry(in.PreviousOutPoint)
+					if err != nil {
+						return fmt.Errorf("transaction %s: %w", tx.TxHash(), err)
+					}
+					undo.Spent = append(undo.Spent, *entry)
+				}
+			}
+
+			txHash := tx.TxHash()
+			for index, out := range tx.TxOut {
+				err := c.addEntry(proto.OutPoint{Hash: txHash, Index: uint32(index)}, &Entry{
+					Amount:     out.Value,
+					PkScript:   out.PkScript,
+					Height:     height,
+					IsCoinBase: tx.IsCoinBase(),
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.setUndo(height, undo)
+	if height >= UNDO_DEPTH {
+		c.setUndo(height-UNDO_DEPTH, nil)
+	}
+	c.bestBlock = undo.Block
+	return c.flushIfFull()
+}
+
+// DisconnectBlock undoes ConnectBlock for the best block, which is at the given height: the
+// outputs it created are removed and the ones it spent are put back. If it can't be, the set is
+// left as it was.
+func (c *Cache) DisconnectBlock(block *proto.Block, height int32) error {
+	hash := block.BlockHash()
+	if hash != c.bestBlock {
+		return fmt.Errorf("block %s isn't the best block %s", hash, c.bestBlock)
+	}
+
+	undo, err := c.blockUndo(height)
+	if err != nil {
+		return err
+	}
+	if undo == nil || undo.Block != hash {
+		return fmt.Errorf("no undo data for block %s", hash)
+	}
+
+	err = c.update(func() error {
+		spent := undo.Spent
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := &block.Transactions[i]
+			txHash := tx.TxHash()
+			for index, out := range tx.TxOut {
+				if IsUnspendable(out.PkScript) {
+					continue
+				}
+				if _, err := c.spendEntry(proto.OutPoint{Hash: txHash, Index: uint32(index)}); err != nil {
+					return fmt.Errorf("transaction %s: %w", txHash, err)
+				}
+			}
+
+			if tx.IsCoinBase() {
+				continue
+			}
+			if len(spent) < len(tx.TxIn) {
+				return fmt.Errorf("undo data for block %s is too short", hash)
+			}
+			for j := len(tx.TxIn) - 1; j >= 0; j-- {
+				entry := spent[len(spent)-1]
+				spent = spent[:len(spent)-1]
+				if err := c.addEntry(tx.TxIn[j].PreviousOutPoint, &entry); err != nil {
+					return err
+				}
+			}
+		}
+		if len(spent) != 0 {
+			return fmt.Errorf("undo data for block %s is too long", hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.setUndo(height, nil)
+	c.bestBlock = block.Header.PrevBlock
+	return c.flushIfFull()
+}
+
+// update makes changes to the set, rolling them back if they fail.
+func (c *Cache) update(changes func() error) error {
+	memory := c.memory
+	c.journal = make(map[proto.OutPoint]journalEntry)
+	defer func() {
+		c.journal = nil
+	}()
+
+	err := changes()
+	if err == nil {
+		return nil
+	}
+
+	for op, saved := range c.journal {
+		if saved.cached {
+			ce := saved.entry
+			c.entries[op] = &ce
+		} else {
+			delete(c.entries, op)
+		}
+	}
+	c.memory = memory
+	return err
+}
+
+// blockUndo returns the undo data for the block at a height, or nil if there isn't any.
+func (c *Cache) blockUndo(height int32) (*BlockUndo, error) {
+	if undo, ok := c.undo[height]; ok {
+		return undo, nil
+	}
+	return c.db.Undo(height)
+}
+
+// setUndo sets (or with nil, removes) the undo data for the block at a height.
+func (c *Cache) setUndo(height int32, undo *BlockUndo) {
+	c.memory -= undoMemory(c.undo[height])
+	c.undo[height] = undo
+	c.memory += undoMemory(undo)
+}
+
+// flushIfFull flushes the cache and empties it if it's over its memory budget.
+func (c *Cache) flushIfFull() error {
+	if c.memory <= c.maxMemory {
+		return nil
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	c.entries = make(map[proto.OutPoint]*cacheEntry)
+	c.memory = 0
+	return nil
+}
+
+// Flush writes everything that's changed to the database in one go, so that it's either all on
+// disk or, if the process dies part way through, none of it is. Unchanged outputs stay cached.
+func (c *Cache) Flush() error {
+	b := &batch{
+		bestBlock: c.bestBlock,
+		entries:   make(map[proto.OutPoint]*Entry),
+		undo:      c.undo,
+	}
+	for op, ce := range c.entries {
+		if ce.dirty {
+			b.entries[op] = ce.entry
+		}
+	}
+	if len(b.entries) == 0 && len(b.undo) == 0 && b.bestBlock == c.db.BestBlock() {
+		return nil
+	}
+
+	if err := c.db.write(b); err != nil {
+		return err
+	}
+
+	for op, ce := range c.entries {
+		if ce.entry == nil {
+			delete(c.entries, op)
+			c.memory -= entryMemory(nil)
+			continue
+		}
+		ce.dirty = false
+		ce.fresh = false
+	}
+	for _, undo := range c.undo {
+		c.memory -= undoMemory(undo)
+	}
+	c.undo = make(map[int32]*BlockUndo)
+	return nil
+}
@@ -0,0 +1,374 @@
+package utxo_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/utxo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChain builds blocks whose transactions spend each other's outputs. Nothing about them is
+// valid besides what the UTXO set cares about.
+type testChain struct {
+	blocks []*proto.Block
+}
+
+func (c *testChain) tip() proto.Hash {
+	if len(c.blocks) == 0 {
+		return proto.Hash{}
+	}
+	return c.blocks[len(c.blocks)-1].BlockHash()
+}
+
+// addBlock adds a block with a coinbase and the given transactions.
+func (c *testChain) addBlock(txs ...proto.Tx) *proto.Block {
+	height := len(c.blocks)
+	coinbase := proto.Tx{
+		Version: 1,
+		TxIn: []proto.TxIn{{
+			PreviousOutPoint: proto.OutPoint{Index: proto.NULL_OUTPOINT_INDEX},
+			SignatureScript:  []byte{0x02, byte(height), byte(height >> 8)},
+		}},
+		TxOut: []proto.TxOut{
+			{Value: 50, PkScript: []byte{0x51}},
+			{Value: 0, PkScript: []byte{utxo.OP_RETURN, 0x00}},
+		},
+	}
+
+	block := &proto.Block{
+		Header:       proto.BlockHeader{Version: 4, PrevBlock: c.tip(), Timestamp: uint32(height)},
+		Transactions: append([]proto.Tx{coinbase}, txs...),
+	}
+	c.blocks = append(c.blocks, block)
+	return block
+}
+
+func spend(value int64, ops ...proto.OutPoint) proto.Tx {
+	tx := proto.Tx{Version: 2, TxOut: []proto.TxOut{{Value: value, PkScript: []byte{0x52}}}}
+	for _, op := range ops {
+		tx.TxIn = append(tx.TxIn, proto.TxIn{PreviousOutPoint: op, Sequence: proto.MAX_TX_IN_SEQUENCE})
+	}
+	return tx
+}
+
+func outPoint(tx proto.Tx, index uint32) proto.OutPoint {
+	return proto.OutPoint{Hash: tx.TxHash(), Index: index}
+}
+
+func openDB(t *testing.T, dir string) *utxo.DB {
+	t.Helper()
+	db, err := utxo.OpenDB(dir, 1<<20)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// snapshot reads every output the test chain could have created.
+func snapshot(t *testing.T, c *utxo.Cache, chain *testChain) map[proto.OutPoint]utxo.Entry {
+	t.Helper()
+	set := make(map[proto.OutPoint]utxo.Entry)
+	for _, block := range chain.blocks {
+		for _, tx := range block.Transactions {
+			txHash := tx.TxHash()
+			for i := range tx.TxOut {
+				op := proto.OutPoint{Hash: txHash, Index: uint32(i)}
+				entry, err := c.Entry(op)
+				require.NoError(t, err)
+				if entry != nil {
+					set[op] = *entry
+				}
+			}
+		}
+	}
+	return set
+}
+
+func TestCache_ConnectBlock(t *testing.T) {
+	cache := utxo.NewCache(openDB(t, t.TempDir()), utxo.DEFAULT_CACHE_SIZE)
+	chain := &testChain{}
+
+	genesis := chain.addBlock()
+	require.NoError(t, cache.ConnectBlock(genesis, 0))
+	assert.Equal(t, genesis.BlockHash(), cache.BestBlock())
+
+	coinbase := genesis.Transactions[0]
+	entry, err := cache.Entry(outPoint(coinbase, 0))
+	require.NoError(t, err)
+	assert.Equal(t, &utxo.Entry{Amount: 50, PkScript: []byte{0x51}, Height: 0, IsCoinBase: true}, entry)
+
+	// The OP_RETURN output is never added
+	entry, err = cache.Entry(outPoint(coinbase, 1))
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// Spend the coinbase, and then the output of that in the same block
+	first := spend(40, outPoint(coinbase, 0))
+	second := spend(30, outPoint(first, 0))
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(first, second), 1))
+
+	for _, op := range []proto.OutPoint{outPoint(coinbase, 0), outPoint(first, 0)} {
+		entry, err := cache.Entry(op)
+		require.NoError(t, err)
+		assert.Nil(t, entry, op)
+	}
+	entry, err = cache.Entry(outPoint(second, 0))
+	require.NoError(t, err)
+	assert.Equal(t, &utxo.Entry{Amount: 30, PkScript: []byte{0x52}, Height: 1}, entry)
+}
+
+func TestCache_ConnectBlockMissingOutput(t *testing.T) {
+	cache := utxo.NewCache(openDB(t, t.TempDir()), utxo.DEFAULT_CACHE_SIZE)
+	chain := &testChain{}
+	genesis := chain.addBlock()
+	require.NoError(t, cache.ConnectBlock(genesis, 0))
+	before := snapshot(t, cache, chain)
+	memory := cache.MemoryUsage()
+
+	// The first transaction is fine, but the second spends the same output again
+	coinbase := outPoint(genesis.Transactions[0], 0)
+	bad := chain.addBlock(spend(40, coinbase), spend(30, coinbase))
+	err := cache.ConnectBlock(bad, 1)
+	require.ErrorIs(t, err, utxo.ErrMissingOutput)
+
+	// Nothing changed
+	assert.Equal(t, genesis.BlockHash(), cache.BestBlock())
+	assert.Equal(t, before, snapshot(t, cache, chain))
+	assert.Equal(t, memory, cache.MemoryUsage())
+
+	// And it has to follow the best block
+	elsewhere := &proto.Block{Header: proto.BlockHeader{PrevBlock: proto.DoubleSHA256([]byte("elsewhere"))}}
+	require.Error(t, cache.ConnectBlock(elsewhere, 1))
+}
+
+func TestCache_DisconnectBlock(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		cache := utxo.NewCache(openDB(t, t.TempDir()), utxo.DEFAULT_CACHE_SIZE)
+		chain := &testChain{}
+		genesis := chain.addBlock()
+		require.NoError(t, cache.ConnectBlock(genesis, 0))
+		before := snapshot(t, cache, chain)
+
+		first := spend(40, outPoint(genesis.Transactions[0], 0))
+		second := spend(30, outPoint(first, 0))
+		block := chain.addBlock(first, second)
+		require.NoError(t, cache.ConnectBlock(block, 1))
+		if flush {
+			require.NoError(t, cache.Flush())
+		}
+
+		// It can only be the best block that's disconnected
+		require.Error(t, cache.DisconnectBlock(genesis, 0))
+
+		require.NoError(t, cache.DisconnectBlock(block, 1))
+		assert.Equal(t, genesis.BlockHash(), cache.BestBlock())
+		assert.Equal(t, before, snapshot(t, cache, chain))
+
+		// The undo data has gone with it
+		require.Error(t, cache.DisconnectBlock(block, 1))
+	}
+}
+
+func TestCache_FlushAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	cache := utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	chain := &testChain{}
+
+	genesis := chain.addBlock()
+	require.NoError(t, cache.ConnectBlock(genesis, 0))
+	block := chain.addBlock(spend(40, outPoint(genesis.Transactions[0], 0)))
+	require.NoError(t, cache.ConnectBlock(block, 1))
+
+	// Nothing's written until the cache is flushed
+	assert.Zero(t, db.Count())
+	assert.True(t, db.BestBlock().IsZero())
+
+	require.NoError(t, cache.Flush())
+	want := snapshot(t, cache, chain)
+	assert.Equal(t, 2, db.Count())
+	require.NoError(t, db.Close())
+
+	db = openDB(t, dir)
+	cache = utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	assert.Equal(t, block.BlockHash(), cache.BestBlock())
+	assert.Equal(t, want, snapshot(t, cache, chain))
+
+	// Undo data survives too
+	require.NoError(t, cache.DisconnectBlock(block, 1))
+	assert.Len(t, snapshot(t, cache, chain), 1)
+}
+
+func TestCache_MemoryBudget(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	cache := utxo.NewCache(db, 2*utxo.CACHE_ENTRY_OVERHEAD)
+	chain := &testChain{}
+
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(), 0))
+	assert.Zero(t, db.Count())
+
+	// The second block takes it over budget, so it's flushed and emptied
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(), 1))
+	assert.Equal(t, 2, db.Count())
+	assert.Equal(t, chain.tip(), db.BestBlock())
+	assert.Zero(t, cache.MemoryUsage())
+
+	// Outputs are read back in as they're needed
+	coinbase := outPoint(chain.blocks[0].Transactions[0], 0)
+	entry, err := cache.Entry(coinbase)
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), entry.Amount)
+
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(spend(10, coinbase)), 2))
+	entry, err = cache.Entry(coinbase)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestDB_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	cache := utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	chain := &testChain{}
+
+	genesis := chain.addBlock()
+	require.NoError(t, cache.ConnectBlock(genesis, 0))
+	require.NoError(t, cache.Flush())
+	want := snapshot(t, cache, chain)
+
+	path := filepath.Join(dir, utxo.DB_FILENAME)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(spend(40, outPoint(genesis.Transactions[0], 0))), 1))
+	require.NoError(t, cache.Flush())
+	require.NoError(t, db.Close())
+
+	// Lose the end of the second flush, as if we crashed while writing it
+	full, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, (info.Size()+full.Size())/2))
+
+	db = openDB(t, dir)
+	cache = utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	assert.Equal(t, genesis.BlockHash(), cache.BestBlock())
+	assert.Equal(t, want, snapshot(t, cache, chain))
+
+	// The damaged record has been dropped, so the log can be written to again
+	require.NoError(t, cache.ConnectBlock(chain.blocks[1], 1))
+	require.NoError(t, cache.Flush())
+	require.NoError(t, db.Close())
+
+	db = openDB(t, dir)
+	assert.Equal(t, chain.blocks[1].BlockHash(), db.BestBlock())
+}
+
+func TestDB_Compaction(t *testing.T) {
+	// Connects and disconnects the same block over and over, so almost all of what's written goes
+	// stale, and returns how big the log ends up
+	churn := func(compactMinSize int64) int64 {
+		dir := t.TempDir()
+		db := openDB(t, dir)
+		db.CompactMinSize = compactMinSize
+		cache := utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+
+		chain := &testChain{}
+		genesis := chain.addBlock()
+		block := chain.addBlock(spend(40, outPoint(genesis.Transactions[0], 0)))
+		require.NoError(t, cache.ConnectBlock(genesis, 0))
+		for i := 0; i < 20; i++ {
+			require.NoError(t, cache.ConnectBlock(block, 1))
+			require.NoError(t, cache.Flush())
+			require.NoError(t, cache.DisconnectBlock(block, 1))
+			require.NoError(t, cache.Flush())
+		}
+		require.NoError(t, cache.ConnectBlock(block, 1))
+		require.NoError(t, cache.Flush())
+		want := snapshot(t, cache, chain)
+		require.NoError(t, db.Close())
+
+		info, err := os.Stat(filepath.Join(dir, utxo.DB_FILENAME))
+		require.NoError(t, err)
+
+		// Whatever happened, it reads back the same
+		db = openDB(t, dir)
+		cache = utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+		assert.Equal(t, block.BlockHash(), cache.BestBlock())
+		assert.Equal(t, want, snapshot(t, cache, chain))
+		require.NoError(t, cache.DisconnectBlock(block, 1))
+		return info.Size()
+	}
+
+	uncompacted := churn(utxo.DEFAULT_COMPACT_MIN_SIZE)
+	compacted := churn(0)
+	assert.Less(t, 4*compacted, uncompacted)
+}
+
+func TestDB_RebuildsIndexAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	cache := utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	chain := &testChain{}
+
+	genesis := chain.addBlock()
+	require.NoError(t, cache.ConnectBlock(genesis, 0))
+	block := chain.addBlock(spend(40, outPoint(genesis.Transactions[0], 0)))
+	require.NoError(t, cache.ConnectBlock(block, 1))
+	require.NoError(t, cache.Flush())
+	want := snapshot(t, cache, chain)
+
+	// Take a copy of the files while it's still open, as if we'd crashed
+	crashed := t.TempDir()
+	for _, name := range []string{utxo.DB_FILENAME, utxo.INDEX_FILENAME} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(crashed, name), data, 0o644))
+	}
+
+	db = openDB(t, crashed)
+	cache = utxo.NewCache(db, utxo.DEFAULT_CACHE_SIZE)
+	assert.Equal(t, 2, db.Count())
+	assert.Equal(t, block.BlockHash(), cache.BestBlock())
+	assert.Equal(t, want, snapshot(t, cache, chain))
+	require.NoError(t, cache.DisconnectBlock(block, 1))
+}
+
+func TestDB_IndexOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	db, err := utxo.OpenDB(dir, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	cache := utxo.NewCache(db, 0)
+	chain := &testChain{}
+
+	// Enough outputs that the index has to grow, with only a few of its pages in memory
+	many := proto.Tx{Version: 2}
+	for i := 0; i < 2*utxo.INDEX_MIN_SLOTS; i++ {
+		many.TxOut = append(many.TxOut, proto.TxOut{Value: int64(i), PkScript: []byte{0x51}})
+	}
+	genesis := chain.addBlock()
+	require.NoError(t, cache.ConnectBlock(genesis, 0))
+	many.TxIn = []proto.TxIn{{PreviousOutPoint: outPoint(genesis.Transactions[0], 0)}}
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(many), 1))
+
+	// Then spend every other one, which shifts the ones after them in the index
+	var spent []proto.OutPoint
+	manyHash := many.TxHash()
+	for i := 0; i < len(many.TxOut); i += 2 {
+		spent = append(spent, proto.OutPoint{Hash: manyHash, Index: uint32(i)})
+	}
+	require.NoError(t, cache.ConnectBlock(chain.addBlock(spend(1, spent...)), 2))
+	require.NoError(t, cache.Flush())
+	want := snapshot(t, cache, chain)
+	// Along with the coinbases of the last two blocks and the spending transaction's output
+	assert.Equal(t, len(many.TxOut)/2+3, len(want))
+	assert.Equal(t, len(want), db.Count())
+	require.NoError(t, db.Close())
+
+	db = openDB(t, dir)
+	cache = utxo.NewCache(db, 0)
+	assert.Equal(t, want, snapshot(t, cache, chain))
+}
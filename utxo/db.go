@@ -0,0 +1,762 @@
+package utxo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// The name of the log file within the database's directory, and of the file that's written
+	// alongside it when it's closed, saying the index matches it.
+	DB_FILENAME   = "chainstate.dat"
+	META_FILENAME = "chainstate.meta"
+
+	// Bumped whenever the layout of a record changes incompatibly.
+	DB_VERSION = 1
+
+	// The log isn't compacted until it's at least this big, however much of it is stale.
+	DEFAULT_COMPACT_MIN_SIZE = 64 << 20
+
+	// How many outputs go in each record of a compacted log.
+	COMPACT_BATCH_SIZE = 100_000
+
+	// The biggest payload a record can have, as its length is written in 32 bits.
+	MAX_RECORD_SIZE = math.MaxUint32
+
+	// Roughly how many bytes each record spends on an output besides its value, for deciding when
+	// to compact.
+	KEY_RECORD_SIZE = proto.HASH_SIZE + 4 + 2
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// valueLoc is where a value is in the log.
+type valueLoc struct {
+	offset int64
+	size   uint32
+}
+
+// batch is a set of changes that are written to the log as a single record, so that after a
+// crash either all of them have happened or none have.
+type batch struct {
+	bestBlock proto.Hash
+	entries   map[proto.OutPoint]*Entry // A nil entry deletes the output
+	undo      map[int32]*BlockUndo      // By height; a nil undo deletes the block's undo data
+}
+
+// DB keeps the unspent output set, and the undo data for each block connected to it, on disk. It's
+// an append-only log of batches of changes, with an index of where the latest value for each
+// output is; every lookup is then a read of the index, which is usually cached, and one of the log.
+// The index is a hash table on disk of which only a bounded number of pages are kept in memory,
+// as there are far too many outputs to keep track of them all there. Once most of the log is
+// stale, it's rewritten with only what's still live.
+//
+// Each batch is framed with its length and a checksum, so one that was only partly written when
+// the process died is recognised and dropped when the database is next opened, leaving the set as
+// it was after the batch before. The index isn't kept crash safe itself: closing the database
+// records that it matches the log, and if it wasn't closed, the index is rebuilt from the log.
+type DB struct {
+	// How big the log must be before it's compacted. It can be changed at any time.
+	CompactMinSize int64
+
+	mu        sync.Mutex
+	dir       string
+	file      *os.File
+	size      int64 // The end of the last complete record
+	live      int64 // Roughly how much of the log isn't stale
+	cacheSize int   // How much of the index to keep in memory
+	stale     bool  // The index may not match the log, so mustn't be trusted when next opened
+
+	bestBlock proto.Hash
+	entries   *diskIndex
+	undo      map[int32]valueLoc
+}
+
+// OpenDB opens the database in dir, creating it if need be, and recovers from any crash that
+// happened while it was last open. Up to indexCacheSize bytes of the index are kept in memory.
+func OpenDB(dir string, indexCacheSize int) (*DB, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create chainstate directory: %w", err)
+	}
+
+	db := &DB{
+		CompactMinSize: DEFAULT_COMPACT_MIN_SIZE,
+		dir:            dir,
+		cacheSize:      indexCacheSize,
+	}
+
+	// A compaction or an index that was being grown when we stopped can just be thrown away
+	for _, path := range []string{db.tmpPath(), db.indexPath() + ".tmp"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unable to remove incomplete compaction: %w", err)
+		}
+	}
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) path() string {
+	return filepath.Join(db.dir, DB_FILENAME)
+}
+
+func (db *DB) tmpPath() string {
+	return db.path() + ".tmp"
+}
+
+func (db *DB) indexPath() string {
+	return filepath.Join(db.dir, INDEX_FILENAME)
+}
+
+func (db *DB) metaPath() string {
+	return filepath.Join(db.dir, META_FILENAME)
+}
+
+// load opens the log, and the index if it was closed along with it. Otherwise the index is rebuilt
+// from the log, and anything after the last complete record is truncated.
+func (db *DB) load() error {
+	f, err := os.OpenFile(db.path(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open chainstate: %w", err)
+	}
+
+	valid, err := db.readMeta(f)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("ignoring chainstate metadata: %v", err)
+		}
+		valid, err = db.rebuild(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// From here on the index only matches the log once it's closed
+	if err := os.Remove(db.metaPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		f.Close()
+		return fmt.Errorf("unable to remove chainstate metadata: %w", err)
+	}
+	if err := syncDir(db.dir); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to remove chainstate metadata: %w", err)
+	}
+
+	db.file = f
+	db.size = valid
+	return nil
+}
+
+// rebuild reads the whole log into a new index, returning how much of it is valid, and truncates
+// the rest.
+func (db *DB) rebuild(f *os.File) (int64, error) {
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		log.Printf("rebuilding chainstate index from %d bytes of log", info.Size())
+	}
+
+	var salt [8]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return 0, err
+	}
+	entries, err := createIndex(db.indexPath(), INDEX_MIN_SLOTS, salt, db.cacheSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create chainstate index: %w", err)
+	}
+
+	db.bestBlock = proto.Hash{}
+	db.entries = entries
+	db.undo = make(map[int32]valueLoc)
+	db.live = 0
+
+	valid, err := db.readLog(f)
+	if err != nil {
+		entries.file.Close()
+		return 0, err
+	}
+
+	if valid == 0 {
+		var version [4]byte
+		binary.LittleEndian.PutUint32(version[:], DB_VERSION)
+		if _, err := f.WriteAt(version[:], 0); err != nil {
+			entries.file.Close()
+			return 0, fmt.Errorf("unable to write chainstate version: %w", err)
+		}
+		valid = int64(len(version))
+	}
+	if err := f.Truncate(valid); err != nil {
+		entries.file.Close()
+		return 0, fmt.Errorf("unable to truncate chainstate: %w", err)
+	}
+	return valid, nil
+}
+
+// readMeta reads what was recorded about the index when the database was closed, and opens it,
+// returning the size of the log. It's an error if the log isn't that size any more.
+func (db *DB) readMeta(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(db.metaPath())
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < 4 || crc32.Checksum(data[:len(data)-4], crcTable) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return 0, fmt.Errorf("damaged chainstate metadata")
+	}
+	r := bytes.NewReader(data[:len(data)-4])
+
+	var meta struct {
+		Version uint32
+		Size    int64
+		Salt    [8]byte
+		Slots   uint64
+		Count   uint64
+		Live    int64
+		Best    proto.Hash
+		Undo    uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &meta); err != nil {
+		return 0, err
+	}
+	if meta.Version != DB_VERSION {
+		return 0, fmt.Errorf("chainstate metadata has version %d, expected %d", meta.Version, DB_VERSION)
+	}
+	if info.Size() != meta.Size {
+		return 0, fmt.Errorf("chainstate is %d bytes, but was %d when it was closed", info.Size(), meta.Size)
+	}
+
+	undo := make(map[int32]valueLoc, meta.Undo)
+	for i := uint32(0); i < meta.Undo; i++ {
+		var u struct {
+			Height int32
+			Offset int64
+			Size   uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &u); err != nil {
+			return 0, err
+		}
+		undo[u.Height] = valueLoc{offset: u.Offset, size: u.Size}
+	}
+
+	entries, err := openIndex(db.indexPath(), meta.Slots, meta.Count, meta.Salt, db.cacheSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open chainstate index: %w", err)
+	}
+	db.bestBlock = meta.Best
+	db.entries = entries
+	db.undo = undo
+	db.live = meta.Live
+	return meta.Size, nil
+}
+
+// writeMeta records that the index matches the log as it is now, with what's needed to open it
+// again. The caller must hold the lock.
+func (db *DB) writeMeta() error {
+	var buf bytes.Buffer
+	meta := []any{
+		uint32(DB_VERSION), db.size, db.entries.salt, db.entries.slots, db.entries.count, db.live,
+		db.bestBlock, uint32(len(db.undo)),
+	}
+	for height, loc := range db.undo {
+		meta = append(meta, height, loc.offset, loc.size)
+	}
+	for _, v := range meta {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(), crcTable))
+
+	tmpPath := db.metaPath() + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, db.metaPath()); err != nil {
+		return err
+	}
+	return syncDir(db.dir)
+}
+
+// readLog applies every complete record in the log, returning how much of it is valid.
+func (db *DB) readLog(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("unable to open chainstate: %w", err)
+	}
+	r := bufio.NewReader(f)
+
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		// Empty, or torn before the version was even written
+		return 0, nil
+	}
+	if version != DB_VERSION {
+		return 0, fmt.Errorf("chainstate has version %d, expected %d", version, DB_VERSION)
+	}
+
+	valid := int64(4)
+	for {
+		var frame [8]byte
+		_, err := io.ReadFull(r, frame[:])
+		if err == io.EOF {
+			break
+		}
+
+		// A length running off the end of the file can only be a torn or corrupt record
+		length := int64(binary.LittleEndian.Uint32(frame[0:4]))
+		if err != nil || length > info.Size()-valid-int64(len(frame)) {
+			log.Printf("discarding damaged chainstate from offset %d", valid)
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil || crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(frame[4:8]) {
+			log.Printf("discarding damaged chainstate from offset %d", valid)
+			break
+		}
+
+		if err := db.apply(valid+int64(len(frame)), payload); err != nil {
+			return 0, fmt.Errorf("unable to read chainstate record at offset %d: %w", valid, err)
+		}
+		valid += int64(len(frame)) + length
+	}
+	return valid, nil
+}
+
+// BestBlock is the hash of the block the set is as of; it's zero if nothing has been written yet.
+func (db *DB) BestBlock() proto.Hash {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.bestBlock
+}
+
+// Has reports whether the output is in the set, without reading it.
+func (db *DB) Has(op proto.OutPoint) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, ok, err := db.entries.get(op)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up output %s: %w", op, err)
+	}
+	return ok, nil
+}
+
+// Count is the number of outputs in the set.
+func (db *DB) Count() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return int(db.entries.count)
+}
+
+// Entry reads an output from the set, returning nil if it isn't there.
+func (db *DB) Entry(op proto.OutPoint) (*Entry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	loc, ok, err := db.entries.get(op)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up output %s: %w", op, err)
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var entry Entry
+	if err := db.readValue(loc, &entry); err != nil {
+		return nil, fmt.Errorf("unable to read output %s: %w", op, err)
+	}
+	return &entry, nil
+}
+
+// Undo reads the undo data for the block at a height, returning nil if there isn't any.
+func (db *DB) Undo(height int32) (*BlockUndo, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	loc, ok := db.undo[height]
+	if !ok {
+		return nil, nil
+	}
+
+	var undo BlockUndo
+	if err := db.readValue(loc, &undo); err != nil {
+		return nil, fmt.Errorf("unable to read undo data for height %d: %w", height, err)
+	}
+	return &undo, nil
+}
+
+func (db *DB) readValue(loc valueLoc, v interface{ UnmarshalFromReader(io.Reader) error }) error {
+	value := make([]byte, loc.size)
+	if _, err := db.file.ReadAt(value, loc.offset); err != nil {
+		return err
+	}
+	return v.UnmarshalFromReader(bytes.NewReader(value))
+}
+
+// write appends a batch to the log and syncs it, compacting the log afterwards if it's mostly stale.
+func (db *DB) write(b *batch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.appendRecord(db.file, db.size, b); err != nil {
+		db.stale = true
+		return err
+	}
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync chainstate: %w", err)
+	}
+
+	if db.size >= db.CompactMinSize && db.size > 2*db.live {
+		if err := db.compact(); err != nil {
+			return fmt.Errorf("unable to compact chainstate: %w", err)
+		}
+	}
+	return nil
+}
+
+// appendRecord writes a batch to the file at the given offset, returning the size of the record,
+// and updates the index to match. If the file isn't the log, it's a compaction, and the index is
+// the one being built for it.
+func (db *DB) appendRecord(f *os.File, offset int64, b *batch) (int64, error) {
+	payload, err := encodeBatch(b)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(payload)) > MAX_RECORD_SIZE {
+		return 0, fmt.Errorf("unable to write chainstate: batch of %d bytes is too big for a record", len(payload))
+	}
+
+	record := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	record = append(record, payload...)
+	if _, err := f.WriteAt(record, offset); err != nil {
+		return 0, fmt.Errorf("unable to write chainstate: %w", err)
+	}
+
+	if f == db.file {
+		db.size += int64(len(record))
+	}
+	return int64(len(record)), db.apply(offset+8, payload)
+}
+
+// encodeBatch lays out a record: the best block, then the changed outputs and the changed undo
+// data. Each is a key, then a flag saying whether it's being deleted or set to the value that
+// follows, preceded by its length.
+func encodeBatch(b *batch) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := b.bestBlock.MarshalToWriter(&buf); err != nil {
+		return nil, err
+	}
+
+	if err := proto.VarInt(len(b.entries)).MarshalToWriter(&buf); err != nil {
+		return nil, err
+	}
+	for op, entry := range b.entries {
+		if err := op.MarshalToWriter(&buf); err != nil {
+			return nil, err
+		}
+		if err := writeValue(&buf, entry); err != nil {
+			return nil, fmt.Errorf("unable to write output %s: %w", op, err)
+		}
+	}
+
+	if err := proto.VarInt(len(b.undo)).MarshalToWriter(&buf); err != nil {
+		return nil, err
+	}
+	for height, undo := range b.undo {
+		if err := binary.Write(&buf, binary.LittleEndian, height); err != nil {
+			return nil, err
+		}
+		if err := writeValue(&buf, undo); err != nil {
+			return nil, fmt.Errorf("unable to write undo data for height %d: %w", height, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeValue[T interface{ MarshalToWriter(io.Writer) error }](buf *bytes.Buffer, v *T) error {
+	if v == nil {
+		return buf.WriteByte(0)
+	}
+
+	var value bytes.Buffer
+	if err := (*v).MarshalToWriter(&value); err != nil {
+		return err
+	}
+	buf.WriteByte(1)
+	if err := proto.VarInt(value.Len()).MarshalToWriter(buf); err != nil {
+		return err
+	}
+	_, err := buf.Write(value.Bytes())
+	return err
+}
+
+// apply updates the index with a record whose payload starts at the given offset in the log.
+func (db *DB) apply(offset int64, payload []byte) error {
+	r := bytes.NewReader(payload)
+	pos := func() int64 {
+		return offset + int64(len(payload)-r.Len())
+	}
+
+	if err := db.bestBlock.UnmarshalFromReader(r); err != nil {
+		return err
+	}
+
+	var count proto.VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return err
+	}
+	for i := proto.VarInt(0); i < count; i++ {
+		var op proto.OutPoint
+		if err := op.UnmarshalFromReader(r); err != nil {
+			return err
+		}
+		loc, ok, err := readValueLoc(r, pos)
+		if err != nil {
+			return fmt.Errorf("unable to read output %s: %w", op, err)
+		}
+
+		var old valueLoc
+		var existed bool
+		if ok {
+			old, existed, err = db.entries.put(op, loc)
+			db.live += int64(loc.size) + KEY_RECORD_SIZE
+		} else {
+			old, existed, err = db.entries.remove(op)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to index output %s: %w", op, err)
+		}
+		if existed {
+			db.live -= int64(old.size) + KEY_RECORD_SIZE
+		}
+	}
+
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return err
+	}
+	for i := proto.VarInt(0); i < count; i++ {
+		var height int32
+		if err := binary.Read(r, binary.LittleEndian, &height); err != nil {
+			return err
+		}
+		loc, ok, err := readValueLoc(r, pos)
+		if err != nil {
+			return fmt.Errorf("unable to read undo data for height %d: %w", height, err)
+		}
+
+		if old, exists := db.undo[height]; exists {
+			db.live -= int64(old.size) + KEY_RECORD_SIZE
+			delete(db.undo, height)
+		}
+		if ok {
+			db.undo[height] = loc
+			db.live += int64(loc.size) + KEY_RECORD_SIZE
+		}
+	}
+
+	return nil
+}
+
+// readValueLoc skips over a value, returning where it is, or false if it's being deleted.
+func readValueLoc(r *bytes.Reader, pos func() int64) (valueLoc, bool, error) {
+	flag, err := r.ReadByte()
+	if err != nil {
+		return valueLoc{}, false, err
+	}
+	if flag == 0 {
+		return valueLoc{}, false, nil
+	}
+
+	var size proto.VarInt
+	if err := size.UnmarshalFromReader(r); err != nil {
+		return valueLoc{}, false, err
+	}
+	if int64(size) > int64(r.Len()) {
+		return valueLoc{}, false, io.ErrUnexpectedEOF
+	}
+
+	loc := valueLoc{offset: pos(), size: uint32(size)}
+	if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil {
+		return valueLoc{}, false, err
+	}
+	return loc, true, nil
+}
+
+// compact rewrites the log with only the live values, alongside the old one, along with an index
+// for it, then renames them into place. The caller must hold the lock.
+func (db *DB) compact() error {
+	f, err := os.OpenFile(db.tmpPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	// The new index is made big enough for every output, so it won't need to grow
+	oldEntries, oldUndo, oldLive := db.entries, db.undo, db.live
+	entries, err := createIndex(db.indexPath()+".tmp", indexSlotsFor(oldEntries.count), oldEntries.salt, db.cacheSize)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Records written to the new log update the new index. The old one is only read from start
+	// to finish, so it doesn't need more than a few pages in memory.
+	db.entries, db.undo, db.live = entries, make(map[int32]valueLoc), 0
+	oldEntries.maxPages = INDEX_MIN_CACHED_PAGES
+	offset, err := db.writeCompacted(f, oldEntries, oldUndo)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(db.tmpPath(), db.path())
+	}
+	if err == nil {
+		err = syncDir(db.dir)
+	}
+	if err != nil {
+		f.Close()
+		entries.file.Close()
+		db.entries, db.undo, db.live = oldEntries, oldUndo, oldLive
+		oldEntries.maxPages = entries.maxPages
+		return err
+	}
+
+	// The new log is in place, so the new index is the one that matches it
+	db.file.Close()
+	db.file = f
+	db.size = offset
+	oldEntries.file.Close()
+	if err := os.Rename(entries.path, db.indexPath()); err != nil {
+		db.stale = true
+		return err
+	}
+	entries.path = db.indexPath()
+	return nil
+}
+
+// writeCompacted writes the live outputs and undo data to a new log, returning its size.
+func (db *DB) writeCompacted(f *os.File, entries *diskIndex, undo map[int32]valueLoc) (int64, error) {
+	var version [4]byte
+	binary.LittleEndian.PutUint32(version[:], DB_VERSION)
+	if _, err := f.Write(version[:]); err != nil {
+		return 0, err
+	}
+	offset := int64(len(version))
+
+	// Every record repeats the best block, so it doesn't matter which is last
+	b := &batch{bestBlock: db.bestBlock}
+	writeBatch := func() error {
+		n, err := db.appendRecord(f, offset, b)
+		offset += n
+		b.entries = make(map[proto.OutPoint]*Entry)
+		b.undo = make(map[int32]*BlockUndo)
+		return err
+	}
+	if err := writeBatch(); err != nil {
+		return 0, err
+	}
+
+	err := entries.forEach(func(op proto.OutPoint, loc valueLoc) error {
+		var entry Entry
+		if err := db.readValue(loc, &entry); err != nil {
+			return fmt.Errorf("unable to read output %s: %w", op, err)
+		}
+		b.entries[op] = &entry
+
+		if len(b.entries) >= COMPACT_BATCH_SIZE {
+			return writeBatch()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for height, loc := range undo {
+		var undo BlockUndo
+		if err := db.readValue(loc, &undo); err != nil {
+			return 0, fmt.Errorf("unable to read undo data for height %d: %w", height, err)
+		}
+		b.undo[height] = &undo
+
+		// Undo data can be big, so it's written a block at a time
+		if err := writeBatch(); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeBatch(); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// indexSlotsFor is how many slots an index should start with to hold count outputs.
+func indexSlotsFor(count uint64) uint64 {
+	slots := uint64(INDEX_MIN_SLOTS)
+	for count*4 > slots*3 {
+		slots *= 2
+	}
+	return slots
+}
+
+// syncDir makes a rename within the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close closes the database, writing out the index and recording that it matches the log, so it
+// doesn't have to be rebuilt when the database is next opened. Everything in the log is already
+// on disk.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return nil
+	}
+	defer func() {
+		db.file.Close()
+		db.file = nil
+	}()
+
+	if err := db.entries.close(); err != nil {
+		return fmt.Errorf("unable to write chainstate index: %w", err)
+	}
+	if db.stale {
+		return nil
+	}
+	if err := db.writeMeta(); err != nil {
+		return fmt.Errorf("unable to write chainstate metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package utxo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// Scripts longer than this can never be satisfied, so outputs with them aren't worth keeping.
+	MAX_SCRIPT_SIZE = 10_000
+
+	// The opcode that marks an output as provably unspendable, e.g. to carry data.
+	OP_RETURN = 0x6a
+)
+
+// Entry is an unspent transaction output, along with what we need to know about the transaction
+// it came from to check it's spent correctly.
+type Entry struct {
+	Amount     int64
+	PkScript   []byte
+	Height     int32 // The height of the block the transaction is in
+	IsCoinBase bool
+}
+
+// IsUnspendable reports whether an output with the script can never be spent, in which case
+// there's no point adding it to the set.
+func IsUnspendable(pkScript []byte) bool {
+	return (len(pkScript) > 0 && pkScript[0] == OP_RETURN) || len(pkScript) > MAX_SCRIPT_SIZE
+}
+
+// The height and coinbase flag are stored together, as bitcoind does, since heights never need
+// the top bit.
+func (e Entry) MarshalToWriter(w io.Writer) error {
+	code := uint32(e.Height) << 1
+	if e.IsCoinBase {
+		code |= 1
+	}
+	if err := binary.Write(w, binary.LittleEndian, code); err != nil {
+		return fmt.Errorf("unable to write height: %w", err)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, e.Amount); err != nil {
+		return fmt.Errorf("unable to write amount: %w", err)
+	}
+
+	if err := proto.VarInt(len(e.PkScript)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write public key script length: %w", err)
+	}
+	if _, err := w.Write(e.PkScript); err != nil {
+		return fmt.Errorf("unable to write public key script: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Entry) UnmarshalFromReader(r io.Reader) error {
+	var code uint32
+	if err := binary.Read(r, binary.LittleEndian, &code); err != nil {
+		return fmt.Errorf("unable to read height: %w", err)
+	}
+	e.Height = int32(code >> 1)
+	e.IsCoinBase = code&1 != 0
+
+	if err := binary.Read(r, binary.LittleEndian, &e.Amount); err != nil {
+		return fmt.Errorf("unable to read amount: %w", err)
+	}
+
+	var length proto.VarInt
+	if err := length.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read public key script length: %w", err)
+	}
+	if length > MAX_SCRIPT_SIZE {
+		return errors.New("public key script too long")
+	}
+	e.PkScript = make([]byte, length)
+	if _, err := io.ReadFull(r, e.PkScript); err != nil {
+		return fmt.Errorf("unable to read public key script: %w", err)
+	}
+
+	return nil
+}
+
+// BlockUndo is what's needed to disconnect a block from the set again: the outputs it spent, in
+// the order its inputs spent them, skipping the coinbase.
+type BlockUndo struct {
+	Block proto.Hash // The block it's for
+	Spent []Entry
+}
+
+func (u BlockUndo) MarshalToWriter(w io.Writer) error {
+	if err := u.Block.MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write block hash: %w", err)
+	}
+
+	if err := proto.VarInt(len(u.Spent)).MarshalToWriter(w); err != nil {
+		return fmt.Errorf("unable to write spent output count: %w", err)
+	}
+	for i, entry := range u.Spent {
+		if err := entry.MarshalToWriter(w); err != nil {
+			return fmt.Errorf("unable to write spent output %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (u *BlockUndo) UnmarshalFromReader(r io.Reader) error {
+	if err := u.Block.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read block hash: %w", err)
+	}
+
+	var count proto.VarInt
+	if err := count.UnmarshalFromReader(r); err != nil {
+		return fmt.Errorf("unable to read spent output count: %w", err)
+	}
+	if count > proto.MAX_PROTOCOL_MESSAGE_LENGTH {
+		return fmt.Errorf("%d spent outputs is more than a block could have", count)
+	}
+
+	u.Spent = make([]Entry, count)
+	for i := range u.Spent {
+		if err := u.Spent[i].UnmarshalFromReader(r); err != nil {
+			return fmt.Errorf("unable to read spent output %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package utxo_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pscott31/mynode/proto"
+	"github.com/pscott31/mynode/utxo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntry_MarshalUnmarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry utxo.Entry
+	}{
+		{"coinbase", utxo.Entry{Amount: 50 * 100_000_000, PkScript: []byte{0x51}, Height: 1, IsCoinBase: true}},
+		{"regular", utxo.Entry{Amount: 1234, PkScript: bytes.Repeat([]byte{0xab}, 300), Height: 840_000}},
+		{"empty script", utxo.Entry{Amount: 0, PkScript: []byte{}, Height: 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, tt.entry.MarshalToWriter(&buf))
+
+			var got utxo.Entry
+			require.NoError(t, got.UnmarshalFromReader(&buf))
+			assert.Equal(t, tt.entry, got)
+			assert.Zero(t, buf.Len())
+		})
+	}
+}
+
+func TestBlockUndo_MarshalUnmarshal(t *testing.T) {
+	undo := utxo.BlockUndo{
+		Block: proto.DoubleSHA256([]byte("block")),
+		Spent: []utxo.Entry{
+			{Amount: 1, PkScript: []byte{0x51}, Height: 5, IsCoinBase: true},
+			{Amount: 2, PkScript: []byte{0x52, 0x53}, Height: 6},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, undo.MarshalToWriter(&buf))
+
+	var got utxo.BlockUndo
+	require.NoError(t, got.UnmarshalFromReader(&buf))
+	assert.Equal(t, undo, got)
+}
+
+func TestIsUnspendable(t *testing.T) {
+	assert.False(t, utxo.IsUnspendable([]byte{0x51}))
+	assert.False(t, utxo.IsUnspendable(nil))
+	assert.True(t, utxo.IsUnspendable([]byte{utxo.OP_RETURN, 0x01, 0x02}))
+	assert.True(t, utxo.IsUnspendable(make([]byte, utxo.MAX_SCRIPT_SIZE+1)))
+}
@@ -0,0 +1,368 @@
+package utxo
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/pscott31/mynode/proto"
+)
+
+const (
+	// The name of the index file within the database's directory.
+	INDEX_FILENAME = "chainstate.idx"
+
+	// The index is read and written a page at a time.
+	INDEX_PAGE_SIZE = 4096
+
+	// Each slot holds a flag saying whether it's in use, an output, and where its value is in the
+	// log. Slots don't straddle pages.
+	INDEX_SLOT_SIZE      = 1 + proto.HASH_SIZE + 4 + 8 + 4
+	INDEX_SLOTS_PER_PAGE = INDEX_PAGE_SIZE / INDEX_SLOT_SIZE
+
+	// How many slots a new index has. It doubles in size whenever it gets three quarters full.
+	INDEX_MIN_SLOTS = 1 << 14
+
+	// The fewest pages kept in memory, however small the cache is.
+	INDEX_MIN_CACHED_PAGES = 16
+
+	// What share of the memory budget for the unspent output set should go on the index, e.g. 8
+	// for an eighth.
+	INDEX_CACHE_FRACTION = 8
+)
+
+// indexPage is a page of the index held in memory.
+type indexPage struct {
+	num   int64
+	data  []byte
+	dirty bool
+	elem  *list.Element
+}
+
+// diskIndex is a hash table on disk from outputs to where their latest values are in the log. It
+// uses linear probing, with deleted slots filled by shifting back the ones after them, so there
+// are no tombstones to build up. Only the most recently used pages are kept in memory, and changed
+// pages are written back when they're dropped or the index is flushed; nothing is synced until
+// then, so the index has to be rebuilt from the log if the process dies while it's open.
+//
+// Outputs are placed by a salted hash, so transactions can't be made to pile up in one place.
+type diskIndex struct {
+	path  string
+	file  *os.File
+	salt  [8]byte
+	slots uint64 // A power of two
+	count uint64
+
+	maxPages int
+	pages    map[int64]*indexPage
+	lru      *list.List // Most recently used at the front
+}
+
+// createIndex creates an empty index at path, replacing any that's there, that keeps up to
+// cacheSize bytes of pages in memory.
+func createIndex(path string, slots uint64, salt [8]byte, cacheSize int) (*diskIndex, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	idx := newIndex(path, f, slots, salt, cacheSize)
+	if err := f.Truncate(idx.numPages() * INDEX_PAGE_SIZE); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// openIndex opens an index that was flushed and closed with the given size and contents.
+func openIndex(path string, slots, count uint64, salt [8]byte, cacheSize int) (*diskIndex, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	idx := newIndex(path, f, slots, salt, cacheSize)
+	idx.count = count
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != idx.numPages()*INDEX_PAGE_SIZE {
+		f.Close()
+		return nil, fmt.Errorf("index is %d bytes, expected %d", info.Size(), idx.numPages()*INDEX_PAGE_SIZE)
+	}
+	return idx, nil
+}
+
+func newIndex(path string, f *os.File, slots uint64, salt [8]byte, cacheSize int) *diskIndex {
+	return &diskIndex{
+		path:     path,
+		file:     f,
+		salt:     salt,
+		slots:    slots,
+		maxPages: max(cacheSize/INDEX_PAGE_SIZE, INDEX_MIN_CACHED_PAGES),
+		pages:    make(map[int64]*indexPage),
+		lru:      list.New(),
+	}
+}
+
+func (idx *diskIndex) numPages() int64 {
+	return int64((idx.slots + INDEX_SLOTS_PER_PAGE - 1) / INDEX_SLOTS_PER_PAGE)
+}
+
+// home is the slot an output would be in if nothing else were in the way.
+func (idx *diskIndex) home(op proto.OutPoint) uint64 {
+	var key [len(idx.salt) + proto.HASH_SIZE + 4]byte
+	copy(key[:], idx.salt[:])
+	copy(key[len(idx.salt):], op.Hash[:])
+	binary.LittleEndian.PutUint32(key[len(idx.salt)+proto.HASH_SIZE:], op.Index)
+	sum := sha256.Sum256(key[:])
+	return binary.LittleEndian.Uint64(sum[:8]) & (idx.slots - 1)
+}
+
+// page returns a page of the index, reading it in if need be and dropping the least recently
+// used one if there are too many in memory.
+func (idx *diskIndex) page(num int64) (*indexPage, error) {
+	if p, ok := idx.pages[num]; ok {
+		idx.lru.MoveToFront(p.elem)
+		return p, nil
+	}
+
+	p := &indexPage{num: num, data: make([]byte, INDEX_PAGE_SIZE)}
+	if _, err := idx.file.ReadAt(p.data, num*INDEX_PAGE_SIZE); err != nil {
+		return nil, fmt.Errorf("unable to read index page %d: %w", num, err)
+	}
+	p.elem = idx.lru.PushFront(p)
+	idx.pages[num] = p
+
+	for len(idx.pages) > idx.maxPages {
+		oldest := idx.lru.Back().Value.(*indexPage)
+		if err := idx.writePage(oldest); err != nil {
+			return nil, err
+		}
+		idx.lru.Remove(oldest.elem)
+		delete(idx.pages, oldest.num)
+	}
+	return p, nil
+}
+
+func (idx *diskIndex) writePage(p *indexPage) error {
+	if !p.dirty {
+		return nil
+	}
+	if _, err := idx.file.WriteAt(p.data, p.num*INDEX_PAGE_SIZE); err != nil {
+		return fmt.Errorf("unable to write index page %d: %w", p.num, err)
+	}
+	p.dirty = false
+	return nil
+}
+
+// indexSlot is a slot of the index, as it is in its page.
+type indexSlot struct {
+	page *indexPage
+	data []byte
+}
+
+func (idx *diskIndex) slot(i uint64) (indexSlot, error) {
+	p, err := idx.page(int64(i / INDEX_SLOTS_PER_PAGE))
+	if err != nil {
+		return indexSlot{}, err
+	}
+	start := (i % INDEX_SLOTS_PER_PAGE) * INDEX_SLOT_SIZE
+	return indexSlot{page: p, data: p.data[start : start+INDEX_SLOT_SIZE]}, nil
+}
+
+func (s indexSlot) used() bool {
+	return s.data[0] != 0
+}
+
+func (s indexSlot) outPoint() proto.OutPoint {
+	var op proto.OutPoint
+	copy(op.Hash[:], s.data[1:1+proto.HASH_SIZE])
+	op.Index = binary.LittleEndian.Uint32(s.data[1+proto.HASH_SIZE:])
+	return op
+}
+
+func (s indexSlot) loc() valueLoc {
+	return valueLoc{
+		offset: int64(binary.LittleEndian.Uint64(s.data[5+proto.HASH_SIZE:])),
+		size:   binary.LittleEndian.Uint32(s.data[13+proto.HASH_SIZE:]),
+	}
+}
+
+func (s indexSlot) set(op proto.OutPoint, loc valueLoc) {
+	s.data[0] = 1
+	copy(s.data[1:], op.Hash[:])
+	binary.LittleEndian.PutUint32(s.data[1+proto.HASH_SIZE:], op.Index)
+	binary.LittleEndian.PutUint64(s.data[5+proto.HASH_SIZE:], uint64(loc.offset))
+	binary.LittleEndian.PutUint32(s.data[13+proto.HASH_SIZE:], loc.size)
+	s.page.dirty = true
+}
+
+func (s indexSlot) copyFrom(other indexSlot) {
+	copy(s.data, other.data)
+	s.page.dirty = true
+}
+
+func (s indexSlot) clear() {
+	clear(s.data)
+	s.page.dirty = true
+}
+
+// find returns the slot an output is in, or the empty one it would go in.
+func (idx *diskIndex) find(op proto.OutPoint) (uint64, indexSlot, error) {
+	for i := idx.home(op); ; i = (i + 1) & (idx.slots - 1) {
+		s, err := idx.slot(i)
+		if err != nil {
+			return 0, indexSlot{}, err
+		}
+		if !s.used() || s.outPoint() == op {
+			return i, s, nil
+		}
+	}
+}
+
+// get returns where an output's value is, or false if it isn't in the index.
+func (idx *diskIndex) get(op proto.OutPoint) (valueLoc, bool, error) {
+	_, s, err := idx.find(op)
+	if err != nil || !s.used() {
+		return valueLoc{}, false, err
+	}
+	return s.loc(), true, nil
+}
+
+// put sets where an output's value is, returning where it was before, if it was there.
+func (idx *diskIndex) put(op proto.OutPoint, loc valueLoc) (valueLoc, bool, error) {
+	if (idx.count+1)*4 > idx.slots*3 {
+		if err := idx.grow(); err != nil {
+			return valueLoc{}, false, fmt.Errorf("unable to grow index: %w", err)
+		}
+	}
+
+	_, s, err := idx.find(op)
+	if err != nil {
+		return valueLoc{}, false, err
+	}
+	var old valueLoc
+	existed := s.used()
+	if existed {
+		old = s.loc()
+	} else {
+		idx.count++
+	}
+	s.set(op, loc)
+	return old, existed, nil
+}
+
+// remove takes an output out of the index, returning where its value was, if it was there. The
+// slots after it are shifted back into the gap, as far as they can go towards their home slots.
+func (idx *diskIndex) remove(op proto.OutPoint) (valueLoc, bool, error) {
+	gap, s, err := idx.find(op)
+	if err != nil || !s.used() {
+		return valueLoc{}, false, err
+	}
+	old := s.loc()
+
+	// The gap's page can drop out of memory while we look further along, so it's fetched again
+	// before it's written to
+	mask := idx.slots - 1
+	for i := (gap + 1) & mask; ; i = (i + 1) & mask {
+		next, err := idx.slot(i)
+		if err != nil {
+			return valueLoc{}, false, err
+		}
+		if !next.used() {
+			break
+		}
+
+		// It can fill the gap if the gap is no further from its home than it is now
+		if home := idx.home(next.outPoint()); (i-home)&mask >= (i-gap)&mask {
+			s, err := idx.slot(gap)
+			if err != nil {
+				return valueLoc{}, false, err
+			}
+			s.copyFrom(next)
+			gap = i
+		}
+	}
+	s, err = idx.slot(gap)
+	if err != nil {
+		return valueLoc{}, false, err
+	}
+	s.clear()
+	idx.count--
+	return old, true, nil
+}
+
+// forEach calls fn for every output in the index, in the order they're stored.
+func (idx *diskIndex) forEach(fn func(op proto.OutPoint, loc valueLoc) error) error {
+	for i := uint64(0); i < idx.slots; i++ {
+		s, err := idx.slot(i)
+		if err != nil {
+			return err
+		}
+		if s.used() {
+			if err := fn(s.outPoint(), s.loc()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// grow doubles the number of slots, rewriting the index alongside and renaming it into place.
+func (idx *diskIndex) grow() error {
+	bigger, err := createIndex(idx.path+".tmp", 2*idx.slots, idx.salt, idx.maxPages*INDEX_PAGE_SIZE)
+	if err != nil {
+		return err
+	}
+	err = idx.forEach(func(op proto.OutPoint, loc valueLoc) error {
+		_, s, err := bigger.find(op)
+		if err != nil {
+			return err
+		}
+		s.set(op, loc)
+		bigger.count++
+		return nil
+	})
+	if err == nil {
+		err = bigger.writeBack()
+	}
+	if err == nil {
+		err = os.Rename(bigger.path, idx.path)
+	}
+	if err != nil {
+		bigger.file.Close()
+		return err
+	}
+
+	bigger.path = idx.path
+	idx.file.Close()
+	*idx = *bigger
+	return nil
+}
+
+// writeBack writes every changed page to the file, without syncing it.
+func (idx *diskIndex) writeBack() error {
+	for _, p := range idx.pages {
+		if err := idx.writePage(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close writes back the changed pages, syncs the file and closes it.
+func (idx *diskIndex) close() error {
+	if err := idx.writeBack(); err != nil {
+		idx.file.Close()
+		return err
+	}
+	if err := idx.file.Sync(); err != nil {
+		idx.file.Close()
+		return fmt.Errorf("unable to sync index: %w", err)
+	}
+	return idx.file.Close()
+}